@@ -1,5 +1,7 @@
 package alipay
 
+import "github.com/jxwt/pay"
+
 // AliWebPayResult 支付宝支付结果回调
 type AliWebPayResult struct {
 	AppID          string `json:"app_id"`
@@ -126,12 +128,12 @@ type AliPayResponse struct {
 //线下收单预创建请求参数
 type PreCreateRequest struct {
 	//必填参数
-	OutTradeNo  string  `json:"out_trade_no"` //商户订单号,64个字符以内、只能包含字母、数字、下划线；需保证在商户端不重复
-	TotalAmount float64 `json:"total_amount"` //订单总金额，单位为元，精确到小数点后两位
-	Subject     string  `json:"subject"`      //订单标题
+	OutTradeNo  string    `json:"out_trade_no"` //商户订单号,64个字符以内、只能包含字母、数字、下划线；需保证在商户端不重复
+	TotalAmount pay.Money `json:"total_amount"` //订单总金额，单位为元，精确到小数点后两位
+	Subject     string    `json:"subject"`      //订单标题
 	//可选参数
 	SellerId           string       `json:"seller_id"`           //卖家支付宝用户ID
-	DiscountableAmount float64      `json:"discountable_amount"` //可打折金额. 参与优惠计算的金额，单位为元，精确到小数点后两位
+	DiscountableAmount pay.Money    `json:"discountable_amount"` //可打折金额. 参与优惠计算的金额，单位为元，精确到小数点后两位
 	GoodsDetail        []GoodDetail `json:"goods_detail"`        //订单包含的商品列表信息.json格式. 其它说明详见：“商品明细说明”
 	Body               string       `json:"body"`                //对商品的描述
 	ProductCode        string       `json:"product_code"`        //销售产品码。
@@ -151,10 +153,10 @@ type PreCreateResult struct {
 }
 type GoodDetail struct {
 	//必填参数
-	GoodsId   string  `json:"goods_id"`   //商品的编号
-	GoodsName string  `json:"goods_name"` //商品名称
-	Quantity  int     `json:"quantity"`   //商品数量
-	Price     float64 `json:"price"`      //商品单价，单位为元
+	GoodsId   string    `json:"goods_id"`   //商品的编号
+	GoodsName string    `json:"goods_name"` //商品名称
+	Quantity  int       `json:"quantity"`   //商品数量
+	Price     pay.Money `json:"price"`      //商品单价，单位为元
 	//可选参数
 	GoodsCategory  string `json:"goods_category"`  //商品类目
 	CategoriesTree string `json:"categories_tree"` //商品类目树
@@ -200,6 +202,31 @@ type AliRefundResponse struct {
 	Sign string `json:"sign"`
 }
 
+// AliRefundQueryRequest 退款查询请求参数
+type AliRefundQueryRequest struct {
+	OutTradeNo   string `json:"out_trade_no,omitempty"` // 与 TradeNo 二选一
+	TradeNo      string `json:"trade_no,omitempty"`     // 与 OutTradeNo 二选一
+	OutRequestNo string `json:"out_request_no"`         // 必须 退款请求号, 退款时未传入则为商户订单号
+}
+
+// AliRefundQueryResponse 退款查询返回参数, 退款单不存在时不返回退款字段
+type AliRefundQueryResponse struct {
+	AlipayTradeFastpayRefundQueryResponse struct {
+		Code         string `json:"code"`
+		Msg          string `json:"msg"`
+		SubCode      string `json:"sub_code"`
+		SubMsg       string `json:"sub_msg"`
+		TradeNo      string `json:"trade_no"`       // 支付宝交易号
+		OutTradeNo   string `json:"out_trade_no"`   // 商户订单号
+		OutRequestNo string `json:"out_request_no"` // 退款请求号
+		TotalAmount  string `json:"total_amount"`   // 订单金额
+		RefundAmount string `json:"refund_amount"`  // 本次退款金额
+		RefundStatus string `json:"refund_status"`  // 退款状态, 仅 REFUND_SUCCESS, 未返回时退款处理中或未成功
+		GmtRefundPay string `json:"gmt_refund_pay"` // 退款时间
+	} `json:"alipay_trade_fastpay_refund_query_response"`
+	Sign string `json:"sign"`
+}
+
 // ToaccountTransferRequest 单笔转账请求
 type ToaccountTransferRequest struct {
 	// 必填
@@ -248,12 +275,12 @@ type AliTradePayResponse struct {
 		PayAmount       string  `json:"pay_amount"`
 		SettleTransRate string  `json:"settle_trans_rate"`
 		TransPayRate    string  `json:"trans_pay_rate"`
-		TotalAmount     float64 `json:"total_amount"`
+		TotalAmount     string  `json:"total_amount"`
 		TransCurrency   string  `json:"trans_currency"`
 		SettleCurrency  string  `json:"settle_currency"`
 		ReceiptAmount   string  `json:"receipt_amount"`
 		BuyerPayAmount  string  `json:"buyer_pay_amount"`
-		PointAmount     float64 `json:"point_amount"`
+		PointAmount     string  `json:"point_amount"`
 		InvoiceAmount   string  `json:"invoice_amount"`
 		GmtPayment      string  `json:"gmt_payment"`
 		FundBillList    []struct {
@@ -312,3 +339,23 @@ type AliTradeCancelResponse struct {
 	} `json:"alipay_trade_cancel_response"`
 	Sign string `json:"sign"`
 }
+
+// AliTradeCloseRequest 关闭交易请求
+type AliTradeCloseRequest struct {
+	OutTradeNo string `json:"out_trade_no,omitempty"` // 与 TradeNo 二选一
+	TradeNo    string `json:"trade_no,omitempty"`     // 与 OutTradeNo 二选一
+	OperatorID string `json:"operator_id,omitempty"`  // 可选 商家操作员编号
+}
+
+// AliTradeCloseResponse 关闭交易返回
+type AliTradeCloseResponse struct {
+	AlipayTradeCloseResponse struct {
+		Code       string `json:"code"`
+		Msg        string `json:"msg"`
+		SubCode    string `json:"sub_code"`
+		SubMsg     string `json:"sub_msg"`
+		TradeNo    string `json:"trade_no"`
+		OutTradeNo string `json:"out_trade_no"`
+	} `json:"alipay_trade_close_response"`
+	Sign string `json:"sign"`
+}
@@ -2,22 +2,19 @@ package alipay
 
 import (
 	"bytes"
+	"context"
 	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha1"
-	"crypto/sha256"
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"github.com/astaxie/beego/httplib"
-	"github.com/astaxie/beego/logs"
+	"github.com/jxwt/pay"
 	"golang.org/x/text/encoding/simplifiedchinese"
 	"golang.org/x/text/transform"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"sort"
 	"strings"
@@ -36,6 +33,18 @@ type AliAppClient struct {
 
 	PrivateKey *rsa.PrivateKey
 	PublicKey  *rsa.PublicKey
+
+	HTTPClient *http.Client // 自定义http客户端, 为空时使用 pay.HTTPSC
+	GatewayURL string       // 自定义网关地址, 为空时按 Sandbox 选择
+	Sandbox    bool         // 使用沙箱网关 openapi.alipaydev.com
+
+	ConfirmPolicy *pay.ConfirmPolicy // 付款码支付结果轮询策略, 为空时使用 pay.DefaultConfirmPolicy
+	RetryPolicy   *pay.RetryPolicy   // 查询等幂等操作的瞬时失败重试策略, 为空时不重试, 可使用 &pay.DefaultRetryPolicy
+	Logger        pay.Logger         // 日志, 为空时使用 pay.DefaultLogger, 输出前自动脱敏
+	Instrument    pay.Instrument     // 调用埋点, 为空时使用 pay.DefaultInstrument
+	MaxBillSize   int64              // 对账单压缩包大小上限(字节), 为0时使用 DefaultMaxBillSize
+
+	SkipVerifyResponse bool // 跳过同步应答验签, 仅用于调试
 }
 
 func (i *AliAppClient) MakePayMap(method string, charge *Charge, rsaType string) (map[string]string, error) {
@@ -75,13 +84,18 @@ func (i *AliAppClient) MakePayMap(method string, charge *Charge, rsaType string)
 		return map[string]string{}, errors.New("json.Marshal: " + err.Error())
 	}
 	m["biz_content"] = string(bizContentJson)
+	var sign string
 	if rsaType == "RSA2" {
-		m["sign"] = i.GenSign(m)
+		sign, err = i.GenSign(m)
 	} else {
-		m["sign"] = i.GenSignRsa1(m)
+		sign, err = i.GenSignRsa1(m)
+	}
+	if err != nil {
+		return nil, err
 	}
+	m["sign"] = sign
 
-	logs.Warning(m)
+	i.log(pay.LevelDebug, "alipay: request", pay.F("method", m["method"]), pay.F("params", m))
 	return m, nil
 }
 
@@ -100,13 +114,18 @@ func (i *AliAppClient) MakeRefund(method string, bizContent *AliRefundRequest, r
 		return map[string]string{}, errors.New("json.Marshal: " + err.Error())
 	}
 	m["biz_content"] = i.NewEncoderToString(bizContentJson)
+	var sign string
 	if rsaType == "RSA2" {
-		m["sign"] = i.GenSign(m)
+		sign, err = i.GenSign(m)
 	} else {
-		m["sign"] = i.GenSignRsa1(m)
+		sign, err = i.GenSignRsa1(m)
 	}
+	if err != nil {
+		return nil, err
+	}
+	m["sign"] = sign
 
-	logs.Warning(m)
+	i.log(pay.LevelDebug, "alipay: request", pay.F("method", m["method"]), pay.F("params", m))
 	return m, nil
 }
 
@@ -125,30 +144,45 @@ func (i *AliAppClient) MakeToaccountTransfer(method string, req *ToaccountTransf
 		return map[string]string{}, errors.New("json.Marshal: " + err.Error())
 	}
 	m["biz_content"] = i.NewEncoderToString(reqJSON)
+	var sign string
 	if rsaType == "RSA2" {
-		m["sign"] = i.GenSign(m)
+		sign, err = i.GenSign(m)
 	} else {
-		m["sign"] = i.GenSignRsa1(m)
+		sign, err = i.GenSignRsa1(m)
 	}
-	logs.Warning(m)
+	if err != nil {
+		return nil, err
+	}
+	m["sign"] = sign
+	i.log(pay.LevelDebug, "alipay: request", pay.F("method", m["method"]), pay.F("params", m))
 	return m, nil
 }
 
 func (i *AliAppClient) ToPay(charge *Charge) (string, error) {
+	return i.ToPayContext(context.Background(), charge)
+}
+
+// ToPayContext 携带ctx的支付
+func (i *AliAppClient) ToPayContext(ctx context.Context, charge *Charge) (string, error) {
 	payMap, err := i.MakePayMap("alipay.trade.apps.pay", charge, "RSA")
 	if err != nil {
 		return "", err
 	}
-	return i.SendToAlipay(payMap, "post")
+	return i.SendToAlipayContext(ctx, payMap, "post")
 }
 
 // 支付宝退款
 func (i *AliAppClient) Refund(refund *AliRefundRequest) (*AliRefundResponse, error) {
+	return i.RefundContext(context.Background(), refund)
+}
+
+// RefundContext 携带ctx的支付宝退款
+func (i *AliAppClient) RefundContext(ctx context.Context, refund *AliRefundRequest) (*AliRefundResponse, error) {
 	payMap, err := i.MakeRefund("alipay.trade.refund", refund, "RSA2")
 	if err != nil {
 		return nil, err
 	}
-	response, err := i.SendToAlipay(payMap, "post")
+	response, err := i.call(ctx, payMap, "post")
 	if err != nil || response == "" {
 		return nil, err
 	}
@@ -162,11 +196,16 @@ func (i *AliAppClient) Refund(refund *AliRefundRequest) (*AliRefundResponse, err
 
 // ToaccountTransfer 单笔转账到支付宝账户
 func (i *AliAppClient) ToaccountTransfer(req *ToaccountTransferRequest) (*ToaccountTransferResponse, error) {
+	return i.ToaccountTransferContext(context.Background(), req)
+}
+
+// ToaccountTransferContext 携带ctx单笔转账到支付宝账户
+func (i *AliAppClient) ToaccountTransferContext(ctx context.Context, req *ToaccountTransferRequest) (*ToaccountTransferResponse, error) {
 	reqMap, err := i.MakeToaccountTransfer("alipay.fund.trans.toaccount.transfer", req, "RSA")
 	if err != nil {
 		return nil, err
 	}
-	response, err := i.SendToAlipay(reqMap, "post")
+	response, err := i.call(ctx, reqMap, "post")
 	if err != nil || response == "" {
 		return nil, err
 	}
@@ -200,14 +239,24 @@ func (i *AliAppClient) ToH5Pay(charge *Charge) (string, error) {
 }
 
 func (i *AliAppClient) CreateOrder(charge *Charge) (string, error) {
+	return i.CreateOrderContext(context.Background(), charge)
+}
+
+// CreateOrderContext 携带ctx创建订单
+func (i *AliAppClient) CreateOrderContext(ctx context.Context, charge *Charge) (string, error) {
 	payMap, err := i.MakePayMap("alipay.trade.create", charge, "RSA2")
 	if err != nil {
 		return "", err
 	}
-	return i.SendToAlipay(payMap, "get")
+	return i.call(ctx, payMap, "get")
 }
 
 func (i *AliAppClient) Login(code string) (string, error) {
+	return i.LoginContext(context.Background(), code)
+}
+
+// LoginContext 携带ctx的授权登录
+func (i *AliAppClient) LoginContext(ctx context.Context, code string) (string, error) {
 	var m = make(map[string]string)
 	m["app_id"] = i.AppID
 	m["method"] = "alipay.system.oauth.token"
@@ -218,11 +267,20 @@ func (i *AliAppClient) Login(code string) (string, error) {
 	m["sign_type"] = "RSA2"
 	m["grant_type"] = "authorization_code"
 	m["code"] = code
-	m["sign"] = i.GenSign(m)
-	return i.SendToAlipay(m, "post")
+	sign, err := i.GenSign(m)
+	if err != nil {
+		return "", err
+	}
+	m["sign"] = sign
+	return i.call(ctx, m, "post")
 }
 
 func (i *AliAppClient) GetLoginUserInfo(authToken string) (string, error) {
+	return i.GetLoginUserInfoContext(context.Background(), authToken)
+}
+
+// GetLoginUserInfoContext 携带ctx获取登录用户信息
+func (i *AliAppClient) GetLoginUserInfoContext(ctx context.Context, authToken string) (string, error) {
 	var m = make(map[string]string)
 	m["app_id"] = i.AppID
 	m["method"] = "alipay.user.info.share"
@@ -233,11 +291,15 @@ func (i *AliAppClient) GetLoginUserInfo(authToken string) (string, error) {
 	m["sign_type"] = "RSA2"
 	m["auth_token"] = authToken
 	m["version"] = "1.0"
-	m["sign"] = i.GenSign(m)
-	return i.SendToAlipay(m, "post")
+	sign, err := i.GenSign(m)
+	if err != nil {
+		return "", err
+	}
+	m["sign"] = sign
+	return i.call(ctx, m, "post")
 }
 
-func (i *AliAppClient) GetAppLoginParams(targetId string) string {
+func (i *AliAppClient) GetAppLoginParams(targetId string) (string, error) {
 	m := map[string]string{
 		"apiname":    "com.alipay.account.auth",
 		"app_id":     i.AppID,
@@ -251,7 +313,11 @@ func (i *AliAppClient) GetAppLoginParams(targetId string) string {
 		"target_id":  targetId,
 		"sign_type":  "RSA2",
 	}
-	m["sign"] = i.GenSign(m)
+	sign, err := i.GenSign(m)
+	if err != nil {
+		return "", err
+	}
+	m["sign"] = sign
 	var data []string
 	for k, v := range m {
 		if v != "" {
@@ -259,27 +325,57 @@ func (i *AliAppClient) GetAppLoginParams(targetId string) string {
 		}
 	}
 	sort.Strings(data)
-	return strings.Join(data, "&")
+	return strings.Join(data, "&"), nil
 }
 
 func (i *AliAppClient) SendToAlipay(m map[string]string, method string) (string, error) {
-	req := httplib.Get("https://openapi.alipay.com/gateway.do")
-	if method == "post" {
-		req = httplib.Post("https://openapi.alipay.com/gateway.do")
-	}
-	for k, v := range m {
-		req.Param(k, v)
-	}
-	resp, err := req.Response()
-	if err != nil {
-		println(err.Error())
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	return string(body), err
+	return i.SendToAlipayContext(context.Background(), m, method)
+}
+
+// SendToAlipayContext 携带ctx请求支付宝网关
+func (i *AliAppClient) SendToAlipayContext(ctx context.Context, m map[string]string, method string) (string, error) {
+	return sendToAlipay(ctx, i.HTTPClient, i.Gateway(), m, method, i.Instrument)
 }
 
 // 退款查询
+//
+// Deprecated: 沿用旧版约定, 按退款请求号 "AliPay"+商户订单号 查询, 请使用 AliTradeRefundQuery 或 Provider.QueryRefund
 func (i *AliAppClient) QueryRefund(outTradeNo string) (*AliRefundResponse, error) {
+	return i.QueryRefundContext(context.Background(), outTradeNo)
+}
+
+// QueryRefundContext 携带ctx的退款查询
+//
+// Deprecated: 请使用 AliTradeRefundQueryContext
+func (i *AliAppClient) QueryRefundContext(ctx context.Context, outTradeNo string) (*AliRefundResponse, error) {
+	res, err := i.AliTradeRefundQueryContext(ctx, &AliRefundQueryRequest{OutTradeNo: outTradeNo, OutRequestNo: "AliPay" + outTradeNo})
+	if err != nil {
+		return nil, err
+	}
+	q := res.AlipayTradeFastpayRefundQueryResponse
+	result := new(AliRefundResponse)
+	result.AliPayTradeRefund.Code = q.Code
+	result.AliPayTradeRefund.Msg = q.Msg
+	result.AliPayTradeRefund.SubCode = q.SubCode
+	result.AliPayTradeRefund.SubMsg = q.SubMsg
+	result.AliPayTradeRefund.TradeNo = q.TradeNo
+	result.AliPayTradeRefund.OutTradeNo = q.OutTradeNo
+	result.AliPayTradeRefund.RefundFee = q.RefundAmount
+	result.AliPayTradeRefund.GmtRefundPay = q.GmtRefundPay
+	result.Sign = res.Sign
+	return result, nil
+}
+
+// AliTradeRefundQuery 按退款请求号查询退款
+func (i *AliAppClient) AliTradeRefundQuery(req *AliRefundQueryRequest) (*AliRefundQueryResponse, error) {
+	return i.AliTradeRefundQueryContext(context.Background(), req)
+}
+
+// AliTradeRefundQueryContext 携带ctx按退款请求号查询退款
+func (i *AliAppClient) AliTradeRefundQueryContext(ctx context.Context, req *AliRefundQueryRequest) (*AliRefundQueryResponse, error) {
+	if req.OutRequestNo == "" || (req.OutTradeNo == "" && req.TradeNo == "") {
+		return nil, errors.New("alipay.trade.fastpay.refund.query: out_request_no and out_trade_no or trade_no required")
+	}
 	var m = make(map[string]string)
 	m["method"] = "alipay.trade.fastpay.refund.query"
 	m["app_id"] = i.AppID
@@ -287,23 +383,24 @@ func (i *AliAppClient) QueryRefund(outTradeNo string) (*AliRefundResponse, error
 	m["charset"] = "utf-8"
 	m["timestamp"] = time.Now().Format("2006-01-02 15:04:05")
 	m["version"] = "1.0"
-	m["sign_type"] = "RSA"
-	bizContent := map[string]string{"out_trade_no": outTradeNo, "out_request_no": "AliPay" + outTradeNo}
-	bizContentJson, err := json.Marshal(bizContent)
+	m["sign_type"] = "RSA2"
+	bizContentJson, err := json.Marshal(req)
 	if err != nil {
 		return nil, errors.New("json.Marshal: " + err.Error())
 	}
 	m["biz_content"] = string(bizContentJson)
-	sign := i.GenSignRsa1(m)
+	sign, err := i.GenSign(m)
+	if err != nil {
+		return nil, err
+	}
 	m["sign"] = sign
 
-	resp, err := i.SendToAlipay(m, "post")
+	resp, err := i.retryCall(ctx, pay.OpQueryRefund, m, "post")
 	if err != nil {
 		return nil, err
 	}
-	result := new(AliRefundResponse)
-	err = json.Unmarshal([]byte(resp), result)
-	if err != nil {
+	result := new(AliRefundQueryResponse)
+	if err := json.Unmarshal([]byte(resp), result); err != nil {
 		return nil, err
 	}
 	return result, nil
@@ -311,6 +408,11 @@ func (i *AliAppClient) QueryRefund(outTradeNo string) (*AliRefundResponse, error
 
 // 订单查询
 func (i *AliAppClient) QueryOrder(outTradeNo string) (*AliWebAppQueryResult, error) {
+	return i.QueryOrderContext(context.Background(), outTradeNo)
+}
+
+// QueryOrderContext 携带ctx的订单查询
+func (i *AliAppClient) QueryOrderContext(ctx context.Context, outTradeNo string) (*AliWebAppQueryResult, error) {
 	var m = make(map[string]string)
 	m["method"] = "alipay.trade.query"
 	m["app_id"] = i.AppID
@@ -325,8 +427,12 @@ func (i *AliAppClient) QueryOrder(outTradeNo string) (*AliWebAppQueryResult, err
 		return &AliWebAppQueryResult{}, errors.New("json.Marshal: " + err.Error())
 	}
 	m["biz_content"] = i.NewEncoderToString(bizContentJson)
-	m["sign"] = i.GenSign(m)
-	response, err := i.SendToAlipay(m, "post")
+	sign, err := i.GenSign(m)
+	if err != nil {
+		return nil, err
+	}
+	m["sign"] = sign
+	response, err := i.retryCall(ctx, pay.OpQueryOrder, m, "post")
 	if err != nil || response == "" {
 		return nil, err
 	}
@@ -339,92 +445,43 @@ func (i *AliAppClient) QueryOrder(outTradeNo string) (*AliWebAppQueryResult, err
 }
 
 func (i *AliAppClient) AliPreCreate(preCreate Charge) (PreCreateResult, error) {
+	return i.AliPreCreateContext(context.Background(), preCreate)
+}
+
+// AliPreCreateContext 携带ctx的线下收单预创建
+func (i *AliAppClient) AliPreCreateContext(ctx context.Context, preCreate Charge) (PreCreateResult, error) {
 	preCreateResult := new(PreCreateResponse)
 	payMap, err := i.MakePayMap("alipay.trade.precreate", &preCreate, "RSA2")
 	if err != nil {
 		return preCreateResult.PreCreateResult, errors.New("json.Marshal: " + err.Error())
 	}
-	response, err := i.SendToAlipay(payMap, "get")
+	response, err := i.call(ctx, payMap, "get")
 	if err != nil || response == "" {
 		return preCreateResult.PreCreateResult, err
 	}
 	err = json.Unmarshal([]byte(response), preCreateResult)
 	if err != nil {
 		return preCreateResult.PreCreateResult, err
-	} else if preCreateResult.PreCreateResult.SubMsg != "" {
-		return preCreateResult.PreCreateResult, errors.New("支付宝下单失败")
 	}
 	return preCreateResult.PreCreateResult, nil
 }
 
 // GenSign 产生签名
-func (i *AliAppClient) GenSignRsa1(m map[string]string) string {
-	var data []string
-
-	for k, v := range m {
-		if v != "" && k != "sign" {
-			data = append(data, fmt.Sprintf(`%s=%s`, k, v))
-		}
-	}
-	sort.Strings(data)
-	signData := strings.Join(data, "&")
-
-	s := sha1.New()
-	_, err := s.Write([]byte(signData))
-	if err != nil {
-		panic(err)
-	}
-	hashByte := s.Sum(nil)
-	signByte, err := i.PrivateKey.Sign(rand.Reader, hashByte, crypto.SHA1)
-	if err != nil {
-		panic(err)
-	}
-	return base64.StdEncoding.EncodeToString(signByte)
+func (i *AliAppClient) GenSignRsa1(m map[string]string) (string, error) {
+	return rsaSign(i.PrivateKey, crypto.SHA1, signContent(m))
 }
 
 // GenSign 产生签名
-func (i *AliAppClient) GenSign(m map[string]string) string {
-	var data []string
-
-	for k, v := range m {
-		if v != "" && k != "sign" {
-			data = append(data, fmt.Sprintf(`%s=%s`, k, v))
-		}
-	}
-	sort.Strings(data)
-	signData := strings.Join(data, "&")
-
-	s := sha256.New()
-	_, err := s.Write([]byte(signData))
-	if err != nil {
-		panic(err)
-	}
-	hashByte := s.Sum(nil)
-	signByte, err := i.PrivateKey.Sign(rand.Reader, hashByte, crypto.SHA256)
-	if err != nil {
-		panic(err)
-	}
-	return base64.StdEncoding.EncodeToString(signByte)
+func (i *AliAppClient) GenSign(m map[string]string) (string, error) {
+	return rsaSign(i.PrivateKey, crypto.SHA256, signContent(m))
 }
 
 // CheckSign 检测签名
-func (i *AliAppClient) CheckSign(signData, sign string) {
-	signByte, err := base64.StdEncoding.DecodeString(sign)
-	if err != nil {
-		panic(err)
-	}
-	s := sha256.New()
-	_, err = s.Write([]byte(signData))
-	if err != nil {
-		//panic(err)
-		logs.Warning(err)
-	}
-	hash := s.Sum(nil)
-	logs.Warning(i.PublicKey)
-	err = rsa.VerifyPKCS1v15(i.PublicKey, crypto.SHA256, hash, signByte)
-	if err != nil {
-		logs.Warning(err)
+func (i *AliAppClient) CheckSign(signData, sign string) error {
+	if i.PublicKey == nil {
+		return errors.New("publicKey is nil")
 	}
+	return verifySign(i.PublicKey, "RSA2", signData, sign)
 }
 
 // ToURL
@@ -456,8 +513,11 @@ func ParsePKCS1PrivateKey(data []byte) (key *rsa.PrivateKey, err error) {
 	if err != nil {
 		return nil, err
 	}
-	key = keyTemp.(*rsa.PrivateKey)
-	return key, err
+	key, ok := keyTemp.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not RSA")
+	}
+	return key, nil
 }
 
 // ParsePKCS1PublicKey 解析公钥
@@ -527,11 +587,16 @@ func formatKey(raw, prefix, suffix string) (result []byte) {
 
 // AliTradePay 支付宝统一收单
 func (i *AliAppClient) AliTradePay(aliTradePay *AliTradePayRequest) (*AliTradePayResponse, error) {
+	return i.AliTradePayContext(context.Background(), aliTradePay)
+}
+
+// AliTradePayContext 携带ctx的统一收单
+func (i *AliAppClient) AliTradePayContext(ctx context.Context, aliTradePay *AliTradePayRequest) (*AliTradePayResponse, error) {
 	payMap, err := i.MakeTradePay("alipay.trade.pay", aliTradePay, "RSA2")
 	if err != nil {
 		return nil, err
 	}
-	response, err := i.SendToAlipay(payMap, "post")
+	response, err := i.call(ctx, payMap, "post")
 	if err != nil || response == "" {
 		return nil, err
 	}
@@ -559,23 +624,33 @@ func (i *AliAppClient) MakeTradePay(method string, bizContent *AliTradePayReques
 		return map[string]string{}, errors.New("json.Marshal: " + err.Error())
 	}
 	m["biz_content"] = i.NewEncoderToString(bizContentJson)
+	var sign string
 	if rsaType == "RSA2" {
-		m["sign"] = i.GenSign(m)
+		sign, err = i.GenSign(m)
 	} else {
-		m["sign"] = i.GenSignRsa1(m)
+		sign, err = i.GenSignRsa1(m)
+	}
+	if err != nil {
+		return nil, err
 	}
+	m["sign"] = sign
 
-	logs.Warning(m)
+	i.log(pay.LevelDebug, "alipay: request", pay.F("method", m["method"]), pay.F("params", m))
 	return m, nil
 }
 
 // AliTradeCancel 支付撤单
 func (i *AliAppClient) AliTradeCancel(aliTradePay *AliTradeCancelRequest) (*AliTradeCancelResponse, error) {
+	return i.AliTradeCancelContext(context.Background(), aliTradePay)
+}
+
+// AliTradeCancelContext 携带ctx的支付撤单
+func (i *AliAppClient) AliTradeCancelContext(ctx context.Context, aliTradePay *AliTradeCancelRequest) (*AliTradeCancelResponse, error) {
 	payMap, err := i.MakeTradeCancel("alipay.trade.cancel", aliTradePay, "RSA2")
 	if err != nil {
 		return nil, err
 	}
-	response, err := i.SendToAlipay(payMap, "post")
+	response, err := i.call(ctx, payMap, "post")
 	if err != nil || response == "" {
 		return nil, err
 	}
@@ -587,6 +662,57 @@ func (i *AliAppClient) AliTradeCancel(aliTradePay *AliTradeCancelRequest) (*AliT
 	return result, nil
 }
 
+// CloseOrder 关闭未支付交易, 关闭后用户无法继续支付
+func (i *AliAppClient) CloseOrder(outTradeNo string) (*AliTradeCloseResponse, error) {
+	return i.CloseOrderContext(context.Background(), outTradeNo)
+}
+
+// CloseOrderContext 携带ctx关闭未支付交易
+// 扫码下单后用户未扫码时交易尚未创建, 返回 pay.ErrOrderNotExist
+func (i *AliAppClient) CloseOrderContext(ctx context.Context, outTradeNo string) (*AliTradeCloseResponse, error) {
+	return i.AliTradeCloseContext(ctx, &AliTradeCloseRequest{OutTradeNo: outTradeNo})
+}
+
+// AliTradeClose 按商户订单号或支付宝交易号关闭交易
+func (i *AliAppClient) AliTradeClose(req *AliTradeCloseRequest) (*AliTradeCloseResponse, error) {
+	return i.AliTradeCloseContext(context.Background(), req)
+}
+
+// AliTradeCloseContext 携带ctx关闭交易
+func (i *AliAppClient) AliTradeCloseContext(ctx context.Context, req *AliTradeCloseRequest) (*AliTradeCloseResponse, error) {
+	if req.OutTradeNo == "" && req.TradeNo == "" {
+		return nil, errors.New("alipay.trade.close: out_trade_no or trade_no required")
+	}
+	var m = make(map[string]string)
+	m["method"] = "alipay.trade.close"
+	m["app_id"] = i.AppID
+	m["format"] = "JSON"
+	m["charset"] = "utf-8"
+	m["timestamp"] = time.Now().Format("2006-01-02 15:04:05")
+	m["version"] = "1.0"
+	m["sign_type"] = "RSA2"
+	bizContentJson, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.New("json.Marshal: " + err.Error())
+	}
+	m["biz_content"] = string(bizContentJson)
+	sign, err := i.GenSign(m)
+	if err != nil {
+		return nil, err
+	}
+	m["sign"] = sign
+
+	resp, err := i.call(ctx, m, "post")
+	if err != nil {
+		return nil, err
+	}
+	result := new(AliTradeCloseResponse)
+	if err := json.Unmarshal([]byte(resp), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 // MakeTradePay 创建支付宝统一收单请求
 func (i *AliAppClient) MakeTradeCancel(method string, bizContent *AliTradeCancelRequest, rsaType string) (map[string]string, error) {
 	var m = make(map[string]string)
@@ -603,13 +729,18 @@ func (i *AliAppClient) MakeTradeCancel(method string, bizContent *AliTradeCancel
 		return map[string]string{}, errors.New("json.Marshal: " + err.Error())
 	}
 	m["biz_content"] = i.NewEncoderToString(bizContentJson)
+	var sign string
 	if rsaType == "RSA2" {
-		m["sign"] = i.GenSign(m)
+		sign, err = i.GenSign(m)
 	} else {
-		m["sign"] = i.GenSignRsa1(m)
+		sign, err = i.GenSignRsa1(m)
 	}
+	if err != nil {
+		return nil, err
+	}
+	m["sign"] = sign
 
-	logs.Warning(m)
+	i.log(pay.LevelDebug, "alipay: request", pay.F("method", m["method"]), pay.F("params", m))
 	return m, nil
 }
 
@@ -655,12 +786,17 @@ func (i *AliAppClient) MakeH5PayMap(charge *Charge, rsaType string) (string, err
 		return "", errors.New("json.Marshal: " + err.Error())
 	}
 	m["biz_content"] = string(bizContentJson)
+	var sign string
 	if rsaType == "RSA2" {
-		m["sign"] = i.GenSign(m)
+		sign, err = i.GenSign(m)
 	} else {
-		m["sign"] = i.GenSignRsa1(m)
+		sign, err = i.GenSignRsa1(m)
 	}
-	logs.Warning(m)
+	if err != nil {
+		return "", err
+	}
+	m["sign"] = sign
+	i.log(pay.LevelDebug, "alipay: request", pay.F("method", m["method"]), pay.F("params", m))
 	// 转form表单
 	buf := bytes.NewBufferString("")
 	for k, v := range m {
@@ -681,11 +817,16 @@ func (i *AliAppClient) MakeH5PayMap(charge *Charge, rsaType string) (string, err
 		</script>
 	</body>
 	</html>`
-	return fmt.Sprintf(formatStr, "https://openapi.alipay.com/gateway.do?charset=utf-8", buf.String()), nil
+	return fmt.Sprintf(formatStr, i.Gateway()+"?charset=utf-8", buf.String()), nil
 }
 
 // TradeRelationBind 分账关系绑定
 func (c *AliAppClient) TradeRelationBind(bizContent *TradeRelationBindRequest) (interface{}, error) {
+	return c.TradeRelationBindContext(context.Background(), bizContent)
+}
+
+// TradeRelationBindContext 携带ctx的分账关系绑定
+func (c *AliAppClient) TradeRelationBindContext(ctx context.Context, bizContent *TradeRelationBindRequest) (interface{}, error) {
 	var m = make(map[string]string)
 	m["app_id"] = c.AppID
 	m["method"] = "alipay.trade.royalty.relation.bind"
@@ -700,19 +841,19 @@ func (c *AliAppClient) TradeRelationBind(bizContent *TradeRelationBindRequest) (
 		return map[string]string{}, errors.New("json.Marshal: " + err.Error())
 	}
 	m["biz_content"] = c.NewEncoderToString(bizContentJson)
-	// if rsaType == "RSA2" {
-	m["sign"] = c.GenSign(m)
-	// } else {
-	// 	m["sign"] = c.GenSignRsa1(m)
-	// }
+	sign, err := c.GenSign(m)
+	if err != nil {
+		return nil, err
+	}
+	m["sign"] = sign
 
-	logs.Warning(m)
+	c.log(pay.LevelDebug, "alipay: request", pay.F("method", m["method"]), pay.F("params", m))
 
-	response, err := c.SendToAlipay(m, "post")
+	response, err := c.call(ctx, m, "post")
 	if err != nil || response == "" {
 		return nil, err
 	}
-	logs.Warning(response)
+	c.log(pay.LevelDebug, "alipay: response", pay.F("method", m["method"]), pay.F("body", response))
 	// result := new(common.AliTradeCancelResponse)
 	// err = json.Unmarshal([]byte(response), result)
 	// if err != nil {
@@ -720,3 +861,13 @@ func (c *AliAppClient) TradeRelationBind(bizContent *TradeRelationBindRequest) (
 	// }
 	return response, nil
 }
+
+// Gateway 当前使用的网关地址
+func (i *AliAppClient) Gateway() string {
+	return gateway(i.GatewayURL, i.Sandbox)
+}
+
+// log 脱敏后记录日志
+func (i *AliAppClient) log(level pay.Level, msg string, fields ...pay.Field) {
+	pay.Log(i.Logger, level, msg, fields...)
+}
@@ -2,22 +2,18 @@ package alipay
 
 import (
 	"bytes"
+	"context"
 	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha1"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/astaxie/beego/httplib"
-	"github.com/astaxie/beego/logs"
 	"github.com/axgle/mahonia"
+	"github.com/jxwt/pay"
 	"golang.org/x/text/encoding/simplifiedchinese"
 	"golang.org/x/text/transform"
 	"io/ioutil"
-	"sort"
+	"net/http"
 	"strings"
 	"time"
 )
@@ -30,6 +26,12 @@ type AliWapClient struct {
 	AppID      string // 应用ID
 	PrivateKey *rsa.PrivateKey
 	PublicKey  *rsa.PublicKey
+
+	HTTPClient *http.Client   // 自定义http客户端, 为空时使用 pay.HTTPSC
+	GatewayURL string         // 自定义网关地址, 为空时按 Sandbox 选择
+	Sandbox    bool           // 使用沙箱网关 openapi.alipaydev.com
+	Logger     pay.Logger     // 日志, 为空时使用 pay.DefaultLogger, 输出前自动脱敏
+	Instrument pay.Instrument // 调用埋点, 为空时使用 pay.DefaultInstrument
 }
 
 func InitAliWapClient(c *AliWapClient) {
@@ -76,13 +78,18 @@ func (i *AliWapClient) MakePayMap(method string, charge *Charge, rsaType string)
 		return map[string]string{}, errors.New("json.Marshal: " + err.Error())
 	}
 	m["biz_content"] = string(bizContentJson)
+	var sign string
 	if rsaType == "RSA2" {
-		m["sign"] = i.GenSign(m)
+		sign, err = i.GenSign(m)
 	} else {
-		m["sign"] = i.GenSignRsa1(m)
+		sign, err = i.GenSignRsa1(m)
+	}
+	if err != nil {
+		return nil, err
 	}
+	m["sign"] = sign
 
-	logs.Warning(m)
+	i.log(pay.LevelDebug, "alipay: request", pay.F("method", m["method"]), pay.F("params", m))
 	return m, nil
 }
 
@@ -122,12 +129,17 @@ func (i *AliWapClient) MakeH5PayMap(method string, charge *Charge, rsaType strin
 		return "", errors.New("json.Marshal: " + err.Error())
 	}
 	m["biz_content"] = string(bizContentJson)
+	var sign string
 	if rsaType == "RSA2" {
-		m["sign"] = i.GenSign(m)
+		sign, err = i.GenSign(m)
 	} else {
-		m["sign"] = i.GenSignRsa1(m)
+		sign, err = i.GenSignRsa1(m)
 	}
-	logs.Warning(m)
+	if err != nil {
+		return "", err
+	}
+	m["sign"] = sign
+	i.log(pay.LevelDebug, "alipay: request", pay.F("method", m["method"]), pay.F("params", m))
 	// 转form表单
 	buf := bytes.NewBufferString("")
 	for k, v := range m {
@@ -148,15 +160,20 @@ func (i *AliWapClient) MakeH5PayMap(method string, charge *Charge, rsaType strin
 		</script>
 	</body>
 	</html>`
-	return fmt.Sprintf(formatStr, "https://openapi.alipay.com/gateway.do?charset=utf-8", buf.String()), nil
+	return fmt.Sprintf(formatStr, i.Gateway()+"?charset=utf-8", buf.String()), nil
 }
 
 func (i *AliWapClient) ToPay(charge *Charge) (string, error) {
+	return i.ToPayContext(context.Background(), charge)
+}
+
+// ToPayContext 携带ctx的手机网站支付
+func (i *AliWapClient) ToPayContext(ctx context.Context, charge *Charge) (string, error) {
 	payMap, err := i.MakePayMap("alipay.trade.wap.pay", charge, "RSA2")
 	if err != nil {
 		return "", err
 	}
-	return i.SendToAlipay(payMap, "post")
+	return i.SendToAlipayContext(ctx, payMap, "post")
 }
 
 // ToH5Pay 支付宝h5支付,返回请求参数
@@ -170,21 +187,22 @@ func (i *AliWapClient) ToH5Pay(charge *Charge) (string, error) {
 }
 
 func (i *AliWapClient) SendToAlipay(m map[string]string, method string) (string, error) {
-	req := httplib.Get("https://openapi.alipay.com/gateway.do")
-	if method == "post" {
-		req = httplib.Post("https://openapi.alipay.com/gateway.do")
-	}
-	for k, v := range m {
-		req.Param(k, v)
-	}
-	resp, err := req.Response()
+	return i.SendToAlipayContext(context.Background(), m, method)
+}
+
+// SendToAlipayContext 携带ctx请求支付宝网关
+func (i *AliWapClient) SendToAlipayContext(ctx context.Context, m map[string]string, method string) (string, error) {
+	body, err := sendToAlipay(ctx, i.HTTPClient, i.Gateway(), m, method, i.Instrument)
 	if err != nil {
-		println(err.Error())
+		return "", err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	a:=ConvertToString(string(body),"gbk", "utf-8")
-	fmt.Println(a)
-	return string(body), err
+	i.log(pay.LevelDebug, "alipay: response", pay.F("method", m["method"]), pay.F("body", ConvertToString(body, "gbk", "utf-8")))
+	return body, nil
+}
+
+// log 脱敏后记录日志
+func (i *AliWapClient) log(level pay.Level, msg string, fields ...pay.Field) {
+	pay.Log(i.Logger, level, msg, fields...)
 }
 
 
@@ -198,53 +216,13 @@ func ConvertToString(src string, srcCode string, tagCode string) string {
 }
 
 // GenSign 产生签名
-func (i *AliWapClient) GenSign(m map[string]string) string {
-	var data []string
-
-	for k, v := range m {
-		if v != "" && k != "sign" {
-			data = append(data, fmt.Sprintf(`%s=%s`, k, v))
-		}
-	}
-	sort.Strings(data)
-	signData := strings.Join(data, "&")
-
-	s := sha256.New()
-	_, err := s.Write([]byte(signData))
-	if err != nil {
-		panic(err)
-	}
-	hashByte := s.Sum(nil)
-	signByte, err := i.PrivateKey.Sign(rand.Reader, hashByte, crypto.SHA256)
-	if err != nil {
-		panic(err)
-	}
-	return base64.StdEncoding.EncodeToString(signByte)
+func (i *AliWapClient) GenSign(m map[string]string) (string, error) {
+	return rsaSign(i.PrivateKey, crypto.SHA256, signContent(m))
 }
 
 // GenSign 产生签名
-func (i *AliWapClient) GenSignRsa1(m map[string]string) string {
-	var data []string
-
-	for k, v := range m {
-		if v != "" && k != "sign" {
-			data = append(data, fmt.Sprintf(`%s=%s`, k, v))
-		}
-	}
-	sort.Strings(data)
-	signData := strings.Join(data, "&")
-
-	s := sha1.New()
-	_, err := s.Write([]byte(signData))
-	if err != nil {
-		panic(err)
-	}
-	hashByte := s.Sum(nil)
-	signByte, err := i.PrivateKey.Sign(rand.Reader, hashByte, crypto.SHA1)
-	if err != nil {
-		panic(err)
-	}
-	return base64.StdEncoding.EncodeToString(signByte)
+func (i *AliWapClient) GenSignRsa1(m map[string]string) (string, error) {
+	return rsaSign(i.PrivateKey, crypto.SHA1, signContent(m))
 }
 
 // NewEncoderToString 将带中文的[]byte 转GB18030字符串
@@ -254,3 +232,8 @@ func (c *AliWapClient) NewEncoderToString(req []byte) string {
 	ret, _ := ioutil.ReadAll(out)
 	return string(ret)
 }
+
+// Gateway 当前使用的网关地址
+func (i *AliWapClient) Gateway() string {
+	return gateway(i.GatewayURL, i.Sandbox)
+}
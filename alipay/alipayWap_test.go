@@ -1,12 +1,43 @@
 package alipay
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/jxwt/pay"
+	"github.com/jxwt/pay/paytest"
 )
 
-func TestToH5Pay(t *testing.T){
-	aliPay := Init("", "", "", "","www.baidu.com")
+var hiddenInput = regexp.MustCompile(`<input type='hidden' name='([^']*)' value='([^']*)'>`)
+
+// submitForm 模拟浏览器提交支付表单
+func submitForm(t *testing.T, s *paytest.AlipayServer, form string) (int, string) {
+	values := url.Values{}
+	for _, m := range hiddenInput.FindAllStringSubmatch(form, -1) {
+		values.Set(m[1], strings.Replace(m[2], "&apos;", "'", -1))
+	}
+	resp, err := s.Client().Get(s.GatewayURL() + "?" + values.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestToH5Pay(t *testing.T) {
+	s := paytest.NewAlipayServer(t)
+	aliPay, err := Init(s.AppID, s.SellerID, s.AppPrivateKey, s.AlipayPublicKey, "http://127.0.0.1/notify")
+	if err != nil {
+		t.Fatal(err)
+	}
 	industryRefluxInfo := &IndustryRefluxInfo{
 		SceneCode: "parking_fee_order",
 		Channel:   "common_park_provider",
@@ -15,7 +46,7 @@ func TestToH5Pay(t *testing.T){
 			StartTime:      "2020-08-02 15:04:05",
 			ParkingLotName: "测试车场",
 			CityCode:       "330100",
-			ParkingLotId:  "1",
+			ParkingLotId:   "1",
 		},
 	}
 	d, _ := json.Marshal(industryRefluxInfo)
@@ -24,25 +55,256 @@ func TestToH5Pay(t *testing.T){
 		IndustryRefluxInfo:   string(d),
 	}
 	externParams, _ := json.Marshal(extern)
-	charge:=&Charge{
+	charge := &Charge{
 		TradeNum:    "sdsfsdfe34343cdd2121e4",
-		MoneyFee:    0.02,
+		MoneyFee:    pay.CNY(2),
 		CallbackURL: aliPay.NotifyURL,
 		Describe:    "test",
-		AuthToken: "202008BBadd7073546f54a2bbfd99b7fc89e5C11",
 		ExtendParam: string(externParams),
-		//BuyerId: "2088702297070826",
-	}
-	//res,err:=aliPay.Client.ToH5Pay(charge)
-	//t.Logf("%v",err)
-	//t.Logf("%v",res)
-	aliWapCient:=&AliWapClient{
-		SellerID: aliPay.Client.SellerID,
-		AppID: aliPay.Client.AppID,
+	}
+	aliWapCient := &AliWapClient{
+		SellerID:   aliPay.Client.SellerID,
+		AppID:      aliPay.Client.AppID,
 		PrivateKey: aliPay.Client.PrivateKey,
-		PublicKey: aliPay.Client.PublicKey,
+		PublicKey:  aliPay.Client.PublicKey,
+		GatewayURL: s.GatewayURL(),
+	}
+	res, err := aliWapCient.ToH5Pay(charge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := submitForm(t, s, res); code != 200 || !strings.Contains(body, charge.TradeNum) {
+		t.Fatalf("gateway rejected form: %d %s", code, body)
+	}
+	if o, _ := s.Order(charge.TradeNum); o.State != paytest.StateNotPay || o.Amount != 2 || o.NotifyURL != aliPay.NotifyURL {
+		t.Fatalf("unexpected order %+v", o)
+	}
+
+	// 篡改金额后验签失败
+	tampered := strings.Replace(res, `"total_amount":"0.02"`, `"total_amount":"0.01"`, 1)
+	if _, body := submitForm(t, s, tampered); !strings.Contains(body, "isv.invalid-signature") {
+		t.Fatalf("tampered form should be rejected: %s", body)
+	}
+
+	if err := s.Pay(charge.TradeNum); err != nil {
+		t.Fatal(err)
+	}
+	form, err := s.NotifyForm(charge.TradeNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := aliPay.Client.ParsePaymentNotification(form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TradeStatus != TradeStatusSuccess || result.TotalAmount != "0.02" {
+		t.Fatalf("unexpected notification %+v", result)
+	}
+}
+
+func TestAliAppClientAgainstGateway(t *testing.T) {
+	s := paytest.NewAlipayServer(t)
+	c, err := NewAliAppClient(s.AppID, s.SellerID, s.AppPrivateKey, s.AlipayPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.GatewayURL = s.GatewayURL()
+	c.HTTPClient = s.Client()
+
+	if _, err := c.CreateOrder(&Charge{TradeNum: "T001", MoneyFee: pay.CNY(100), Describe: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	q, err := c.QueryOrder("T001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.AlipayTradeQueryResponse.TradeStatus != TradeStatusWaitBuyerPay {
+		t.Fatalf("unexpected query %+v", q)
+	}
+	if err := s.Pay("T001"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := c.Refund(&AliRefundRequest{OutTradeNo: "T001", RefundAmount: "0.40", OutRequestNo: "R1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.AliPayTradeRefund.RefundFee != "0.40" || r.AliPayTradeRefund.FundChange != "Y" {
+		t.Fatalf("unexpected refund %+v", r)
+	}
+	if _, err := c.Refund(&AliRefundRequest{OutTradeNo: "T001", RefundAmount: "0.70", OutRequestNo: "R2"}); err == nil {
+		t.Fatal("expected over-refund error")
+	}
+
+	s.FailNext("alipay.trade.query", "ACQ.SYSTEM_ERROR", 1)
+	_, err = c.QueryOrder("T001")
+	if !pay.IsRetryable(err) {
+		t.Fatalf("expected retryable provider error, got %v", err)
+	}
+	q, err = c.QueryOrder("T001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.AlipayTradeQueryResponse.TradeStatus != TradeStatusSuccess {
+		t.Fatalf("unexpected query %+v", q)
+	}
+}
+
+func TestCloseOrder(t *testing.T) {
+	s := paytest.NewAlipayServer(t)
+	c, err := Init(s.AppID, s.SellerID, s.AppPrivateKey, s.AlipayPublicKey, "http://127.0.0.1/notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Client.GatewayURL = s.GatewayURL()
+	c.Client.HTTPClient = s.Client()
+	for _, no := range []string{"T001", "T002"} {
+		if _, err := c.Client.CreateOrder(&Charge{TradeNum: no, MoneyFee: pay.CNY(100), Describe: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := c.Client.CloseOrder("T001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.AlipayTradeCloseResponse.OutTradeNo != "T001" {
+		t.Fatalf("unexpected response %+v", res)
+	}
+	if o, _ := s.Order("T001"); o.State != paytest.StateClosed {
+		t.Fatalf("order state %s", o.State)
+	}
+	if _, err := c.Client.CloseOrder("T001"); err == nil {
+		t.Fatal("expected error closing closed order")
+	}
+	p, err := NewProvider(c, pay.CashChannelAliMiniPay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(context.Background(), "T001"); err != nil {
+		t.Fatalf("close closed order: %v", err)
+	}
+
+	if err := s.Pay("T002"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(context.Background(), "T002"); err == nil {
+		t.Fatal("expected error closing paid order")
+	}
+	if err := p.Close(context.Background(), "T003"); !errors.Is(err, pay.ErrOrderNotExist) {
+		t.Fatalf("close unknown order: %v", err)
+	}
+}
+
+func TestProviderCloseUnscannedPrecreate(t *testing.T) {
+	s := paytest.NewAlipayServer(t)
+	c, err := Init(s.AppID, s.SellerID, s.AppPrivateKey, s.AlipayPublicKey, "http://127.0.0.1/notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Client.GatewayURL = s.GatewayURL()
+	c.Client.HTTPClient = s.Client()
+	p, err := NewProvider(c, pay.CashChannelAliCodePay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := p.CreatePayment(ctx, &pay.PaymentRequest{TradeNo: "T001", Amount: pay.CNY(100), Subject: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	// 用户未扫码, 交易尚未创建, 无法直接关闭
+	if _, err := c.Client.CloseOrder("T001"); !errors.Is(err, pay.ErrOrderNotExist) {
+		t.Fatalf("close unscanned order: %v", err)
+	}
+	if err := p.Close(ctx, "T001"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pay("T001"); err == nil {
+		t.Fatal("closed qr code can still be paid")
+	}
+}
+
+func TestQueryOrderRetry(t *testing.T) {
+	s := paytest.NewAlipayServer(t)
+	c, err := Init(s.AppID, s.SellerID, s.AppPrivateKey, s.AlipayPublicKey, "http://127.0.0.1/notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Client.GatewayURL = s.GatewayURL()
+	c.Client.HTTPClient = s.Client()
+	policy := pay.DefaultRetryPolicy
+	policy.BaseDelay = time.Millisecond
+	c.Client.RetryPolicy = &policy
+	if _, err := c.Client.CreateOrder(&Charge{TradeNum: "T001", MoneyFee: pay.CNY(100), Describe: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.FailNext("alipay.trade.query", "ACQ.SYSTEM_ERROR", 2)
+	q, err := c.Client.QueryOrder("T001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.AlipayTradeQueryResponse.OutTradeNo != "T001" {
+		t.Fatalf("unexpected query %+v", q)
+	}
+
+	s.FailNext("alipay.trade.query", "ACQ.SYSTEM_ERROR", policy.MaxAttempts)
+	if _, err := c.Client.QueryOrder("T001"); !pay.IsRetryable(err) {
+		t.Fatalf("expected retryable error after max attempts, got %v", err)
+	}
+}
+
+// callRecorder 记录埋点
+type callRecorder struct {
+	calls []pay.Call
+}
+
+func (r *callRecorder) Start(ctx context.Context, call *pay.Call) context.Context {
+	return ctx
+}
+
+func (r *callRecorder) End(ctx context.Context, call *pay.Call) {
+	r.calls = append(r.calls, *call)
+}
+
+func TestClientInstrument(t *testing.T) {
+	s := paytest.NewAlipayServer(t)
+	c, err := Init(s.AppID, s.SellerID, s.AppPrivateKey, s.AlipayPublicKey, "http://127.0.0.1/notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Client.GatewayURL = s.GatewayURL()
+	c.Client.HTTPClient = s.Client()
+	r := &callRecorder{}
+	c.Client.Instrument = r
+	if _, err := c.Client.QueryOrder("T404"); !errors.Is(err, pay.ErrOrderNotExist) {
+		t.Fatalf("expected order not exist, got %v", err)
+	}
+	if _, err := c.Client.CreateOrder(&Charge{TradeNum: "T001", MoneyFee: pay.CNY(100), Describe: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []pay.Call{
+		{Provider: "alipay", Method: "alipay.trade.query", Tenant: s.AppID, Code: "ACQ.TRADE_NOT_EXIST"},
+		{Provider: "alipay", Method: "alipay.trade.create", Tenant: s.AppID, Code: pay.CodeSuccess},
+	}
+	if len(r.calls) != len(want) {
+		t.Fatalf("unexpected calls %+v", r.calls)
+	}
+	for n, w := range want {
+		got := r.calls[n]
+		if got.Provider != w.Provider || got.Method != w.Method || got.Tenant != w.Tenant || got.Code != w.Code {
+			t.Fatalf("call %d: got %+v want %+v", n, got, w)
+		}
+	}
+}
+
+func TestYuanToMoney(t *testing.T) {
+	if m, err := yuanToMoney("88.88"); err != nil || m != pay.CNY(8888) {
+		t.Fatalf("88.88: %v %v", m, err)
+	}
+	if m, err := yuanToMoney(""); err != nil || !m.IsZero() {
+		t.Fatalf("empty: %v %v", m, err)
+	}
+	if _, err := yuanToMoney("8x.88"); err == nil {
+		t.Fatal("malformed amount parsed")
 	}
-	res,err:=aliWapCient.ToH5Pay(charge)
-	t.Logf("%v",err)
-	t.Logf("%v",res)
 }
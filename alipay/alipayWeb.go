@@ -1,16 +1,12 @@
 package alipay
 
 import (
+	"context"
 	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha1"
-	"encoding/base64"
 	"errors"
-	"fmt"
+	"net/http"
 	"net/url"
-	"sort"
-	"strings"
 )
 
 var aliWebClient *AliWebClient
@@ -23,6 +19,8 @@ type AliWebClient struct {
 	CallbackURL string          // 回调接口
 	PrivateKey  *rsa.PrivateKey // 私钥
 	PublicKey   *rsa.PublicKey  // 公钥
+	HTTPClient  *http.Client    // 自定义http客户端, 为空时使用 pay.HTTPSC
+	GatewayURL  string          // 自定义网关地址, 为空时使用 WebGateway
 }
 
 func InitAliWebClient(c *AliWebClient) {
@@ -47,11 +45,13 @@ func (i *AliWebClient) Pay(charge *Charge) (map[string]string, error) {
 	m["total_fee"] = AliyunMoneyFeeToString(charge.MoneyFee)
 	m["seller_id"] = i.SellerID
 
-	sign := i.GenSign(m)
-
+	sign, err := i.GenSign(m)
+	if err != nil {
+		return nil, err
+	}
 	m["sign"] = sign
 	m["sign_type"] = "RSA"
-	return map[string]string{"url": ToURL("https://mapi.alipay.com/gateway.do", m)}, nil
+	return map[string]string{"url": ToURL(i.Gateway(), m)}, nil
 }
 
 func (i *AliWebClient) PayToClient(charge *Charge) (map[string]string, error) {
@@ -60,56 +60,47 @@ func (i *AliWebClient) PayToClient(charge *Charge) (map[string]string, error) {
 
 // 订单查询
 func (i *AliWebClient) QueryOrder(outTradeNo string) (AliWebQueryResult, error) {
+	return i.QueryOrderContext(context.Background(), outTradeNo)
+}
+
+// QueryOrderContext 携带ctx的订单查询
+func (i *AliWebClient) QueryOrderContext(ctx context.Context, outTradeNo string) (AliWebQueryResult, error) {
 	var m = make(map[string]string)
 	m["systemsService"] = "single_trade_query"
 	m["partner"] = i.PartnerID
 	m["_input_charset"] = "utf-8"
 	m["out_trade_no"] = outTradeNo
 
-	sign := i.GenSign(m)
-
+	sign, err := i.GenSign(m)
+	if err != nil {
+		return AliWebQueryResult{}, err
+	}
 	m["sign"] = sign
 	m["sign_type"] = "RSA"
-	return GetAlipay(ToURL("https://mapi.alipay.com/gateway.do", m))
+	return GetAlipayContext(ctx, i.HTTPClient, ToURL(i.Gateway(), m))
 }
 
 // GenSign 产生签名
-func (i *AliWebClient) GenSign(m map[string]string) string {
-	var data []string
-	for k, v := range m {
-		if v != "" && k != "sign" && k != "sign_type" {
-			data = append(data, fmt.Sprintf(`%s=%s`, k, v))
-		}
-	}
-	sort.Strings(data)
-	signData := strings.Join(data, "&")
-	s := sha1.New()
-	_, err := s.Write([]byte(signData))
+func (i *AliWebClient) GenSign(m map[string]string) (string, error) {
+	sign, err := rsaSign(i.PrivateKey, crypto.SHA1, signContent(m, "sign_type"))
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	hashByte := s.Sum(nil)
-	signByte, err := i.PrivateKey.Sign(rand.Reader, hashByte, crypto.SHA1)
-	if err != nil {
-		panic(err)
-	}
-	return url.QueryEscape(base64.StdEncoding.EncodeToString(signByte))
+	return url.QueryEscape(sign), nil
 }
 
 // CheckSign 检测签名
-func (i *AliWebClient) CheckSign(signData, sign string) {
-	signByte, err := base64.StdEncoding.DecodeString(sign)
-	if err != nil {
-		panic(err)
-	}
-	s := sha1.New()
-	_, err = s.Write([]byte(signData))
-	if err != nil {
-		panic(err)
+func (i *AliWebClient) CheckSign(signData, sign string) error {
+	if i.PublicKey == nil {
+		return errors.New("publicKey is nil")
 	}
-	hash := s.Sum(nil)
-	err = rsa.VerifyPKCS1v15(i.PublicKey, crypto.SHA1, hash, signByte)
-	if err != nil {
-		panic(err)
+	return verifySign(i.PublicKey, "RSA", signData, sign)
+}
+
+// Gateway 当前使用的网关地址
+func (i *AliWebClient) Gateway() string {
+	if i.GatewayURL != "" {
+		return i.GatewayURL
 	}
+	return WebGateway
 }
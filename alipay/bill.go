@@ -0,0 +1,397 @@
+package alipay
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jxwt/pay"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/transform"
+)
+
+// 对账单 https://opendocs.alipay.com/open/02e7gr
+// 下载地址为 zip 压缩包, 内含 GBK 编码的明细与汇总 csv, 以 # 开头的行为说明与合计
+
+// 账单类型
+const (
+	BillTypeTrade        = "trade"        // 业务账单, 支付宝交易收单明细
+	BillTypeSignCustomer = "signcustomer" // 账务账单, 支付宝余额收入支出明细
+)
+
+// DefaultMaxBillSize 对账单压缩包默认大小上限, 可通过 AliAppClient.MaxBillSize 调整
+const DefaultMaxBillSize = 64 << 20
+
+// billLocation 账单时间为北京时间
+var billLocation = time.FixedZone("CST", 8*3600)
+
+// AliBillDownloadURLQueryRequest 查询对账单下载地址请求
+type AliBillDownloadURLQueryRequest struct {
+	BillType string `json:"bill_type"` // 账单类型, trade 或 signcustomer
+	BillDate string `json:"bill_date"` // 日账单 2006-01-02, 月账单 2006-01
+}
+
+// AliBillDownloadURLQueryResponse 查询对账单下载地址返回
+type AliBillDownloadURLQueryResponse struct {
+	AlipayDataDataserviceBillDownloadurlQueryResponse struct {
+		Code            string `json:"code"`
+		Msg             string `json:"msg"`
+		SubCode         string `json:"sub_code"`
+		SubMsg          string `json:"sub_msg"`
+		BillDownloadURL string `json:"bill_download_url"` // 下载地址, 30秒内有效
+	} `json:"alipay_data_dataservice_bill_downloadurl_query_response"`
+	Sign string `json:"sign"`
+}
+
+// BillRecord 对账单明细
+type BillRecord struct {
+	TradeNo    string    // 支付宝交易号
+	OutTradeNo string    // 商户订单号
+	Type       string    // 业务类型(交易、退款), 账务账单为账务类型
+	Subject    string    // 商品名称
+	Amount     pay.Money // 订单金额, 业务账单退款明细为原订单金额; 账务账单为收入减支出, 退款为负数
+	Receipt    pay.Money // 商家实收, 仅业务账单, 退款明细为负数
+	Fee        pay.Money // 服务费, 按账单原值
+	Refund     pay.Money // 退款金额, 退款明细时为退款金额, 否则为0
+	RefundNo   string    // 退款批次号/请求号
+	CreatedAt  time.Time // 创建时间, 账务账单为发生时间
+	FinishedAt time.Time // 完成时间, 账务账单为发生时间
+
+	Raw map[string]string // 原始明细, 键为账单表头
+}
+
+// billColumns 明细字段对应的表头, 不含括号中的单位, 业务账单与账务账单表头不同
+var billColumns = map[string][]string{
+	"tradeNo":    {"支付宝交易号", "业务流水号"},
+	"outTradeNo": {"商户订单号"},
+	"type":       {"业务类型", "账务类型"},
+	"subject":    {"商品名称"},
+	"amount":     {"订单金额"},
+	"income":     {"收入金额", "收入"},
+	"expense":    {"支出金额", "支出"},
+	"receipt":    {"商家实收"},
+	"fee":        {"服务费"},
+	"refundNo":   {"退款批次号/请求号"},
+	"createdAt":  {"创建时间", "发生时间", "入账时间"},
+	"finishedAt": {"完成时间", "发生时间", "入账时间"},
+}
+
+// BillReader 对账单明细迭代器, 逐行解析不一次性载入全部明细
+//
+//	r, err := client.DownloadBill(alipay.BillTypeTrade, "2021-06-01")
+//	if err != nil { ... }
+//	defer r.Close()
+//	for {
+//		rec, err := r.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		...
+//	}
+type BillReader struct {
+	Name   string   // 明细文件名
+	Header []string // 明细表头
+
+	file   io.Closer
+	csv    *csv.Reader
+	column map[string]int
+	n      int
+}
+
+// DownloadBill 下载对账单并返回明细迭代器, 账单未生成时返回 pay.ErrBillNotExist
+// date 日账单为 2006-01-02, 月账单为 2006-01
+func (i *AliAppClient) DownloadBill(billType, date string) (*BillReader, error) {
+	return i.DownloadBillContext(context.Background(), billType, date)
+}
+
+// DownloadBillContext 携带ctx下载对账单
+// zip 需随机读取, 压缩包整体下载到内存, 大小受 MaxBillSize 限制; 仅明细 csv 的解压与解析为流式
+func (i *AliAppClient) DownloadBillContext(ctx context.Context, billType, date string) (*BillReader, error) {
+	res, err := i.AliBillDownloadURLQueryContext(ctx, &AliBillDownloadURLQueryRequest{BillType: billType, BillDate: date})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", res.AlipayDataDataserviceBillDownloadurlQueryResponse.BillDownloadURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := i.HTTPClient
+	if client == nil {
+		client = &pay.HTTPSC.Client
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("alipay: download bill: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("alipay: download bill: %s", resp.Status)
+	}
+	limit := i.maxBillSize()
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("alipay: download bill: size %d exceeds limit %d", resp.ContentLength, limit)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("alipay: download bill: %w", err)
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("alipay: download bill: size exceeds limit %d", limit)
+	}
+	return OpenBill(body)
+}
+
+// maxBillSize 对账单压缩包大小上限
+func (i *AliAppClient) maxBillSize() int64 {
+	if i.MaxBillSize > 0 {
+		return i.MaxBillSize
+	}
+	return DefaultMaxBillSize
+}
+
+// AliBillDownloadURLQuery 查询对账单下载地址
+func (i *AliAppClient) AliBillDownloadURLQuery(req *AliBillDownloadURLQueryRequest) (*AliBillDownloadURLQueryResponse, error) {
+	return i.AliBillDownloadURLQueryContext(context.Background(), req)
+}
+
+// AliBillDownloadURLQueryContext 携带ctx查询对账单下载地址
+func (i *AliAppClient) AliBillDownloadURLQueryContext(ctx context.Context, req *AliBillDownloadURLQueryRequest) (*AliBillDownloadURLQueryResponse, error) {
+	if req.BillType == "" || req.BillDate == "" {
+		return nil, errors.New("alipay.data.dataservice.bill.downloadurl.query: bill_type and bill_date required")
+	}
+	var m = make(map[string]string)
+	m["method"] = "alipay.data.dataservice.bill.downloadurl.query"
+	m["app_id"] = i.AppID
+	m["format"] = "JSON"
+	m["charset"] = "utf-8"
+	m["timestamp"] = time.Now().Format("2006-01-02 15:04:05")
+	m["version"] = "1.0"
+	m["sign_type"] = "RSA2"
+	bizContentJson, err := json.Marshal(req)
+	if err != nil {
+		return nil, errors.New("json.Marshal: " + err.Error())
+	}
+	m["biz_content"] = string(bizContentJson)
+	sign, err := i.GenSign(m)
+	if err != nil {
+		return nil, err
+	}
+	m["sign"] = sign
+
+	resp, err := i.retryCall(ctx, pay.OpDownloadBill, m, "post")
+	if err != nil {
+		return nil, err
+	}
+	result := new(AliBillDownloadURLQueryResponse)
+	if err := json.Unmarshal([]byte(resp), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// OpenBill 解析已下载的对账单压缩包, 取其中的明细文件(文件名不含"汇总")
+func OpenBill(data []byte) (*BillReader, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("alipay: open bill: %w", err)
+	}
+	for _, f := range zr.File {
+		name := zipName(f.Name)
+		if !strings.HasSuffix(strings.ToLower(name), ".csv") || strings.Contains(name, "汇总") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("alipay: open bill %s: %w", name, err)
+		}
+		r, err := newBillReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("alipay: open bill %s: %w", name, err)
+		}
+		r.Name = name
+		return r, nil
+	}
+	return nil, errors.New("alipay: open bill: detail csv not found")
+}
+
+// zipName 支付宝压缩包内的文件名为 GBK 编码
+func zipName(name string) string {
+	if utf8.ValidString(name) {
+		return name
+	}
+	if s, _, err := transform.String(simplifiedchinese.GBK.NewDecoder(), name); err == nil {
+		return s
+	}
+	return name
+}
+
+// newBillReader 读取表头, 跳过以 # 开头的说明行
+func newBillReader(rc io.ReadCloser) (*BillReader, error) {
+	cr := csv.NewReader(transform.NewReader(rc, simplifiedchinese.GBK.NewDecoder()))
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("missing header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := &BillReader{file: rc, csv: cr, column: make(map[string]int)}
+	for n, h := range header {
+		h = strings.TrimSpace(h)
+		r.Header = append(r.Header, h)
+		r.column[billColumn(h)] = n
+	}
+	return r, nil
+}
+
+// billColumn 去掉表头中的单位, 如 订单金额（元） -> 订单金额
+func billColumn(h string) string {
+	if n := strings.IndexAny(h, "（("); n > 0 {
+		return h[:n]
+	}
+	return h
+}
+
+// Next 返回下一条明细, 读完时返回 io.EOF
+func (r *BillReader) Next() (*BillRecord, error) {
+	row, err := r.csv.Read()
+	if err != nil {
+		return nil, err
+	}
+	r.n++
+	rec := &BillRecord{Raw: make(map[string]string, len(r.Header))}
+	for n, h := range r.Header {
+		if n < len(row) {
+			rec.Raw[h] = strings.TrimSpace(row[n])
+		}
+	}
+	rec.TradeNo = r.get(row, "tradeNo")
+	rec.OutTradeNo = r.get(row, "outTradeNo")
+	rec.Type = r.get(row, "type")
+	rec.Subject = r.get(row, "subject")
+	rec.RefundNo = r.get(row, "refundNo")
+	if err := r.parse(rec, row); err != nil {
+		return nil, fmt.Errorf("alipay: bill %s record %d: %w", r.Name, r.n, err)
+	}
+	return rec, nil
+}
+
+// parse 解析金额与时间
+func (r *BillReader) parse(rec *BillRecord, row []string) error {
+	var err error
+	if _, ok := r.index("amount"); ok {
+		if rec.Amount, err = r.money(row, "amount"); err != nil {
+			return err
+		}
+	} else {
+		income, err := r.money(row, "income")
+		if err != nil {
+			return err
+		}
+		expense, err := r.money(row, "expense")
+		if err != nil {
+			return err
+		}
+		// 账务账单支出列可能带负号
+		if expense.Amount < 0 {
+			expense.Amount = -expense.Amount
+		}
+		if rec.Amount, err = income.Sub(expense); err != nil {
+			return err
+		}
+	}
+	if rec.Receipt, err = r.money(row, "receipt"); err != nil {
+		return err
+	}
+	if rec.Fee, err = r.money(row, "fee"); err != nil {
+		return err
+	}
+	if strings.Contains(rec.Type, "退款") {
+		// 业务账单退款明细的订单金额为原订单金额, 退款金额体现为负数的商家实收
+		refunded := rec.Amount
+		if _, ok := r.index("receipt"); ok {
+			refunded = rec.Receipt
+		}
+		if refunded.Amount < 0 {
+			rec.Refund = pay.CNY(-refunded.Amount)
+		}
+	}
+	if rec.CreatedAt, err = r.time(row, "createdAt"); err != nil {
+		return err
+	}
+	if rec.FinishedAt, err = r.time(row, "finishedAt"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// index 字段所在列
+func (r *BillReader) index(field string) (int, bool) {
+	for _, h := range billColumns[field] {
+		if n, ok := r.column[h]; ok {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// get 取字段值, 账单中没有该列时返回空
+func (r *BillReader) get(row []string, field string) string {
+	n, ok := r.index(field)
+	if !ok || n >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[n])
+}
+
+// money 解析以元为单位的金额, 为空时为0
+func (r *BillReader) money(row []string, field string) (pay.Money, error) {
+	v := r.get(row, field)
+	if v == "" {
+		return pay.CNY(0), nil
+	}
+	return pay.ParseMoney(v)
+}
+
+// time 解析北京时间, 为空时为零值
+func (r *BillReader) time(row []string, field string) (time.Time, error) {
+	v := r.get(row, field)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", v, billLocation)
+}
+
+// Close 关闭明细文件
+func (r *BillReader) Close() error {
+	return r.file.Close()
+}
+
+// ReadAll 读取剩余全部明细, 账单较大时应使用 Next 逐条处理
+func (r *BillReader) ReadAll() ([]*BillRecord, error) {
+	var res []*BillRecord
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		res = append(res, rec)
+	}
+}
@@ -0,0 +1,137 @@
+package alipay
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jxwt/pay"
+	"github.com/jxwt/pay/paytest"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func TestDownloadBill(t *testing.T) {
+	s := paytest.NewAlipayServer(t)
+	c, err := Init(s.AppID, s.SellerID, s.AppPrivateKey, s.AlipayPublicKey, "http://127.0.0.1/notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Client.GatewayURL = s.GatewayURL()
+	c.Client.HTTPClient = s.Client()
+	p, err := NewProvider(c, pay.CashChannelAliCodePay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := p.CreatePayment(ctx, &pay.PaymentRequest{TradeNo: "T001", Amount: pay.CNY(10000), Subject: "停车费"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pay("T001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Refund(ctx, &pay.RefundRequest{TradeNo: "T001", RefundNo: "R1", TotalAmount: pay.CNY(10000), RefundAmount: pay.CNY(3000)}); err != nil {
+		t.Fatal(err)
+	}
+	o, _ := s.Order("T001")
+
+	today := time.Now().In(billLocation).Format("2006-01-02")
+	r, err := c.Client.DownloadBill(BillTypeTrade, today)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Name != s.SellerID+"0156_"+today[:4]+today[5:7]+today[8:]+"_业务明细.csv" {
+		t.Fatalf("bill name %q", r.Name)
+	}
+	recs, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("got %d records", len(recs))
+	}
+	trade, refund := recs[0], recs[1]
+	if trade.TradeNo != o.TransactionID || trade.OutTradeNo != "T001" || trade.Type != "交易" || trade.Subject != "停车费" {
+		t.Fatalf("trade record %+v", trade)
+	}
+	if trade.Amount != pay.CNY(10000) || trade.Receipt != pay.CNY(10000) || trade.Fee != pay.CNY(-60) || !trade.Refund.IsZero() {
+		t.Fatalf("trade amounts %+v", trade)
+	}
+	if !trade.FinishedAt.Equal(o.PaidAt.Truncate(time.Second)) {
+		t.Fatalf("finished at %v, paid at %v", trade.FinishedAt, o.PaidAt)
+	}
+	// 退款明细的订单金额为原订单金额, 退款金额取负数的商家实收
+	if refund.Type != "退款" || refund.RefundNo != "R1" || refund.Amount != pay.CNY(10000) || refund.Receipt != pay.CNY(-3000) || refund.Refund != pay.CNY(3000) || refund.Fee != pay.CNY(18) {
+		t.Fatalf("refund record %+v", refund)
+	}
+	if refund.Raw["商户订单号"] != "T001" {
+		t.Fatalf("raw %v", refund.Raw)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	c.Client.MaxBillSize = 512
+	if _, err := c.Client.DownloadBill(BillTypeTrade, today); err == nil || !strings.Contains(err.Error(), "exceeds limit") {
+		t.Fatalf("expected size limit error, got %v", err)
+	}
+	c.Client.MaxBillSize = 0
+
+	tomorrow := time.Now().In(billLocation).AddDate(0, 0, 1).Format("2006-01-02")
+	if _, err := c.Client.DownloadBill(BillTypeTrade, tomorrow); !errors.Is(err, pay.ErrBillNotExist) {
+		t.Fatalf("expected ErrBillNotExist, got %v", err)
+	}
+}
+
+func TestOpenBillSignCustomer(t *testing.T) {
+	detail := "#支付宝账务明细查询\r\n" +
+		"#账号：[20881021778468800156]\r\n" +
+		"账务流水号,业务流水号,商户订单号,商品名称,发生时间,对方账号,收入金额（+元）,支出金额（-元）,账户余额（元）,交易渠道,业务类型,备注\r\n" +
+		"20210601001\t,2021060122001\t,T001\t,停车费,2021-06-01 10:00:00,159****5620,100.00,,100.00,支付宝,在线支付,\r\n" +
+		"20210601002\t,2021060122001\t,T001\t,停车费,2021-06-01 11:00:00,159****5620,,-30.00,70.00,支付宝,交易退款,\r\n" +
+		"#账务明细列表结束\r\n"
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"20881021778468800156_20210601_账务明细.csv":     detail,
+		"20881021778468800156_20210601_账务明细(汇总).csv": "#支付宝账务汇总查询\r\n",
+	} {
+		enc := simplifiedchinese.GBK.NewEncoder()
+		gbkName, _ := enc.String(name)
+		gbkContent, _ := enc.String(content)
+		w, err := zw.Create(gbkName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(gbkContent))
+	}
+	zw.Close()
+
+	r, err := OpenBill(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Name != "20881021778468800156_20210601_账务明细.csv" {
+		t.Fatalf("bill name %q", r.Name)
+	}
+	recs, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("got %d records", len(recs))
+	}
+	at := time.Date(2021, 6, 1, 10, 0, 0, 0, billLocation)
+	if recs[0].TradeNo != "2021060122001" || recs[0].Amount != pay.CNY(10000) || !recs[0].CreatedAt.Equal(at) || !recs[0].Refund.IsZero() {
+		t.Fatalf("income record %+v", recs[0])
+	}
+	if recs[1].Type != "交易退款" || recs[1].Amount != pay.CNY(-3000) || recs[1].Refund != pay.CNY(3000) {
+		t.Fatalf("refund record %+v", recs[1])
+	}
+}
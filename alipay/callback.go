@@ -4,11 +4,8 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"github.com/astaxie/beego/logs"
+	"github.com/jxwt/pay"
 	"net/http"
-	"sort"
-	"strings"
 )
 
 func MapStringToStruct(m map[string]string, i interface{}) error {
@@ -23,52 +20,35 @@ func MapStringToStruct(m map[string]string, i interface{}) error {
 	return nil
 }
 
-// 支付宝app支付回调
+// 支付宝app支付回调, getPublicKey 按商户单号返回支付宝公钥
+// 验签失败时应答fail并返回错误; 需校验app_id/seller_id时使用 AliAppClient.HandlePaymentNotification
 func AliAppCallback(w http.ResponseWriter, r *http.Request, getPublicKey func(string) *rsa.PublicKey) (*AliWebPayResult, error) {
-	var result string
+	var result = "fail"
 	defer func() {
 		w.Write([]byte(result))
 	}()
 
 	var m = make(map[string]string)
-	var signSlice []string
-	r.ParseForm()
-	aliAppClient := new(AliAppClient)
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
 	for k, v := range r.Form {
 		m[k] = v[0]
-		if k == "sign" || k == "sign_type" {
-			continue
-		}
-		if k == "out_trade_no" {
-			aliAppClient.PublicKey = getPublicKey(v[0])
-		}
-		signSlice = append(signSlice, fmt.Sprintf("%s=%s", k, v[0]))
-	}
-	sort.Strings(signSlice)
-	signData := strings.Join(signSlice, "&")
-	if m["sign_type"] != "RSA2" {
-		result = "error"
-		logs.Warning("签名类型未知")
 	}
-	if aliAppClient.PublicKey == nil {
-		logs.Error("支付宝public key 失效")
+	publicKey := getPublicKey(m["out_trade_no"])
+	if publicKey == nil {
+		pay.Log(nil, pay.LevelError, "alipay: callback public key not found", pay.F("out_trade_no", m["out_trade_no"]))
 		return nil, errors.New("未知支付信息")
 	}
-
-	aliAppClient.CheckSign(signData, m["sign"])
-
-	mByte, err := json.Marshal(m)
-	logs.Warning(string(mByte))
-	if err != nil {
-		result = "error"
-		logs.Warning(err)
+	if err := VerifyNotifySign(publicKey, m); err != nil {
+		pay.Log(nil, pay.LevelError, "alipay: callback sign error", pay.F("out_trade_no", m["out_trade_no"]), pay.F("err", err))
+		return nil, err
 	}
 
 	var aliPay AliWebPayResult
-	err = json.Unmarshal(mByte, &aliPay)
-	if err != nil {
-		result = "error"
-		logs.Error("m is %v, err is %v", m, err)
+	if err := MapStringToStruct(m, &aliPay); err != nil {
+		pay.Log(nil, pay.LevelError, "alipay: parse callback", pay.F("params", m), pay.F("err", err))
+		return nil, err
 	}
 	result = "success"
 	return &aliPay, nil
@@ -1,17 +1,36 @@
 package alipay
 
 import (
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"github.com/astaxie/beego/logs"
 	"github.com/jxwt/pay"
-	"github.com/shopspring/decimal"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
 
+// 支付宝网关地址
+const (
+	ProdGateway    = "https://openapi.alipay.com/gateway.do"    // 开放平台正式网关
+	SandboxGateway = "https://openapi.alipaydev.com/gateway.do" // 开放平台沙箱网关
+	WebGateway     = "https://mapi.alipay.com/gateway.do"       // 即时到账(旧版网页支付)网关
+)
+
+// gateway 选择开放平台网关, 自定义地址优先, 其次沙箱, 默认正式网关
+func gateway(custom string, sandbox bool) string {
+	if custom != "" {
+		return custom
+	}
+	if sandbox {
+		return SandboxGateway
+	}
+	return ProdGateway
+}
+
 type ExtendParam struct {
 	SysServiceProviderId string `json:"sys_service_provider_id"`
 	IndustryRefluxInfo   string `json:"industry_reflux_info"`
@@ -33,20 +52,20 @@ type IndustryRefluxInfo struct {
 
 // Charge 支付参数
 type Charge struct {
-	TradeNum    string  `json:"tradeNum,omitempty"`
-	Origin      string  `json:"origin,omitempty"`
-	UserID      string  `json:"userId,omitempty"`
-	PayMethod   int64   `json:"payMethod,omitempty"`
-	MoneyFee    float64 `json:"MoneyFee,omitempty"`
-	CallbackURL string  `json:"callbackURL,omitempty"`
-	ReturnURL   string  `json:"returnURL,omitempty"`
-	ShowURL     string  `json:"showURL,omitempty"`
-	Describe    string  `json:"describe,omitempty"`
-	OpenID      string  `json:"openid,omitempty"`
-	CheckName   bool    `json:"check_name,omitempty"`
-	ReUserName  string  `json:"re_user_name,omitempty"`
-	BuyerId     string  `json:"buyerId,omitempty"`
-	SceneType   string  `json:"omitempty"` //h5支付使用
+	TradeNum    string    `json:"tradeNum,omitempty"`
+	Origin      string    `json:"origin,omitempty"`
+	UserID      string    `json:"userId,omitempty"`
+	PayMethod   int64     `json:"payMethod,omitempty"`
+	MoneyFee    pay.Money `json:"MoneyFee,omitempty"`
+	CallbackURL string    `json:"callbackURL,omitempty"`
+	ReturnURL   string    `json:"returnURL,omitempty"`
+	ShowURL     string    `json:"showURL,omitempty"`
+	Describe    string    `json:"describe,omitempty"`
+	OpenID      string    `json:"openid,omitempty"`
+	CheckName   bool      `json:"check_name,omitempty"`
+	ReUserName  string    `json:"re_user_name,omitempty"`
+	BuyerId     string    `json:"buyerId,omitempty"`
+	SceneType   string    `json:"omitempty"` //h5支付使用
 
 	AuthToken          string
 	ExtendParam        string
@@ -58,17 +77,65 @@ func RandomStr() string {
 	return fmt.Sprintf("%d", time.Now().UnixNano())
 }
 
+// sendToAlipay 以表单方式请求支付宝网关, method 为 post 时参数放在body中, 否则放在query中
+// client 为空时使用 pay.HTTPSC, in 为空时使用 pay.DefaultInstrument; 埋点结果码取应答中的 sub_code/code
+func sendToAlipay(ctx context.Context, client *http.Client, gateway string, m map[string]string, method string, in pay.Instrument) (string, error) {
+	call := &pay.Call{Provider: "alipay", Method: m["method"], Tenant: m["app_id"]}
+	var body string
+	err := pay.Observe(ctx, in, call, func(ctx context.Context) error {
+		var err error
+		body, err = doSendToAlipay(ctx, client, gateway, m, method)
+		var perr *pay.ProviderError
+		if err == nil && errors.As(checkResponse(m["method"], []byte(body)), &perr) {
+			call.Code = pay.ResultCode(perr)
+		}
+		return err
+	})
+	return body, err
+}
+
+// doSendToAlipay 发送网关请求
+func doSendToAlipay(ctx context.Context, client *http.Client, gateway string, m map[string]string, method string) (string, error) {
+	form := url.Values{}
+	for k, v := range m {
+		form.Set(k, v)
+	}
+	var req *http.Request
+	var err error
+	if method == "post" {
+		req, err = http.NewRequest("POST", gateway, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=utf-8")
+		}
+	} else {
+		req, err = http.NewRequest("GET", gateway+"?"+form.Encode(), nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	_, body, err := pay.DoRequest(ctx, client, req)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
 // 对支付宝者查订单
 func GetAlipay(url string) (AliWebQueryResult, error) {
+	return GetAlipayContext(context.Background(), nil, url)
+}
+
+// GetAlipayContext 携带ctx对支付宝者查订单, client 为空时使用 pay.HTTPSC
+func GetAlipayContext(ctx context.Context, client *http.Client, url string) (AliWebQueryResult, error) {
 	var xmlRe AliWebQueryResult
 
-	re, err := pay.HTTPSC.GetData(url)
+	re, err := getData(ctx, client, url)
 	if err != nil {
 		return xmlRe, errors.New("HTTPSC.PostData: " + err.Error())
 	}
 	err = xml.Unmarshal(re, &xmlRe)
 	if err != nil {
-		logs.Error("get body:", string(re))
+		pay.Log(nil, pay.LevelError, "alipay: unmarshal response", pay.F("url", url), pay.F("body", re))
 		return xmlRe, errors.New("xml.Unmarshal: " + err.Error())
 	}
 	return xmlRe, nil
@@ -76,24 +143,39 @@ func GetAlipay(url string) (AliWebQueryResult, error) {
 
 //对支付宝者查订单
 func GetAlipayApp(urls string) (AliWebAppQueryResult, error) {
+	return GetAlipayAppContext(context.Background(), nil, urls)
+}
+
+// GetAlipayAppContext 携带ctx对支付宝者查订单, client 为空时使用 pay.HTTPSC
+func GetAlipayAppContext(ctx context.Context, client *http.Client, urls string) (AliWebAppQueryResult, error) {
 	var aliPay AliWebAppQueryResult
 
-	re, err := pay.HTTPSC.GetData(urls)
+	re, err := getData(ctx, client, urls)
 	if err != nil {
 		return aliPay, errors.New("HTTPSC.PostData: " + err.Error())
 	}
 
 	err = json.Unmarshal(re, &aliPay)
 	if err != nil {
-		panic(fmt.Sprintf("re is %v, err is %v", re, err))
+		return aliPay, fmt.Errorf("json.Unmarshal: %w", err)
 	}
 
 	return aliPay, nil
 }
 
-// 支付宝金额转字符串
-func AliyunMoneyFeeToString(moneyFee float64) string {
-	return decimal.NewFromFloat(moneyFee).Truncate(2).String()
+// getData 发送get请求
+func getData(ctx context.Context, client *http.Client, rawURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, body, err := pay.DoRequest(ctx, client, req)
+	return body, err
+}
+
+// 支付宝金额转字符串, 单位元, 固定两位小数
+func AliyunMoneyFeeToString(moneyFee pay.Money) string {
+	return moneyFee.String()
 }
 
 // ToURL
@@ -0,0 +1,31 @@
+package alipay
+
+import (
+	"context"
+
+	"github.com/jxwt/pay"
+)
+
+// ConfirmPayment 轮询订单直到支付成功或关闭, 截止时仍未支付则撤销订单并返回 pay.ErrPaymentTimeout
+// 用于付款码支付返回 10003 等待用户输入密码的场景, 截止时间取 ctx 的 Deadline
+func (i *AliAppClient) ConfirmPayment(ctx context.Context, tradeNo string) (pay.PaymentStatus, error) {
+	policy := pay.DefaultConfirmPolicy
+	if i.ConfirmPolicy != nil {
+		policy = *i.ConfirmPolicy
+	}
+	query := func(ctx context.Context) (pay.PaymentStatus, error) {
+		result, err := i.QueryOrderContext(ctx, tradeNo)
+		if err != nil {
+			return "", err
+		}
+		return result.PaymentStatus()
+	}
+	cancel := func(ctx context.Context) (bool, error) {
+		result, err := i.AliTradeCancelContext(ctx, &AliTradeCancelRequest{OutTradeNo: tradeNo})
+		if err != nil {
+			return false, err
+		}
+		return result.AlipayTradeCancelResponse.RetryFlag == "Y", nil
+	}
+	return policy.Confirm(ctx, query, cancel)
+}
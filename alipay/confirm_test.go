@@ -0,0 +1,52 @@
+package alipay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jxwt/pay"
+	"github.com/jxwt/pay/paytest"
+)
+
+func TestConfirmPayment(t *testing.T) {
+	s := paytest.NewAlipayServer(t)
+	c, err := NewAliAppClient(s.AppID, s.SellerID, s.AppPrivateKey, s.AlipayPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.GatewayURL = s.GatewayURL()
+	c.HTTPClient = s.Client()
+	c.ConfirmPolicy = &pay.ConfirmPolicy{Interval: 5 * time.Millisecond, Multiplier: 1, Timeout: 200 * time.Millisecond, CancelTimeout: time.Second}
+	tradePay := func(tradeNo string) {
+		t.Helper()
+		s.FailNext("alipay.trade.pay", paytest.StateUserPaying, 1)
+		res, err := c.AliTradePay(&AliTradePayRequest{OutTradeNo: tradeNo, Scene: "bar_code", AuthCode: "284567890123456789", Subject: "test", TotalAmount: "1.00"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.AlipayTradePayResponse.Code != "10003" {
+			t.Fatalf("code %s, want 10003", res.AlipayTradePayResponse.Code)
+		}
+	}
+
+	tradePay("T001")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Pay("T001")
+	}()
+	status, err := c.ConfirmPayment(context.Background(), "T001")
+	if err != nil || status != pay.StatusPaid {
+		t.Fatalf("got %s %v", status, err)
+	}
+
+	tradePay("T002")
+	status, err = c.ConfirmPayment(context.Background(), "T002")
+	if !errors.Is(err, pay.ErrPaymentTimeout) || status != pay.StatusClosed {
+		t.Fatalf("got %s %v", status, err)
+	}
+	if o, _ := s.Order("T002"); o.State != paytest.StateRevoked {
+		t.Fatalf("order state %s, want REVOKED", o.State)
+	}
+}
@@ -0,0 +1,75 @@
+package alipay
+
+import (
+	"encoding/json"
+
+	"github.com/jxwt/pay"
+)
+
+// 公共错误码 https://opendocs.alipay.com/common/02km9f
+
+// 网关返回码
+const (
+	codeSuccess = "10000" // 接口调用成功
+	codeWaiting = "10003" // 等待用户付款, 仅统一收单返回
+)
+
+// subCodeTradeStatusError 交易状态不合法, 已关闭与已支付的交易均返回, 不能直接映射为通用错误
+const subCodeTradeStatusError = "ACQ.TRADE_STATUS_ERROR"
+
+// subCodes sub_code 对应的通用错误
+var subCodes = map[string]error{
+	"ACQ.TRADE_HAS_SUCCESS":         pay.ErrOrderPaid,
+	"ACQ.TRADE_HAS_CLOSE":           pay.ErrOrderClosed,
+	"ACQ.TRADE_NOT_EXIST":           pay.ErrOrderNotExist,
+	"ACQ.BUYER_BALANCE_NOT_ENOUGH":  pay.ErrInsufficientBalance,
+	"ACQ.SELLER_BALANCE_NOT_ENOUGH": pay.ErrInsufficientBalance,
+	"PAYER_BALANCE_NOT_ENOUGH":      pay.ErrInsufficientBalance,
+	"isv.invalid-signature":         pay.ErrSignature,
+	"isp.bill_not_exist":            pay.ErrBillNotExist,
+}
+
+// retryableSubCodes 可原样重试的 sub_code
+var retryableSubCodes = map[string]bool{
+	"ACQ.SYSTEM_ERROR":     true,
+	"aop.ACQ.SYSTEM_ERROR": true,
+	"SYSTEM_ERROR":         true,
+	"isp.unknow-error":     true,
+}
+
+// responseError code 不为 10000/10003 时返回 *pay.ProviderError, 20000(服务不可用)可重试
+func responseError(code, msg, subCode, subMsg string, raw []byte) error {
+	if code == codeSuccess || code == codeWaiting {
+		return nil
+	}
+	message := subMsg
+	if message == "" {
+		message = msg
+	}
+	return &pay.ProviderError{
+		Provider:  "alipay",
+		Code:      code,
+		SubCode:   subCode,
+		Message:   message,
+		Retryable: code == "20000" || retryableSubCodes[subCode],
+		Raw:       raw,
+		Err:       subCodes[subCode],
+	}
+}
+
+// checkResponse 按接口名取应答节点, 业务失败时返回 *pay.ProviderError
+func checkResponse(method string, body []byte) error {
+	var res map[string]json.RawMessage
+	if err := json.Unmarshal(body, &res); err != nil {
+		return err
+	}
+	node, ok := res[responseKey(method)]
+	if !ok {
+		node = res["error_response"]
+	}
+	r := new(AliPayResponse)
+	if err := json.Unmarshal(node, r); err != nil {
+		return err
+	}
+	return responseError(r.Code, r.Msg, r.SubCode, r.SubMsg, body)
+}
@@ -0,0 +1,52 @@
+package alipay
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jxwt/pay"
+)
+
+func TestQueryOrderProviderError(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := `{"code":"40004","msg":"Business Failed","sub_code":"ACQ.TRADE_NOT_EXIST","sub_msg":"交易不存在"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(signResponse(t, key, "alipay_trade_query_response", content)))
+	}))
+	defer srv.Close()
+
+	c := &AliAppClient{AppID: "2021000000000001", PrivateKey: key, PublicKey: &key.PublicKey, GatewayURL: srv.URL, HTTPClient: srv.Client()}
+	_, err = c.QueryOrder("T001")
+	if !errors.Is(err, pay.ErrOrderNotExist) {
+		t.Fatalf("want ErrOrderNotExist, got %v", err)
+	}
+	var pe *pay.ProviderError
+	if !errors.As(err, &pe) || pe.Code != "40004" || pe.SubCode != "ACQ.TRADE_NOT_EXIST" || pe.Message != "交易不存在" || len(pe.Raw) == 0 {
+		t.Fatalf("unexpected provider error %+v", pe)
+	}
+}
+
+func TestResponseErrorRetryable(t *testing.T) {
+	if err := responseError("10000", "Success", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := responseError("10003", "等待用户付款", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !pay.IsRetryable(responseError("40004", "Business Failed", "ACQ.SYSTEM_ERROR", "系统错误", nil)) {
+		t.Fatal("ACQ.SYSTEM_ERROR should be retryable")
+	}
+	if !pay.IsRetryable(responseError("20000", "Service Currently Unavailable", "isp.unknow-error", "服务暂不可用", nil)) {
+		t.Fatal("20000 should be retryable")
+	}
+	if err := responseError("40004", "Business Failed", "ACQ.TRADE_HAS_SUCCESS", "交易已被支付", nil); !errors.Is(err, pay.ErrOrderPaid) || pay.IsRetryable(err) {
+		t.Fatalf("unexpected %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package alipay
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/jxwt/pay"
+)
+
+var (
+	// ErrNotifySign 通知验签失败, 归类为 pay.ErrSignature
+	ErrNotifySign = fmt.Errorf("alipay: notification sign mismatch: %w", pay.ErrSignature)
+	// ErrNotifyMerchant 通知的app_id/seller_id与客户端配置不符
+	ErrNotifyMerchant = errors.New("alipay: notification merchant mismatch")
+	// ErrNotifyStatus 未知的交易状态
+	ErrNotifyStatus = errors.New("alipay: unexpected trade_status")
+)
+
+// 交易状态 trade_status
+const (
+	TradeStatusWaitBuyerPay = "WAIT_BUYER_PAY" // 交易创建, 等待买家付款
+	TradeStatusSuccess      = "TRADE_SUCCESS"  // 交易支付成功
+	TradeStatusFinished     = "TRADE_FINISHED" // 交易结束, 不可退款
+	TradeStatusClosed       = "TRADE_CLOSED"   // 未付款交易超时关闭, 或支付完成后全额退款
+)
+
+// IsPaid 是否支付成功
+func (r *AliWebPayResult) IsPaid() bool {
+	return r.TradeStatus == TradeStatusSuccess || r.TradeStatus == TradeStatusFinished
+}
+
+// ParsePaymentNotification 校验并解析异步通知
+// 依次校验签名(RSA/RSA2)、app_id/seller_id 及 trade_status, 任一项失败均返回错误
+func (i *AliAppClient) ParsePaymentNotification(form url.Values) (*AliWebPayResult, error) {
+	m := make(map[string]string)
+	for k, v := range form {
+		m[k] = v[0]
+	}
+	if err := VerifyNotifySign(i.PublicKey, m); err != nil {
+		return nil, err
+	}
+	if m["app_id"] != i.AppID {
+		return nil, ErrNotifyMerchant
+	}
+	if i.SellerID != "" && m["seller_id"] != i.SellerID {
+		return nil, ErrNotifyMerchant
+	}
+	switch m["trade_status"] {
+	case TradeStatusSuccess, TradeStatusFinished, TradeStatusClosed:
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrNotifyStatus, m["trade_status"])
+	}
+	result := new(AliWebPayResult)
+	if err := MapStringToStruct(m, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// HandlePaymentNotification 处理异步通知, 校验通过后才应答success
+func (i *AliAppClient) HandlePaymentNotification(w http.ResponseWriter, r *http.Request) (*AliWebPayResult, error) {
+	if err := r.ParseForm(); err != nil {
+		w.Write([]byte("fail"))
+		return nil, err
+	}
+	result, err := i.ParsePaymentNotification(r.Form)
+	if err != nil {
+		w.Write([]byte("fail"))
+		return nil, err
+	}
+	w.Write([]byte("success"))
+	return result, nil
+}
+
+// VerifyNotifySign 按 sign_type 校验异步通知签名
+// 待签名串为除 sign、sign_type 外的非空参数按key排序后以&连接
+func VerifyNotifySign(publicKey *rsa.PublicKey, m map[string]string) error {
+	if publicKey == nil {
+		return errors.New("publicKey is nil")
+	}
+	var signSlice []string
+	for k, v := range m {
+		if k == "sign" || k == "sign_type" || v == "" {
+			continue
+		}
+		signSlice = append(signSlice, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(signSlice)
+	return verifySign(publicKey, m["sign_type"], strings.Join(signSlice, "&"), m["sign"])
+}
+
+// verifySign RSA(SHA1)/RSA2(SHA256) 验签
+func verifySign(publicKey *rsa.PublicKey, signType, signData, sign string) error {
+	signByte, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotifySign, err)
+	}
+	var hash crypto.Hash
+	var digest []byte
+	switch signType {
+	case "RSA2":
+		h := sha256.Sum256([]byte(signData))
+		hash, digest = crypto.SHA256, h[:]
+	case "RSA":
+		h := sha1.Sum([]byte(signData))
+		hash, digest = crypto.SHA1, h[:]
+	default:
+		return fmt.Errorf("%w: unknown sign_type %s", ErrNotifySign, signType)
+	}
+	if err := rsa.VerifyPKCS1v15(publicKey, hash, digest, signByte); err != nil {
+		return ErrNotifySign
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package alipay
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jxwt/pay"
+)
+
+// signNotify 模拟支付宝对通知参数签名
+func signNotify(t *testing.T, key *rsa.PrivateKey, form url.Values) url.Values {
+	var data []string
+	for k := range form {
+		if k != "sign" && k != "sign_type" && form.Get(k) != "" {
+			data = append(data, fmt.Sprintf("%s=%s", k, form.Get(k)))
+		}
+	}
+	sort.Strings(data)
+	signData := []byte(strings.Join(data, "&"))
+	var sig []byte
+	var err error
+	if form.Get("sign_type") == "RSA" {
+		h := sha1.Sum(signData)
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, h[:])
+	} else {
+		h := sha256.Sum256(signData)
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Set("sign", base64.StdEncoding.EncodeToString(sig))
+	return form
+}
+
+func notifyForm(signType string) url.Values {
+	return url.Values{
+		"app_id":       {"2021000000000001"},
+		"seller_id":    {"2088000000000001"},
+		"notify_id":    {"ac05099524730693a8b330c5ecf72da9786"},
+		"notify_type":  {"trade_status_sync"},
+		"out_trade_no": {"T20201010001"},
+		"trade_no":     {"2020101022001400000000000001"},
+		"trade_status": {TradeStatusSuccess},
+		"total_amount": {"1.01"},
+		"gmt_payment":  {"2020-10-10 10:10:10"},
+		"subject":      {"停车费"},
+		"sign_type":    {signType},
+	}
+}
+
+func TestParsePaymentNotification(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &AliAppClient{AppID: "2021000000000001", SellerID: "2088000000000001", PublicKey: &key.PublicKey}
+
+	for _, signType := range []string{"RSA2", "RSA"} {
+		res, err := c.ParsePaymentNotification(signNotify(t, key, notifyForm(signType)))
+		if err != nil {
+			t.Fatalf("%s: %v", signType, err)
+		}
+		if !res.IsPaid() || res.OutTradeNo != "T20201010001" || res.TotalAmount != "1.01" {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	}
+
+	forged := signNotify(t, key, notifyForm("RSA2"))
+	forged.Set("total_amount", "0.01")
+	if _, err := c.ParsePaymentNotification(forged); !errors.Is(err, ErrNotifySign) || !errors.Is(err, pay.ErrSignature) || pay.ResultCode(err) != pay.CodeSignature {
+		t.Fatalf("want ErrNotifySign, got %v", err)
+	}
+
+	other := notifyForm("RSA2")
+	other.Set("app_id", "2021000000000002")
+	if _, err := c.ParsePaymentNotification(signNotify(t, key, other)); !errors.Is(err, ErrNotifyMerchant) {
+		t.Fatalf("want ErrNotifyMerchant, got %v", err)
+	}
+
+	waiting := notifyForm("RSA2")
+	waiting.Set("trade_status", "WAIT_BUYER_PAY")
+	if _, err := c.ParsePaymentNotification(signNotify(t, key, waiting)); !errors.Is(err, ErrNotifyStatus) {
+		t.Fatalf("want ErrNotifyStatus, got %v", err)
+	}
+}
+
+func TestHandlePaymentNotificationAck(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &AliAppClient{AppID: "2021000000000001", SellerID: "2088000000000001", PublicKey: &key.PublicKey}
+
+	forged := signNotify(t, key, notifyForm("RSA2"))
+	forged.Set("sign", base64.StdEncoding.EncodeToString([]byte("forged")))
+	r := httptest.NewRequest("POST", "/notify", strings.NewReader(forged.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	if _, err := c.HandlePaymentNotification(w, r); err == nil || w.Body.String() != "fail" {
+		t.Fatalf("forged notification accepted: %v %s", err, w.Body.String())
+	}
+
+	r = httptest.NewRequest("POST", "/notify", strings.NewReader(signNotify(t, key, notifyForm("RSA2")).Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	if _, err := c.HandlePaymentNotification(w, r); err != nil || w.Body.String() != "success" {
+		t.Fatalf("valid notification rejected: %v %s", err, w.Body.String())
+	}
+}
@@ -0,0 +1,276 @@
+package alipay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jxwt/pay"
+)
+
+// Provider 支付宝的 pay.Provider 实现, 一个实例对应一种支付方式
+type Provider struct {
+	client    *AliClient
+	channelID int
+}
+
+// aliChannels 支付宝支持的支付方式
+var aliChannels = []int{
+	pay.CashChannelAliAppPay,
+	pay.CashChannelAliH5Pay,
+	pay.CashChannelAliCodePay,
+	pay.CashChannelAliMiniPay,
+}
+
+// NewProvider 按支付方式创建支付宝支付实现
+func NewProvider(c *AliClient, channelID int) (*Provider, error) {
+	for _, id := range aliChannels {
+		if id == channelID {
+			return &Provider{client: c, channelID: channelID}, nil
+		}
+	}
+	return nil, fmt.Errorf("alipay: unsupported channel %d", channelID)
+}
+
+// RegisterProviders 将客户端注册到所有支付宝支付方式
+func RegisterProviders(r *pay.Registry, c *AliClient) {
+	for _, id := range aliChannels {
+		r.Register(id, &Provider{client: c, channelID: id})
+	}
+}
+
+// CreatePayment 统一下单
+func (p *Provider) CreatePayment(ctx context.Context, req *pay.PaymentRequest) (*pay.PaymentResult, error) {
+	if p.client.Client.PrivateKey == nil {
+		return nil, errors.New("privateKey is nil")
+	}
+	charge := &Charge{
+		TradeNum:    req.TradeNo,
+		MoneyFee:    req.Amount,
+		Describe:    req.Subject,
+		CallbackURL: p.client.NotifyURL,
+		ReturnURL:   req.ReturnURL,
+		BuyerId:     req.OpenID,
+		AuthToken:   req.AuthToken,
+	}
+	if req.NotifyURL != "" {
+		charge.CallbackURL = req.NotifyURL
+	}
+	res := &pay.PaymentResult{ChannelID: p.channelID, TradeNo: req.TradeNo}
+	switch p.channelID {
+	case pay.CashChannelAliAppPay:
+		body, err := p.client.Client.AppPay(charge)
+		if err != nil {
+			return nil, err
+		}
+		res.Body = body
+	case pay.CashChannelAliH5Pay:
+		body, err := p.client.Client.ToH5Pay(charge)
+		if err != nil {
+			return nil, err
+		}
+		res.Body = body
+	case pay.CashChannelAliCodePay:
+		result, err := p.client.Client.AliPreCreateContext(ctx, *charge)
+		if err != nil {
+			return nil, err
+		}
+		res.PayURL = result.QrCode
+	case pay.CashChannelAliMiniPay:
+		body, err := p.client.Client.CreateOrderContext(ctx, charge)
+		if err != nil {
+			return nil, err
+		}
+		result := new(TradeCreateResult)
+		if err := json.Unmarshal([]byte(body), result); err != nil {
+			return nil, err
+		}
+		res.PrepayID = result.AliPayTradeCreateResponse.TradeNo
+		res.Params = map[string]string{"trade_no": res.PrepayID}
+	}
+	return res, nil
+}
+
+// Query 查询订单
+func (p *Provider) Query(ctx context.Context, tradeNo string) (*pay.QueryResult, error) {
+	result, err := p.client.Client.QueryOrderContext(ctx, tradeNo)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, errors.New("alipay.trade.query: empty response")
+	}
+	status, err := result.PaymentStatus()
+	if err != nil {
+		return nil, err
+	}
+	r := result.AlipayTradeQueryResponse
+	amount, err := yuanToMoney(r.TotalAmount)
+	if err != nil {
+		return nil, err
+	}
+	return &pay.QueryResult{
+		TradeNo:       r.OutTradeNo,
+		TransactionID: r.TradeNo,
+		TradeState:    r.TradeStatus,
+		Status:        status,
+		Paid:          status.IsPaid(),
+		Amount:        amount,
+		PaidAt:        r.SendPayDate,
+	}, nil
+}
+
+// Refund 申请退款, fund_change 为 Y 时退款成功, 否则为处理中, 需调用 QueryRefund 确认
+// 重复提交已成功的退款请求号时支付宝同样返回 N
+func (p *Provider) Refund(ctx context.Context, req *pay.RefundRequest) (*pay.RefundResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	refund := &AliRefundRequest{
+		OutRequestNo: req.RefundNo,
+		RefundAmount: AliyunMoneyFeeToString(req.RefundAmount),
+		RefundReason: req.Reason,
+	}
+	if req.TransactionID != "" {
+		refund.TradeNo = req.TransactionID
+	} else {
+		refund.OutTradeNo = req.TradeNo
+	}
+	result, err := p.client.Client.RefundContext(ctx, refund)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, errors.New("alipay.trade.refund: empty response")
+	}
+	r := result.AliPayTradeRefund
+	refunded, err := yuanToMoney(r.RefundFee)
+	if err != nil {
+		return nil, err
+	}
+	return &pay.RefundResult{
+		TradeNo:       r.OutTradeNo,
+		TransactionID: r.TradeNo,
+		RefundNo:      req.RefundNo,
+		RefundAmount:  req.RefundAmount,
+		RefundedTotal: refunded,
+		RefundState:   r.FundChange,
+		Status:        refundStatus(r.FundChange == fundChanged),
+	}, nil
+}
+
+// QueryRefund 按商户单号与退款请求号查询退款, 退款单不存在时返回 pay.ErrRefundNotExist
+func (p *Provider) QueryRefund(ctx context.Context, tradeNo, refundNo string) (*pay.RefundResult, error) {
+	if tradeNo == "" || refundNo == "" {
+		return nil, fmt.Errorf("%w: alipay refund query requires trade no and refund no", pay.ErrInvalidRefund)
+	}
+	result, err := p.client.Client.AliTradeRefundQueryContext(ctx, &AliRefundQueryRequest{OutTradeNo: tradeNo, OutRequestNo: refundNo})
+	if err != nil {
+		return nil, err
+	}
+	r := result.AlipayTradeFastpayRefundQueryResponse
+	if r.OutRequestNo == "" && r.RefundAmount == "" {
+		return nil, fmt.Errorf("%w: %s %s", pay.ErrRefundNotExist, tradeNo, refundNo)
+	}
+	amount, err := yuanToMoney(r.RefundAmount)
+	if err != nil {
+		return nil, err
+	}
+	return &pay.RefundResult{
+		TradeNo:       r.OutTradeNo,
+		TransactionID: r.TradeNo,
+		RefundNo:      r.OutRequestNo,
+		RefundAmount:  amount,
+		RefundState:   r.RefundStatus,
+		Status:        refundStatus(r.RefundStatus == refundSuccess),
+	}, nil
+}
+
+// Close 关闭未支付订单, 订单已关闭时视为成功
+// 扫码下单后用户未扫码时交易尚未创建, 关闭返回交易不存在, 此时改为撤销使二维码失效;
+// 撤销前用户恰好完成支付的, 支付宝会原路退款
+func (p *Provider) Close(ctx context.Context, tradeNo string) error {
+	_, err := p.client.Client.CloseOrderContext(ctx, tradeNo)
+	if errors.Is(err, pay.ErrOrderNotExist) {
+		_, err = p.client.Client.AliTradeCancelContext(ctx, &AliTradeCancelRequest{OutTradeNo: tradeNo})
+	}
+	if errors.Is(err, pay.ErrOrderClosed) {
+		return nil
+	}
+	var pe *pay.ProviderError
+	if errors.As(err, &pe) && pe.SubCode == subCodeTradeStatusError && p.tradeClosed(ctx, tradeNo) {
+		return nil
+	}
+	return err
+}
+
+// tradeClosed 查询交易是否已关闭
+// 关闭已关闭与已支付的交易均返回 ACQ.TRADE_STATUS_ERROR, 需查询交易状态区分, 查询失败时按未关闭处理
+func (p *Provider) tradeClosed(ctx context.Context, tradeNo string) bool {
+	result, err := p.client.Client.QueryOrderContext(ctx, tradeNo)
+	if err != nil || result == nil {
+		return false
+	}
+	return result.AlipayTradeQueryResponse.TradeStatus == TradeStatusClosed
+}
+
+// ParseNotification 校验签名、商户及交易状态并解析异步通知
+func (p *Provider) ParseNotification(r *http.Request) (*pay.Notification, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	result, err := p.client.Client.ParsePaymentNotification(r.Form)
+	if err != nil {
+		return nil, err
+	}
+	status, err := result.PaymentStatus()
+	if err != nil {
+		return nil, err
+	}
+	amount, err := yuanToMoney(result.TotalAmount)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]string)
+	for k, v := range r.Form {
+		raw[k] = v[0]
+	}
+	return &pay.Notification{
+		TradeNo:       result.OutTradeNo,
+		TransactionID: result.TradeNo,
+		Amount:        amount,
+		Status:        status,
+		Paid:          result.IsPaid(),
+		PaidAt:        result.GmtPayment,
+		Raw:           raw,
+	}, nil
+}
+
+const (
+	// refundSuccess 退款查询返回的退款成功状态, 未返回时退款尚未成功
+	refundSuccess = "REFUND_SUCCESS"
+	// fundChanged 退款接口返回本次退款发生了资金变化
+	fundChanged = "Y"
+)
+
+// refundStatus 支付宝只明确返回退款成功, 其余情况按处理中处理
+func refundStatus(success bool) pay.RefundStatus {
+	if success {
+		return pay.RefundSuccess
+	}
+	return pay.RefundProcessing
+}
+
+// yuanToMoney 支付宝金额字符串(元)转 pay.Money, 未返回时为0, 格式错误时返回错误而不是按0处理
+func yuanToMoney(amount string) (pay.Money, error) {
+	if amount == "" {
+		return pay.CNY(0), nil
+	}
+	m, err := pay.ParseMoney(amount)
+	if err != nil {
+		return pay.Money{}, fmt.Errorf("alipay: %w", err)
+	}
+	return m, nil
+}
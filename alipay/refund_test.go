@@ -0,0 +1,111 @@
+package alipay
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jxwt/pay"
+	"github.com/jxwt/pay/paytest"
+)
+
+func TestProviderRefund(t *testing.T) {
+	s := paytest.NewAlipayServer(t)
+	c, err := Init(s.AppID, s.SellerID, s.AppPrivateKey, s.AlipayPublicKey, "http://127.0.0.1/notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Client.GatewayURL = s.GatewayURL()
+	c.Client.HTTPClient = s.Client()
+	p, err := NewProvider(c, pay.CashChannelAliCodePay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := p.CreatePayment(ctx, &pay.PaymentRequest{TradeNo: "T001", Amount: pay.CNY(100), Subject: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pay("T001"); err != nil {
+		t.Fatal(err)
+	}
+	o, _ := s.Order("T001")
+
+	r1, err := p.Refund(ctx, &pay.RefundRequest{TradeNo: "T001", RefundNo: "R1", TotalAmount: pay.CNY(100), RefundAmount: pay.CNY(30)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r1.RefundAmount != pay.CNY(30) || r1.RefundedTotal != pay.CNY(30) || r1.Status != pay.RefundSuccess {
+		t.Fatalf("first refund: %+v", r1)
+	}
+	// 按支付宝交易号退款
+	r2, err := p.Refund(ctx, &pay.RefundRequest{TransactionID: o.TransactionID, RefundNo: "R2", RefundAmount: pay.CNY(50)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.TradeNo != "T001" || r2.RefundAmount != pay.CNY(50) || r2.RefundedTotal != pay.CNY(80) {
+		t.Fatalf("second refund: %+v", r2)
+	}
+	if _, err := p.Refund(ctx, &pay.RefundRequest{TradeNo: "T001", RefundNo: "R3", RefundAmount: pay.CNY(30)}); err == nil {
+		t.Fatal("expected over-refund error")
+	}
+	if _, err := p.Refund(ctx, &pay.RefundRequest{TradeNo: "T001", RefundAmount: pay.CNY(1)}); !errors.Is(err, pay.ErrInvalidRefund) {
+		t.Fatalf("missing refund no: %v", err)
+	}
+
+	q, err := p.QueryRefund(ctx, "T001", "R2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.RefundNo != "R2" || q.RefundAmount != pay.CNY(50) || q.Status != pay.RefundSuccess {
+		t.Fatalf("query: %+v", q)
+	}
+	if _, err := p.QueryRefund(ctx, "T001", "R3"); !errors.Is(err, pay.ErrRefundNotExist) {
+		t.Fatalf("unknown refund: %v", err)
+	}
+	// 重复提交未发生资金变化, 需查询确认
+	again, err := p.Refund(ctx, &pay.RefundRequest{TradeNo: "T001", RefundNo: "R2", RefundAmount: pay.CNY(50)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Status != pay.RefundProcessing {
+		t.Fatalf("repeated refund: %+v", again)
+	}
+	// 未返回 refund_status 的退款尚未成功
+	if err := s.SetRefundState("R1", "PROCESSING"); err != nil {
+		t.Fatal(err)
+	}
+	q, err = p.QueryRefund(ctx, "T001", "R1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.RefundAmount != pay.CNY(30) || q.Status != pay.RefundProcessing {
+		t.Fatalf("processing query: %+v", q)
+	}
+}
+
+func TestLegacyQueryRefund(t *testing.T) {
+	s := paytest.NewAlipayServer(t)
+	c, err := Init(s.AppID, s.SellerID, s.AppPrivateKey, s.AlipayPublicKey, "http://127.0.0.1/notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Client.GatewayURL = s.GatewayURL()
+	c.Client.HTTPClient = s.Client()
+	if _, err := c.Client.CreateOrder(&Charge{TradeNum: "T001", MoneyFee: pay.CNY(100), Describe: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pay("T001"); err != nil {
+		t.Fatal(err)
+	}
+	// 旧版退款使用 "AliPay"+商户订单号 作为退款请求号
+	if _, err := c.Client.Refund(&AliRefundRequest{OutTradeNo: "T001", RefundAmount: "0.40", OutRequestNo: "AliPayT001"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.QueryRefund("1RefundT001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := res.AliPayTradeRefund; r.OutTradeNo != "T001" || r.RefundFee != "0.40" {
+		t.Fatalf("legacy refund query: %+v", r)
+	}
+}
@@ -0,0 +1,51 @@
+package alipay
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrNoPrivateKey 未配置或未能解析商户私钥
+var ErrNoPrivateKey = errors.New("alipay: private key is nil")
+
+// signContent 待签名串, 非空参数(排除 sign 及 exclude)按key排序后以&连接
+func signContent(m map[string]string, exclude ...string) string {
+	var data []string
+	for k, v := range m {
+		if v == "" || k == "sign" || contains(exclude, k) {
+			continue
+		}
+		data = append(data, fmt.Sprintf(`%s=%s`, k, v))
+	}
+	sort.Strings(data)
+	return strings.Join(data, "&")
+}
+
+// rsaSign 使用商户私钥对待签名串做 PKCS1v15 签名并base64编码
+func rsaSign(key *rsa.PrivateKey, hash crypto.Hash, content string) (string, error) {
+	if key == nil {
+		return "", ErrNoPrivateKey
+	}
+	h := hash.New()
+	h.Write([]byte(content))
+	signByte, err := rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+	if err != nil {
+		return "", fmt.Errorf("alipay sign: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(signByte), nil
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
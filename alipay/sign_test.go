@@ -0,0 +1,46 @@
+package alipay
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestSignWithoutKey(t *testing.T) {
+	c := &AliAppClient{AppID: "2021000000000001"}
+	if _, err := c.MakePayMap("alipay.trade.app.pay", &Charge{TradeNum: "T1"}, "RSA2"); !errors.Is(err, ErrNoPrivateKey) {
+		t.Fatalf("want ErrNoPrivateKey, got %v", err)
+	}
+	if _, err := (&AliWebClient{}).GenSign(map[string]string{"a": "1"}); !errors.Is(err, ErrNoPrivateKey) {
+		t.Fatalf("want ErrNoPrivateKey, got %v", err)
+	}
+}
+
+func TestNewAliAppClient(t *testing.T) {
+	if _, err := Init("2021000000000001", "2088000000000001", "bad", "bad", ""); err == nil {
+		t.Fatal("bad keys should be rejected")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	pubDER, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	c, err := NewAliAppClient("2021000000000001", "2088000000000001",
+		base64.StdEncoding.EncodeToString(priDER), base64.StdEncoding.EncodeToString(pubDER))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]string{"app_id": c.AppID, "method": "alipay.trade.query", "sign_type": "RSA2"}
+	sign, err := c.GenSign(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckSign(signContent(m), sign); err != nil {
+		t.Fatalf("sign should verify with own public key: %v", err)
+	}
+}
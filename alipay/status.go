@@ -0,0 +1,31 @@
+package alipay
+
+import (
+	"fmt"
+
+	"github.com/jxwt/pay"
+)
+
+// PaymentStatus 支付宝 trade_status 转为统一订单状态
+// 部分退款后交易仍为 TRADE_SUCCESS, 全额退款后为 TRADE_CLOSED, 退款进度需结合退款查询判断
+func PaymentStatus(tradeStatus string) (pay.PaymentStatus, error) {
+	switch tradeStatus {
+	case TradeStatusWaitBuyerPay:
+		return pay.StatusPending, nil
+	case TradeStatusSuccess, TradeStatusFinished:
+		return pay.StatusPaid, nil
+	case TradeStatusClosed:
+		return pay.StatusClosed, nil
+	}
+	return "", fmt.Errorf("%w: alipay trade_status %q", pay.ErrUnknownStatus, tradeStatus)
+}
+
+// PaymentStatus 订单查询结果对应的统一订单状态
+func (r *AliWebAppQueryResult) PaymentStatus() (pay.PaymentStatus, error) {
+	return PaymentStatus(r.AlipayTradeQueryResponse.TradeStatus)
+}
+
+// PaymentStatus 异步通知对应的统一订单状态
+func (r *AliWebPayResult) PaymentStatus() (pay.PaymentStatus, error) {
+	return PaymentStatus(r.TradeStatus)
+}
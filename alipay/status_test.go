@@ -0,0 +1,69 @@
+package alipay
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jxwt/pay"
+	"github.com/jxwt/pay/paytest"
+)
+
+func TestPaymentStatus(t *testing.T) {
+	cases := map[string]pay.PaymentStatus{
+		TradeStatusWaitBuyerPay: pay.StatusPending,
+		TradeStatusSuccess:      pay.StatusPaid,
+		TradeStatusFinished:     pay.StatusPaid,
+		TradeStatusClosed:       pay.StatusClosed,
+	}
+	for state, want := range cases {
+		if got, err := PaymentStatus(state); err != nil || got != want {
+			t.Fatalf("%s: got %s %v, want %s", state, got, err, want)
+		}
+	}
+	if _, err := PaymentStatus("TRADE_PENDING"); !errors.Is(err, pay.ErrUnknownStatus) {
+		t.Fatalf("unknown status: %v", err)
+	}
+}
+
+func TestProviderQueryStatus(t *testing.T) {
+	s := paytest.NewAlipayServer(t)
+	c, err := Init(s.AppID, s.SellerID, s.AppPrivateKey, s.AlipayPublicKey, "http://127.0.0.1/notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Client.GatewayURL = s.GatewayURL()
+	c.Client.HTTPClient = s.Client()
+	p, err := NewProvider(c, pay.CashChannelAliCodePay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := p.CreatePayment(ctx, &pay.PaymentRequest{TradeNo: "T001", Amount: pay.CNY(100), Subject: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	status := pay.StatusCreated
+	check := func(want pay.PaymentStatus) {
+		t.Helper()
+		res, err := p.Query(ctx, "T001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != want {
+			t.Fatalf("got %s, want %s", res.Status, want)
+		}
+		if status, err = status.Transition(res.Status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(pay.StatusPending)
+	if err := s.Pay("T001"); err != nil {
+		t.Fatal(err)
+	}
+	check(pay.StatusPaid)
+	// 全额退款后交易关闭
+	if _, err := p.Refund(ctx, &pay.RefundRequest{TradeNo: "T001", RefundNo: "R1", TotalAmount: pay.CNY(100), RefundAmount: pay.CNY(100)}); err != nil {
+		t.Fatal(err)
+	}
+	check(pay.StatusClosed)
+}
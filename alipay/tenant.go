@@ -0,0 +1,69 @@
+package alipay
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jxwt/pay"
+)
+
+// TenantClientKind 商户注册表中支付宝客户端的渠道名
+const TenantClientKind = "alipay"
+
+// RegisterTenantClients 向商户注册表注册支付宝客户端构建方法, notifyURL 为异步通知地址
+func RegisterTenantClients(r *pay.TenantRegistry, notifyURL string) {
+	r.RegisterBuilder(TenantClientKind, func(item pay.PayItem) (interface{}, error) {
+		if item.AliPayAppId == "" || item.AliPayPrivateKey == "" {
+			return nil, pay.ErrTenantNotConfigured
+		}
+		c, err := Init(item.AliPayAppId, item.AliPayPartnerId, item.AliPayPrivateKey, item.AliPayPublicKey, notifyURL)
+		if err != nil {
+			return nil, err
+		}
+		c.AppId = item.AliPayAppId
+		c.PartnerId = item.AliPayPartnerId
+		return c, nil
+	})
+}
+
+// TenantClient 获取商户的支付宝客户端
+func TenantClient(r *pay.TenantRegistry, tenantID int) (*AliClient, error) {
+	c, err := r.Client(tenantID, TenantClientKind)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*AliClient), nil
+}
+
+// FindTenant 按通知中的 app_id/seller_id 反查商户, 商户未配置 partner 时只比对 app_id
+func FindTenant(r *pay.TenantRegistry, appID, sellerID string) (int, error) {
+	return r.FindTenant(func(item pay.PayItem) bool {
+		return item.AliPayAppId == appID && (item.AliPayPartnerId == "" || item.AliPayPartnerId == sellerID)
+	})
+}
+
+// HandleTenantPaymentNotification 按通知中的 app_id 从注册表取得商户公钥并处理异步通知
+// 校验通过后才应答success, 返回通知所属的商户ID
+func HandleTenantPaymentNotification(w http.ResponseWriter, r *http.Request, reg *pay.TenantRegistry) (int, *AliWebPayResult, error) {
+	if err := r.ParseForm(); err != nil {
+		w.Write([]byte("fail"))
+		return 0, nil, err
+	}
+	tenantID, err := FindTenant(reg, r.Form.Get("app_id"), r.Form.Get("seller_id"))
+	if err != nil {
+		w.Write([]byte("fail"))
+		return 0, nil, fmt.Errorf("alipay notification app_id %s: %w", r.Form.Get("app_id"), err)
+	}
+	c, err := TenantClient(reg, tenantID)
+	if err != nil {
+		w.Write([]byte("fail"))
+		return tenantID, nil, err
+	}
+	result, err := c.Client.ParsePaymentNotification(r.Form)
+	if err != nil {
+		w.Write([]byte("fail"))
+		return tenantID, nil, err
+	}
+	w.Write([]byte("success"))
+	return tenantID, result, nil
+}
@@ -0,0 +1,90 @@
+package alipay
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jxwt/pay"
+)
+
+// 同步应答验签 https://opendocs.alipay.com/common/02mse7
+// 待验签内容为应答中 xxx_response 节点的原始JSON串
+
+// ErrResponseUnsigned 应答中缺少 sign
+var ErrResponseUnsigned = errors.New("alipay: response has no sign")
+
+// responseKey 接口名对应的应答节点, 如 alipay.trade.query -> alipay_trade_query_response
+func responseKey(method string) string {
+	return strings.Replace(method, ".", "_", -1) + "_response"
+}
+
+// VerifyResponseSign 校验同步应答签名, 失败时返回 *pay.ResponseSignError
+// 网关层错误(如 app_id 无效)返回 error_response 且不带签名, 此时不校验, 由调用方按 code 处理
+func VerifyResponseSign(publicKey *rsa.PublicKey, method, signType string, body []byte) error {
+	fail := func(err error) error {
+		return &pay.ResponseSignError{Provider: "alipay", API: method, Err: err}
+	}
+	var res map[string]json.RawMessage
+	if err := json.Unmarshal(body, &res); err != nil {
+		return fail(err)
+	}
+	var sign string
+	if raw, ok := res["sign"]; ok {
+		if err := json.Unmarshal(raw, &sign); err != nil {
+			return fail(err)
+		}
+	}
+	content, ok := res[responseKey(method)]
+	if !ok {
+		content, ok = res["error_response"]
+		if ok && sign == "" {
+			return nil
+		}
+	}
+	if !ok {
+		return fail(fmt.Errorf("missing %s", responseKey(method)))
+	}
+	if sign == "" {
+		return fail(ErrResponseUnsigned)
+	}
+	if publicKey == nil {
+		return fail(errors.New("publicKey is nil"))
+	}
+	if err := verifySign(publicKey, signType, string(content), sign); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// call 请求网关, 校验应答签名并将业务失败转为 *pay.ProviderError
+// SkipVerifyResponse 为 true 时不校验签名
+func (i *AliAppClient) call(ctx context.Context, m map[string]string, method string) (string, error) {
+	response, err := i.SendToAlipayContext(ctx, m, method)
+	if err != nil || response == "" {
+		return response, err
+	}
+	if !i.SkipVerifyResponse {
+		if err := VerifyResponseSign(i.PublicKey, m["method"], m["sign_type"], []byte(response)); err != nil {
+			return "", err
+		}
+	}
+	if err := checkResponse(m["method"], []byte(response)); err != nil {
+		return "", err
+	}
+	return response, nil
+}
+
+// retryCall 同 call, 按 RetryPolicy 重试瞬时失败, 重试时沿用已签名的请求参数
+func (i *AliAppClient) retryCall(ctx context.Context, op string, m map[string]string, method string) (string, error) {
+	var response string
+	err := i.RetryPolicy.Do(ctx, "alipay", op, func(ctx context.Context) error {
+		var err error
+		response, err = i.call(ctx, m, method)
+		return err
+	})
+	return response, err
+}
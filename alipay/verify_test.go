@@ -0,0 +1,90 @@
+package alipay
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jxwt/pay"
+)
+
+// signResponse 模拟支付宝对应答节点签名, 节点内容保留原始空白
+func signResponse(t *testing.T, key *rsa.PrivateKey, node, content string) string {
+	h := sha256.Sum256([]byte(content))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf(`{"%s":%s,"sign":"%s"}`, node, content, base64.StdEncoding.EncodeToString(sig))
+}
+
+func TestVerifyResponseSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := `{"code":"10000","msg":"Success","trade_no":"2020101022001400000000000001", "out_trade_no":"T001","trade_status":"TRADE_SUCCESS","total_amount":"1.01"}`
+	body := signResponse(t, key, "alipay_trade_query_response", content)
+	if err := VerifyResponseSign(&key.PublicKey, "alipay.trade.query", "RSA2", []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	var signErr *pay.ResponseSignError
+	forged := signResponse(t, key, "alipay_trade_query_response", content)
+	forged = forged[:len(`{"alipay_trade_query_response":`)] + `{"code":"10000","msg":"Success","trade_status":"TRADE_SUCCESS","total_amount":"9.99"}` + forged[len(`{"alipay_trade_query_response":`)+len(content):]
+	if err := VerifyResponseSign(&key.PublicKey, "alipay.trade.query", "RSA2", []byte(forged)); !errors.As(err, &signErr) || !errors.Is(err, ErrNotifySign) {
+		t.Fatalf("want ResponseSignError, got %v", err)
+	}
+	unsigned := `{"alipay_trade_query_response":` + content + `}`
+	if err := VerifyResponseSign(&key.PublicKey, "alipay.trade.query", "RSA2", []byte(unsigned)); !errors.Is(err, ErrResponseUnsigned) {
+		t.Fatalf("want ErrResponseUnsigned, got %v", err)
+	}
+	// 网关层错误不带签名
+	gatewayErr := `{"error_response":{"code":"40002","msg":"Invalid Arguments","sub_code":"isv.invalid-app-id","sub_msg":"无效的AppID参数"}}`
+	if err := VerifyResponseSign(&key.PublicKey, "alipay.trade.query", "RSA2", []byte(gatewayErr)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueryOrderVerifiesResponse(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := `{"code":"10000","msg":"Success","out_trade_no":"T001","trade_status":"TRADE_SUCCESS","total_amount":"1.01"}`
+	signer := key
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(signResponse(t, signer, "alipay_trade_query_response", content)))
+	}))
+	defer srv.Close()
+
+	c := &AliAppClient{AppID: "2021000000000001", PrivateKey: key, PublicKey: &key.PublicKey, GatewayURL: srv.URL, HTTPClient: srv.Client()}
+	res, err := c.QueryOrder("T001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.AlipayTradeQueryResponse.TradeStatus != "TRADE_SUCCESS" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	signer = other
+	var signErr *pay.ResponseSignError
+	if _, err := c.QueryOrder("T001"); !errors.As(err, &signErr) {
+		t.Fatalf("want ResponseSignError, got %v", err)
+	}
+	c.SkipVerifyResponse = true
+	if _, err := c.QueryOrder("T001"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,142 @@
+package pay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPaymentTimeout 截止时间前未确认支付结果, 订单已撤销
+var ErrPaymentTimeout = errors.New("pay: payment not confirmed before deadline, order cancelled")
+
+// ConfirmPolicy 付款码等待用户支付时的轮询策略
+type ConfirmPolicy struct {
+	Interval      time.Duration // 首次查询前等待时间
+	MaxInterval   time.Duration // 查询间隔上限
+	Multiplier    float64       // 每次查询后间隔的增长倍数, 小于1时按1处理
+	Timeout       time.Duration // ctx 未设置截止时间时的最长等待时间
+	CancelTimeout time.Duration // 截止后撤销订单的超时时间
+	CancelRetries int           // 撤销结果需要重试时的最多重试次数
+}
+
+// DefaultConfirmPolicy 默认轮询策略, 与微信、支付宝付款码文档建议的30秒等待一致
+var DefaultConfirmPolicy = ConfirmPolicy{
+	Interval:      2 * time.Second,
+	MaxInterval:   10 * time.Second,
+	Multiplier:    1.5,
+	Timeout:       30 * time.Second,
+	CancelTimeout: 10 * time.Second,
+	CancelRetries: 3,
+}
+
+// StatusFunc 查询订单并返回统一订单状态
+type StatusFunc func(ctx context.Context) (PaymentStatus, error)
+
+// CancelOrderFunc 撤销订单, retry 为 true 表示三方要求再次调用撤销
+type CancelOrderFunc func(ctx context.Context) (retry bool, err error)
+
+// Confirm 轮询订单直到终态或截止时间, 截止(或 ctx 被取消)时仍未支付则撤销订单并返回 ErrPaymentTimeout
+// 截止时间取 ctx 的 Deadline, 未设置时为 Timeout 之后.
+// 网络错误、可重试错误及订单不存在(下单后短时间内可能查不到)继续轮询, 其他业务错误直接返回且不撤销
+func (p ConfirmPolicy) Confirm(ctx context.Context, query StatusFunc, cancel CancelOrderFunc) (PaymentStatus, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		var stop context.CancelFunc
+		ctx, stop = context.WithTimeout(ctx, p.Timeout)
+		defer stop()
+		deadline, _ = ctx.Deadline()
+	}
+	status := StatusPending
+	interval := p.Interval
+	for {
+		if !p.wait(ctx, interval, deadline) {
+			break
+		}
+		s, err := query(ctx)
+		if err == nil {
+			status = s
+			if s != StatusPending && s != StatusCreated {
+				return status, nil
+			}
+		} else if !pollable(err) {
+			return status, err
+		}
+		interval = p.next(interval)
+	}
+	// 原 ctx 已到期, 撤销使用独立的超时
+	if err := p.cancel(cancel); err != nil {
+		return status, fmt.Errorf("pay: cancel after confirm timeout: %w", err)
+	}
+	return StatusClosed, ErrPaymentTimeout
+}
+
+// wait 等待 interval, 截止时间先到时返回 false; 临近截止时缩短等待以便最后再查询一次
+func (p ConfirmPolicy) wait(ctx context.Context, interval time.Duration, deadline time.Time) bool {
+	left := time.Until(deadline)
+	if left <= 0 {
+		return false
+	}
+	if interval > left/2 {
+		interval = left / 2
+	}
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// next 下一次查询间隔
+func (p ConfirmPolicy) next(interval time.Duration) time.Duration {
+	m := p.Multiplier
+	if m < 1 {
+		m = 1
+	}
+	interval = time.Duration(float64(interval) * m)
+	if p.MaxInterval > 0 && interval > p.MaxInterval {
+		interval = p.MaxInterval
+	}
+	return interval
+}
+
+// cancel 撤销订单, 三方要求重试时最多重试 CancelRetries 次
+func (p ConfirmPolicy) cancel(cancel CancelOrderFunc) error {
+	ctx, stop := context.WithTimeout(context.Background(), p.CancelTimeout)
+	defer stop()
+	for n := 0; ; n++ {
+		retry, err := cancel(ctx)
+		if err != nil && !IsRetryable(err) {
+			return err
+		}
+		if err == nil && !retry {
+			return nil
+		}
+		if n >= p.CancelRetries {
+			if err == nil {
+				err = errors.New("cancel still requires retry")
+			}
+			return err
+		}
+		deadline, _ := ctx.Deadline()
+		if !p.wait(ctx, p.Interval, deadline) {
+			return ctx.Err()
+		}
+	}
+}
+
+// pollable 查询出错后是否继续轮询
+func pollable(err error) bool {
+	if errors.Is(err, ErrSignature) {
+		return false
+	}
+	var e *ProviderError
+	if !errors.As(err, &e) {
+		// 网络错误等
+		return true
+	}
+	return e.Retryable || errors.Is(err, ErrOrderNotExist)
+}
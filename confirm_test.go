@@ -0,0 +1,75 @@
+package pay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var testConfirmPolicy = ConfirmPolicy{
+	Interval:      5 * time.Millisecond,
+	MaxInterval:   20 * time.Millisecond,
+	Multiplier:    2,
+	Timeout:       200 * time.Millisecond,
+	CancelTimeout: 100 * time.Millisecond,
+	CancelRetries: 2,
+}
+
+func TestConfirmPaid(t *testing.T) {
+	results := []PaymentStatus{StatusPending, "", StatusPending, StatusPaid}
+	errs := []error{nil, errors.New("connection reset"), &ProviderError{Code: "SYSTEMERROR", Retryable: true}, nil}
+	n := 0
+	query := func(ctx context.Context) (PaymentStatus, error) {
+		s, err := results[n], errs[n]
+		n++
+		return s, err
+	}
+	cancel := func(ctx context.Context) (bool, error) {
+		t.Fatal("paid order must not be cancelled")
+		return false, nil
+	}
+	status, err := testConfirmPolicy.Confirm(context.Background(), query, cancel)
+	if err != nil || status != StatusPaid || n != 4 {
+		t.Fatalf("got %s %v after %d queries", status, err, n)
+	}
+}
+
+func TestConfirmTimeout(t *testing.T) {
+	query := func(ctx context.Context) (PaymentStatus, error) {
+		return StatusPending, nil
+	}
+	calls := 0
+	cancel := func(ctx context.Context) (bool, error) {
+		calls++
+		return calls == 1, nil
+	}
+	status, err := testConfirmPolicy.Confirm(context.Background(), query, cancel)
+	if !errors.Is(err, ErrPaymentTimeout) || status != StatusClosed {
+		t.Fatalf("got %s %v", status, err)
+	}
+	if calls != 2 {
+		t.Fatalf("cancel called %d times, want 2", calls)
+	}
+
+	cancelErr := &ProviderError{Code: "FAIL", SubCode: "ORDERPAID"}
+	_, err = testConfirmPolicy.Confirm(context.Background(), query, func(ctx context.Context) (bool, error) {
+		return false, cancelErr
+	})
+	if !errors.As(err, &cancelErr) || errors.Is(err, ErrPaymentTimeout) {
+		t.Fatalf("cancel failure: %v", err)
+	}
+}
+
+func TestConfirmStopsOnBusinessError(t *testing.T) {
+	want := &ProviderError{Code: "FAIL", SubCode: "AUTHCODEEXPIRE"}
+	_, err := testConfirmPolicy.Confirm(context.Background(), func(ctx context.Context) (PaymentStatus, error) {
+		return "", want
+	}, func(ctx context.Context) (bool, error) {
+		t.Fatal("unexpected cancel")
+		return false, nil
+	})
+	if err != want {
+		t.Fatalf("got %v", err)
+	}
+}
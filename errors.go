@@ -0,0 +1,80 @@
+package pay
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 三方错误码归类后的通用错误, 使用 errors.Is 判断
+var (
+	// ErrOrderPaid 订单已支付
+	ErrOrderPaid = errors.New("pay: order already paid")
+	// ErrOrderClosed 订单已关闭
+	ErrOrderClosed = errors.New("pay: order already closed")
+	// ErrOrderNotExist 订单不存在
+	ErrOrderNotExist = errors.New("pay: order does not exist")
+	// ErrInsufficientBalance 余额不足
+	ErrInsufficientBalance = errors.New("pay: insufficient balance")
+	// ErrRefundNotExist 退款单不存在
+	ErrRefundNotExist = errors.New("pay: refund does not exist")
+	// ErrBillNotExist 对账单不存在或尚未生成
+	ErrBillNotExist = errors.New("pay: bill does not exist")
+	// ErrDuplicate 重复提交, 相同请求正在处理或支付平台已受理
+	ErrDuplicate = errors.New("pay: duplicate submission")
+	// ErrSignature 签名错误或验签失败
+	ErrSignature = errors.New("pay: signature error")
+)
+
+// ProviderError 三方或支付平台返回的业务错误, 使用 errors.As 获取
+type ProviderError struct {
+	Provider  string // alipay, wxpay, jxpay
+	Code      string // 网关返回码, 支付宝 code, 微信v2 return_code/result_code, 微信v3 HTTP状态码
+	SubCode   string // 业务错误码, 支付宝 sub_code, 微信v2 err_code, 微信v3 code
+	Message   string // 错误描述
+	Retryable bool   // 是否可原样重试, 如系统繁忙
+	Raw       []byte // 原始应答
+	Err       error  // 归类后的通用错误, 如 ErrOrderPaid, 可为空
+}
+
+func (e *ProviderError) Error() string {
+	parts := []string{e.Provider + ":"}
+	for _, s := range []string{e.Code, e.SubCode, e.Message} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Unwrap 返回归类后的通用错误
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable 错误是否可重试
+func IsRetryable(err error) bool {
+	var e *ProviderError
+	return errors.As(err, &e) && e.Retryable
+}
+
+// ResponseSignError 三方同步应答验签失败, 应答内容不可信
+type ResponseSignError struct {
+	Provider string // alipay, wxpay
+	API      string // 接口名或路径
+	Err      error  // 具体原因
+}
+
+func (e *ResponseSignError) Error() string {
+	return fmt.Sprintf("%s: response signature verification failed for %s: %v", e.Provider, e.API, e.Err)
+}
+
+// Unwrap 返回具体原因, 便于 errors.Is 判断
+func (e *ResponseSignError) Unwrap() error {
+	return e.Err
+}
+
+// Is 验签失败归类为 ErrSignature
+func (e *ResponseSignError) Is(target error) bool {
+	return target == ErrSignature
+}
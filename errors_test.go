@@ -0,0 +1,30 @@
+package pay
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestProviderError(t *testing.T) {
+	var err error = &ProviderError{Provider: "wxpay", Code: "FAIL", SubCode: "ORDERPAID", Message: "该订单已支付", Err: ErrOrderPaid}
+	err = fmt.Errorf("wx app pay: %w", err)
+	if !errors.Is(err, ErrOrderPaid) {
+		t.Fatal("want ErrOrderPaid")
+	}
+	var pe *ProviderError
+	if !errors.As(err, &pe) || pe.SubCode != "ORDERPAID" {
+		t.Fatalf("errors.As failed: %v", err)
+	}
+	if err.Error() != "wx app pay: wxpay: FAIL ORDERPAID 该订单已支付" {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+	if IsRetryable(err) {
+		t.Fatal("ORDERPAID is not retryable")
+	}
+
+	sig := &ResponseSignError{Provider: "alipay", API: "alipay.trade.query", Err: errors.New("bad sign")}
+	if !errors.Is(sig, ErrSignature) {
+		t.Fatal("ResponseSignError should match ErrSignature")
+	}
+}
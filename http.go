@@ -1,9 +1,9 @@
 package pay
 
 import (
+	"context"
 	"crypto/tls"
-	"github.com/astaxie/beego/httplib"
-	"github.com/astaxie/beego/logs"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -24,7 +24,13 @@ var (
 
 func init() {
 	HTTPC = &HTTPClient{}
-	HTTPSC = NewHTTPSClient([]byte{}, []byte{})
+	HTTPSC, _ = NewHTTPSClient(nil, nil)
+}
+
+// SetHTTPClient 替换默认http客户端, 内部支付平台及未单独配置客户端的三方请求均使用该客户端
+func SetHTTPClient(c *http.Client) {
+	HTTPC = &HTTPClient{Client: *c}
+	HTTPSC = &HTTPSClient{Client: *c}
 }
 
 // HTTPSClient HTTPS客户端结构
@@ -32,27 +38,23 @@ type HTTPSClient struct {
 	http.Client
 }
 
-// NewHTTPSClient 获取默认https客户端
-func NewHTTPSClient(certPEMBlock, keyPEMBlock []byte) *HTTPSClient {
+// NewHTTPSClient 获取https客户端, 证书为空时不带客户端证书, 证书格式错误时返回错误
+func NewHTTPSClient(certPEMBlock, keyPEMBlock []byte) (*HTTPSClient, error) {
 	config := new(tls.Config)
 	if len(certPEMBlock) != 0 && len(keyPEMBlock) != 0 {
 		cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
 		if err != nil {
-			panic("load x509 cert error:" + err.Error())
-			return nil
+			return nil, errors.New("load x509 cert error:" + err.Error())
 		}
 		config = &tls.Config{
 			Certificates: []tls.Certificate{
 				cert,
 			},
 		}
-	} else {
-		config = &tls.Config{
-			InsecureSkipVerify: true,
-		}
 	}
 
 	tr := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
 		TLSClientConfig: config,
 	}
 	client := http.Client{
@@ -61,32 +63,37 @@ func NewHTTPSClient(certPEMBlock, keyPEMBlock []byte) *HTTPSClient {
 	}
 	return &HTTPSClient{
 		Client: client,
-	}
+	}, nil
 }
 
 // PostData 提交post数据
 func (c *HTTPSClient) PostData(url string, contentType string, data string) ([]byte, error) {
-	req := httplib.Post(url)
-	req.Body(data)
-	req.Header("Content-Type", contentType)
-	resp, err := req.Response()
+	return c.PostDataContext(context.Background(), url, contentType, data)
+}
+
+// PostDataContext 携带ctx提交post数据
+func (c *HTTPSClient) PostDataContext(ctx context.Context, url string, contentType string, data string) ([]byte, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(data))
 	if err != nil {
-		logs.Error("post url:%s failed:%s", url, err)
 		return nil, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	req.Header.Set("Content-Type", contentType)
+	_, body, err := DoRequest(ctx, &c.Client, req)
 	return body, err
-
 }
 
-// PostData 提交post数据
+// GetData 获取get数据
 func (c *HTTPSClient) GetData(url string) ([]byte, error) {
-	req := httplib.Get(url)
-	resp, err := req.Response()
+	return c.GetDataContext(context.Background(), url)
+}
+
+// GetDataContext 携带ctx获取get数据
+func (c *HTTPSClient) GetDataContext(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	_, body, err := DoRequest(ctx, &c.Client, req)
 	return body, err
 }
 
@@ -97,10 +104,34 @@ type HTTPClient struct {
 
 // PostData post数据
 func (c *HTTPClient) PostData(url, format string, data string) ([]byte, error) {
-	resp, err := c.Post(url, format, strings.NewReader(data))
+	return c.PostDataContext(context.Background(), url, format, data)
+}
+
+// PostDataContext 携带ctx提交post数据
+func (c *HTTPClient) PostDataContext(ctx context.Context, url, format string, data string) ([]byte, error) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", format)
+	_, body, err := DoRequest(ctx, &c.Client, req)
+	return body, err
+}
+
+// DoRequest 携带ctx发送请求并读取返回body, client 为空时使用 HTTPSC
+// 返回的 Response.Body 已读取并关闭, 仅用于读取状态码与header
+func DoRequest(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, []byte, error) {
+	if client == nil {
+		client = &HTTPSC.Client
+	}
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+	return resp, body, nil
 }
@@ -0,0 +1,42 @@
+package pay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDoRequestContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := DoRequest(ctx, srv.Client(), req); err == nil {
+		t.Fatal("request should be cancelled by ctx")
+	}
+
+	req, _ = http.NewRequest("GET", srv.URL, nil)
+	_, body, err := DoRequest(context.Background(), srv.Client(), req)
+	if err != nil || string(body) != "ok" {
+		t.Fatalf("unexpected result %q %v", body, err)
+	}
+}
+
+func TestNewHTTPSClientBadCert(t *testing.T) {
+	if _, err := NewHTTPSClient([]byte("bad"), []byte("bad")); err == nil {
+		t.Fatal("bad cert should return error")
+	}
+	if c, err := NewHTTPSClient(nil, nil); err != nil || c == nil {
+		t.Fatalf("client without cert: %v", err)
+	}
+}
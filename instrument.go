@@ -0,0 +1,107 @@
+package pay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// 调用结果码, 三方业务错误使用三方错误码
+const (
+	CodeSuccess   = "SUCCESS"   // 调用成功
+	CodeSignature = "SIGNATURE" // 签名错误或应答验签失败
+	CodeTimeout   = "TIMEOUT"   // 超时
+	CodeCanceled  = "CANCELED"  // ctx 被取消
+	CodeError     = "ERROR"     // 网络、解析等其他错误
+)
+
+// Call 一次三方网关或支付平台调用, 由 Instrument 记录
+type Call struct {
+	Provider string        // alipay, wxpay, jxpay
+	Method   string        // 接口, 如 /pay/orderquery、alipay.trade.query、GET /v3/certificates、DoPay
+	Tenant   string        // 商户, 微信为 sub_mch_id 或 mch_id, 支付宝为 app_id, 支付平台为 TenantID
+	Start    time.Time     // 开始时间
+	Duration time.Duration // 耗时, 结束时填写
+	Code     string        // 结果码, 结束时填写, 见 ResultCode
+	Err      error         // 调用错误, 结束时填写
+}
+
+// Instrument 调用埋点, 用于上报指标与链路追踪, 实现需并发安全
+// 现成实现见 payprom(Prometheus) 与 payotel(OpenTelemetry) 子模块
+type Instrument interface {
+	// Start 调用开始, 返回的 ctx 用于本次请求并传给 End, 可携带 span
+	Start(ctx context.Context, call *Call) context.Context
+	// End 调用结束, call 已填写耗时与结果码
+	End(ctx context.Context, call *Call)
+}
+
+// DefaultInstrument 客户端未设置 Instrument 时使用, 及包级函数使用, 为空时不埋点
+var DefaultInstrument Instrument
+
+// Observe 以 in 记录 fn 的调用, in 为空时使用 DefaultInstrument
+// fn 可在返回前填写 call.Code, 未填写时按返回的错误取 ResultCode
+func Observe(ctx context.Context, in Instrument, call *Call, fn func(ctx context.Context) error) error {
+	if in == nil {
+		in = DefaultInstrument
+	}
+	if in == nil {
+		return fn(ctx)
+	}
+	call.Start = time.Now()
+	ctx = in.Start(ctx, call)
+	err := fn(ctx)
+	call.Duration = time.Since(call.Start)
+	call.Err = err
+	if call.Code == "" {
+		call.Code = ResultCode(err)
+	}
+	in.End(ctx, call)
+	return err
+}
+
+// ResultCode 错误对应的结果码: 三方业务错误取 sub_code/err_code, 没有时取 code
+func ResultCode(err error) string {
+	if err == nil {
+		return CodeSuccess
+	}
+	var e *ProviderError
+	switch {
+	case errors.As(err, &e):
+		if e.SubCode != "" {
+			return e.SubCode
+		}
+		return e.Code
+	case errors.Is(err, ErrSignature):
+		return CodeSignature
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return CodeTimeout
+	}
+	return CodeError
+}
+
+// MultiInstrument 组合多个埋点, 如同时上报指标与链路
+func MultiInstrument(ins ...Instrument) Instrument {
+	return multiInstrument(ins)
+}
+
+type multiInstrument []Instrument
+
+func (m multiInstrument) Start(ctx context.Context, call *Call) context.Context {
+	for _, in := range m {
+		ctx = in.Start(ctx, call)
+	}
+	return ctx
+}
+
+func (m multiInstrument) End(ctx context.Context, call *Call) {
+	for n := len(m) - 1; n >= 0; n-- {
+		m[n].End(ctx, call)
+	}
+}
@@ -0,0 +1,123 @@
+package pay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type ctxKey struct{}
+
+// recorder 记录调用的埋点
+type recorder struct {
+	name  string
+	mu    sync.Mutex
+	calls []Call
+	order *[]string
+}
+
+func (r *recorder) Start(ctx context.Context, call *Call) context.Context {
+	if r.order != nil {
+		*r.order = append(*r.order, "start "+r.name)
+	}
+	return context.WithValue(ctx, ctxKey{}, r.name)
+}
+
+func (r *recorder) End(ctx context.Context, call *Call) {
+	if r.order != nil {
+		*r.order = append(*r.order, "end "+r.name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, *call)
+}
+
+func TestObserve(t *testing.T) {
+	r := &recorder{name: "r"}
+	call := &Call{Provider: "wxpay", Method: "/pay/orderquery", Tenant: "1900000109"}
+	err := Observe(context.Background(), r, call, func(ctx context.Context) error {
+		if ctx.Value(ctxKey{}) != "r" {
+			t.Fatal("ctx from Start not passed to fn")
+		}
+		return &ProviderError{Provider: "wxpay", Code: "FAIL", SubCode: "SYSTEMERROR"}
+	})
+	if err == nil || len(r.calls) != 1 {
+		t.Fatalf("err %v calls %v", err, r.calls)
+	}
+	c := r.calls[0]
+	if c.Code != "SYSTEMERROR" || c.Err != err || c.Start.IsZero() || c.Duration <= 0 || c.Tenant != "1900000109" {
+		t.Fatalf("unexpected call %+v", c)
+	}
+
+	// fn 填写的结果码优先
+	call = &Call{Provider: "alipay"}
+	Observe(context.Background(), r, call, func(ctx context.Context) error {
+		call.Code = "ACQ.TRADE_NOT_EXIST"
+		return nil
+	})
+	if r.calls[1].Code != "ACQ.TRADE_NOT_EXIST" {
+		t.Fatalf("unexpected code %s", r.calls[1].Code)
+	}
+
+	// 未设置埋点时直接调用
+	called := false
+	Observe(context.Background(), nil, &Call{}, func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	if !called {
+		t.Fatal("fn not called without instrument")
+	}
+}
+
+func TestResultCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, CodeSuccess},
+		{&ProviderError{Code: "40004", SubCode: "ACQ.TRADE_NOT_EXIST"}, "ACQ.TRADE_NOT_EXIST"},
+		{fmt.Errorf("wrap: %w", &ProviderError{Code: "failed"}), "failed"},
+		{&ResponseSignError{Err: errors.New("bad")}, CodeSignature},
+		{context.Canceled, CodeCanceled},
+		{fmt.Errorf("HTTPSC.PostData: %w", context.DeadlineExceeded), CodeTimeout},
+		{errors.New("xml.Unmarshal: EOF"), CodeError},
+	}
+	for _, tt := range tests {
+		if got := ResultCode(tt.err); got != tt.want {
+			t.Errorf("ResultCode(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestMultiInstrument(t *testing.T) {
+	var order []string
+	a := &recorder{name: "a", order: &order}
+	b := &recorder{name: "b", order: &order}
+	Observe(context.Background(), MultiInstrument(a, b), &Call{}, func(ctx context.Context) error { return nil })
+	if fmt.Sprint(order) != "[start a start b end b end a]" || len(a.calls) != 1 || len(b.calls) != 1 {
+		t.Fatalf("unexpected order %v", order)
+	}
+}
+
+func TestPayClientInstrument(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"State":"failed","Message":"余额不足"}`))
+	}))
+	defer srv.Close()
+
+	r := &recorder{}
+	c := NewPayClient(srv.URL)
+	c.Instrument = r
+	c.DoPay(context.Background(), &DoPayRequest{TenantID: 7, OrderID: 1, Money: CNY(100)})
+	if len(r.calls) != 1 {
+		t.Fatalf("unexpected calls %v", r.calls)
+	}
+	if call := r.calls[0]; call.Provider != "jxpay" || call.Method != OpDoPay || call.Tenant != "7" || call.Code != "failed" {
+		t.Fatalf("unexpected call %+v", call)
+	}
+}
@@ -0,0 +1,117 @@
+package pay
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/astaxie/beego/logs"
+)
+
+// Level 日志级别
+type Level int
+
+// 日志级别, 取值与 slog 一致
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG"
+	case l < LevelWarn:
+		return "INFO"
+	case l < LevelError:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+// Field 日志字段
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F 构造日志字段
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger 结构化日志接口, 可适配 zap、zerolog、logrus 等
+// 库内调用前已对字段脱敏, 实现方无需再处理
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// LoggerFunc 函数适配为 Logger
+type LoggerFunc func(level Level, msg string, fields ...Field)
+
+// Log 实现 Logger
+func (f LoggerFunc) Log(level Level, msg string, fields ...Field) {
+	f(level, msg, fields...)
+}
+
+// NopLogger 丢弃所有日志
+type NopLogger struct{}
+
+// Log 实现 Logger
+func (NopLogger) Log(Level, string, ...Field) {}
+
+// BeegoLogger 输出到 beego logs, 字段按 key=value 追加在消息后
+type BeegoLogger struct{}
+
+// Log 实现 Logger
+func (BeegoLogger) Log(level Level, msg string, fields ...Field) {
+	line := FormatFields(msg, fields)
+	switch {
+	case level < LevelInfo:
+		logs.Debug(line)
+	case level < LevelWarn:
+		logs.Info(line)
+	case level < LevelError:
+		logs.Warning(line)
+	default:
+		logs.Error(line)
+	}
+}
+
+// DefaultLogger 客户端未设置 Logger 时使用, 及包级函数使用
+var DefaultLogger Logger = BeegoLogger{}
+
+// Log 字段脱敏后写入 l, l 为空时使用 DefaultLogger
+func Log(l Logger, level Level, msg string, fields ...Field) {
+	if l == nil {
+		l = DefaultLogger
+	}
+	if l == nil {
+		return
+	}
+	redacted := make([]Field, len(fields))
+	for n, f := range fields {
+		redacted[n] = Field{Key: f.Key, Value: RedactValue(f.Key, f.Value)}
+	}
+	l.Log(level, RedactText(msg), redacted...)
+}
+
+// FormatFields 将消息与字段格式化为 "msg key=value ..." 的单行文本
+func FormatFields(msg string, fields []Field) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, f := range fields {
+		b.WriteString(" ")
+		b.WriteString(f.Key)
+		b.WriteString("=")
+		s := fmt.Sprint(f.Value)
+		if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+	return b.String()
+}
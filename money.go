@@ -0,0 +1,154 @@
+package pay
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// CurrencyCNY 人民币
+const CurrencyCNY = "CNY"
+
+var (
+	// ErrSubMinorUnit 金额精度超过币种最小单位(如人民币小于分)
+	ErrSubMinorUnit = errors.New("pay: amount finer than currency minor unit")
+	// ErrCurrencyMismatch 不同币种的金额不能运算
+	ErrCurrencyMismatch = errors.New("pay: currency mismatch")
+)
+
+// currencyExponent 币种最小单位的小数位数, 未列出的币种按2位处理
+var currencyExponent = map[string]int32{
+	"JPY": 0,
+	"KRW": 0,
+}
+
+// Money 金额, 以币种最小单位(人民币为分)的整数保存, 避免浮点误差
+// json 序列化为以元为单位的数字, 与内部支付平台原有的 float64 字段兼容;
+// json 中不含币种, 仅支持人民币: 解析结果固定为 CNY, 序列化其他币种时返回 ErrCurrencyMismatch
+type Money struct {
+	Amount   int64  // 最小单位金额, 人民币为分
+	Currency string // ISO 4217 币种, 为空视为 CNY
+}
+
+// NewMoney 按最小单位创建金额
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// CNY 按分创建人民币金额
+func CNY(fen int64) Money {
+	return Money{Amount: fen, Currency: CurrencyCNY}
+}
+
+// ParseMoney 解析以元为单位的人民币金额字符串, 如 "1.01"
+// 小数位超过分时返回 ErrSubMinorUnit
+func ParseMoney(s string) (Money, error) {
+	return ParseMoneyIn(s, CurrencyCNY)
+}
+
+// ParseMoneyIn 解析指定币种以主单位表示的金额字符串
+func ParseMoneyIn(s, currency string) (Money, error) {
+	d, err := decimal.NewFromString(strings.TrimSpace(s))
+	if err != nil {
+		return Money{}, fmt.Errorf("pay: invalid amount %q: %v", s, err)
+	}
+	return fromDecimal(d, currency)
+}
+
+// MoneyFromFloat 将以元为单位的浮点金额转为人民币金额, 用于兼容旧调用方
+// 浮点值无法精确表示为分时返回 ErrSubMinorUnit, 不做截断
+func MoneyFromFloat(f float64) (Money, error) {
+	return fromDecimal(decimal.NewFromFloat(f), CurrencyCNY)
+}
+
+// fromDecimal 主单位金额转为最小单位
+func fromDecimal(d decimal.Decimal, currency string) (Money, error) {
+	minor := d.Shift(exponent(currency))
+	if !minor.Equal(minor.Truncate(0)) {
+		return Money{}, fmt.Errorf("%w: %s %s", ErrSubMinorUnit, d.String(), currency)
+	}
+	return Money{Amount: minor.IntPart(), Currency: currency}, nil
+}
+
+// exponent 币种小数位数
+func exponent(currency string) int32 {
+	if e, ok := currencyExponent[currency]; ok {
+		return e
+	}
+	return 2
+}
+
+// CurrencyCode 币种, 为空时返回 CNY
+func (m Money) CurrencyCode() string {
+	if m.Currency == "" {
+		return CurrencyCNY
+	}
+	return m.Currency
+}
+
+// Decimal 以主单位表示的金额
+func (m Money) Decimal() decimal.Decimal {
+	return decimal.New(m.Amount, -exponent(m.CurrencyCode()))
+}
+
+// String 以主单位表示的金额字符串, 人民币固定两位小数, 如 "1.01"
+func (m Money) String() string {
+	return m.Decimal().StringFixed(exponent(m.CurrencyCode()))
+}
+
+// Float64 以主单位表示的浮点金额, 仅用于展示或兼容旧接口
+func (m Money) Float64() float64 {
+	f, _ := m.Decimal().Float64()
+	return f
+}
+
+// IsZero 金额是否为0
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// IsPositive 金额是否大于0
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+// Add 金额相加, 币种不同时返回 ErrCurrencyMismatch
+func (m Money) Add(o Money) (Money, error) {
+	if m.CurrencyCode() != o.CurrencyCode() {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: m.CurrencyCode()}, nil
+}
+
+// Sub 金额相减, 币种不同时返回 ErrCurrencyMismatch
+func (m Money) Sub(o Money) (Money, error) {
+	if m.CurrencyCode() != o.CurrencyCode() {
+		return Money{}, ErrCurrencyMismatch
+	}
+	return Money{Amount: m.Amount - o.Amount, Currency: m.CurrencyCode()}, nil
+}
+
+// MarshalJSON 序列化为以元为单位的数字, json 中无法表示币种, 非人民币金额返回 ErrCurrencyMismatch
+func (m Money) MarshalJSON() ([]byte, error) {
+	if m.CurrencyCode() != CurrencyCNY {
+		return nil, fmt.Errorf("%w: json amount is CNY only, got %s", ErrCurrencyMismatch, m.CurrencyCode())
+	}
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON 解析以元为单位的数字或字符串, json 中不含币种, 结果固定为人民币
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*m = Money{}
+		return nil
+	}
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
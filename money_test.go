@@ -0,0 +1,85 @@
+package pay
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	for s, fen := range map[string]int64{"1.01": 101, "0.1": 10, "100": 10000, "0.00": 0, "-2.5": -250} {
+		m, err := ParseMoney(s)
+		if err != nil || m.Amount != fen || m.CurrencyCode() != CurrencyCNY {
+			t.Fatalf("%s: %+v %v", s, m, err)
+		}
+	}
+	if _, err := ParseMoney("0.001"); !errors.Is(err, ErrSubMinorUnit) {
+		t.Fatalf("want ErrSubMinorUnit, got %v", err)
+	}
+	if _, err := ParseMoney("1.0x"); err == nil {
+		t.Fatal("invalid amount accepted")
+	}
+}
+
+func TestMoneyFromFloat(t *testing.T) {
+	m, err := MoneyFromFloat(0.29)
+	if err != nil || m.Amount != 29 {
+		t.Fatalf("unexpected %+v %v", m, err)
+	}
+	// 浮点运算 0.1+0.2 不能精确表示为分, 拒绝而不是截断
+	a, b := 0.1, 0.2
+	if _, err := MoneyFromFloat(a + b); !errors.Is(err, ErrSubMinorUnit) {
+		t.Fatalf("want ErrSubMinorUnit, got %v", err)
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	cases := map[string]Money{
+		"1.01":  CNY(101),
+		"0.10":  CNY(10),
+		"-0.05": CNY(-5),
+		"120":   NewMoney(120, "JPY"),
+	}
+	for want, m := range cases {
+		if m.String() != want {
+			t.Fatalf("%+v: want %s got %s", m, want, m.String())
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	sum, err := CNY(101).Add(Money{Amount: 99})
+	if err != nil || sum != CNY(200) {
+		t.Fatalf("unexpected %+v %v", sum, err)
+	}
+	if _, err := CNY(1).Sub(NewMoney(1, "USD")); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Fatalf("want ErrCurrencyMismatch, got %v", err)
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	b, err := json.Marshal(DoPayRequest{Money: CNY(1999)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(b, &raw)
+	if raw["money"] != 19.99 {
+		t.Fatalf("money should be encoded in yuan, got %v", raw["money"])
+	}
+
+	var r DoPayRequest
+	if err := json.Unmarshal([]byte(`{"money":19.99,"discountMoney":"0.5"}`), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Money.Amount != 1999 || r.DiscountMoney.Amount != 50 {
+		t.Fatalf("unexpected %+v", r)
+	}
+	if err := json.Unmarshal([]byte(`{"money":0.015}`), &r); !errors.Is(err, ErrSubMinorUnit) {
+		t.Fatalf("want ErrSubMinorUnit, got %v", err)
+	}
+	// json 不含币种, 其他币种不能序列化, 避免解析时被当作人民币
+	if _, err := json.Marshal(DoPayRequest{Money: NewMoney(120, "JPY")}); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Fatalf("want ErrCurrencyMismatch, got %v", err)
+	}
+}
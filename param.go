@@ -9,6 +9,9 @@ const (
 // 内部支付域名
 const (
 	urlPay = "http://jxpay.com"
+
+	// DefaultPayURL 内部支付平台默认地址
+	DefaultPayURL = urlPay + ":8091"
 )
 
 // CommonResponse beego框架统一返回结构
@@ -20,21 +23,23 @@ type CommonResponse struct {
 
 // DoPayRequest 支付请求
 type DoPayRequest struct {
-	ServiceID     int     `json:"serviceID"`     // 服务ID
-	Name          string  `json:"name"`          // 服务名称
-	TenantID      int     `json:"tenantID"`      // 商户ID
-	OrderID       int     `json:"orderID"`       // 订单号 或者 batchID
-	Money         float64 `json:"money"`         // 金额
-	CashReasonID  int     `json:"cashReasonID"`  // 支付原因ID
-	CashChannelID int     `json:"cashChannelID"` // 支付方式ID
-	CallBackURL   string  `json:"callBackURL"`   // 支付回调地址(内部回调地址)
+	ServiceID     int    `json:"serviceID"`     // 服务ID
+	Name          string `json:"name"`          // 服务名称
+	TenantID      int    `json:"tenantID"`      // 商户ID
+	OrderID       int    `json:"orderID"`       // 订单号 或者 batchID
+	Money         Money  `json:"money"`         // 金额
+	CashReasonID  int    `json:"cashReasonID"`  // 支付原因ID
+	CashChannelID int    `json:"cashChannelID"` // 支付方式ID
+	CallBackURL   string `json:"callBackURL"`   // 支付回调地址(内部回调地址)
 	// 非必须参数
-	UserID        int     `json:"userID"`        // 系统内的用户ID(可空)
-	ThirdUserID   string  `json:"thirdUserID"`   // 三方用户ID(可空)
-	TradeNumber   string  `json:"tradeNumber"`   // 商户单号(只用于存两份cashflow的服务,目前只有停车服务需要)
-	DiscountMoney float64 `json:"discountMoney"` // 优惠金额
-	PresentMoney  float64 `json:"presentMoney"`  // 赠送金额
-	ExtendParams  string  `json:"extendParams"`  // 额外参数(目前停车用)
+	UserID        int    `json:"userID"`        // 系统内的用户ID(可空)
+	ThirdUserID   string `json:"thirdUserID"`   // 三方用户ID(可空)
+	TradeNumber   string `json:"tradeNumber"`   // 商户单号(只用于存两份cashflow的服务,目前只有停车服务需要)
+	DiscountMoney Money  `json:"discountMoney"` // 优惠金额
+	PresentMoney  Money  `json:"presentMoney"`  // 赠送金额
+	ExtendParams  string `json:"extendParams"`  // 额外参数(目前停车用)
+	// IdempotencyKey 幂等键, 相同键的重复提交只生成一笔流水; 为空时按 服务/商户/订单/支付原因/支付方式/金额 生成
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 // 服务注册参数
@@ -61,6 +66,9 @@ type PayItem struct {
 	WxPayKey         string
 	WxCertPEM        string
 	WxKeyPEM         string
+	WxKeyPemNo       string // 商户API证书序列号, APIv3签名使用
+	WxAPIv3Key       string // APIv3密钥, 解密平台证书与回调通知使用
+	WxPayV3          bool   // 下单使用APIv3接口
 	AliPayPublicKey  string
 	AliPayPrivateKey string
 	AliPayAppId      string
@@ -71,12 +79,12 @@ type PayItem struct {
 
 // SendCallBackNotify 回调通知
 type SendCallBackNotify struct {
-	TradeNumber   string  `json:"tradeNumber"`   // 商户单号
-	Money         float64 `json:"money"`         // 金额
-	OrderID       int     `json:"orderID"`       // 订单ID
-	CashChannelID int     `json:"cashChannelID"` // 支付方式
-	ConfirmAt     string  `json:"confirmAt"`     // 支付完成时间
-	CashReasonID  int     `json:"cashReasonID"`  // 支付原因
+	TradeNumber   string `json:"tradeNumber"`   // 商户单号
+	Money         Money  `json:"money"`         // 金额
+	OrderID       int    `json:"orderID"`       // 订单ID
+	CashChannelID int    `json:"cashChannelID"` // 支付方式
+	ConfirmAt     string `json:"confirmAt"`     // 支付完成时间
+	CashReasonID  int    `json:"cashReasonID"`  // 支付原因
 }
 
 // QRCodePayResponse 二维码支付返回
@@ -98,18 +106,20 @@ type DoOutPayRequest struct {
 	CashChannelID int          `json:"cashChannelID"` // 支付方式ID
 	OutPayLists   []OutPayList `json:"outPayLists"`   // 出账列表
 	CallBackURL   string       `json:"callBackURL"`   // 支付回调地址(内部回调地址)
+	// IdempotencyKey 幂等键, 相同键的重复提交只生成一笔流水; 为空时按 服务/商户/订单/支付原因/支付方式/金额 生成
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 // OutPayList 出账列表
 type OutPayList struct {
-	PayMoney    float64 `json:"payMoney"`    // 原订单金额
-	TradeNumber string  `json:"tradeNumber"` // 商户单号
-	RefundMoney float64 `json:"refundMoney"` // 需要退款金额
+	PayMoney    Money  `json:"payMoney"`    // 原订单金额
+	TradeNumber string `json:"tradeNumber"` // 商户单号
+	RefundMoney Money  `json:"refundMoney"` // 需要退款金额
 }
 
 // WxRefundRequest 微信退款请求
 type WxRefundRequest struct {
-	PayMoney    float64
+	PayMoney    Money
 	TradeNumber string
-	RefundMoney float64
+	RefundMoney Money
 }
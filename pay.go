@@ -1,74 +1,185 @@
 package pay
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"github.com/astaxie/beego/logs"
-	"io/ioutil"
+	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+// PayClient 内部支付平台客户端
+type PayClient struct {
+	BaseURL    string       // 支付平台地址(含端口), 为空时使用 DefaultPayURL
+	HTTPClient *http.Client // 自定义http客户端, 为空时使用 HTTPC
+	// RetryPolicy 网络错误重试策略, 为空时不重试; 需在 Operations 中开启 OpDoPay/OpDoOutPay, 重试沿用同一幂等键
+	RetryPolicy *RetryPolicy
+	Logger      Logger     // 日志, 为空时使用 DefaultLogger, 输出前自动脱敏
+	Instrument  Instrument // 调用埋点, 为空时使用 DefaultInstrument
+
+	inflight sync.Map // 处理中的请求, 防止同一订单并发重复提交
+}
+
+// inflightKey 重复提交判断依据
+type inflightKey struct {
+	api          string
+	serviceID    int
+	tenantID     int
+	orderID      int
+	cashReasonID int
+}
+
+// idempotencyKey 未指定幂等键时按请求生成, 包含支付方式与金额, 换渠道或改金额重新提交时不会命中上一次的流水
+func (k inflightKey) idempotencyKey(cashChannelID int, amount Money) string {
+	return strings.Join([]string{
+		strings.Trim(k.api, "/"),
+		strconv.Itoa(k.serviceID),
+		strconv.Itoa(k.tenantID),
+		strconv.Itoa(k.orderID),
+		strconv.Itoa(k.cashReasonID),
+		strconv.Itoa(cashChannelID),
+		amount.String(),
+	}, ":")
+}
+
+// outPayTotal 出账列表退款金额合计
+func outPayTotal(list []OutPayList) (Money, error) {
+	var total Money
+	for i, l := range list {
+		if i == 0 {
+			total = l.RefundMoney
+			continue
+		}
+		var err error
+		if total, err = total.Add(l.RefundMoney); err != nil {
+			return Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// acquire 标记请求处理中, 同一请求已在处理时返回 ErrDuplicate
+func (c *PayClient) acquire(k inflightKey) (release func(), err error) {
+	if _, loaded := c.inflight.LoadOrStore(k, struct{}{}); loaded {
+		return nil, fmt.Errorf("%w: service %d tenant %d order %d reason %d in flight",
+			ErrDuplicate, k.serviceID, k.tenantID, k.orderID, k.cashReasonID)
+	}
+	return func() { c.inflight.Delete(k) }, nil
+}
+
+// DefaultPayClient 包级 Register/DoPay/DoOutPay 使用的客户端
+var DefaultPayClient = NewPayClient(DefaultPayURL)
+
+// NewPayClient 创建内部支付平台客户端
+func NewPayClient(baseURL string) *PayClient {
+	return &PayClient{BaseURL: baseURL}
+}
+
+// post 以json提交到支付平台, idempotencyKey 非空时通过 Idempotency-Key 头传递
+// 支付平台以 409 拒绝重复提交时返回包装 ErrDuplicate 的 *ProviderError
+func (c *PayClient) post(ctx context.Context, api string, data []byte, idempotencyKey string) ([]byte, error) {
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultPayURL
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(baseURL, "/")+api, strings.NewReader(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = &HTTPC.Client
+	}
+	resp, body, err := DoRequest(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return nil, &ProviderError{Provider: "jxpay", Code: strconv.Itoa(resp.StatusCode), Message: strings.TrimSpace(string(body)), Raw: body, Err: ErrDuplicate}
+	}
+	return body, nil
+}
+
 func checkRemote() {
 	conn, err := net.Dial("ip:icmp", urlPay)
 	if err != nil {
-		logs.Critical("支付平台无法访问，修改host文件 将jxpay.com指向指定地址")
+		Log(nil, LevelError, "支付平台无法访问，修改host文件 将jxpay.com指向指定地址", F("err", err))
 		return
 	}
 	add := conn.RemoteAddr()
-	logs.Info(add.String())
+	Log(nil, LevelInfo, "支付平台地址", F("addr", add.String()))
 }
 
 // 注册函数
 func Register(req *RegisterRequest) (*RegisterResponse, error) {
+	return RegisterContext(context.Background(), req)
+}
+
+// RegisterContext 携带ctx的注册函数
+func RegisterContext(ctx context.Context, req *RegisterRequest) (*RegisterResponse, error) {
+	return DefaultPayClient.Register(ctx, req)
+}
+
+// Register 注册服务
+func (c *PayClient) Register(ctx context.Context, req *RegisterRequest) (*RegisterResponse, error) {
 	//checkRemote()
 	data, _ := json.Marshal(req)
-	resp, err := http.Post(urlPay+":8091"+apiRegister,
-		"application/json",
-		strings.NewReader(string(data)))
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	var body []byte
+	err := Observe(ctx, c.Instrument, &Call{Provider: "jxpay", Method: "Register"}, func(ctx context.Context) error {
+		var err error
+		body, err = c.post(ctx, apiRegister, data, "")
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	d := new(RegisterResponse)
-	err = json.Unmarshal(body, d)
-	logs.Error(err)
+	if err := json.Unmarshal(body, d); err != nil {
+		Log(c.Logger, LevelError, "jxpay: unmarshal register response", F("err", err), F("body", body))
+	}
 	return d, nil
 }
 
 // 支付函数 .
 func DoPay(r *DoPayRequest) (interface{}, error) {
-	if r.Money < 0.01 {
-		return "支付金额不能小于0.01", errors.New("支付金额不能小于0.01")
-	}
-	req, _ := json.Marshal(r)
-	resp, err := http.Post(urlPay+":8091"+apiDoPay,
-		"application/json",
-		strings.NewReader(string(req)))
-	if err != nil {
-		return nil, err
-	}
+	return DoPayContext(context.Background(), r)
+}
+
+// DoPayContext 携带ctx的支付函数
+func DoPayContext(ctx context.Context, r *DoPayRequest) (interface{}, error) {
+	return DefaultPayClient.DoPay(ctx, r)
+}
 
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+// DoPay 发起支付, 同一 服务/商户/订单/支付原因 的支付处理中时返回 ErrDuplicate
+func (c *PayClient) DoPay(ctx context.Context, r *DoPayRequest) (interface{}, error) {
+	if r.Money.Amount < 1 {
+		return nil, errors.New("支付金额不能小于0.01")
+	}
+	k := inflightKey{api: apiDoPay, serviceID: r.ServiceID, tenantID: r.TenantID, orderID: r.OrderID, cashReasonID: r.CashReasonID}
+	release, err := c.acquire(k)
 	if err != nil {
 		return nil, err
 	}
-	d := new(CommonResponse)
-	if err = json.Unmarshal(body, d); err != nil {
-		logs.Error(err)
-		return "", err
-	}
-	if d.State == "failed" {
-		return d.Message, errors.New(d.Message)
+	defer release()
+	p := *r
+	if p.IdempotencyKey == "" {
+		p.IdempotencyKey = k.idempotencyKey(r.CashChannelID, r.Money)
 	}
-	return d.Data, nil
+	req, _ := json.Marshal(&p)
+	var data interface{}
+	err = c.RetryPolicy.Do(ctx, "jxpay", OpDoPay, func(ctx context.Context) error {
+		data, err = c.do(ctx, OpDoPay, r.TenantID, apiDoPay, req, p.IdempotencyKey)
+		return err
+	})
+	return data, err
 }
 
 // GetIPAddr 获取本机内网地址
@@ -90,26 +201,63 @@ func GetIPAddr() string {
 
 // 支付函数 .
 func DoOutPay(r *DoOutPayRequest) (interface{}, error) {
-	req, _ := json.Marshal(r)
-	resp, err := http.Post(urlPay+":8091"+apiDoOutPay,
-		"application/json",
-		strings.NewReader(string(req)))
-	if err != nil {
-		return nil, err
-	}
+	return DoOutPayContext(context.Background(), r)
+}
+
+// DoOutPayContext 携带ctx的出账函数
+func DoOutPayContext(ctx context.Context, r *DoOutPayRequest) (interface{}, error) {
+	return DefaultPayClient.DoOutPay(ctx, r)
+}
 
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+// DoOutPay 发起出账, 同一 服务/商户/订单/支付原因 的出账处理中时返回 ErrDuplicate
+func (c *PayClient) DoOutPay(ctx context.Context, r *DoOutPayRequest) (interface{}, error) {
+	k := inflightKey{api: apiDoOutPay, serviceID: r.ServiceID, tenantID: r.TenantID, orderID: r.OrderID, cashReasonID: r.CashReasonID}
+	release, err := c.acquire(k)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
+	p := *r
+	if p.IdempotencyKey == "" {
+		total, err := outPayTotal(r.OutPayLists)
+		if err != nil {
+			return nil, err
+		}
+		p.IdempotencyKey = k.idempotencyKey(r.CashChannelID, total)
+	}
+	req, _ := json.Marshal(&p)
+	var data interface{}
+	err = c.RetryPolicy.Do(ctx, "jxpay", OpDoOutPay, func(ctx context.Context) error {
+		data, err = c.do(ctx, OpDoOutPay, r.TenantID, apiDoOutPay, req, p.IdempotencyKey)
+		return err
+	})
+	return data, err
+}
+
+// do 提交到支付平台并解析统一返回, 以 op 为接口名记录埋点
+func (c *PayClient) do(ctx context.Context, op string, tenantID int, api string, data []byte, idempotencyKey string) (interface{}, error) {
+	var res interface{}
+	call := &Call{Provider: "jxpay", Method: op, Tenant: strconv.Itoa(tenantID)}
+	err := Observe(ctx, c.Instrument, call, func(ctx context.Context) error {
+		body, err := c.post(ctx, api, data, idempotencyKey)
+		if err != nil {
+			return err
+		}
+		res, err = c.parseCommonResponse(body)
+		return err
+	})
+	return res, err
+}
+
+// parseCommonResponse 解析支付平台返回, 失败时返回 *ProviderError
+func (c *PayClient) parseCommonResponse(body []byte) (interface{}, error) {
 	d := new(CommonResponse)
-	if err = json.Unmarshal(body, d); err != nil {
-		logs.Error(err)
-		return "", err
+	if err := json.Unmarshal(body, d); err != nil {
+		Log(c.Logger, LevelError, "jxpay: unmarshal response", F("err", err), F("body", body))
+		return nil, err
 	}
 	if d.State == "failed" {
-		return d.Message, errors.New(d.Message)
+		return nil, &ProviderError{Provider: "jxpay", Code: d.State, Message: d.Message, Raw: body}
 	}
 	return d.Data, nil
 }
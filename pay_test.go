@@ -0,0 +1,172 @@
+package pay
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPayClientBaseURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != apiDoPay {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"State":"success","Data":"ok"}`))
+	}))
+	defer srv.Close()
+
+	c := NewPayClient(srv.URL)
+	data, err := c.DoPay(context.Background(), &DoPayRequest{Money: CNY(100)})
+	if err != nil || data != "ok" {
+		t.Fatalf("unexpected result %v %v", data, err)
+	}
+}
+
+func TestDoPayFailed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"State":"failed","Message":"余额不足"}`))
+	}))
+	defer srv.Close()
+
+	data, err := NewPayClient(srv.URL).DoPay(context.Background(), &DoPayRequest{Money: CNY(100)})
+	var pe *ProviderError
+	if data != nil || !errors.As(err, &pe) || pe.Message != "余额不足" {
+		t.Fatalf("unexpected result %v %v", data, err)
+	}
+}
+
+func TestDoPayIdempotencyKey(t *testing.T) {
+	var header, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Idempotency-Key")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.Write([]byte(`{"State":"success","Data":"ok"}`))
+	}))
+	defer srv.Close()
+
+	c := NewPayClient(srv.URL)
+	req := &DoPayRequest{ServiceID: 1, TenantID: 2, OrderID: 3, CashReasonID: 4, CashChannelID: CashChannelWxCodePay, Money: CNY(100)}
+	if _, err := c.DoPay(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	want := "api/pay/doPay:1:2:3:4:" + strconv.Itoa(CashChannelWxCodePay) + ":1.00"
+	if header != want || !strings.Contains(body, `"idempotencyKey":"`+want+`"`) {
+		t.Fatalf("unexpected key header %q body %s", header, body)
+	}
+	if req.IdempotencyKey != "" {
+		t.Fatalf("request mutated: %q", req.IdempotencyKey)
+	}
+
+	req.IdempotencyKey = "custom"
+	if _, err := c.DoPay(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if header != "custom" {
+		t.Fatalf("unexpected key header %q", header)
+	}
+}
+
+func TestDoPayIdempotencyKeyChannelChange(t *testing.T) {
+	var headers []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get("Idempotency-Key"))
+		w.Write([]byte(`{"State":"success","Data":"ok"}`))
+	}))
+	defer srv.Close()
+
+	// 用户先选微信扫码未支付, 改用支付宝扫码后重新提交同一订单
+	c := NewPayClient(srv.URL)
+	req := &DoPayRequest{ServiceID: 1, TenantID: 2, OrderID: 3, CashReasonID: 4, CashChannelID: CashChannelWxCodePay, Money: CNY(100)}
+	if _, err := c.DoPay(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	req.CashChannelID = CashChannelAliCodePay
+	if _, err := c.DoPay(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	req.Money = CNY(80)
+	if _, err := c.DoPay(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 3 || headers[0] == headers[1] || headers[1] == headers[2] {
+		t.Fatalf("channel or amount change reused key: %q", headers)
+	}
+}
+
+func TestDoOutPayIdempotencyKey(t *testing.T) {
+	var header string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("Idempotency-Key")
+		w.Write([]byte(`{"State":"success","Data":"ok"}`))
+	}))
+	defer srv.Close()
+
+	req := &DoOutPayRequest{ServiceID: 1, TenantID: 2, OrderID: 3, CashReasonID: 4, CashChannelID: CashChannelAliAppPay, OutPayLists: []OutPayList{
+		{PayMoney: CNY(100), TradeNumber: "T1", RefundMoney: CNY(30)},
+		{PayMoney: CNY(200), TradeNumber: "T2", RefundMoney: CNY(50)},
+	}}
+	if _, err := NewPayClient(srv.URL).DoOutPay(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if want := "api/pay/doOutPay:1:2:3:4:" + strconv.Itoa(CashChannelAliAppPay) + ":0.80"; header != want {
+		t.Fatalf("key %q, want %q", header, want)
+	}
+}
+
+func TestDoPayInFlightDuplicate(t *testing.T) {
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-unblock
+		w.Write([]byte(`{"State":"success","Data":"ok"}`))
+	}))
+	defer srv.Close()
+
+	c := NewPayClient(srv.URL)
+	req := &DoPayRequest{ServiceID: 1, TenantID: 2, OrderID: 3, CashReasonID: 4, Money: CNY(100)}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.DoPay(context.Background(), req)
+		done <- err
+	}()
+	<-entered
+
+	if _, err := c.DoPay(context.Background(), req); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("expected ErrDuplicate, got %v", err)
+	}
+	// 出账与支付互不影响
+	out := &DoOutPayRequest{ServiceID: 1, TenantID: 2, OrderID: 3, CashReasonID: 4}
+	if _, err := c.DoOutPay(context.Background(), out); errors.Is(err, ErrDuplicate) {
+		t.Fatalf("outpay blocked by pay: %v", err)
+	}
+
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.inflight.Load(inflightKey{api: apiDoPay, serviceID: 1, tenantID: 2, orderID: 3, cashReasonID: 4}); ok {
+		t.Fatal("in-flight key not released")
+	}
+}
+
+func TestDoOutPayConflict(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("duplicate"))
+	}))
+	defer srv.Close()
+
+	_, err := NewPayClient(srv.URL).DoOutPay(context.Background(), &DoOutPayRequest{OrderID: 1})
+	var pe *ProviderError
+	if !errors.Is(err, ErrDuplicate) || !errors.As(err, &pe) || pe.Code != "409" {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
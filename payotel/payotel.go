@@ -0,0 +1,62 @@
+// Package payotel 为三方网关与支付平台调用创建 OpenTelemetry span
+//
+//	pay.DefaultInstrument = payotel.NewTracer(nil)
+package payotel
+
+import (
+	"context"
+
+	"github.com/jxwt/pay"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName 上报的 instrumentation 名称
+const instrumentationName = "github.com/jxwt/pay/payotel"
+
+// span 属性
+const (
+	AttrProvider = attribute.Key("pay.provider")
+	AttrMethod   = attribute.Key("pay.method")
+	AttrTenant   = attribute.Key("pay.tenant")
+	AttrCode     = attribute.Key("pay.result_code")
+)
+
+// Tracer 实现 pay.Instrument, 每次调用创建一个 client span
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer 创建埋点, tp 为空时使用 otel.GetTracerProvider()
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Tracer{tracer: tp.Tracer(instrumentationName)}
+}
+
+// Start 实现 pay.Instrument, span 名为 "provider method"
+func (t *Tracer) Start(ctx context.Context, call *pay.Call) context.Context {
+	ctx, _ = t.tracer.Start(ctx, call.Provider+" "+call.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(call.Start),
+		trace.WithAttributes(
+			AttrProvider.String(call.Provider),
+			AttrMethod.String(call.Method),
+			AttrTenant.String(call.Tenant),
+		),
+	)
+	return ctx
+}
+
+// End 实现 pay.Instrument, 失败时 span 状态为 Error, 描述已脱敏
+func (t *Tracer) End(ctx context.Context, call *pay.Call) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(AttrCode.String(call.Code))
+	if call.Err != nil {
+		span.SetStatus(codes.Error, pay.RedactText(call.Err.Error()))
+	}
+	span.End(trace.WithTimestamp(call.Start.Add(call.Duration)))
+}
@@ -0,0 +1,57 @@
+package payotel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jxwt/pay"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracer(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tr := NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+
+	ctx := context.Background()
+	call := &pay.Call{Provider: "wxpay", Method: "/pay/micropay", Tenant: "1900000109"}
+	err := pay.Observe(ctx, tr, call, func(ctx context.Context) error {
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			t.Fatal("span not in ctx")
+		}
+		return &pay.ProviderError{Provider: "wxpay", Code: "FAIL", SubCode: "AUTH_CODE_INVALID", Message: "auth_code=134567890123456789"}
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	pay.Observe(ctx, tr, &pay.Call{Provider: "alipay", Method: "alipay.trade.query"}, func(ctx context.Context) error {
+		return nil
+	})
+
+	spans := sr.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("spans %d", len(spans))
+	}
+	s := spans[0]
+	if s.Name() != "wxpay /pay/micropay" || s.SpanKind() != trace.SpanKindClient {
+		t.Fatalf("unexpected span %s %v", s.Name(), s.SpanKind())
+	}
+	attrs := map[string]string{}
+	for _, kv := range s.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.AsString()
+	}
+	if attrs["pay.provider"] != "wxpay" || attrs["pay.tenant"] != "1900000109" || attrs["pay.result_code"] != "AUTH_CODE_INVALID" {
+		t.Fatalf("unexpected attributes %v", attrs)
+	}
+	if s.Status().Code != codes.Error || s.Status().Description != "wxpay: FAIL AUTH_CODE_INVALID auth_code=***6789" {
+		t.Fatalf("unexpected status %+v", s.Status())
+	}
+	if !s.EndTime().Equal(call.Start.Add(call.Duration)) {
+		t.Fatalf("unexpected end time %v", s.EndTime())
+	}
+	if spans[1].Status().Code != codes.Unset {
+		t.Fatalf("unexpected status %+v", spans[1].Status())
+	}
+}
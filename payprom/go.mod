@@ -0,0 +1,10 @@
+module github.com/jxwt/pay/payprom
+
+go 1.14
+
+require (
+	github.com/jxwt/pay v0.0.0
+	github.com/prometheus/client_golang v1.11.1
+)
+
+replace github.com/jxwt/pay => ../
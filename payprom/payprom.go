@@ -0,0 +1,107 @@
+// Package payprom 以 Prometheus 指标上报三方网关与支付平台调用
+//
+//	c := payprom.NewCollector(payprom.Opts{})
+//	prometheus.MustRegister(c)
+//	pay.DefaultInstrument = c
+package payprom
+
+import (
+	"context"
+	"expvar"
+	"strings"
+
+	"github.com/jxwt/pay"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Opts 指标配置
+type Opts struct {
+	Namespace     string    // 指标前缀, 为空时为 pay
+	Buckets       []float64 // 耗时直方图分桶(秒), 为空时使用 prometheus.DefBuckets
+	NoTenantLabel bool      // 调用次数不按商户区分, 商户较多时避免标签过多
+}
+
+// Collector 实现 pay.Instrument 与 prometheus.Collector
+//
+// 指标:
+//
+//	pay_calls_total{provider, method, tenant, code}    调用次数
+//	pay_call_duration_seconds{provider, method}        调用耗时
+//	pay_retries_total{provider, operation}             重试次数, 取自 pay.RetryStats
+type Collector struct {
+	calls    *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	retries  *prometheus.Desc
+	tenant   bool
+}
+
+// NewCollector 创建指标采集器, 需注册到 prometheus.Registerer
+func NewCollector(opts Opts) *Collector {
+	ns := opts.Namespace
+	if ns == "" {
+		ns = "pay"
+	}
+	buckets := opts.Buckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	labels := []string{"provider", "method", "code"}
+	if !opts.NoTenantLabel {
+		labels = []string{"provider", "method", "tenant", "code"}
+	}
+	return &Collector{
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Name:      "calls_total",
+			Help:      "Number of payment gateway calls by result code.",
+		}, labels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Name:      "call_duration_seconds",
+			Help:      "Payment gateway call latency in seconds.",
+			Buckets:   buckets,
+		}, []string{"provider", "method"}),
+		retries: prometheus.NewDesc(prometheus.BuildFQName(ns, "", "retries_total"),
+			"Number of retried payment gateway calls.", []string{"provider", "operation"}, nil),
+		tenant: !opts.NoTenantLabel,
+	}
+}
+
+// Start 实现 pay.Instrument
+func (c *Collector) Start(ctx context.Context, call *pay.Call) context.Context {
+	return ctx
+}
+
+// End 实现 pay.Instrument
+func (c *Collector) End(ctx context.Context, call *pay.Call) {
+	if c.tenant {
+		c.calls.WithLabelValues(call.Provider, call.Method, call.Tenant, call.Code).Inc()
+	} else {
+		c.calls.WithLabelValues(call.Provider, call.Method, call.Code).Inc()
+	}
+	c.duration.WithLabelValues(call.Provider, call.Method).Observe(call.Duration.Seconds())
+}
+
+// Describe 实现 prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.calls.Describe(ch)
+	c.duration.Describe(ch)
+	ch <- c.retries
+}
+
+// Collect 实现 prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.calls.Collect(ch)
+	c.duration.Collect(ch)
+	pay.RetryStats.Do(func(kv expvar.KeyValue) {
+		n, ok := kv.Value.(*expvar.Int)
+		if !ok {
+			return
+		}
+		provider, op := kv.Key, ""
+		if i := strings.IndexByte(kv.Key, '.'); i >= 0 {
+			provider, op = kv.Key[:i], kv.Key[i+1:]
+		}
+		ch <- prometheus.MustNewConstMetric(c.retries, prometheus.CounterValue, float64(n.Value()), provider, op)
+	})
+}
@@ -0,0 +1,57 @@
+package payprom
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jxwt/pay"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector(Opts{})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+
+	ctx := context.Background()
+	pay.Observe(ctx, c, &pay.Call{Provider: "wxpay", Method: "/pay/orderquery", Tenant: "1900000109"}, func(ctx context.Context) error {
+		return nil
+	})
+	pay.Observe(ctx, c, &pay.Call{Provider: "wxpay", Method: "/pay/orderquery", Tenant: "1900000109"}, func(ctx context.Context) error {
+		return &pay.ProviderError{Provider: "wxpay", Code: "FAIL", SubCode: "SYSTEMERROR", Retryable: true}
+	})
+	pay.Observe(ctx, c, &pay.Call{Provider: "alipay", Method: "alipay.trade.query", Tenant: "2016"}, func(ctx context.Context) error {
+		return errors.New("xml.Unmarshal: EOF")
+	})
+	pay.RetryStats.Add("payprom.QueryOrder", 2)
+
+	expected := `
+# HELP pay_calls_total Number of payment gateway calls by result code.
+# TYPE pay_calls_total counter
+pay_calls_total{code="ERROR",method="alipay.trade.query",provider="alipay",tenant="2016"} 1
+pay_calls_total{code="SUCCESS",method="/pay/orderquery",provider="wxpay",tenant="1900000109"} 1
+pay_calls_total{code="SYSTEMERROR",method="/pay/orderquery",provider="wxpay",tenant="1900000109"} 1
+# HELP pay_retries_total Number of retried payment gateway calls.
+# TYPE pay_retries_total counter
+pay_retries_total{operation="QueryOrder",provider="payprom"} 2
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "pay_calls_total", "pay_retries_total"); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(c.duration); n != 2 {
+		t.Fatalf("duration series %d", n)
+	}
+}
+
+func TestCollectorNoTenantLabel(t *testing.T) {
+	c := NewCollector(Opts{Namespace: "shop", NoTenantLabel: true})
+	pay.Observe(context.Background(), c, &pay.Call{Provider: "jxpay", Method: pay.OpDoPay, Tenant: "7"}, func(ctx context.Context) error {
+		return nil
+	})
+	if v := testutil.ToFloat64(c.calls.WithLabelValues("jxpay", pay.OpDoPay, pay.CodeSuccess)); v != 1 {
+		t.Fatalf("calls %v", v)
+	}
+}
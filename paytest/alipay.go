@@ -0,0 +1,567 @@
+package paytest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// 支付宝网关返回码
+const (
+	alipayCodeSuccess = "10000"
+	alipayCodeWaiting = "10003"
+	alipayCodeFailed  = "40004"
+	alipayCodeBusy    = "20000"
+)
+
+// AlipayServer 模拟支付宝开放平台网关 gateway.do
+// 客户端将 GatewayURL 设为 GatewayURL()、HTTPClient 设为 Client() 即可接入
+type AlipayServer struct {
+	*httptest.Server
+	*store
+
+	AppID    string // 测试应用ID
+	SellerID string // 测试卖家支付宝用户ID
+
+	AppPrivateKey   string // 应用私钥, 不带PEM头尾的PKCS8 base64, 可直接传给 alipay.Init
+	AlipayPublicKey string // 支付宝公钥, 不带PEM头尾的PKIX base64
+
+	t         testing.TB
+	appKey    *rsa.PublicKey  // 校验商户请求签名
+	alipayKey *rsa.PrivateKey // 对应答与通知签名
+}
+
+// NewAlipayServer 启动支付宝模拟网关, 测试结束时自动关闭
+func NewAlipayServer(t testing.TB) *AlipayServer {
+	app := rsaKey(t)
+	alipay := rsaKey(t)
+	s := &AlipayServer{
+		store:     newStore(),
+		AppID:     "2016091200494382",
+		SellerID:  "2088102177846880",
+		t:         t,
+		appKey:    &app.PublicKey,
+		alipayKey: alipay,
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AppPrivateKey = base64Key(der)
+	der, err = x509.MarshalPKIXPublicKey(&alipay.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AlipayPublicKey = base64Key(der)
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// GatewayURL 网关地址
+func (s *AlipayServer) GatewayURL() string {
+	return s.URL + "/gateway.do"
+}
+
+// serveHTTP 校验 app_id 与请求签名后按 method 分发, 应答节点使用请求的 sign_type 签名
+func (s *AlipayServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/bill/download" {
+		s.serveBill(w, r)
+		return
+	}
+	if r.URL.Path != "/gateway.do" {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := make(map[string]string)
+	for k, v := range r.Form {
+		req[k] = v[0]
+	}
+	method := req["method"]
+	var res map[string]interface{}
+	switch {
+	case req["app_id"] != s.AppID:
+		res = alipayError("40002", "isv.invalid-app-id")
+	case s.verify(req) != nil:
+		res = alipayError("40002", "isv.invalid-signature")
+	default:
+		biz, err := bizContent(req["biz_content"])
+		if err != nil {
+			res = alipayError("40002", "isv.invalid-parameter")
+			break
+		}
+		code := s.fault(method)
+		if code != "" && !(code == StateUserPaying && method == "alipay.trade.pay") {
+			res = alipayFault(code)
+			break
+		}
+		if method == "alipay.trade.wap.pay" || method == "alipay.trade.page.pay" {
+			s.cashier(w, method, req, biz)
+			return
+		}
+		res = s.dispatch(method, req, biz, code == StateUserPaying)
+	}
+	if _, ok := res["code"]; !ok {
+		res["code"] = alipayCodeSuccess
+		res["msg"] = "Success"
+	}
+	s.writeResponse(w, method, req["sign_type"], res)
+}
+
+func (s *AlipayServer) dispatch(method string, req, biz map[string]string, userPaying bool) map[string]interface{} {
+	switch method {
+	case "alipay.trade.create", "alipay.trade.precreate":
+		return s.create(method, req, biz)
+	case "alipay.trade.pay":
+		return s.tradePay(biz, userPaying)
+	case "alipay.trade.query":
+		return s.query(biz)
+	case "alipay.trade.refund":
+		return s.refundTrade(biz)
+	case "alipay.trade.fastpay.refund.query":
+		return s.refundQuery(biz)
+	case "alipay.trade.cancel":
+		return s.cancel(biz)
+	case "alipay.trade.close":
+		return s.closeTrade(biz)
+	case "alipay.fund.trans.toaccount.transfer":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return map[string]interface{}{
+			"out_biz_no": biz["out_biz_no"],
+			"order_id":   s.nextID("2019"),
+			"pay_date":   time.Now().Format("2006-01-02 15:04:05"),
+		}
+	case "alipay.system.oauth.token":
+		return map[string]interface{}{
+			"user_id":       "2088102104794936",
+			"access_token":  "authbseB" + req["code"],
+			"expires_in":    3600,
+			"refresh_token": "authbseR" + req["code"],
+			"re_expires_in": 3600,
+		}
+	case "alipay.user.info.share":
+		return map[string]interface{}{
+			"user_id":   "2088102104794936",
+			"nick_name": "沙箱用户",
+			"avatar":    "https://tfs.alipayobjects.com/images/partner/T1.png",
+		}
+	case "alipay.trade.royalty.relation.bind":
+		return map[string]interface{}{"result_code": "SUCCESS"}
+	case "alipay.data.dataservice.bill.downloadurl.query":
+		return s.billURL(biz)
+	}
+	return alipayError("40004", "isv.invalid-method")
+}
+
+// verify 校验商户请求签名, 待签名串为除 sign 外的非空参数
+func (s *AlipayServer) verify(req map[string]string) error {
+	sig, err := base64.StdEncoding.DecodeString(req["sign"])
+	if err != nil {
+		return err
+	}
+	hash, digest, err := alipayDigest(req["sign_type"], alipayContent(req, "sign"))
+	if err != nil {
+		return err
+	}
+	return rsa.VerifyPKCS1v15(s.appKey, hash, digest, sig)
+}
+
+// sign 使用支付宝私钥签名
+func (s *AlipayServer) sign(signType, content string) string {
+	hash, digest, err := alipayDigest(signType, content)
+	if err != nil {
+		// 请求的 sign_type 有误时仍按RSA2签名, 由客户端验签失败
+		hash, digest, _ = alipayDigest("RSA2", content)
+	}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.alipayKey, hash, digest)
+	if err != nil {
+		s.t.Error(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// writeResponse 输出 {"xxx_response":{...},"sign":"..."}, 对应答节点的原始JSON签名
+func (s *AlipayServer) writeResponse(w http.ResponseWriter, method, signType string, res map[string]interface{}) {
+	node, _ := json.Marshal(res)
+	key, _ := json.Marshal(strings.Replace(method, ".", "_", -1) + "_response")
+	sign, _ := json.Marshal(s.sign(signType, string(node)))
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	fmt.Fprintf(w, `{%s:%s,"sign":%s}`, key, node, sign)
+}
+
+func (s *AlipayServer) create(method string, req, biz map[string]string) map[string]interface{} {
+	amount, err := yuanToFen(biz["total_amount"])
+	if err != nil || biz["out_trade_no"] == "" {
+		return alipayError(alipayCodeFailed, "ACQ.INVALID_PARAMETER")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[biz["out_trade_no"]]
+	if ok && o.State != StateNotPay {
+		return alipayError(alipayCodeFailed, "ACQ.TRADE_HAS_SUCCESS")
+	}
+	if !ok {
+		o = &Order{TradeNo: biz["out_trade_no"], TransactionID: s.nextID("2021"), Amount: amount, State: StateNotPay,
+			TradeType: method, Subject: biz["subject"], OpenID: biz["buyer_id"], NotifyURL: req["notify_url"],
+			Unscanned: method == "alipay.trade.precreate"}
+		s.orders[o.TradeNo] = o
+	}
+	res := map[string]interface{}{"out_trade_no": o.TradeNo, "trade_no": o.TransactionID}
+	if method == "alipay.trade.precreate" {
+		res["qr_code"] = "https://qr.alipay.com/bax" + o.TransactionID
+	}
+	return res
+}
+
+// cashier 手机网站、电脑网站支付由浏览器提交到网关, 下单后返回收银台页面
+func (s *AlipayServer) cashier(w http.ResponseWriter, method string, req, biz map[string]string) {
+	res := s.create(method, req, biz)
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	if _, failed := res["code"]; failed {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "<html><body>%s</body></html>", res["sub_code"])
+		return
+	}
+	fmt.Fprintf(w, "<html><body>收银台 %s</body></html>", res["out_trade_no"])
+}
+
+func (s *AlipayServer) tradePay(biz map[string]string, userPaying bool) map[string]interface{} {
+	amount, err := yuanToFen(biz["total_amount"])
+	if err != nil || biz["auth_code"] == "" {
+		return alipayError(alipayCodeFailed, "ACQ.INVALID_PARAMETER")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o, ok := s.orders[biz["out_trade_no"]]; ok && o.State != StateNotPay {
+		return alipayError(alipayCodeFailed, "ACQ.TRADE_HAS_SUCCESS")
+	}
+	o := &Order{TradeNo: biz["out_trade_no"], TransactionID: s.nextID("2021"), Amount: amount, State: StateNotPay,
+		TradeType: "alipay.trade.pay", Subject: biz["subject"]}
+	s.orders[o.TradeNo] = o
+	if userPaying {
+		o.State = StateUserPaying
+		res := alipayTrade(o)
+		res["code"] = alipayCodeWaiting
+		res["msg"] = "order success pay inprocess"
+		return res
+	}
+	s.paid(o)
+	return alipayTrade(o)
+}
+
+func (s *AlipayServer) query(biz map[string]string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.findOrder(biz["out_trade_no"], biz["trade_no"])
+	if o == nil {
+		return alipayError(alipayCodeFailed, "ACQ.TRADE_NOT_EXIST")
+	}
+	res := alipayTrade(o)
+	res["trade_status"] = tradeStatus(o)
+	return res
+}
+
+func (s *AlipayServer) refundTrade(biz map[string]string) map[string]interface{} {
+	amount, err := yuanToFen(biz["refund_amount"])
+	if err != nil {
+		return alipayError(alipayCodeFailed, "ACQ.INVALID_PARAMETER")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.findOrder(biz["out_trade_no"], biz["trade_no"])
+	if o == nil {
+		return alipayError(alipayCodeFailed, "ACQ.TRADE_NOT_EXIST")
+	}
+	// 未传 out_request_no 时按 out_trade_no 处理, 与支付宝一致
+	refundNo := biz["out_request_no"]
+	if refundNo == "" {
+		refundNo = o.TradeNo
+	}
+	_, repeated := s.refunds[refundNo]
+	_, o, err = s.refund(o.TradeNo, refundNo, amount)
+	switch err {
+	case errTradeState:
+		return alipayError(alipayCodeFailed, "ACQ.TRADE_STATUS_ERROR")
+	case errRefundAmount:
+		return alipayError(alipayCodeFailed, "ACQ.REFUND_AMT_NOT_EQUAL_TOTAL")
+	}
+	fundChange := "Y"
+	if repeated {
+		fundChange = "N"
+	}
+	return map[string]interface{}{
+		"trade_no":       o.TransactionID,
+		"out_trade_no":   o.TradeNo,
+		"buyer_logon_id": "159****5620",
+		"buyer_user_id":  o.OpenID,
+		"fund_change":    fundChange,
+		"refund_fee":     fenToYuan(o.Refunded),
+		"gmt_refund_pay": time.Now().Format("2006-01-02 15:04:05"),
+	}
+}
+
+// refundQuery 退款单不存在时返回成功但不带退款字段, 与支付宝一致
+func (s *AlipayServer) refundQuery(biz map[string]string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.findOrder(biz["out_trade_no"], biz["trade_no"])
+	if o == nil {
+		return alipayError(alipayCodeFailed, "ACQ.TRADE_NOT_EXIST")
+	}
+	res := map[string]interface{}{"trade_no": o.TransactionID, "out_trade_no": o.TradeNo}
+	r, ok := s.refunds[biz["out_request_no"]]
+	if !ok || r.TradeNo != o.TradeNo {
+		return res
+	}
+	res["out_request_no"] = r.RefundNo
+	res["total_amount"] = fenToYuan(o.Amount)
+	res["refund_amount"] = fenToYuan(r.Amount)
+	// 支付宝只返回退款成功状态, 处理中时不返回 refund_status
+	if r.State == StateSuccess {
+		res["refund_status"] = "REFUND_SUCCESS"
+	}
+	res["gmt_refund_pay"] = time.Now().Format("2006-01-02 15:04:05")
+	return res
+}
+
+// cancel 已支付订单全额退款, 未支付订单关闭
+func (s *AlipayServer) cancel(biz map[string]string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.findOrder(biz["out_trade_no"], biz["trade_no"])
+	if o == nil {
+		return alipayError(alipayCodeFailed, "ACQ.TRADE_NOT_EXIST")
+	}
+	action := "close"
+	if o.State == StateSuccess && o.Refunded == 0 {
+		action = "refund"
+		s.refunds[o.TradeNo+"-cancel"] = &Refund{TradeNo: o.TradeNo, RefundNo: o.TradeNo + "-cancel", RefundID: s.nextID("50"), Amount: o.Amount, State: StateSuccess}
+		o.Refunded = o.Amount
+	}
+	o.State = StateRevoked
+	return map[string]interface{}{"trade_no": o.TransactionID, "out_trade_no": o.TradeNo, "retry_flag": "N", "action": action}
+}
+
+func (s *AlipayServer) closeTrade(biz map[string]string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.findOrder(biz["out_trade_no"], biz["trade_no"])
+	// 扫码下单后用户未扫码时交易尚未创建, 与支付宝一致无法关闭, 需撤销
+	if o == nil || o.Unscanned {
+		return alipayError(alipayCodeFailed, "ACQ.TRADE_NOT_EXIST")
+	}
+	// 已关闭与已支付的交易均返回交易状态不合法, 与支付宝一致
+	if o.State != StateNotPay && o.State != StateUserPaying {
+		return alipayError(alipayCodeFailed, "ACQ.TRADE_STATUS_ERROR")
+	}
+	o.State = StateClosed
+	return map[string]interface{}{"trade_no": o.TransactionID, "out_trade_no": o.TradeNo}
+}
+
+// alipayTrade 下单、支付与查询共用的交易字段
+func alipayTrade(o *Order) map[string]interface{} {
+	res := map[string]interface{}{
+		"trade_no":     o.TransactionID,
+		"out_trade_no": o.TradeNo,
+		"total_amount": fenToYuan(o.Amount),
+	}
+	if !o.PaidAt.IsZero() {
+		res["buyer_logon_id"] = "159****5620"
+		res["buyer_user_id"] = o.OpenID
+		res["receipt_amount"] = fenToYuan(o.Amount)
+		res["buyer_pay_amount"] = fenToYuan(o.Amount)
+		res["invoice_amount"] = fenToYuan(o.Amount)
+		res["gmt_payment"] = o.PaidAt.Format("2006-01-02 15:04:05")
+		res["send_pay_date"] = o.PaidAt.Format("2006-01-02 15:04:05")
+	}
+	return res
+}
+
+// tradeStatus 订单状态转换为支付宝 trade_status, 全额退款后交易关闭
+func tradeStatus(o *Order) string {
+	switch o.State {
+	case StateSuccess:
+		return "TRADE_SUCCESS"
+	case StateRefund:
+		if o.Refunded < o.Amount {
+			return "TRADE_SUCCESS"
+		}
+		return "TRADE_CLOSED"
+	case StateClosed, StateRevoked:
+		return "TRADE_CLOSED"
+	}
+	return "WAIT_BUYER_PAY"
+}
+
+// alipayError 业务失败应答
+func alipayError(code, subCode string) map[string]interface{} {
+	msg := "Business Failed"
+	if code == "40002" {
+		msg = "Invalid Arguments"
+	}
+	return map[string]interface{}{"code": code, "msg": msg, "sub_code": subCode, "sub_msg": subCode}
+}
+
+// alipayFault FailNext 注入的错误, isp.* 按服务不可用返回
+func alipayFault(subCode string) map[string]interface{} {
+	if strings.HasPrefix(subCode, "isp.") {
+		res := alipayError(alipayCodeBusy, subCode)
+		res["msg"] = "Service Currently Unavailable"
+		return res
+	}
+	return alipayError(alipayCodeFailed, subCode)
+}
+
+// NotifyForm 订单当前状态对应的已签名(RSA2)异步通知参数
+func (s *AlipayServer) NotifyForm(tradeNo string) (url.Values, error) {
+	s.mu.Lock()
+	o, ok := s.orders[tradeNo]
+	if !ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("paytest: order %s not found", tradeNo)
+	}
+	m := map[string]string{
+		"app_id":         s.AppID,
+		"seller_id":      s.SellerID,
+		"charset":        "utf-8",
+		"version":        "1.0",
+		"sign_type":      "RSA2",
+		"notify_type":    "trade_status_sync",
+		"notify_id":      s.nextID("ac05"),
+		"notify_time":    time.Now().Format("2006-01-02 15:04:05"),
+		"out_trade_no":   o.TradeNo,
+		"trade_no":       o.TransactionID,
+		"trade_status":   tradeStatus(o),
+		"subject":        o.Subject,
+		"total_amount":   fenToYuan(o.Amount),
+		"buyer_id":       o.OpenID,
+		"gmt_create":     o.PaidAt.Format("2006-01-02 15:04:05"),
+		"gmt_payment":    o.PaidAt.Format("2006-01-02 15:04:05"),
+		"receipt_amount": fenToYuan(o.Amount),
+	}
+	if o.Refunded > 0 {
+		m["refund_fee"] = fenToYuan(o.Refunded)
+	}
+	s.mu.Unlock()
+	m["sign"] = s.sign("RSA2", alipayContent(m, "sign", "sign_type"))
+	form := url.Values{}
+	for k, v := range m {
+		form.Set(k, v)
+	}
+	return form, nil
+}
+
+// Notify 向回调地址推送异步通知, url 为空时使用下单时的 notify_url, 返回回调应答
+func (s *AlipayServer) Notify(url, tradeNo string) (string, error) {
+	form, err := s.NotifyForm(tradeNo)
+	if err != nil {
+		return "", err
+	}
+	if url == "" {
+		o, _ := s.Order(tradeNo)
+		url = o.NotifyURL
+	}
+	return post(url, "application/x-www-form-urlencoded", []byte(form.Encode()), nil)
+}
+
+// alipayContent 待签名串, 非空参数(排除 exclude)按key排序后以&连接
+func alipayContent(m map[string]string, exclude ...string) string {
+	var data []string
+	for k, v := range m {
+		skip := v == ""
+		for _, e := range exclude {
+			skip = skip || k == e
+		}
+		if !skip {
+			data = append(data, k+"="+v)
+		}
+	}
+	sort.Strings(data)
+	return strings.Join(data, "&")
+}
+
+// alipayDigest RSA 使用SHA1, RSA2 使用SHA256
+func alipayDigest(signType, content string) (crypto.Hash, []byte, error) {
+	switch signType {
+	case "RSA2":
+		h := sha256.Sum256([]byte(content))
+		return crypto.SHA256, h[:], nil
+	case "RSA":
+		h := sha1.Sum([]byte(content))
+		return crypto.SHA1, h[:], nil
+	}
+	return 0, nil, fmt.Errorf("unknown sign_type %q", signType)
+}
+
+// bizContent 解析 biz_content, 兼容客户端以GB18030编码提交的内容
+func bizContent(raw string) (map[string]string, error) {
+	res := make(map[string]string)
+	if raw == "" {
+		return res, nil
+	}
+	if !utf8.ValidString(raw) {
+		decoded, err := simplifiedchinese.GB18030.NewDecoder().String(raw)
+		if err != nil {
+			return nil, err
+		}
+		raw = decoded
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &m); err != nil {
+		return nil, err
+	}
+	for k, v := range m {
+		switch v := v.(type) {
+		case string:
+			res[k] = v
+		case float64:
+			res[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		case nil:
+		default:
+			b, _ := json.Marshal(v)
+			res[k] = string(b)
+		}
+	}
+	return res, nil
+}
+
+// yuanToFen 元转分
+func yuanToFen(yuan string) (int64, error) {
+	f, err := strconv.ParseFloat(yuan, 64)
+	if err != nil {
+		return 0, err
+	}
+	if f <= 0 {
+		return 0, errors.New("amount must be positive")
+	}
+	return int64(math.Round(f * 100)), nil
+}
+
+// fenToYuan 分转元, 保留两位小数
+func fenToYuan(fen int64) string {
+	return fmt.Sprintf("%d.%02d", fen/100, fen%100)
+}
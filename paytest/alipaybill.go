@@ -0,0 +1,178 @@
+package paytest
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// alipayFeeRate 模拟账单中的服务费率(千分比), 服务费四舍五入到分, 交易为负数, 退款退还服务费为正数
+const alipayFeeRate = 6
+
+// alipayLocation 账单时间为北京时间
+var alipayLocation = time.FixedZone("CST", 8*3600)
+
+// alipayBillHeader 业务明细表头
+var alipayBillHeader = []string{
+	"支付宝交易号", "商户订单号", "业务类型", "商品名称", "创建时间", "完成时间",
+	"门店编号", "门店名称", "操作员", "终端号", "对方账户",
+	"订单金额（元）", "商家实收（元）", "支付宝红包（元）", "集分宝（元）", "支付宝优惠（元）", "商家优惠（元）",
+	"券核销金额（元）", "券名称", "商家红包消费金额（元）", "卡消费金额（元）",
+	"退款批次号/请求号", "服务费（元）", "分润（元）", "备注",
+}
+
+// billURL 查询对账单下载地址, 仅支持业务账单; 模拟网关当日账单即可下载, 晚于今日的账单不存在
+func (s *AlipayServer) billURL(biz map[string]string) map[string]interface{} {
+	if biz["bill_type"] != "trade" {
+		return alipayError(alipayCodeFailed, "isv.invalid-bill-type")
+	}
+	date := biz["bill_date"]
+	if _, err := billPeriod(date); err != nil {
+		return alipayError(alipayCodeFailed, "isv.invalid-bill-date")
+	}
+	if date > time.Now().In(alipayLocation).Format("2006-01-02")[:len(date)] {
+		return alipayError(alipayCodeFailed, "isp.bill_not_exist")
+	}
+	return map[string]interface{}{"bill_download_url": s.URL + "/bill/download?" + url.Values{"bill_date": {date}}.Encode()}
+}
+
+// billPeriod 日账单 2006-01-02, 月账单 2006-01
+func billPeriod(date string) (time.Time, error) {
+	if len(date) == len("2006-01") {
+		return time.ParseInLocation("2006-01", date, alipayLocation)
+	}
+	return time.ParseInLocation("2006-01-02", date, alipayLocation)
+}
+
+// serveBill 下载账单压缩包, 内含 GBK 编码的业务明细与汇总, 文件名同样为 GBK 编码
+func (s *AlipayServer) serveBill(w http.ResponseWriter, r *http.Request) {
+	date := r.URL.Query().Get("bill_date")
+	if _, err := billPeriod(date); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	detail, summary := s.billCSV(date)
+	prefix := s.SellerID + "0156_" + strings.Replace(date, "-", "", -1)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct{ name, content string }{
+		{prefix + "_业务明细.csv", detail},
+		{prefix + "_业务明细(汇总).csv", summary},
+	} {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: gbk(f.name), Method: zip.Deflate})
+		if err == nil {
+			_, err = fw.Write([]byte(gbk(f.content)))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Write(buf.Bytes())
+}
+
+// billCSV 按支付时间与退款时间生成业务明细与汇总, 交易号等长数字后带制表符, 与支付宝一致
+func (s *AlipayServer) billCSV(date string) (string, string) {
+	type row struct {
+		at     time.Time
+		fields []string
+	}
+	var rows []row
+	var trades, refunds int
+	var income, refunded, ordered int64
+	// line 退款明细的订单金额为原订单金额, 商家实收为负数的退款金额, 与支付宝一致
+	line := func(o *Order, typ string, at time.Time, receipt int64, refundNo string) row {
+		abs := receipt
+		if abs < 0 {
+			abs = -abs
+		}
+		fee := (abs*alipayFeeRate + 500) / 1000
+		if receipt > 0 {
+			fee = -fee
+		}
+		ordered += o.Amount
+		at = at.In(alipayLocation)
+		f := make([]string, len(alipayBillHeader))
+		f[0], f[1], f[2], f[3] = o.TransactionID+"\t", o.TradeNo+"\t", typ, o.Subject
+		f[4], f[5] = at.Format("2006-01-02 15:04:05"), at.Format("2006-01-02 15:04:05")
+		f[10] = "159****5620"
+		f[11], f[12] = fenToYuan(o.Amount), signedYuan(receipt)
+		for _, n := range []int{13, 14, 15, 16, 17, 19, 20, 23} {
+			f[n] = "0.00"
+		}
+		f[21] = refundNo
+		f[22] = signedYuan(fee)
+		return row{at: at, fields: f}
+	}
+	s.mu.Lock()
+	for _, o := range s.orders {
+		if o.PaidAt.IsZero() || !strings.HasPrefix(o.PaidAt.In(alipayLocation).Format("2006-01-02"), date) {
+			continue
+		}
+		rows = append(rows, line(o, "交易", o.PaidAt, o.Amount, ""))
+		trades++
+		income += o.Amount
+	}
+	for _, r := range s.refunds {
+		o, ok := s.orders[r.TradeNo]
+		if !ok || !strings.HasPrefix(r.RefundedAt.In(alipayLocation).Format("2006-01-02"), date) {
+			continue
+		}
+		rows = append(rows, line(o, "退款", r.RefundedAt, -r.Amount, r.RefundNo))
+		refunds++
+		refunded += r.Amount
+	}
+	s.mu.Unlock()
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].at.Before(rows[j].at) })
+
+	start, _ := billPeriod(date)
+	end := start.AddDate(0, 0, 1)
+	if len(date) == len("2006-01") {
+		end = start.AddDate(0, 1, 0)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#支付宝业务明细查询\r\n#账号：[%s0156]\r\n", s.SellerID)
+	fmt.Fprintf(&b, "#起始日期：[%s]   终止日期：[%s]\r\n", start.Format("2006年01月02日 15:04:05"), end.Format("2006年01月02日 15:04:05"))
+	b.WriteString("#-----------------------------------------业务明细列表----------------------------------------\r\n")
+	b.WriteString(strings.Join(alipayBillHeader, ",") + "\r\n")
+	for _, r := range rows {
+		b.WriteString(strings.Join(r.fields, ",") + "\r\n")
+	}
+	b.WriteString("#-----------------------------------------业务明细列表结束------------------------------------\r\n")
+	fmt.Fprintf(&b, "#交易合计：%d笔，商家实收共%s元，商家优惠共0.00元\r\n", trades, fenToYuan(income))
+	fmt.Fprintf(&b, "#退款合计：%d笔，商家实收退款共%s元，商家优惠退款共0.00元\r\n", refunds, signedYuan(-refunded))
+	fmt.Fprintf(&b, "#导出时间：[%s]\r\n", time.Now().In(alipayLocation).Format("2006年01月02日 15:04:05"))
+
+	summary := "#支付宝业务汇总查询\r\n门店编号,门店名称,交易订单总笔数,退款订单总笔数,订单金额（元）,商家实收（元）\r\n" +
+		fmt.Sprintf("合计,,%d,%d,%s,%s\r\n", trades, refunds, fenToYuan(ordered), signedYuan(income-refunded))
+	return b.String(), summary
+}
+
+// gbk 转为 GBK 编码, 模拟数据均可编码
+func gbk(s string) string {
+	res, err := simplifiedchinese.GBK.NewEncoder().String(s)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// signedYuan 分转元, 负数带负号
+func signedYuan(fen int64) string {
+	if fen < 0 {
+		return "-" + fenToYuan(-fen)
+	}
+	return fenToYuan(fen)
+}
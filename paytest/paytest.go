@@ -0,0 +1,248 @@
+// Package paytest 提供基于 httptest 的支付宝、微信支付模拟网关, 用于离线端到端测试
+//
+// 模拟网关使用测试密钥对应答与异步通知签名, 在内存中保存订单与退款状态,
+// 测试中通过 Pay 模拟用户完成支付, 通过 Notify 向回调地址推送已签名的异步通知.
+// 本包不依赖 wxpay、alipay 包, 两个包的测试均可引用.
+package paytest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 订单状态, 取值与微信 trade_state 一致, 支付宝网关按 tradeStatus 转换
+const (
+	StateNotPay     = "NOTPAY"     // 未支付
+	StateSuccess    = "SUCCESS"    // 支付成功
+	StateUserPaying = "USERPAYING" // 付款码支付等待用户输入密码
+	StateRefund     = "REFUND"     // 转入退款
+	StateClosed     = "CLOSED"     // 已关闭
+	StateRevoked    = "REVOKED"    // 已撤销(付款码支付)
+)
+
+// Order 模拟网关中的订单
+type Order struct {
+	TradeNo       string    // 商户单号
+	TransactionID string    // 网关交易号
+	Amount        int64     // 订单金额, 单位分
+	Refunded      int64     // 累计退款金额, 单位分
+	State         string    // 订单状态
+	TradeType     string    // 下单方式, 如 JSAPI、NATIVE、alipay.trade.create
+	Subject       string    // 商品描述
+	OpenID        string    // 付款用户
+	SubMchID      string    // 服务商模式下的子商户号
+	NotifyURL     string    // 下单时传入的通知地址
+	Unscanned     bool      // 支付宝扫码下单后用户尚未扫码, 交易尚未创建
+	PaidAt        time.Time // 支付完成时间
+}
+
+// Refund 模拟网关中的退款单
+type Refund struct {
+	TradeNo    string    // 商户单号
+	RefundNo   string    // 商户退款单号
+	RefundID   string    // 网关退款单号
+	Amount     int64     // 退款金额, 单位分
+	State      string    // 退款状态, 模拟网关中退款立即成功, 可由 SetRefundState 修改
+	RefundedAt time.Time // 退款时间
+}
+
+// store 订单与退款的内存存储, 由各模拟网关共用实现
+type store struct {
+	mu      sync.Mutex
+	seq     int
+	orders  map[string]*Order
+	refunds map[string]*Refund
+	faults  map[string][]string
+}
+
+func newStore() *store {
+	return &store{
+		orders:  make(map[string]*Order),
+		refunds: make(map[string]*Refund),
+		faults:  make(map[string][]string),
+	}
+}
+
+// nextID 生成网关单号
+func (s *store) nextID(prefix string) string {
+	s.seq++
+	return fmt.Sprintf("%s%s%06d", prefix, time.Now().Format("20060102"), s.seq)
+}
+
+// Order 查看订单当前状态
+func (s *store) Order(tradeNo string) (Order, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[tradeNo]
+	if !ok {
+		return Order{}, false
+	}
+	return *o, true
+}
+
+// Refunds 查看订单的全部退款单, 按商户退款单号排序
+func (s *store) Refunds(tradeNo string) []Refund {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []Refund
+	for _, r := range s.refunds {
+		if r.TradeNo == tradeNo {
+			res = append(res, *r)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].RefundNo < res[j].RefundNo })
+	return res
+}
+
+// SetRefundState 修改退款单状态, 用于模拟退款处理中、退款关闭等情况
+// 状态取值与微信 refund_status 一致, 如 PROCESSING、REFUNDCLOSE
+func (s *store) SetRefundState(refundNo, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.refunds[refundNo]
+	if !ok {
+		return fmt.Errorf("paytest: refund %s not found", refundNo)
+	}
+	r.State = state
+	return nil
+}
+
+// AddOrder 预置一笔未支付订单, 用于客户端本地拼装支付串、不经过网关下单的支付方式
+func (s *store) AddOrder(tradeNo string, amount int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orders[tradeNo] = &Order{TradeNo: tradeNo, Amount: amount, State: StateNotPay}
+}
+
+// Pay 模拟用户完成支付
+func (s *store) Pay(tradeNo string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[tradeNo]
+	if !ok {
+		return fmt.Errorf("paytest: order %s not found", tradeNo)
+	}
+	if o.State != StateNotPay && o.State != StateUserPaying {
+		return fmt.Errorf("paytest: order %s is %s", tradeNo, o.State)
+	}
+	s.paid(o)
+	return nil
+}
+
+// paid 订单置为支付成功, 调用方需持有锁
+func (s *store) paid(o *Order) {
+	o.State = StateSuccess
+	o.Unscanned = false
+	o.PaidAt = time.Now()
+	if o.TransactionID == "" {
+		o.TransactionID = s.nextID("42")
+	}
+	if o.OpenID == "" {
+		o.OpenID = "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"
+	}
+}
+
+// FailNext 使接下来 times 次调用 api 返回错误码 code, 用于模拟网关繁忙等异常
+// 微信 api 为接口路径, 如 /pay/orderquery; 支付宝 api 为接口名, 如 alipay.trade.query
+func (s *store) FailNext(api, code string, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n := 0; n < times; n++ {
+		s.faults[api] = append(s.faults[api], code)
+	}
+}
+
+// fault 取出一次预设的错误码
+func (s *store) fault(api string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	codes := s.faults[api]
+	if len(codes) == 0 {
+		return ""
+	}
+	s.faults[api] = codes[1:]
+	return codes[0]
+}
+
+// refund 发起退款, 同一退款单号重复提交时返回原退款单
+func (s *store) refund(tradeNo, refundNo string, amount int64) (*Refund, *Order, error) {
+	o, ok := s.orders[tradeNo]
+	if !ok {
+		return nil, nil, errOrderNotExist
+	}
+	if r, ok := s.refunds[refundNo]; ok {
+		return r, o, nil
+	}
+	if o.State != StateSuccess && o.State != StateRefund {
+		return nil, o, errTradeState
+	}
+	if amount <= 0 || o.Refunded+amount > o.Amount {
+		return nil, o, errRefundAmount
+	}
+	o.Refunded += amount
+	o.State = StateRefund
+	r := &Refund{TradeNo: tradeNo, RefundNo: refundNo, RefundID: s.nextID("50"), Amount: amount, State: StateSuccess, RefundedAt: time.Now()}
+	s.refunds[refundNo] = r
+	return r, o, nil
+}
+
+// 模拟网关的业务错误, 由各网关转换为自身错误码
+var (
+	errOrderNotExist = errors.New("order not exist")
+	errTradeState    = errors.New("trade state error")
+	errRefundAmount  = errors.New("refund amount exceeds order amount")
+)
+
+// rsaKey 生成测试用RSA密钥
+func rsaKey(t testing.TB) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// privateKeyPEM PKCS8 PEM 格式私钥
+func privateKeyPEM(t testing.TB, key *rsa.PrivateKey) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// selfSignedCert 以 key 自签名的证书, 返回证书PEM与十六进制序列号
+func selfSignedCert(t testing.TB, key *rsa.PrivateKey, commonName string, notAfter time.Time) (string, string) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), strings.ToUpper(fmt.Sprintf("%X", serial))
+}
+
+// base64Key 去掉PEM头尾的base64密钥, 支付宝客户端使用该格式
+func base64Key(der []byte) string {
+	return base64.StdEncoding.EncodeToString(der)
+}
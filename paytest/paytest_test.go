@@ -0,0 +1,78 @@
+package paytest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStoreRefund(t *testing.T) {
+	s := newStore()
+	s.AddOrder("T001", 100)
+	if _, _, err := s.refund("T001", "R1", 10); err != errTradeState {
+		t.Fatalf("refund before pay: %v", err)
+	}
+	if err := s.Pay("T001"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pay("T001"); err == nil {
+		t.Fatal("paid twice")
+	}
+	if _, _, err := s.refund("T001", "R1", 60); err != nil {
+		t.Fatal(err)
+	}
+	// 同一退款单号重复提交不重复扣减
+	if _, _, err := s.refund("T001", "R1", 60); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.refund("T001", "R2", 50); err != errRefundAmount {
+		t.Fatalf("over refund: %v", err)
+	}
+	if _, _, err := s.refund("T002", "R3", 1); err != errOrderNotExist {
+		t.Fatalf("unknown order: %v", err)
+	}
+	o, _ := s.Order("T001")
+	if o.Refunded != 60 || o.State != StateRefund || len(s.Refunds("T001")) != 1 {
+		t.Fatalf("unexpected order %+v", o)
+	}
+}
+
+func TestFailNext(t *testing.T) {
+	s := newStore()
+	s.FailNext("/pay/orderquery", "SYSTEMERROR", 2)
+	for n := 0; n < 2; n++ {
+		if code := s.fault("/pay/orderquery"); code != "SYSTEMERROR" {
+			t.Fatalf("call %d: %q", n, code)
+		}
+	}
+	if code := s.fault("/pay/orderquery"); code != "" {
+		t.Fatalf("fault not consumed: %q", code)
+	}
+}
+
+func TestWechatServerRejectsBadSign(t *testing.T) {
+	s := NewWechatServer(t)
+	m := map[string]string{"appid": s.AppID, "mch_id": s.MchID, "out_trade_no": "T001", "nonce_str": "1"}
+	m["sign"] = wechatSign("wrong key", "", m)
+	res, err := post(s.URL+"/pay/orderquery", "text/xml", encodeXML(m), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res, "签名错误") {
+		t.Fatalf("unexpected response %s", res)
+	}
+}
+
+func TestAmount(t *testing.T) {
+	for _, c := range []struct {
+		yuan string
+		fen  int64
+	}{{"0.01", 1}, {"1.10", 110}, {"19.99", 1999}} {
+		fen, err := yuanToFen(c.yuan)
+		if err != nil || fen != c.fen {
+			t.Fatalf("yuanToFen(%s) = %d, %v", c.yuan, fen, err)
+		}
+		if yuan := fenToYuan(c.fen); yuan != c.yuan {
+			t.Fatalf("fenToYuan(%d) = %s", c.fen, yuan)
+		}
+	}
+}
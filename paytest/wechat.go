@@ -0,0 +1,518 @@
+package paytest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// WechatServer 模拟微信支付网关, 同时提供v2 XML接口与v3 JSON接口
+// 客户端将 BaseURL 设为 URL、HTTPClient 设为 Client() 即可接入
+type WechatServer struct {
+	*httptest.Server
+	*store
+
+	AppID    string // 测试appid
+	MchID    string // 测试商户号
+	PayKey   string // v2签名key
+	APIv3Key string // APIv3密钥, 用于加密平台证书与v3通知
+
+	MerchantKeyPEM  string // 商户API私钥, 用于双向证书与v3请求签名
+	MerchantCertPEM string // 商户API证书
+	MerchantSerial  string // 商户API证书序列号
+
+	PlatformCertPEM string // 平台证书
+	PlatformSerial  string // 平台证书序列号
+
+	t           testing.TB
+	merchantKey *rsa.PublicKey
+	platformKey *rsa.PrivateKey
+	applyments  map[string]int64 // 进件申请, business_code -> applyment_id
+}
+
+// NewWechatServer 启动微信支付模拟网关, 测试结束时自动关闭
+func NewWechatServer(t testing.TB) *WechatServer {
+	merchant := rsaKey(t)
+	platform := rsaKey(t)
+	s := &WechatServer{
+		store:       newStore(),
+		AppID:       "wxd678efh567hg6787",
+		MchID:       "1230000109",
+		PayKey:      "192006250b4c09247ec02edce69f6a2d",
+		APIv3Key:    "0123456789abcdef0123456789abcdef",
+		t:           t,
+		merchantKey: &merchant.PublicKey,
+		platformKey: platform,
+		applyments:  make(map[string]int64),
+	}
+	s.MerchantKeyPEM = privateKeyPEM(t, merchant)
+	s.MerchantCertPEM, s.MerchantSerial = selfSignedCert(t, merchant, s.MchID, time.Now().AddDate(5, 0, 0))
+	s.PlatformCertPEM, s.PlatformSerial = selfSignedCert(t, platform, "Tenpay.com Root CA", time.Now().AddDate(5, 0, 0))
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *WechatServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/v3/") {
+		s.serveV3(w, r)
+		return
+	}
+	s.serveV2(w, r)
+}
+
+// serveV2 v2 XML接口, 校验商户号与签名后按路径分发
+func (s *WechatServer) serveV2(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	req, err := parseXML(body)
+	if err != nil {
+		writeXML(w, map[string]string{"return_code": "FAIL", "return_msg": "XML格式错误"})
+		return
+	}
+	if req["mch_id"] != s.MchID && req["mchid"] != s.MchID {
+		writeXML(w, map[string]string{"return_code": "FAIL", "return_msg": "mch_id参数格式错误"})
+		return
+	}
+	if req["sign"] != wechatSign(s.PayKey, req["sign_type"], req) {
+		writeXML(w, map[string]string{"return_code": "FAIL", "return_msg": "签名错误"})
+		return
+	}
+	var res map[string]string
+	if code := s.fault(r.URL.Path); code != "" && !(code == StateUserPaying && r.URL.Path == "/pay/micropay") {
+		res = wechatError(code)
+	} else {
+		switch r.URL.Path {
+		case "/pay/unifiedorder":
+			res = s.unifiedOrder(req)
+		case "/pay/orderquery":
+			res = s.orderQuery(req)
+		case "/pay/micropay":
+			res = s.microPay(req, code == StateUserPaying)
+		case "/pay/closeorder":
+			res = s.closeOrder(req)
+		case "/secapi/pay/refund":
+			res = s.refundV2(req)
+		case "/pay/refundquery":
+			res = s.refundQuery(req)
+		case "/secapi/pay/reverse":
+			res = s.reverse(req)
+		case "/mmpaymkttransfers/promotion/transfers":
+			// 企业付款应答不带签名
+			writeXML(w, s.transfers(req))
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+	}
+	res["return_code"] = "SUCCESS"
+	res["return_msg"] = "OK"
+	res["appid"] = req["appid"]
+	res["mch_id"] = s.MchID
+	res["nonce_str"] = strconv.FormatInt(time.Now().UnixNano(), 36)
+	if res["result_code"] == "" {
+		res["result_code"] = "SUCCESS"
+	}
+	res["sign"] = wechatSign(s.PayKey, req["sign_type"], res)
+	writeXML(w, res)
+}
+
+// wechatError 业务失败应答
+func wechatError(code string) map[string]string {
+	return map[string]string{"result_code": "FAIL", "err_code": code, "err_code_des": code}
+}
+
+// findOrder 按 out_trade_no 或 transaction_id 查找订单, 调用方需持有锁
+func (s *store) findOrder(tradeNo, transactionID string) *Order {
+	if tradeNo != "" {
+		return s.orders[tradeNo]
+	}
+	for _, o := range s.orders {
+		if transactionID != "" && o.TransactionID == transactionID {
+			return o
+		}
+	}
+	return nil
+}
+
+func (s *WechatServer) unifiedOrder(req map[string]string) map[string]string {
+	amount, _ := strconv.ParseInt(req["total_fee"], 10, 64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.orders[req["out_trade_no"]]
+	if ok && o.State == StateSuccess {
+		return wechatError("ORDERPAID")
+	}
+	if ok && o.Amount != amount {
+		return wechatError("INVALID_REQUEST")
+	}
+	if !ok {
+		o = &Order{TradeNo: req["out_trade_no"], Amount: amount, State: StateNotPay, TradeType: req["trade_type"], Subject: req["body"], NotifyURL: req["notify_url"]}
+		o.OpenID = req["openid"] + req["sub_openid"]
+		s.orders[o.TradeNo] = o
+	}
+	res := map[string]string{"trade_type": o.TradeType, "prepay_id": "wx" + s.nextID("")}
+	switch o.TradeType {
+	case "NATIVE":
+		res["code_url"] = "weixin://wxpay/bizpayurl?pr=" + o.TradeNo
+	case "MWEB":
+		res["mweb_url"] = "https://wx.tenpay.com/cgi-bin/mmpayweb-bin/checkmweb?prepay_id=" + res["prepay_id"]
+	}
+	return res
+}
+
+func (s *WechatServer) orderQuery(req map[string]string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.findOrder(req["out_trade_no"], req["transaction_id"])
+	if o == nil {
+		return wechatError("ORDERNOTEXIST")
+	}
+	return orderFields(o)
+}
+
+// orderFields 订单查询与通知共用的订单字段
+func orderFields(o *Order) map[string]string {
+	res := map[string]string{
+		"out_trade_no": o.TradeNo,
+		"trade_state":  o.State,
+		"trade_type":   o.TradeType,
+		"total_fee":    strconv.FormatInt(o.Amount, 10),
+		"fee_type":     "CNY",
+	}
+	if !o.PaidAt.IsZero() {
+		res["transaction_id"] = o.TransactionID
+		res["openid"] = o.OpenID
+		res["bank_type"] = "OTHERS"
+		res["cash_fee"] = strconv.FormatInt(o.Amount, 10)
+		res["time_end"] = o.PaidAt.Format("20060102150405")
+	}
+	return res
+}
+
+func (s *WechatServer) microPay(req map[string]string, userPaying bool) map[string]string {
+	amount, _ := strconv.ParseInt(req["total_fee"], 10, 64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o, ok := s.orders[req["out_trade_no"]]; ok && o.State == StateSuccess {
+		return wechatError("ORDERPAID")
+	}
+	o := &Order{TradeNo: req["out_trade_no"], Amount: amount, State: StateNotPay, TradeType: "MICROPAY", Subject: req["body"]}
+	s.orders[o.TradeNo] = o
+	if userPaying {
+		o.State = StateUserPaying
+		return wechatError(StateUserPaying)
+	}
+	s.paid(o)
+	return orderFields(o)
+}
+
+func (s *WechatServer) closeOrder(req map[string]string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.orders[req["out_trade_no"]]
+	switch {
+	case o == nil:
+		return wechatError("ORDERNOTEXIST")
+	case o.State == StateSuccess || o.State == StateRefund:
+		return wechatError("ORDERPAID")
+	case o.State == StateClosed:
+		return wechatError("ORDERCLOSED")
+	}
+	o.State = StateClosed
+	return map[string]string{}
+}
+
+func (s *WechatServer) refundV2(req map[string]string) map[string]string {
+	total, _ := strconv.ParseInt(req["total_fee"], 10, 64)
+	amount, _ := strconv.ParseInt(req["refund_fee"], 10, 64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.findOrder(req["out_trade_no"], req["transaction_id"])
+	if o == nil {
+		return wechatError("ORDERNOTEXIST")
+	}
+	if total != o.Amount {
+		return wechatError("INVALID_REQUEST")
+	}
+	r, o, err := s.refund(o.TradeNo, req["out_refund_no"], amount)
+	switch err {
+	case errTradeState:
+		return wechatError("TRADE_STATE_ERROR")
+	case errRefundAmount:
+		return wechatError("INVALID_REQUEST")
+	}
+	return map[string]string{
+		"transaction_id":  o.TransactionID,
+		"out_trade_no":    o.TradeNo,
+		"out_refund_no":   r.RefundNo,
+		"refund_id":       r.RefundID,
+		"refund_fee":      strconv.FormatInt(r.Amount, 10),
+		"total_fee":       strconv.FormatInt(o.Amount, 10),
+		"cash_fee":        strconv.FormatInt(o.Amount, 10),
+		"cash_refund_fee": strconv.FormatInt(r.Amount, 10),
+	}
+}
+
+func (s *WechatServer) refundQuery(req map[string]string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var refunds []*Refund
+	for _, r := range s.refunds {
+		switch {
+		case req["out_refund_no"] != "" && r.RefundNo == req["out_refund_no"],
+			req["refund_id"] != "" && r.RefundID == req["refund_id"],
+			req["out_refund_no"] == "" && req["refund_id"] == "" && r.TradeNo == req["out_trade_no"]:
+			refunds = append(refunds, r)
+		}
+	}
+	if len(refunds) == 0 {
+		return wechatError("REFUNDNOTEXIST")
+	}
+	sort.Slice(refunds, func(i, j int) bool { return refunds[i].RefundNo < refunds[j].RefundNo })
+	o := s.orders[refunds[0].TradeNo]
+	res := map[string]string{
+		"transaction_id": o.TransactionID,
+		"out_trade_no":   o.TradeNo,
+		"total_fee":      strconv.FormatInt(o.Amount, 10),
+		"cash_fee":       strconv.FormatInt(o.Amount, 10),
+		"refund_fee":     strconv.FormatInt(o.Refunded, 10),
+		"refund_count":   strconv.Itoa(len(refunds)),
+	}
+	for n, r := range refunds {
+		res[fmt.Sprintf("out_refund_no_%d", n)] = r.RefundNo
+		res[fmt.Sprintf("refund_id_%d", n)] = r.RefundID
+		res[fmt.Sprintf("refund_fee_%d", n)] = strconv.FormatInt(r.Amount, 10)
+		res[fmt.Sprintf("refund_status_%d", n)] = r.State
+		res[fmt.Sprintf("refund_channel_%d", n)] = "ORIGINAL"
+		res[fmt.Sprintf("refund_recv_accout_%d", n)] = "支付用户的零钱"
+		res[fmt.Sprintf("refund_success_time_%d", n)] = time.Now().Format("2006-01-02 15:04:05")
+	}
+	return res
+}
+
+func (s *WechatServer) reverse(req map[string]string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.findOrder(req["out_trade_no"], req["transaction_id"])
+	if o == nil {
+		return wechatError("ORDERNOTEXIST")
+	}
+	if o.State == StateSuccess && o.Refunded == 0 {
+		s.refunds[o.TradeNo+"-reverse"] = &Refund{TradeNo: o.TradeNo, RefundNo: o.TradeNo + "-reverse", RefundID: s.nextID("50"), Amount: o.Amount, State: StateSuccess}
+		o.Refunded = o.Amount
+	}
+	o.State = StateRevoked
+	return map[string]string{"recall": "N"}
+}
+
+func (s *WechatServer) transfers(req map[string]string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]string{
+		"return_code":      "SUCCESS",
+		"result_code":      "SUCCESS",
+		"mch_appid":        req["mch_appid"],
+		"mchid":            s.MchID,
+		"nonce_str":        req["nonce_str"],
+		"partner_trade_no": req["partner_trade_no"],
+		"payment_no":       s.nextID("10"),
+		"payment_time":     time.Now().Format("2006-01-02 15:04:05"),
+	}
+}
+
+// NotifyBody 订单当前状态对应的已签名v2支付结果通知
+func (s *WechatServer) NotifyBody(tradeNo string) ([]byte, error) {
+	s.mu.Lock()
+	o, ok := s.orders[tradeNo]
+	if !ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("paytest: order %s not found", tradeNo)
+	}
+	m := orderFields(o)
+	s.mu.Unlock()
+	delete(m, "trade_state")
+	m["return_code"] = "SUCCESS"
+	m["result_code"] = "SUCCESS"
+	m["appid"] = s.AppID
+	m["mch_id"] = s.MchID
+	m["nonce_str"] = strconv.FormatInt(time.Now().UnixNano(), 36)
+	m["is_subscribe"] = "N"
+	m["sign"] = wechatSign(s.PayKey, "", m)
+	return encodeXML(m), nil
+}
+
+// Notify 向回调地址推送v2支付结果通知, url 为空时使用下单时的 notify_url, 返回回调应答
+func (s *WechatServer) Notify(url, tradeNo string) (string, error) {
+	body, err := s.NotifyBody(tradeNo)
+	if err != nil {
+		return "", err
+	}
+	if url == "" {
+		o, _ := s.Order(tradeNo)
+		url = o.NotifyURL
+	}
+	return post(url, "text/xml", body, nil)
+}
+
+// RefundNotifyBody 生成v2退款结果通知报文, req_info 按微信规则使用 PayKey 加密
+func (s *WechatServer) RefundNotifyBody(refundNo string) ([]byte, error) {
+	s.mu.Lock()
+	r, ok := s.refunds[refundNo]
+	if !ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("paytest: refund %s not found", refundNo)
+	}
+	o := s.orders[r.TradeNo]
+	info := map[string]string{
+		"transaction_id":        o.TransactionID,
+		"out_trade_no":          o.TradeNo,
+		"refund_id":             r.RefundID,
+		"out_refund_no":         r.RefundNo,
+		"total_fee":             strconv.FormatInt(o.Amount, 10),
+		"settlement_total_fee":  strconv.FormatInt(o.Amount, 10),
+		"refund_fee":            strconv.FormatInt(r.Amount, 10),
+		"settlement_refund_fee": strconv.FormatInt(r.Amount, 10),
+		"refund_status":         r.State,
+		"success_time":          time.Now().Format("2006-01-02 15:04:05"),
+		"refund_recv_accout":    "支付用户的零钱",
+		"refund_account":        "REFUND_SOURCE_RECHARGE_FUNDS",
+		"refund_request_source": "API",
+	}
+	s.mu.Unlock()
+	reqInfo, err := encryptReqInfo(s.PayKey, encodeXML(info))
+	if err != nil {
+		return nil, err
+	}
+	return encodeXML(map[string]string{
+		"return_code": "SUCCESS",
+		"appid":       s.AppID,
+		"mch_id":      s.MchID,
+		"nonce_str":   strconv.FormatInt(time.Now().UnixNano(), 36),
+		"req_info":    reqInfo,
+	}), nil
+}
+
+// RefundNotify 向回调地址推送v2退款结果通知, 返回回调应答
+func (s *WechatServer) RefundNotify(url, refundNo string) (string, error) {
+	body, err := s.RefundNotifyBody(refundNo)
+	if err != nil {
+		return "", err
+	}
+	return post(url, "text/xml", body, nil)
+}
+
+// encryptReqInfo AES-256-ECB 加密退款通知, 密钥为 PayKey 的MD5小写十六进制串
+func encryptReqInfo(payKey string, plain []byte) (string, error) {
+	sum := md5.Sum([]byte(payKey))
+	block, err := aes.NewCipher([]byte(hex.EncodeToString(sum[:])))
+	if err != nil {
+		return "", err
+	}
+	size := block.BlockSize()
+	pad := size - len(plain)%size
+	plain = append(plain, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	out := make([]byte, len(plain))
+	for n := 0; n < len(plain); n += size {
+		block.Encrypt(out[n:n+size], plain[n:n+size])
+	}
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// post 推送通知并读取应答
+func post(url, contentType string, body []byte, header http.Header) (string, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	res, err := ioutil.ReadAll(resp.Body)
+	return string(res), err
+}
+
+// wechatSign v2签名, signType 为空时使用MD5
+func wechatSign(key, signType string, m map[string]string) string {
+	var data []string
+	for k, v := range m {
+		if v != "" && k != "sign" && k != "key" {
+			data = append(data, k+"="+v)
+		}
+	}
+	sort.Strings(data)
+	signStr := strings.Join(data, "&") + "&key=" + key
+	if signType == "HMAC-SHA256" {
+		h := hmac.New(sha256.New, []byte(key))
+		h.Write([]byte(signStr))
+		return strings.ToUpper(fmt.Sprintf("%x", h.Sum(nil)))
+	}
+	return strings.ToUpper(fmt.Sprintf("%x", md5.Sum([]byte(signStr))))
+}
+
+// parseXML 将v2报文展开为map
+func parseXML(body []byte) (map[string]string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	m := make(map[string]string)
+	var k string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch v := token.(type) {
+		case xml.StartElement:
+			k = v.Name.Local
+		case xml.CharData:
+			if data := strings.TrimSpace(string(v)); data != "" {
+				m[k] = data
+			}
+		}
+	}
+}
+
+// encodeXML 按key排序输出v2报文
+func encodeXML(m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	buf.WriteString("<xml>")
+	for _, k := range keys {
+		buf.WriteString("<" + k + "><![CDATA[" + m[k] + "]]></" + k + ">")
+	}
+	buf.WriteString("</xml>")
+	return buf.Bytes()
+}
+
+func writeXML(w http.ResponseWriter, m map[string]string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(encodeXML(m))
+}
@@ -0,0 +1,519 @@
+package paytest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// v3authPattern 商户请求签名头
+var v3authPattern = regexp.MustCompile(`^WECHATPAY2-SHA256-RSA2048 mchid="(.*)",nonce_str="(.*)",timestamp="(\d+)",serial_no="(.*)",signature="(.*)"$`)
+
+// v3Order v3订单查询返回与支付通知明文
+type v3Order struct {
+	AppID          string   `json:"appid,omitempty"`
+	MchID          string   `json:"mchid,omitempty"`
+	SpAppID        string   `json:"sp_appid,omitempty"`
+	SpMchID        string   `json:"sp_mchid,omitempty"`
+	SubMchID       string   `json:"sub_mchid,omitempty"`
+	OutTradeNo     string   `json:"out_trade_no"`
+	TransactionID  string   `json:"transaction_id,omitempty"`
+	TradeType      string   `json:"trade_type,omitempty"`
+	TradeState     string   `json:"trade_state"`
+	TradeStateDesc string   `json:"trade_state_desc"`
+	BankType       string   `json:"bank_type,omitempty"`
+	SuccessTime    string   `json:"success_time,omitempty"`
+	Payer          v3Payer  `json:"payer"`
+	Amount         v3Amount `json:"amount"`
+}
+
+type v3Payer struct {
+	OpenID    string `json:"openid,omitempty"`
+	SpOpenID  string `json:"sp_openid,omitempty"`
+	SubOpenID string `json:"sub_openid,omitempty"`
+}
+
+type v3Amount struct {
+	Total       int64  `json:"total"`
+	Refund      int64  `json:"refund,omitempty"`
+	PayerTotal  int64  `json:"payer_total,omitempty"`
+	PayerRefund int64  `json:"payer_refund,omitempty"`
+	Currency    string `json:"currency,omitempty"`
+}
+
+// v3Refund v3退款返回与退款通知明文
+type v3Refund struct {
+	MchID               string   `json:"mchid,omitempty"`
+	SpMchID             string   `json:"sp_mchid,omitempty"`
+	SubMchID            string   `json:"sub_mchid,omitempty"`
+	RefundID            string   `json:"refund_id"`
+	OutRefundNo         string   `json:"out_refund_no"`
+	TransactionID       string   `json:"transaction_id"`
+	OutTradeNo          string   `json:"out_trade_no"`
+	Channel             string   `json:"channel"`
+	UserReceivedAccount string   `json:"user_received_account"`
+	SuccessTime         string   `json:"success_time"`
+	CreateTime          string   `json:"create_time"`
+	Status              string   `json:"status"`
+	RefundStatus        string   `json:"refund_status,omitempty"`
+	Amount              v3Amount `json:"amount"`
+}
+
+// serveV3 v3 JSON接口, 校验商户请求签名后按路径分发, 应答使用平台证书签名
+func (s *WechatServer) serveV3(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := s.verifyV3Request(r, body); err != nil {
+		s.writeV3(w, http.StatusUnauthorized, map[string]string{"code": "SIGN_ERROR", "message": err.Error()})
+		return
+	}
+	if code := s.fault(r.URL.Path); code != "" {
+		s.writeV3(w, http.StatusInternalServerError, map[string]string{"code": code, "message": code})
+		return
+	}
+	path := r.URL.Path
+	switch {
+	case path == "/v3/certificates" && r.Method == "GET":
+		s.writeV3(w, http.StatusOK, s.certificates())
+	case strings.HasPrefix(path, "/v3/pay/") && strings.Contains(path, "/out-trade-no/") && strings.HasSuffix(path, "/close"):
+		s.v3Close(w, strings.TrimSuffix(path[strings.Index(path, "/out-trade-no/")+len("/out-trade-no/"):], "/close"))
+	case strings.HasPrefix(path, "/v3/pay/") && strings.Contains(path, "/out-trade-no/"):
+		s.v3Query(w, r, path[strings.Index(path, "/out-trade-no/")+len("/out-trade-no/"):])
+	case strings.HasPrefix(path, "/v3/pay/transactions/") || strings.HasPrefix(path, "/v3/pay/partner/transactions/"):
+		s.v3Transaction(w, path[strings.LastIndex(path, "/")+1:], body)
+	case path == "/v3/refund/domestic/refunds" && r.Method == "POST":
+		s.v3Refund(w, body)
+	case strings.HasPrefix(path, "/v3/refund/domestic/refunds/"):
+		s.v3QueryRefund(w, strings.TrimPrefix(path, "/v3/refund/domestic/refunds/"))
+	case path == "/v3/applyment4sub/applyment/" && r.Method == "POST":
+		s.v3Applyment(w, r, body)
+	case strings.HasPrefix(path, "/v3/applyment4sub/applyment/business_code/"):
+		s.v3ApplymentQuery(w, strings.TrimPrefix(path, "/v3/applyment4sub/applyment/business_code/"))
+	case path == "/v3/merchant/media/upload":
+		s.writeV3(w, http.StatusOK, map[string]string{"media_id": "H1ihR9JUtVj-J7CJqBUY5ZOrG_Je75H-rKhaSLxuL" + s.nextIDLocked("")})
+	default:
+		s.writeV3(w, http.StatusNotFound, map[string]string{"code": "NOT_FOUND", "message": "接口不存在"})
+	}
+}
+
+// nextIDLocked 加锁生成网关单号
+func (s *store) nextIDLocked(prefix string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextID(prefix)
+}
+
+// verifyV3Request 校验商户请求签名, 图片上传只对meta部分签名
+func (s *WechatServer) verifyV3Request(r *http.Request, body []byte) error {
+	auth := v3authPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+	if auth == nil {
+		return fmt.Errorf("bad Authorization header")
+	}
+	signed := body
+	if r.URL.Path == "/v3/merchant/media/upload" {
+		meta, err := multipartMeta(r, body)
+		if err != nil {
+			return err
+		}
+		signed = meta
+	}
+	message := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), auth[3], auth[2], signed)
+	sig, err := base64.StdEncoding.DecodeString(auth[5])
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256([]byte(message))
+	if err := rsa.VerifyPKCS1v15(s.merchantKey, crypto.SHA256, h[:], sig); err != nil {
+		return fmt.Errorf("签名错误")
+	}
+	return nil
+}
+
+// multipartMeta 取图片上传请求中的meta部分
+func multipartMeta(r *http.Request, body []byte) ([]byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return nil, fmt.Errorf("missing meta: %v", err)
+		}
+		if part.FormName() == "meta" {
+			return ioutil.ReadAll(part)
+		}
+	}
+}
+
+// writeV3 输出应答并签名
+func (s *WechatServer) writeV3(w http.ResponseWriter, status int, v interface{}) {
+	var body []byte
+	if v != nil {
+		body, _ = json.Marshal(v)
+	}
+	for k, v := range s.SignV3(body) {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// SignV3 使用平台证书私钥对应答或通知签名, 返回 Wechatpay-* 签名头
+func (s *WechatServer) SignV3(body []byte) http.Header {
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 36)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s\n", timestamp, nonce, body)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.platformKey, crypto.SHA256, h[:])
+	if err != nil {
+		s.t.Error(err)
+	}
+	header := http.Header{}
+	header.Set("Wechatpay-Timestamp", timestamp)
+	header.Set("Wechatpay-Nonce", nonce)
+	header.Set("Wechatpay-Serial", s.PlatformSerial)
+	header.Set("Wechatpay-Signature", base64.StdEncoding.EncodeToString(sig))
+	return header
+}
+
+// encryptV3 AEAD_AES_256_GCM 加密, 返回 resource 结构
+func (s *WechatServer) encryptV3(plaintext []byte, associatedData string) map[string]string {
+	block, err := aes.NewCipher([]byte(s.APIv3Key))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	nonce := fmt.Sprintf("%012d", time.Now().UnixNano()%1e12)
+	return map[string]string{
+		"algorithm":       "AEAD_AES_256_GCM",
+		"nonce":           nonce,
+		"associated_data": associatedData,
+		"ciphertext":      base64.StdEncoding.EncodeToString(gcm.Seal(nil, []byte(nonce), plaintext, []byte(associatedData))),
+	}
+}
+
+// certificates /v3/certificates 返回
+func (s *WechatServer) certificates() interface{} {
+	resource := s.encryptV3([]byte(s.PlatformCertPEM), "certificate")
+	return map[string]interface{}{
+		"data": []map[string]interface{}{{
+			"serial_no":           s.PlatformSerial,
+			"effective_time":      time.Now().Add(-time.Hour).Format(time.RFC3339),
+			"expire_time":         time.Now().AddDate(5, 0, 0).Format(time.RFC3339),
+			"encrypt_certificate": resource,
+		}},
+	}
+}
+
+func (s *WechatServer) v3Transaction(w http.ResponseWriter, tradeType string, body []byte) {
+	var req struct {
+		AppID       string   `json:"appid"`
+		MchID       string   `json:"mchid"`
+		SpAppID     string   `json:"sp_appid"`
+		SpMchID     string   `json:"sp_mchid"`
+		SubMchID    string   `json:"sub_mchid"`
+		Description string   `json:"description"`
+		OutTradeNo  string   `json:"out_trade_no"`
+		NotifyURL   string   `json:"notify_url"`
+		Amount      v3Amount `json:"amount"`
+		Payer       *v3Payer `json:"payer"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.OutTradeNo == "" || req.Amount.Total <= 0 {
+		s.writeV3(w, http.StatusBadRequest, map[string]string{"code": "PARAM_ERROR", "message": "参数错误"})
+		return
+	}
+	if req.MchID+req.SpMchID != s.MchID {
+		s.writeV3(w, http.StatusBadRequest, map[string]string{"code": "MCH_NOT_EXISTS", "message": "商户号不存在"})
+		return
+	}
+	s.mu.Lock()
+	o, ok := s.orders[req.OutTradeNo]
+	if ok && o.State == StateSuccess {
+		s.mu.Unlock()
+		s.writeV3(w, http.StatusForbidden, map[string]string{"code": "ORDERPAID", "message": "订单已支付"})
+		return
+	}
+	if !ok {
+		o = &Order{TradeNo: req.OutTradeNo, Amount: req.Amount.Total, State: StateNotPay, TradeType: strings.ToUpper(tradeType), Subject: req.Description, NotifyURL: req.NotifyURL, SubMchID: req.SubMchID}
+		if req.Payer != nil {
+			o.OpenID = req.Payer.OpenID + req.Payer.SpOpenID + req.Payer.SubOpenID
+		}
+		s.orders[o.TradeNo] = o
+	}
+	prepayID := "wx" + s.nextID("")
+	s.mu.Unlock()
+	res := map[string]string{}
+	switch tradeType {
+	case "h5":
+		res["h5_url"] = "https://wx.tenpay.com/cgi-bin/mmpayweb-bin/checkmweb?prepay_id=" + prepayID
+	case "native":
+		res["code_url"] = "weixin://wxpay/bizpayurl?pr=" + req.OutTradeNo
+	default:
+		res["prepay_id"] = prepayID
+	}
+	s.writeV3(w, http.StatusOK, res)
+}
+
+// v3OrderLocked 订单的v3结构, 调用方需持有锁
+func (s *WechatServer) v3OrderLocked(o *Order) *v3Order {
+	res := &v3Order{
+		OutTradeNo:     o.TradeNo,
+		TradeType:      o.TradeType,
+		TradeState:     o.State,
+		TradeStateDesc: o.State,
+		Amount:         v3Amount{Total: o.Amount, Currency: "CNY"},
+	}
+	if o.SubMchID != "" {
+		res.SpAppID, res.SpMchID, res.SubMchID = s.AppID, s.MchID, o.SubMchID
+		res.Payer.SpOpenID = o.OpenID
+	} else {
+		res.AppID, res.MchID = s.AppID, s.MchID
+		res.Payer.OpenID = o.OpenID
+	}
+	if !o.PaidAt.IsZero() {
+		res.TransactionID = o.TransactionID
+		res.BankType = "OTHERS"
+		res.SuccessTime = o.PaidAt.Format(time.RFC3339)
+		res.Amount.PayerTotal = o.Amount
+	}
+	return res
+}
+
+func (s *WechatServer) v3Query(w http.ResponseWriter, r *http.Request, tradeNo string) {
+	s.mu.Lock()
+	o, ok := s.orders[tradeNo]
+	var res *v3Order
+	if ok {
+		res = s.v3OrderLocked(o)
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.writeV3(w, http.StatusNotFound, map[string]string{"code": "ORDER_NOT_EXIST", "message": "订单不存在"})
+		return
+	}
+	s.writeV3(w, http.StatusOK, res)
+}
+
+func (s *WechatServer) v3Close(w http.ResponseWriter, tradeNo string) {
+	s.mu.Lock()
+	o, ok := s.orders[tradeNo]
+	state := ""
+	if ok {
+		state = o.State
+		if state == StateNotPay {
+			o.State = StateClosed
+		}
+	}
+	s.mu.Unlock()
+	switch {
+	case !ok:
+		s.writeV3(w, http.StatusNotFound, map[string]string{"code": "ORDER_NOT_EXIST", "message": "订单不存在"})
+	case state == StateSuccess || state == StateRefund:
+		s.writeV3(w, http.StatusBadRequest, map[string]string{"code": "ORDERPAID", "message": "订单已支付"})
+	default:
+		s.writeV3(w, http.StatusNoContent, nil)
+	}
+}
+
+// v3RefundLocked 退款单的v3结构, 调用方需持有锁
+func (s *WechatServer) v3RefundLocked(r *Refund) *v3Refund {
+	o := s.orders[r.TradeNo]
+	res := &v3Refund{
+		RefundID:            r.RefundID,
+		OutRefundNo:         r.RefundNo,
+		TransactionID:       o.TransactionID,
+		OutTradeNo:          o.TradeNo,
+		Channel:             "ORIGINAL",
+		UserReceivedAccount: "支付用户零钱",
+		SuccessTime:         time.Now().Format(time.RFC3339),
+		CreateTime:          time.Now().Format(time.RFC3339),
+		Status:              r.State,
+		Amount:              v3Amount{Total: o.Amount, Refund: r.Amount, PayerTotal: o.Amount, PayerRefund: r.Amount, Currency: "CNY"},
+	}
+	if o.SubMchID != "" {
+		res.SpMchID, res.SubMchID = s.MchID, o.SubMchID
+	} else {
+		res.MchID = s.MchID
+	}
+	return res
+}
+
+func (s *WechatServer) v3Refund(w http.ResponseWriter, body []byte) {
+	var req struct {
+		OutTradeNo    string   `json:"out_trade_no"`
+		TransactionID string   `json:"transaction_id"`
+		OutRefundNo   string   `json:"out_refund_no"`
+		Amount        v3Amount `json:"amount"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.OutRefundNo == "" {
+		s.writeV3(w, http.StatusBadRequest, map[string]string{"code": "PARAM_ERROR", "message": "参数错误"})
+		return
+	}
+	s.mu.Lock()
+	var res *v3Refund
+	var err error
+	o := s.findOrder(req.OutTradeNo, req.TransactionID)
+	if o == nil {
+		err = errOrderNotExist
+	} else if req.Amount.Total != o.Amount {
+		err = errRefundAmount
+	} else {
+		var r *Refund
+		if r, _, err = s.refund(o.TradeNo, req.OutRefundNo, req.Amount.Refund); err == nil {
+			res = s.v3RefundLocked(r)
+		}
+	}
+	s.mu.Unlock()
+	switch err {
+	case nil:
+		s.writeV3(w, http.StatusOK, res)
+	case errOrderNotExist:
+		s.writeV3(w, http.StatusNotFound, map[string]string{"code": "RESOURCE_NOT_EXISTS", "message": "订单不存在"})
+	case errTradeState:
+		s.writeV3(w, http.StatusForbidden, map[string]string{"code": "TRADE_STATE_ERROR", "message": "订单状态错误"})
+	default:
+		s.writeV3(w, http.StatusBadRequest, map[string]string{"code": "INVALID_REQUEST", "message": err.Error()})
+	}
+}
+
+func (s *WechatServer) v3QueryRefund(w http.ResponseWriter, refundNo string) {
+	s.mu.Lock()
+	var res *v3Refund
+	if r, ok := s.refunds[refundNo]; ok {
+		res = s.v3RefundLocked(r)
+	}
+	s.mu.Unlock()
+	if res == nil {
+		s.writeV3(w, http.StatusNotFound, map[string]string{"code": "RESOURCE_NOT_EXISTS", "message": "退款单不存在"})
+		return
+	}
+	s.writeV3(w, http.StatusOK, res)
+}
+
+// v3Applyment 特约商户进件, 校验敏感字段使用平台证书加密
+func (s *WechatServer) v3Applyment(w http.ResponseWriter, r *http.Request, body []byte) {
+	var req struct {
+		BusinessCode string `json:"business_code"`
+		ContactInfo  *struct {
+			ContactName string `json:"contact_name"`
+		} `json:"contact_info"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.BusinessCode == "" {
+		s.writeV3(w, http.StatusBadRequest, map[string]string{"code": "PARAM_ERROR", "message": "参数错误"})
+		return
+	}
+	if r.Header.Get("Wechatpay-Serial") != s.PlatformSerial {
+		s.writeV3(w, http.StatusBadRequest, map[string]string{"code": "PARAM_ERROR", "message": "平台证书序列号错误"})
+		return
+	}
+	if req.ContactInfo != nil {
+		if _, err := s.DecryptSensitive(req.ContactInfo.ContactName); err != nil {
+			s.writeV3(w, http.StatusBadRequest, map[string]string{"code": "PARAM_ERROR", "message": "敏感信息解密失败"})
+			return
+		}
+	}
+	s.mu.Lock()
+	s.seq++
+	applymentID := 2000002124775000 + int64(s.seq)
+	s.applyments[req.BusinessCode] = applymentID
+	s.mu.Unlock()
+	s.writeV3(w, http.StatusOK, map[string]int64{"applyment_id": applymentID})
+}
+
+func (s *WechatServer) v3ApplymentQuery(w http.ResponseWriter, businessCode string) {
+	s.mu.Lock()
+	applymentID, ok := s.applyments[businessCode]
+	s.mu.Unlock()
+	if !ok {
+		s.writeV3(w, http.StatusNotFound, map[string]string{"code": "RESOURCE_NOT_EXISTS", "message": "申请单不存在"})
+		return
+	}
+	s.writeV3(w, http.StatusOK, map[string]interface{}{
+		"business_code":       businessCode,
+		"applyment_id":        applymentID,
+		"applyment_state":     "APPLYMENT_STATE_AUDITING",
+		"applyment_state_msg": "审核中",
+	})
+}
+
+// DecryptSensitive 使用平台私钥解密商户上送的敏感信息(RSA-OAEP)
+func (s *WechatServer) DecryptSensitive(ciphertext string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	plain, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, s.platformKey, data, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// NotifyV3 向回调地址推送v3支付结果通知, url 为空时使用下单时的 notify_url, 返回回调应答
+func (s *WechatServer) NotifyV3(url, tradeNo string) (string, error) {
+	s.mu.Lock()
+	o, ok := s.orders[tradeNo]
+	var plaintext []byte
+	if ok {
+		plaintext, _ = json.Marshal(s.v3OrderLocked(o))
+		if url == "" {
+			url = o.NotifyURL
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("paytest: order %s not found", tradeNo)
+	}
+	return s.notifyV3(url, "TRANSACTION.SUCCESS", "transaction", plaintext)
+}
+
+// NotifyV3Refund 向回调地址推送v3退款结果通知, 返回回调应答
+func (s *WechatServer) NotifyV3Refund(url, refundNo string) (string, error) {
+	s.mu.Lock()
+	r, ok := s.refunds[refundNo]
+	var plaintext []byte
+	if ok {
+		res := s.v3RefundLocked(r)
+		res.RefundStatus, res.Status = res.Status, ""
+		plaintext, _ = json.Marshal(res)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("paytest: refund %s not found", refundNo)
+	}
+	return s.notifyV3(url, "REFUND.SUCCESS", "refund", plaintext)
+}
+
+func (s *WechatServer) notifyV3(url, eventType, originalType string, plaintext []byte) (string, error) {
+	resource := s.encryptV3(plaintext, originalType)
+	resource["original_type"] = originalType
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":            "EV-" + s.nextIDLocked(""),
+		"create_time":   time.Now().Format(time.RFC3339),
+		"resource_type": "encrypt-resource",
+		"event_type":    eventType,
+		"summary":       "通知",
+		"resource":      resource,
+	})
+	return post(url, "application/json", body, s.SignV3(body))
+}
@@ -0,0 +1,224 @@
+package pay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// ErrProviderNotFound 支付方式未注册
+var ErrProviderNotFound = errors.New("pay: provider not registered")
+
+// ErrNotSupported 三方渠道不支持该操作
+var ErrNotSupported = errors.New("pay: operation not supported")
+
+// Provider 三方支付统一接口, 由 alipay、wxpay 包实现
+type Provider interface {
+	// CreatePayment 下单, 返回前端调起支付所需参数
+	CreatePayment(ctx context.Context, req *PaymentRequest) (*PaymentResult, error)
+	// Query 按商户单号查询订单
+	Query(ctx context.Context, tradeNo string) (*QueryResult, error)
+	// Refund 申请退款
+	Refund(ctx context.Context, req *RefundRequest) (*RefundResult, error)
+	// QueryRefund 按商户退款单号查询退款, 支付宝需同时传商户单号, 微信可为空
+	QueryRefund(ctx context.Context, tradeNo, refundNo string) (*RefundResult, error)
+	// Close 关闭未支付订单, 订单已关闭时返回 nil, 已支付时返回错误
+	Close(ctx context.Context, tradeNo string) error
+	// ParseNotification 校验并解析异步通知
+	ParseNotification(r *http.Request) (*Notification, error)
+}
+
+// PaymentRequest 统一下单请求
+type PaymentRequest struct {
+	TradeNo   string // 商户单号
+	Amount    Money  // 金额
+	Subject   string // 商品描述
+	NotifyURL string // 异步通知地址, 为空时使用客户端配置
+	ReturnURL string // 同步跳转地址(网页支付用)
+	OpenID    string // 微信openid 或 支付宝buyer_id
+	SceneInfo string // 场景信息(微信H5用)
+	AuthToken string // 支付宝第三方应用授权token
+}
+
+// PaymentResult 统一下单返回
+type PaymentResult struct {
+	ChannelID int               // 支付方式ID
+	TradeNo   string            // 商户单号
+	PrepayID  string            // 三方预支付单号(微信prepay_id/支付宝trade_no)
+	Params    map[string]string // 前端调起支付参数(微信App/小程序/公众号)
+	PayURL    string            // 跳转或二维码链接(微信H5/扫码, 支付宝扫码)
+	Body      string            // 支付串或表单(支付宝App/H5)
+}
+
+// QueryResult 统一订单查询返回
+type QueryResult struct {
+	TradeNo       string        // 商户单号
+	TransactionID string        // 三方交易号
+	TradeState    string        // 三方原始订单状态
+	Status        PaymentStatus // 统一订单状态
+	Paid          bool          // 是否已支付
+	Amount        Money         // 订单金额
+	PaidAt        string        // 支付完成时间
+}
+
+// RefundRequest 统一退款请求, 同一订单可多次部分退款, 每次使用不同的 RefundNo
+type RefundRequest struct {
+	TradeNo       string // 商户单号, 与 TransactionID 二选一
+	TransactionID string // 三方交易号, 与 TradeNo 二选一, 均填写时以三方交易号为准
+	RefundNo      string // 商户退款单号, 必填, 重复提交同一单号不会重复退款
+	TotalAmount   Money  // 订单金额, 微信退款必填
+	RefundAmount  Money  // 本次退款金额
+	Reason        string // 退款原因
+}
+
+// RefundResult 统一退款返回
+type RefundResult struct {
+	TradeNo          string       // 商户单号
+	TransactionID    string       // 三方交易号
+	RefundNo         string       // 商户退款单号
+	RefundID         string       // 三方退款单号, 支付宝无此字段
+	RefundAmount     Money        // 本次退款金额
+	RefundedTotal    Money        // 订单累计退款金额, 三方未返回时为0
+	SettlementAmount Money        // 应结退款金额, 微信为去掉非充值代金券后的金额, 三方未返回时为0
+	RefundState      string       // 三方原始退款状态
+	Status           RefundStatus // 统一退款状态
+}
+
+// Notification 统一支付结果通知
+type Notification struct {
+	TradeNo       string            // 商户单号
+	TransactionID string            // 三方交易号
+	Amount        Money             // 支付金额
+	Status        PaymentStatus     // 统一订单状态
+	Paid          bool              // 是否支付成功
+	PaidAt        string            // 支付完成时间
+	Raw           map[string]string // 原始通知参数
+}
+
+// Registry 按支付方式ID保存三方支付实现
+type Registry struct {
+	mu        sync.RWMutex
+	providers map[int]Provider
+}
+
+// NewRegistry 创建空的注册表
+func NewRegistry() *Registry {
+	return &Registry{providers: make(map[int]Provider)}
+}
+
+// Register 注册支付方式, 重复注册时覆盖
+func (r *Registry) Register(channelID int, p Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[channelID] = p
+}
+
+// Provider 获取支付方式对应的实现
+func (r *Registry) Provider(channelID int) (Provider, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.providers[channelID]
+	if !ok {
+		return nil, fmt.Errorf("%w: channel %d(%s)", ErrProviderNotFound, channelID, GetChannelName(channelID))
+	}
+	return p, nil
+}
+
+// Charge 按支付方式下单
+func (r *Registry) Charge(ctx context.Context, channelID int, req *PaymentRequest) (*PaymentResult, error) {
+	p, err := r.Provider(channelID)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.CreatePayment(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	res.ChannelID = channelID
+	return res, nil
+}
+
+// Query 按支付方式查询订单
+func (r *Registry) Query(ctx context.Context, channelID int, tradeNo string) (*QueryResult, error) {
+	p, err := r.Provider(channelID)
+	if err != nil {
+		return nil, err
+	}
+	return p.Query(ctx, tradeNo)
+}
+
+// Refund 按支付方式退款
+func (r *Registry) Refund(ctx context.Context, channelID int, req *RefundRequest) (*RefundResult, error) {
+	p, err := r.Provider(channelID)
+	if err != nil {
+		return nil, err
+	}
+	return p.Refund(ctx, req)
+}
+
+// QueryRefund 按支付方式查询退款
+func (r *Registry) QueryRefund(ctx context.Context, channelID int, tradeNo, refundNo string) (*RefundResult, error) {
+	p, err := r.Provider(channelID)
+	if err != nil {
+		return nil, err
+	}
+	return p.QueryRefund(ctx, tradeNo, refundNo)
+}
+
+// Close 按支付方式关闭订单
+func (r *Registry) Close(ctx context.Context, channelID int, tradeNo string) error {
+	p, err := r.Provider(channelID)
+	if err != nil {
+		return err
+	}
+	return p.Close(ctx, tradeNo)
+}
+
+// ParseNotification 按支付方式解析异步通知
+func (r *Registry) ParseNotification(channelID int, req *http.Request) (*Notification, error) {
+	p, err := r.Provider(channelID)
+	if err != nil {
+		return nil, err
+	}
+	return p.ParseNotification(req)
+}
+
+// DefaultRegistry 默认注册表, 包级函数均使用该注册表
+var DefaultRegistry = NewRegistry()
+
+// RegisterProvider 向默认注册表注册支付方式
+func RegisterProvider(channelID int, p Provider) {
+	DefaultRegistry.Register(channelID, p)
+}
+
+// Charge 使用默认注册表下单
+func Charge(ctx context.Context, channelID int, req *PaymentRequest) (*PaymentResult, error) {
+	return DefaultRegistry.Charge(ctx, channelID, req)
+}
+
+// Query 使用默认注册表查询订单
+func Query(ctx context.Context, channelID int, tradeNo string) (*QueryResult, error) {
+	return DefaultRegistry.Query(ctx, channelID, tradeNo)
+}
+
+// Refund 使用默认注册表退款
+func Refund(ctx context.Context, channelID int, req *RefundRequest) (*RefundResult, error) {
+	return DefaultRegistry.Refund(ctx, channelID, req)
+}
+
+// QueryRefund 使用默认注册表查询退款
+func QueryRefund(ctx context.Context, channelID int, tradeNo, refundNo string) (*RefundResult, error) {
+	return DefaultRegistry.QueryRefund(ctx, channelID, tradeNo, refundNo)
+}
+
+// Close 使用默认注册表关闭订单
+func Close(ctx context.Context, channelID int, tradeNo string) error {
+	return DefaultRegistry.Close(ctx, channelID, tradeNo)
+}
+
+// ParseNotification 使用默认注册表解析异步通知
+func ParseNotification(channelID int, r *http.Request) (*Notification, error) {
+	return DefaultRegistry.ParseNotification(channelID, r)
+}
@@ -0,0 +1,70 @@
+package pay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type fakeProvider struct {
+	created *PaymentRequest
+}
+
+func (f *fakeProvider) CreatePayment(ctx context.Context, req *PaymentRequest) (*PaymentResult, error) {
+	f.created = req
+	return &PaymentResult{TradeNo: req.TradeNo, PayURL: "weixin://wxpay/test"}, nil
+}
+
+func (f *fakeProvider) Query(ctx context.Context, tradeNo string) (*QueryResult, error) {
+	return &QueryResult{TradeNo: tradeNo, Paid: true}, nil
+}
+
+func (f *fakeProvider) Refund(ctx context.Context, req *RefundRequest) (*RefundResult, error) {
+	return &RefundResult{TradeNo: req.TradeNo, RefundNo: req.RefundNo}, nil
+}
+
+func (f *fakeProvider) QueryRefund(ctx context.Context, tradeNo, refundNo string) (*RefundResult, error) {
+	return nil, ErrNotSupported
+}
+
+func (f *fakeProvider) Close(ctx context.Context, tradeNo string) error {
+	return nil
+}
+
+func (f *fakeProvider) ParseNotification(r *http.Request) (*Notification, error) {
+	return &Notification{}, nil
+}
+
+func TestRegistryCharge(t *testing.T) {
+	r := NewRegistry()
+	f := new(fakeProvider)
+	r.Register(CashChannelWxCodePay, f)
+
+	res, err := r.Charge(context.Background(), CashChannelWxCodePay, &PaymentRequest{TradeNo: "T001", Amount: CNY(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ChannelID != CashChannelWxCodePay || res.TradeNo != "T001" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if f.created == nil || f.created.Amount != CNY(1) {
+		t.Fatalf("request not dispatched: %+v", f.created)
+	}
+
+	q, err := r.Query(context.Background(), CashChannelWxCodePay, "T001")
+	if err != nil || !q.Paid {
+		t.Fatalf("query: %+v %v", q, err)
+	}
+	if _, err := r.QueryRefund(context.Background(), CashChannelWxCodePay, "T001", "R001"); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("want ErrNotSupported, got %v", err)
+	}
+}
+
+func TestRegistryNotFound(t *testing.T) {
+	r := NewRegistry()
+	_, err := r.Charge(context.Background(), CashChannelAliAppPay, &PaymentRequest{})
+	if !errors.Is(err, ErrProviderNotFound) {
+		t.Fatalf("want ErrProviderNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package pay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// sensitiveSuffixes 需脱敏的参数名后缀, 参数名转小写并去掉 _ 与 - 后比较
+// 覆盖签名、密钥、令牌、付款码、openid、证件号、银行账号与手机号
+var sensitiveSuffixes = []string{
+	"sign", "signature", "key", "secret", "token", "password",
+	"authcode", "openid", "unionid", "buyerid", "buyeruserid", "buyerlogonid",
+	"idcardnumber", "idcardno", "iddocnumber", "idnumber", "idno", "certno",
+	"accountnumber", "accountno", "bankaccount", "bankcard", "cardno", "encbankno", "enctruename",
+	"phonenumber", "mobile",
+}
+
+// IsSensitive 参数名是否需要脱敏
+func IsSensitive(key string) bool {
+	k := strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+	for _, s := range sensitiveSuffixes {
+		if strings.HasSuffix(k, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mask 脱敏, 较长的值保留末4位便于排查
+func Mask(value string) string {
+	if len(value) > 8 {
+		return "***" + value[len(value)-4:]
+	}
+	return "***"
+}
+
+var (
+	xmlField  = regexp.MustCompile(`<([A-Za-z0-9_\-]+)>(<!\[CDATA\[.*?\]\]>|[^<]*)</([A-Za-z0-9_\-]+)>`)
+	jsonField = regexp.MustCompile(`"([A-Za-z0-9_\-]+)"(\s*:\s*)"((?:[^"\\]|\\.)*)"`)
+	formField = regexp.MustCompile(`(^|[?&\s])([A-Za-z0-9_\-.]+)=([^&\s]*)`)
+)
+
+// RedactText 脱敏文本中的 xml 节点、json 字符串字段与 key=value 参数
+func RedactText(s string) string {
+	s = xmlField.ReplaceAllStringFunc(s, func(m string) string {
+		g := xmlField.FindStringSubmatch(m)
+		if g[1] != g[3] || !IsSensitive(g[1]) {
+			return m
+		}
+		v := strings.TrimSuffix(strings.TrimPrefix(g[2], "<![CDATA["), "]]>")
+		return "<" + g[1] + ">" + Mask(v) + "</" + g[1] + ">"
+	})
+	s = jsonField.ReplaceAllStringFunc(s, func(m string) string {
+		g := jsonField.FindStringSubmatch(m)
+		if !IsSensitive(g[1]) {
+			return m
+		}
+		return `"` + g[1] + `"` + g[2] + `"` + Mask(g[3]) + `"`
+	})
+	return formField.ReplaceAllStringFunc(s, func(m string) string {
+		g := formField.FindStringSubmatch(m)
+		if !IsSensitive(g[2]) {
+			return m
+		}
+		return g[1] + g[2] + "=" + Mask(g[3])
+	})
+}
+
+// RedactMap 返回脱敏后的参数副本
+func RedactMap(m map[string]string) map[string]string {
+	res := make(map[string]string, len(m))
+	for k, v := range m {
+		if IsSensitive(k) {
+			res[k] = Mask(v)
+		} else {
+			res[k] = RedactText(v)
+		}
+	}
+	return res
+}
+
+// RedactValue 按字段名与值类型脱敏, 结构体等复合类型转为json后处理
+func RedactValue(key string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if IsSensitive(key) {
+		return Mask(fmt.Sprint(value))
+	}
+	switch v := value.(type) {
+	case string:
+		return RedactText(v)
+	case []byte:
+		return RedactText(string(v))
+	case error:
+		return RedactText(v.Error())
+	case map[string]string:
+		return RedactMap(v)
+	case url.Values:
+		res := make(url.Values, len(v))
+		for k, vs := range v {
+			for _, s := range vs {
+				res.Add(k, RedactValue(k, s).(string))
+			}
+		}
+		return res
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case fmt.Stringer:
+		return RedactText(v.String())
+	}
+	if b, err := json.Marshal(value); err == nil {
+		return RedactText(string(b))
+	}
+	return RedactText(fmt.Sprintf("%+v", value))
+}
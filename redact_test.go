@@ -0,0 +1,89 @@
+package pay
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIsSensitive(t *testing.T) {
+	for _, k := range []string{"sign", "paySign", "pay_key", "APIv3Key", "auth_code", "openid", "sub_openid", "buyer_id",
+		"app_auth_token", "id_card_number", "cert_no", "account_number", "bank_account", "enc_bank_no", "purePhoneNumber"} {
+		if !IsSensitive(k) {
+			t.Errorf("%s should be sensitive", k)
+		}
+	}
+	for _, k := range []string{"sign_type", "out_trade_no", "total_fee", "nonce_str", "appid", "mch_id", "transaction_id"} {
+		if IsSensitive(k) {
+			t.Errorf("%s should not be sensitive", k)
+		}
+	}
+}
+
+func TestRedactText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{
+			"<xml><appid><![CDATA[wx123]]></appid><sign><![CDATA[0123456789ABCDEF]]></sign><openid>oUpF8uMuAJO_M2pxb1Q9zNjWeS6o</openid></xml>",
+			"<xml><appid><![CDATA[wx123]]></appid><sign>***CDEF</sign><openid>***eS6o</openid></xml>",
+		},
+		{
+			`{"alipay_trade_query_response":{"code":"10000","buyer_user_id":"2088102177846880"},"sign":"abc"}`,
+			`{"alipay_trade_query_response":{"code":"10000","buyer_user_id":"***6880"},"sign":"***"}`,
+		},
+		{
+			"https://openapi.alipay.com/gateway.do?app_id=2016&sign=abcdefghijklmn&sign_type=RSA2",
+			"https://openapi.alipay.com/gateway.do?app_id=2016&sign=***klmn&sign_type=RSA2",
+		},
+		{"auth_code=134567890123456789", "auth_code=***6789"},
+	}
+	for _, tt := range tests {
+		if got := RedactText(tt.in); got != tt.want {
+			t.Errorf("RedactText(%s)\n got %s\nwant %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactValue(t *testing.T) {
+	m := map[string]string{"sign": "0123456789ABCDEF", "out_trade_no": "T001"}
+	got := RedactValue("params", m).(map[string]string)
+	if got["sign"] != "***CDEF" || got["out_trade_no"] != "T001" || m["sign"] != "0123456789ABCDEF" {
+		t.Fatalf("unexpected map %v, original %v", got, m)
+	}
+	v := RedactValue("form", url.Values{"openid": {"o123456789"}}).(url.Values)
+	if v.Get("openid") != "***6789" {
+		t.Fatalf("unexpected values %v", v)
+	}
+	s := struct {
+		OpenID string `json:"openid"`
+		Amount int    `json:"amount"`
+	}{"o123456789", 100}
+	if got := RedactValue("result", s); got != `{"openid":"***6789","amount":100}` {
+		t.Fatalf("unexpected struct %v", got)
+	}
+	if got := RedactValue("err", errors.New("bad sign=0123456789")); got != "bad sign=***6789" {
+		t.Fatalf("unexpected error %v", got)
+	}
+	if got := RedactValue("private_key", "-----BEGIN KEY-----"); got != "***----" {
+		t.Fatalf("unexpected key %v", got)
+	}
+	if got := RedactValue("total_fee", 100); got != 100 {
+		t.Fatalf("unexpected int %v", got)
+	}
+}
+
+func TestLogRedacts(t *testing.T) {
+	var line string
+	l := LoggerFunc(func(level Level, msg string, fields ...Field) {
+		line = level.String() + " " + FormatFields(msg, fields)
+	})
+	Log(l, LevelWarn, "request", F("body", "<xml><sign>0123456789ABCDEF</sign></xml>"), F("openid", "o123456789"))
+	if strings.Contains(line, "0123456789ABCDEF") || strings.Contains(line, "o123456789") {
+		t.Fatalf("secret leaked: %s", line)
+	}
+	if line != `WARN request body=<xml><sign>***CDEF</sign></xml> openid=***6789` {
+		t.Fatalf("unexpected line %s", line)
+	}
+}
@@ -0,0 +1,40 @@
+package pay
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RefundStatus 统一退款状态
+type RefundStatus string
+
+// 统一退款状态
+const (
+	RefundProcessing RefundStatus = "processing" // 退款处理中
+	RefundSuccess    RefundStatus = "success"    // 退款成功
+	RefundClosed     RefundStatus = "closed"     // 退款关闭
+	RefundFailed     RefundStatus = "failed"     // 退款异常, 需人工处理
+)
+
+// ErrInvalidRefund 退款请求参数错误
+var ErrInvalidRefund = errors.New("pay: invalid refund request")
+
+// Validate 校验退款请求, 发往三方之前调用
+func (r *RefundRequest) Validate() error {
+	switch {
+	case r.TradeNo == "" && r.TransactionID == "":
+		return fmt.Errorf("%w: trade no or transaction id required", ErrInvalidRefund)
+	case r.RefundNo == "":
+		return fmt.Errorf("%w: refund no required", ErrInvalidRefund)
+	case !r.RefundAmount.IsPositive():
+		return fmt.Errorf("%w: refund amount must be positive", ErrInvalidRefund)
+	case r.TotalAmount.IsPositive() && r.RefundAmount.Amount > r.TotalAmount.Amount:
+		return fmt.Errorf("%w: refund amount %s exceeds total %s", ErrInvalidRefund, r.RefundAmount, r.TotalAmount)
+	}
+	return nil
+}
+
+// String 状态名
+func (s RefundStatus) String() string {
+	return string(s)
+}
@@ -0,0 +1,29 @@
+package pay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRefundRequestValidate(t *testing.T) {
+	ok := []RefundRequest{
+		{TradeNo: "T1", RefundNo: "R1", TotalAmount: CNY(100), RefundAmount: CNY(100)},
+		{TransactionID: "4200", RefundNo: "R2", RefundAmount: CNY(1)},
+	}
+	for _, r := range ok {
+		if err := r.Validate(); err != nil {
+			t.Fatalf("%+v: %v", r, err)
+		}
+	}
+	bad := []RefundRequest{
+		{RefundNo: "R1", RefundAmount: CNY(1)},
+		{TradeNo: "T1", RefundAmount: CNY(1)},
+		{TradeNo: "T1", RefundNo: "R1"},
+		{TradeNo: "T1", RefundNo: "R1", TotalAmount: CNY(100), RefundAmount: CNY(101)},
+	}
+	for _, r := range bad {
+		if err := r.Validate(); !errors.Is(err, ErrInvalidRefund) {
+			t.Fatalf("%+v: got %v", r, err)
+		}
+	}
+}
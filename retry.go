@@ -0,0 +1,127 @@
+package pay
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// 可配置重试的操作名
+const (
+	OpQueryOrder      = "QueryOrder"      // 订单查询
+	OpQueryRefund     = "QueryRefund"     // 退款查询
+	OpGetCertificates = "GetCertificates" // 微信平台证书下载
+	OpDownloadBill    = "DownloadBill"    // 对账单下载地址查询
+	OpDoPay           = "DoPay"           // 支付平台支付, 依赖幂等键防止重复扣款
+	OpDoOutPay        = "DoOutPay"        // 支付平台出账, 依赖幂等键防止重复出账
+)
+
+// RetryPolicy 三方网关瞬时失败的重试策略
+// 仅重试网络错误与可重试的业务错误(如微信 SYSTEMERROR、支付宝 ACQ.SYSTEM_ERROR), 且只对 Operations 中启用的操作生效
+type RetryPolicy struct {
+	MaxAttempts int             // 最多调用次数(含首次), 小于等于1时不重试
+	BaseDelay   time.Duration   // 首次重试前等待时间
+	MaxDelay    time.Duration   // 等待时间上限
+	Multiplier  float64         // 每次重试后等待时间的增长倍数, 小于1时按1处理
+	Jitter      float64         // 随机抖动比例(0~1), 实际等待时间在 [d*(1-Jitter), d] 之间
+	Operations  map[string]bool // 启用重试的操作, 非幂等操作不应开启
+
+	// OnRetry 每次重试前回调, attempt 为即将进行的第几次调用, 可为空
+	OnRetry func(provider, op string, attempt int, err error)
+}
+
+// DefaultRetryPolicy 默认重试策略, 仅对查询类幂等操作开启
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+	Multiplier:  2,
+	Jitter:      0.2,
+	Operations: map[string]bool{
+		OpQueryOrder:      true,
+		OpQueryRefund:     true,
+		OpGetCertificates: true,
+		OpDownloadBill:    true,
+	},
+}
+
+// RetryStats 重试次数, 按 "provider.操作" 统计, 通过 expvar 的 pay_retries 暴露
+var RetryStats = expvar.NewMap("pay_retries")
+
+// Do 调用 fn, 失败且可重试时按策略退避后重试, 返回最后一次的错误
+// p 为空或操作未启用时只调用一次
+func (p *RetryPolicy) Do(ctx context.Context, provider, op string, fn func(ctx context.Context) error) error {
+	err := fn(ctx)
+	if p == nil || !p.Operations[op] {
+		return err
+	}
+	delay := p.BaseDelay
+	for attempt := 2; attempt <= p.MaxAttempts && retryable(ctx, err); attempt++ {
+		if !p.sleep(ctx, p.jitter(delay)) {
+			return err
+		}
+		RetryStats.Add(provider+"."+op, 1)
+		if p.OnRetry != nil {
+			p.OnRetry(provider, op, attempt, err)
+		}
+		err = fn(ctx)
+		delay = p.next(delay)
+	}
+	return err
+}
+
+// next 下一次重试前的等待时间
+func (p *RetryPolicy) next(delay time.Duration) time.Duration {
+	m := p.Multiplier
+	if m < 1 {
+		m = 1
+	}
+	delay = time.Duration(float64(delay) * m)
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// jitter 随机缩短等待时间, 避免多个客户端同时重试
+func (p *RetryPolicy) jitter(delay time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return delay
+	}
+	j := p.Jitter
+	if j > 1 {
+		j = 1
+	}
+	return delay - time.Duration(rand.Float64()*j*float64(delay))
+}
+
+// sleep 等待 delay, ctx 在等待结束前取消或到期时返回 false
+func (p *RetryPolicy) sleep(ctx context.Context, delay time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return false
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// retryable 错误是否属于瞬时失败: 可重试的业务错误或网络错误, 验签失败与 ctx 取消不重试
+func retryable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil || errors.Is(err, ErrSignature) {
+		return false
+	}
+	var e *ProviderError
+	if errors.As(err, &e) {
+		return e.Retryable
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
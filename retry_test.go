@@ -0,0 +1,103 @@
+package pay
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"testing"
+	"time"
+)
+
+func testRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		Multiplier:  2,
+		Jitter:      0.5,
+		Operations:  map[string]bool{OpQueryOrder: true},
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	busy := &ProviderError{Provider: "wxpay", SubCode: "SYSTEMERROR", Retryable: true}
+	timeout := &net.DNSError{IsTimeout: true}
+	paid := &ProviderError{Provider: "wxpay", SubCode: "ORDERPAID", Err: ErrOrderPaid}
+	tests := []struct {
+		name  string
+		op    string
+		errs  []error
+		calls int
+		err   error
+	}{
+		{"success", OpQueryOrder, []error{nil}, 1, nil},
+		{"retryable then success", OpQueryOrder, []error{busy, timeout, nil}, 3, nil},
+		{"exhausted", OpQueryOrder, []error{busy, busy, busy, nil}, 3, busy},
+		{"business error", OpQueryOrder, []error{paid, nil}, 1, paid},
+		{"signature", OpQueryOrder, []error{&ResponseSignError{Err: errors.New("bad")}, nil}, 1, ErrSignature},
+		{"operation disabled", OpDoPay, []error{busy, nil}, 1, busy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := testRetryPolicy().Do(context.Background(), "test", tt.op, func(ctx context.Context) error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if calls != tt.calls || !errors.Is(err, tt.err) {
+				t.Fatalf("calls %d err %v", calls, err)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyNil(t *testing.T) {
+	var p *RetryPolicy
+	calls := 0
+	err := p.Do(context.Background(), "test", OpQueryOrder, func(ctx context.Context) error {
+		calls++
+		return &ProviderError{Retryable: true}
+	})
+	if calls != 1 || err == nil {
+		t.Fatalf("calls %d err %v", calls, err)
+	}
+}
+
+func TestRetryPolicyDeadline(t *testing.T) {
+	p := testRetryPolicy()
+	p.BaseDelay = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	calls := 0
+	start := time.Now()
+	p.Do(ctx, "test", OpQueryOrder, func(ctx context.Context) error {
+		calls++
+		return &ProviderError{Retryable: true}
+	})
+	if calls != 1 || time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("calls %d after %v", calls, time.Since(start))
+	}
+}
+
+func TestRetryStats(t *testing.T) {
+	var attempts []int
+	p := testRetryPolicy()
+	p.OnRetry = func(provider, op string, attempt int, err error) {
+		attempts = append(attempts, attempt)
+	}
+	before := retryCount("stats." + OpQueryOrder)
+	p.Do(context.Background(), "stats", OpQueryOrder, func(ctx context.Context) error {
+		return &ProviderError{Retryable: true}
+	})
+	if n := retryCount("stats."+OpQueryOrder) - before; n != 2 || len(attempts) != 2 || attempts[1] != 3 {
+		t.Fatalf("retries %d attempts %v", n, attempts)
+	}
+}
+
+func retryCount(key string) int64 {
+	v := RetryStats.Get(key)
+	if v == nil {
+		return 0
+	}
+	return v.(*expvar.Int).Value()
+}
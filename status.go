@@ -0,0 +1,95 @@
+package pay
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PaymentStatus 统一订单状态, 由各渠道的原始状态归一而来
+type PaymentStatus string
+
+// 统一订单状态
+const (
+	StatusCreated           PaymentStatus = "created"            // 本地已创建, 未向三方下单
+	StatusPending           PaymentStatus = "pending"            // 已下单, 等待用户支付
+	StatusPaid              PaymentStatus = "paid"               // 支付成功
+	StatusPartiallyRefunded PaymentStatus = "partially_refunded" // 部分退款
+	StatusRefunded          PaymentStatus = "refunded"           // 全额退款
+	StatusClosed            PaymentStatus = "closed"             // 已关闭或已撤销
+	StatusFailed            PaymentStatus = "failed"             // 支付失败
+)
+
+var (
+	// ErrInvalidTransition 不允许的状态流转
+	ErrInvalidTransition = errors.New("pay: invalid payment status transition")
+	// ErrUnknownStatus 无法识别的三方订单状态
+	ErrUnknownStatus = errors.New("pay: unknown payment status")
+)
+
+// statusTransitions 各状态允许流转到的状态, 终态没有后继
+// 支付宝全额退款后交易关闭, 微信付款码撤销后订单关闭, 因此已支付订单可直接关闭
+var statusTransitions = map[PaymentStatus][]PaymentStatus{
+	StatusCreated:           {StatusPending, StatusPaid, StatusClosed, StatusFailed},
+	StatusPending:           {StatusPaid, StatusClosed, StatusFailed},
+	StatusPaid:              {StatusPartiallyRefunded, StatusRefunded, StatusClosed},
+	StatusPartiallyRefunded: {StatusPartiallyRefunded, StatusRefunded, StatusClosed},
+	StatusRefunded:          nil,
+	StatusClosed:            nil,
+	StatusFailed:            nil,
+}
+
+// Valid 是否为已定义的状态
+func (s PaymentStatus) Valid() bool {
+	_, ok := statusTransitions[s]
+	return ok
+}
+
+// IsFinal 是否为终态
+func (s PaymentStatus) IsFinal() bool {
+	return s.Valid() && len(statusTransitions[s]) == 0
+}
+
+// IsPaid 用户是否已完成支付, 退款中的订单也视为已支付
+func (s PaymentStatus) IsPaid() bool {
+	return s == StatusPaid || s == StatusPartiallyRefunded || s == StatusRefunded
+}
+
+// CanTransition 是否允许从 s 流转到 to, 状态不变视为允许(重复通知、重复查询)
+func (s PaymentStatus) CanTransition(to PaymentStatus) bool {
+	if !s.Valid() || !to.Valid() {
+		return false
+	}
+	if s == to {
+		return true
+	}
+	for _, next := range statusTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition 校验并返回流转后的状态, 不允许时返回 ErrInvalidTransition
+func (s PaymentStatus) Transition(to PaymentStatus) (PaymentStatus, error) {
+	if !s.CanTransition(to) {
+		return s, fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, s, to)
+	}
+	return to, nil
+}
+
+// String 状态名
+func (s PaymentStatus) String() string {
+	return string(s)
+}
+
+// Status 支付平台返回状态对应的统一状态, 受理成功为 pending, failed 为 failed
+func (d *CommonResponse) Status() (PaymentStatus, error) {
+	switch d.State {
+	case "success":
+		return StatusPending, nil
+	case "failed":
+		return StatusFailed, nil
+	}
+	return "", fmt.Errorf("%w: jxpay state %q", ErrUnknownStatus, d.State)
+}
@@ -0,0 +1,56 @@
+package pay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPaymentStatusTransition(t *testing.T) {
+	path := []PaymentStatus{StatusCreated, StatusPending, StatusPaid, StatusPartiallyRefunded, StatusPartiallyRefunded, StatusRefunded}
+	s := path[0]
+	for _, to := range path[1:] {
+		next, err := s.Transition(to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s = next
+	}
+	if !s.IsFinal() || !s.IsPaid() {
+		t.Fatalf("refunded should be final and paid: %s", s)
+	}
+
+	illegal := []struct{ from, to PaymentStatus }{
+		{StatusPaid, StatusPending},
+		{StatusRefunded, StatusPartiallyRefunded},
+		{StatusClosed, StatusPaid},
+		{StatusPending, StatusRefunded},
+		{StatusFailed, StatusPaid},
+		{StatusCreated, "unknown"},
+	}
+	for _, c := range illegal {
+		got, err := c.from.Transition(c.to)
+		if !errors.Is(err, ErrInvalidTransition) {
+			t.Fatalf("%s -> %s: expected ErrInvalidTransition, got %v", c.from, c.to, err)
+		}
+		if got != c.from {
+			t.Fatalf("%s -> %s: status changed to %s", c.from, c.to, got)
+		}
+	}
+
+	// 重复通知不改变状态
+	if !StatusPaid.CanTransition(StatusPaid) || StatusPending.IsFinal() {
+		t.Fatal("unexpected transition rules")
+	}
+}
+
+func TestCommonResponseStatus(t *testing.T) {
+	if s, err := (&CommonResponse{State: "failed"}).Status(); err != nil || s != StatusFailed {
+		t.Fatalf("failed: %s %v", s, err)
+	}
+	if s, err := (&CommonResponse{State: "success"}).Status(); err != nil || s != StatusPending {
+		t.Fatalf("success: %s %v", s, err)
+	}
+	if _, err := (&CommonResponse{State: "?"}).Status(); !errors.Is(err, ErrUnknownStatus) {
+		t.Fatalf("unknown: %v", err)
+	}
+}
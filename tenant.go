@@ -0,0 +1,199 @@
+package pay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTenantNotFound 注册表中没有对应的商户
+	ErrTenantNotFound = errors.New("pay: tenant not found")
+	// ErrTenantNotConfigured 商户未配置该渠道的支付参数
+	ErrTenantNotConfigured = errors.New("pay: tenant not configured for provider")
+)
+
+// TenantLoader 商户支付参数加载器, 由业务方按自身存储实现
+type TenantLoader interface {
+	// LoadPayItems 加载全部商户的支付参数
+	LoadPayItems(ctx context.Context) ([]PayItem, error)
+}
+
+// TenantLoaderFunc 函数形式的 TenantLoader
+type TenantLoaderFunc func(ctx context.Context) ([]PayItem, error)
+
+// LoadPayItems 实现 TenantLoader
+func (f TenantLoaderFunc) LoadPayItems(ctx context.Context) ([]PayItem, error) {
+	return f(ctx)
+}
+
+// ClientBuilder 按商户支付参数构建并校验三方客户端, 由 wxpay、alipay 包提供
+// 商户未配置该渠道时应返回 ErrTenantNotConfigured
+type ClientBuilder func(item PayItem) (interface{}, error)
+
+// TenantRegistry 按商户缓存由 PayItem 构建的三方客户端
+// Reload 时仅重建支付参数发生变化的商户, 未变化的商户沿用已构建的客户端
+type TenantRegistry struct {
+	loader TenantLoader
+
+	// ReloadError 后台热更新失败时回调, 失败时继续使用上一次加载的参数
+	ReloadError func(err error)
+
+	mu       sync.RWMutex
+	tenants  map[int]*tenantEntry
+	builders map[string]ClientBuilder
+}
+
+// tenantEntry 单个商户的支付参数与已构建的客户端
+type tenantEntry struct {
+	item PayItem
+
+	mu      sync.Mutex
+	clients map[string]interface{}
+}
+
+// NewTenantRegistry 创建商户注册表并完成首次加载
+func NewTenantRegistry(ctx context.Context, loader TenantLoader) (*TenantRegistry, error) {
+	r := &TenantRegistry{
+		loader:   loader,
+		tenants:  make(map[int]*tenantEntry),
+		builders: make(map[string]ClientBuilder),
+	}
+	if err := r.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// RegisterBuilder 注册渠道客户端的构建方法, 重复注册时覆盖并清空该渠道已构建的客户端
+func (r *TenantRegistry) RegisterBuilder(kind string, b ClientBuilder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.builders[kind] = b
+	for _, e := range r.tenants {
+		e.mu.Lock()
+		delete(e.clients, kind)
+		e.mu.Unlock()
+	}
+}
+
+// Reload 重新加载全部商户支付参数, 加载失败时保留原有参数
+func (r *TenantRegistry) Reload(ctx context.Context) error {
+	items, err := r.loader.LoadPayItems(ctx)
+	if err != nil {
+		return fmt.Errorf("pay: load tenants: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tenants := make(map[int]*tenantEntry, len(items))
+	for _, item := range items {
+		if old, ok := r.tenants[item.TenantId]; ok && old.item == item {
+			tenants[item.TenantId] = old
+			continue
+		}
+		tenants[item.TenantId] = &tenantEntry{item: item, clients: make(map[string]interface{})}
+	}
+	r.tenants = tenants
+	return nil
+}
+
+// Update 更新单个商户的支付参数, 参数变化时丢弃该商户已构建的客户端
+func (r *TenantRegistry) Update(item PayItem) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.tenants[item.TenantId]; ok && old.item == item {
+		return
+	}
+	r.tenants[item.TenantId] = &tenantEntry{item: item, clients: make(map[string]interface{})}
+}
+
+// Remove 移除商户
+func (r *TenantRegistry) Remove(tenantID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tenants, tenantID)
+}
+
+// Watch 按 interval 定期热更新, 直到 ctx 结束
+func (r *TenantRegistry) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reload(ctx); err != nil && r.ReloadError != nil {
+				r.ReloadError(err)
+			}
+		}
+	}
+}
+
+// PayItem 获取商户当前的支付参数
+func (r *TenantRegistry) PayItem(tenantID int) (PayItem, error) {
+	e, err := r.entry(tenantID)
+	if err != nil {
+		return PayItem{}, err
+	}
+	return e.item, nil
+}
+
+// FindTenant 按条件查找唯一匹配的商户, 用于从异步通知中的商户号反查商户
+func (r *TenantRegistry) FindTenant(match func(item PayItem) bool) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	found := 0
+	tenantID := 0
+	for id, e := range r.tenants {
+		if match(e.item) {
+			found++
+			tenantID = id
+		}
+	}
+	switch found {
+	case 0:
+		return 0, ErrTenantNotFound
+	case 1:
+		return tenantID, nil
+	default:
+		return 0, fmt.Errorf("pay: %d tenants match the notification", found)
+	}
+}
+
+// Client 获取商户指定渠道的客户端, 首次使用时构建并缓存
+func (r *TenantRegistry) Client(tenantID int, kind string) (interface{}, error) {
+	r.mu.RLock()
+	b, ok := r.builders[kind]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("pay: no client builder for %s", kind)
+	}
+	e, err := r.entry(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if c, ok := e.clients[kind]; ok {
+		return c, nil
+	}
+	c, err := b(e.item)
+	if err != nil {
+		return nil, fmt.Errorf("pay: tenant %d %s client: %w", tenantID, kind, err)
+	}
+	e.clients[kind] = c
+	return c, nil
+}
+
+func (r *TenantRegistry) entry(tenantID int) (*tenantEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.tenants[tenantID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrTenantNotFound, tenantID)
+	}
+	return e, nil
+}
@@ -0,0 +1,99 @@
+package pay
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestTenantRegistryReload(t *testing.T) {
+	var mu sync.Mutex
+	items := []PayItem{
+		{TenantId: 1, WxMchId: "1000000001", WxPayKey: "key1"},
+		{TenantId: 2, WxMchId: "1000000002", WxPayKey: "key2"},
+	}
+	var loadErr error
+	loader := TenantLoaderFunc(func(ctx context.Context) ([]PayItem, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]PayItem(nil), items...), loadErr
+	})
+	r, err := NewTenantRegistry(context.Background(), loader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builds := 0
+	r.RegisterBuilder("wx", func(item PayItem) (interface{}, error) {
+		if item.WxMchId == "" {
+			return nil, ErrTenantNotConfigured
+		}
+		builds++
+		return &PayItem{WxPayKey: item.WxPayKey}, nil
+	})
+
+	c1, err := r.Client(1, "wx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := r.Client(1, "wx"); again != c1 || builds != 1 {
+		t.Fatalf("client should be cached, builds=%d", builds)
+	}
+	if _, err := r.Client(3, "wx"); !errors.Is(err, ErrTenantNotFound) {
+		t.Fatalf("want ErrTenantNotFound, got %v", err)
+	}
+
+	// 商户1密钥变更, 商户2不变
+	mu.Lock()
+	items[0].WxPayKey = "key1-rotated"
+	mu.Unlock()
+	c2, _ := r.Client(2, "wx")
+	if err := r.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c1New, _ := r.Client(1, "wx")
+	if c1New == c1 || c1New.(*PayItem).WxPayKey != "key1-rotated" {
+		t.Fatal("changed tenant should be rebuilt")
+	}
+	if again, _ := r.Client(2, "wx"); again != c2 {
+		t.Fatal("unchanged tenant should keep its client")
+	}
+
+	// 加载失败时保留原有参数
+	mu.Lock()
+	loadErr = errors.New("db down")
+	mu.Unlock()
+	if err := r.Reload(context.Background()); err == nil {
+		t.Fatal("reload should fail")
+	}
+	if item, err := r.PayItem(1); err != nil || item.WxPayKey != "key1-rotated" {
+		t.Fatalf("tenant lost after failed reload: %v", err)
+	}
+
+	r.Update(PayItem{TenantId: 4})
+	if _, err := r.Client(4, "wx"); !errors.Is(err, ErrTenantNotConfigured) {
+		t.Fatalf("want ErrTenantNotConfigured, got %v", err)
+	}
+}
+
+func TestTenantRegistryFindTenant(t *testing.T) {
+	r, err := NewTenantRegistry(context.Background(), TenantLoaderFunc(func(ctx context.Context) ([]PayItem, error) {
+		return []PayItem{
+			{TenantId: 1, WxMchId: "1000000001", WxSubMchId: "1"},
+			{TenantId: 2, WxMchId: "1000000001", WxSubMchId: "2"},
+		}, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := r.FindTenant(func(item PayItem) bool { return item.WxSubMchId == "2" })
+	if err != nil || id != 2 {
+		t.Fatalf("FindTenant = %d, %v", id, err)
+	}
+	if _, err := r.FindTenant(func(item PayItem) bool { return item.WxMchId == "1000000001" }); err == nil {
+		t.Fatal("ambiguous match should fail")
+	}
+	if _, err := r.FindTenant(func(item PayItem) bool { return false }); !errors.Is(err, ErrTenantNotFound) {
+		t.Fatalf("want ErrTenantNotFound, got %v", err)
+	}
+}
@@ -3,54 +3,46 @@ package wxpay
 import (
 	"encoding/xml"
 	"errors"
-	"fmt"
-	"github.com/astaxie/beego/logs"
+	"github.com/jxwt/pay"
 	"net/http"
 )
 
-func WeChatAppCallback(w http.ResponseWriter,body []byte, callback func(string) string) (*WeChatPayResult, error) {
+// WeChatAppCallback 支付回调, callback 按商户单号返回支付密钥
+// 签名校验失败时应答FAIL并返回错误; 需校验商户号与金额时使用 WxClient.HandlePaymentNotification
+// 多商户按商户号取密钥时使用 HandleTenantPaymentNotification
+func WeChatAppCallback(w http.ResponseWriter, body []byte, callback func(string) string) (*WeChatPayResult, error) {
 	var returnCode = "FAIL"
 	var returnMsg = ""
 	defer func() {
-		formatStr := `<xml><return_code><![CDATA[%s]]></return_code>
-                  <return_msg>![CDATA[%s]]</return_msg></xml>`
-		returnBody := fmt.Sprintf(formatStr, returnCode, returnMsg)
-		w.Write([]byte(returnBody))
+		if returnCode == "SUCCESS" {
+			w.Write([]byte(WechatCallBackSuccessRes()))
+			return
+		}
+		w.Write([]byte(WechatCallBackFailRes(returnMsg)))
 	}()
 	var reXML WeChatPayResult
 	err := xml.Unmarshal(body, &reXML)
 	if err != nil {
-		logs.Warning(err)
+		pay.Log(nil, pay.LevelWarn, "wxpay: parse payment callback", pay.F("err", err))
 		returnMsg = "参数错误"
-		returnCode = "FAIL"
+		return nil, err
 	}
 
 	if reXML.ReturnCode != "SUCCESS" {
-		logs.Error(reXML)
-		returnCode = "FAIL"
+		pay.Log(nil, pay.LevelError, "wxpay: payment callback failed", pay.F("callback", reXML))
+		returnMsg = reXML.ReturnMsg
 		return &reXML, errors.New(reXML.ReturnCode)
 	}
 
-	m := XmlToMap(body)
-	wxClient := new(WxClient)
-	var signData []string
-	for k, v := range m {
-		if k == "sign" {
-			continue
-		}
-		if k == "out_trade_no" {
-			wxClient.PayKey = callback(v)
-		}
-		signData = append(signData, fmt.Sprintf("%v=%v", k, v))
-	}
-
-	mySign, err := WechatGenSign(wxClient.PayKey, m)
+	m, err := XmlToMap(body)
 	if err != nil {
+		returnMsg = "参数错误"
 		return &reXML, err
 	}
-
-	if mySign != m["sign"] {
-		logs.Error("签名交易错误")
+	if err := verifyNotifySign(callback(m["out_trade_no"]), m); err != nil {
+		pay.Log(nil, pay.LevelError, "wxpay: payment callback sign error", pay.F("out_trade_no", m["out_trade_no"]))
+		returnMsg = "签名错误"
+		return &reXML, err
 	}
 
 	returnCode = "SUCCESS"
@@ -0,0 +1,271 @@
+package wxpay
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jxwt/pay"
+)
+
+// 平台证书 https://pay.weixin.qq.com/wiki/doc/apiv3/apis/wechatpay5_1.shtml
+// 平台证书会轮换, 新旧证书在过渡期内同时有效, 需按 Wechatpay-Serial 选择验签证书
+
+var (
+	// CertRefreshInterval 平台证书定期刷新间隔
+	CertRefreshInterval = 12 * time.Hour
+	// CertRefreshBefore 在证书过期前多久提前刷新
+	CertRefreshBefore = 24 * time.Hour
+	// CertMissRefreshInterval 遇到未知序列号时两次强制刷新的最小间隔, 防止伪造序列号频繁触发下载
+	CertMissRefreshInterval = time.Minute
+)
+
+// PlatformCertificate 解密后的平台证书
+type PlatformCertificate struct {
+	SerialNo      string
+	EffectiveTime time.Time
+	ExpireTime    time.Time
+	PEM           string // 证书原文, 用于敏感信息加密
+	Certificate   *x509.Certificate
+}
+
+// PublicKey 证书公钥
+func (c *PlatformCertificate) PublicKey() (*rsa.PublicKey, error) {
+	pub, ok := c.Certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("wxpay: platform certificate is not rsa")
+	}
+	return pub, nil
+}
+
+// validAt 证书在 t 时刻是否有效
+func (c *PlatformCertificate) validAt(t time.Time) bool {
+	return !t.Before(c.EffectiveTime) && t.Before(c.ExpireTime)
+}
+
+// CertificateStore 并发安全的平台证书缓存, 按序列号保存全部证书并在过期前自动刷新
+type CertificateStore struct {
+	client *WxClient
+
+	mu          sync.RWMutex
+	certs       map[string]*PlatformCertificate
+	refreshAt   time.Time // 下次定期刷新时间
+	lastRefresh time.Time
+
+	refreshMu sync.Mutex // 保证同一时刻只有一个刷新请求
+}
+
+// NewCertificateStore 创建平台证书缓存, 证书在首次使用时下载
+func NewCertificateStore(c *WxClient) *CertificateStore {
+	return &CertificateStore{client: c, certs: make(map[string]*PlatformCertificate)}
+}
+
+// certStore 客户端使用的证书缓存, 未配置 CertStore 时使用客户端自己的缓存, 首次使用时创建
+// 缓存随客户端释放, 密钥轮换后新建的客户端不会沿用旧密钥签名与解密
+func (i *WxClient) certStore() *CertificateStore {
+	if i.CertStore != nil {
+		return i.CertStore
+	}
+	i.certMu.Lock()
+	defer i.certMu.Unlock()
+	if i.platformCerts == nil {
+		i.platformCerts = NewCertificateStore(i)
+	}
+	return i.platformCerts
+}
+
+// Get 按序列号获取平台证书, 缓存中没有时强制刷新一次
+func (s *CertificateStore) Get(ctx context.Context, serial string) (*PlatformCertificate, error) {
+	if err := s.refreshIfNeeded(ctx); err != nil {
+		return nil, err
+	}
+	if cert := s.lookup(serial); cert != nil {
+		return cert, nil
+	}
+	// 新证书可能在定期刷新之前就开始使用
+	s.mu.RLock()
+	recent := time.Since(s.lastRefresh) < CertMissRefreshInterval
+	s.mu.RUnlock()
+	if !recent {
+		if err := s.Refresh(ctx); err != nil {
+			return nil, err
+		}
+		if cert := s.lookup(serial); cert != nil {
+			return cert, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrPlatformCertNotFound, serial)
+}
+
+// Newest 返回当前有效且生效时间最新的平台证书, 用于敏感信息加密
+func (s *CertificateStore) Newest(ctx context.Context) (*PlatformCertificate, error) {
+	if err := s.refreshIfNeeded(ctx); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var newest *PlatformCertificate
+	for _, cert := range s.certs {
+		if !cert.validAt(now) {
+			continue
+		}
+		if newest == nil || cert.EffectiveTime.After(newest.EffectiveTime) {
+			newest = cert
+		}
+	}
+	if newest == nil {
+		return nil, ErrPlatformCertNotFound
+	}
+	return newest, nil
+}
+
+// Certificates 缓存中的全部证书, 按生效时间排序
+func (s *CertificateStore) Certificates() []*PlatformCertificate {
+	s.mu.RLock()
+	res := make([]*PlatformCertificate, 0, len(s.certs))
+	for _, cert := range s.certs {
+		res = append(res, cert)
+	}
+	s.mu.RUnlock()
+	sort.Slice(res, func(a, b int) bool { return res[a].EffectiveTime.Before(res[b].EffectiveTime) })
+	return res
+}
+
+// Verify 按 Wechatpay-Serial 对应的平台证书校验应答或通知签名
+func (s *CertificateStore) Verify(ctx context.Context, header http.Header, body []byte) error {
+	cert, err := s.Get(ctx, header.Get(HeaderWechatpaySerial))
+	if err != nil {
+		return err
+	}
+	return verifyV3Header(cert, header, body)
+}
+
+// lookup 按序列号查找未过期的证书
+func (s *CertificateStore) lookup(serial string) *PlatformCertificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cert, ok := s.certs[serial]
+	if !ok || !time.Now().Before(cert.ExpireTime) {
+		return nil
+	}
+	return cert
+}
+
+// refreshIfNeeded 到达刷新时间时刷新, 刷新失败但仍有有效证书时继续使用缓存
+func (s *CertificateStore) refreshIfNeeded(ctx context.Context) error {
+	s.mu.RLock()
+	due := !time.Now().Before(s.refreshAt)
+	empty := len(s.certs) == 0
+	s.mu.RUnlock()
+	if !due {
+		return nil
+	}
+	err := s.Refresh(ctx)
+	if err != nil && !empty {
+		s.client.log(pay.LevelWarn, "wxpay: refresh platform certificates", pay.F("err", err))
+		return nil
+	}
+	return err
+}
+
+// Refresh 重新下载平台证书, 用下载的证书校验应答签名后替换缓存
+// 距上次刷新不足 CertMissRefreshInterval 且未到刷新时间时不重复下载
+func (s *CertificateStore) Refresh(ctx context.Context) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	// 等待锁期间其他请求可能已经刷新
+	s.mu.RLock()
+	fresh := len(s.certs) > 0 && time.Since(s.lastRefresh) < CertMissRefreshInterval && time.Now().Before(s.refreshAt)
+	s.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	var resp *http.Response
+	var body []byte
+	err := s.client.retry(ctx, pay.OpGetCertificates, func(ctx context.Context) error {
+		var err error
+		resp, body, err = s.client.v3Do(ctx, "GET", "/v3/certificates", nil)
+		if err == nil && resp.StatusCode/100 != 2 {
+			err = v3StatusError("GET", "/v3/certificates", resp.StatusCode, body)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	res := new(GetCertificatesResponse)
+	if err := json.Unmarshal(body, res); err != nil {
+		return errors.New("json.Unmarshal: " + err.Error())
+	}
+	certs := make(map[string]*PlatformCertificate, len(res.Data))
+	for _, d := range res.Data {
+		cert, err := decryptPlatformCertificate(s.client.apiV3Key(), d.SerialNo, d.EffectiveTime, d.ExpireTime, d.EncryptCertificate.Nonce, d.EncryptCertificate.AssociatedData, d.EncryptCertificate.Ciphertext)
+		if err != nil {
+			return fmt.Errorf("wxpay: decrypt platform certificate %s: %v", d.SerialNo, err)
+		}
+		certs[cert.SerialNo] = cert
+	}
+	// 证书下载应答本身也需验签, 使用刚下载的证书
+	signer, ok := certs[resp.Header.Get(HeaderWechatpaySerial)]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrPlatformCertNotFound, resp.Header.Get(HeaderWechatpaySerial))
+	}
+	if err := verifyV3Header(signer, resp.Header, body); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	refreshAt := now.Add(CertRefreshInterval)
+	for _, cert := range certs {
+		if t := cert.ExpireTime.Add(-CertRefreshBefore); cert.validAt(now) && t.Before(refreshAt) {
+			refreshAt = t
+		}
+	}
+	if refreshAt.Before(now.Add(CertMissRefreshInterval)) {
+		refreshAt = now.Add(CertMissRefreshInterval)
+	}
+	s.mu.Lock()
+	s.certs = certs
+	s.refreshAt = refreshAt
+	s.lastRefresh = now
+	s.mu.Unlock()
+	return nil
+}
+
+// decryptPlatformCertificate 解密并解析平台证书, 时间缺失时取证书自身有效期
+func decryptPlatformCertificate(apiv3key, serial, effective, expire, nonce, associatedData, ciphertext string) (*PlatformCertificate, error) {
+	plaintext, err := DecryptV3Resource(apiv3key, nonce, associatedData, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	x, err := parseCertificate(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	cert := &PlatformCertificate{
+		SerialNo:      serial,
+		EffectiveTime: x.NotBefore,
+		ExpireTime:    x.NotAfter,
+		PEM:           string(plaintext),
+		Certificate:   x,
+	}
+	if t, err := time.Parse(time.RFC3339, effective); err == nil {
+		cert.EffectiveTime = t
+	}
+	if t, err := time.Parse(time.RFC3339, expire); err == nil {
+		cert.ExpireTime = t
+	}
+	if cert.SerialNo == "" {
+		cert.SerialNo = fmt.Sprintf("%X", x.SerialNumber)
+	}
+	return cert, nil
+}
@@ -0,0 +1,167 @@
+package wxpay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jxwt/pay"
+)
+
+func TestCertificateStoreNewest(t *testing.T) {
+	old := newTestPlatform(t, 0x01, time.Now().Add(2*time.Hour))
+	newer := newTestPlatform(t, 0x02, time.Now().Add(48*time.Hour))
+	c, done := v3NotifyClient(t, old, newer)
+	defer done()
+
+	// 两张证书 NotBefore 相同, 以 effective_time 区分
+	s := NewCertificateStore(c)
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Certificates()); n != 2 {
+		t.Fatalf("want 2 certs, got %d", n)
+	}
+	s.certs[old.serial].EffectiveTime = time.Now().Add(-2 * time.Hour)
+	cert, err := s.Newest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.SerialNo != newer.serial {
+		t.Fatalf("want newest %s, got %s", newer.serial, cert.SerialNo)
+	}
+	// 快过期的证书使刷新时间提前
+	if s.refreshAt.After(time.Now().Add(CertRefreshInterval)) {
+		t.Fatalf("refreshAt %v not before interval", s.refreshAt)
+	}
+}
+
+func TestCertificateStoreRotation(t *testing.T) {
+	first := newTestPlatform(t, 0x01, time.Now().Add(48*time.Hour))
+	second := newTestPlatform(t, 0x02, time.Now().Add(72*time.Hour))
+	var fetches int32
+	current := []*testPlatform{first}
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		mu.Lock()
+		platforms := current
+		mu.Unlock()
+		certificatesHandler(t, platforms...)(w, r)
+	}))
+	defer srv.Close()
+	_, keyPEM := testV3Key(t)
+	c := &WxClient{MchID: "1230000109", APIv3Key: testAPIv3Key, KeyPEM: keyPEM, BaseURL: srv.URL, HTTPClient: srv.Client()}
+	s := NewCertificateStore(c)
+
+	// 并发首次使用只下载一次
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Get(context.Background(), first.serial); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("want 1 fetch, got %d", n)
+	}
+
+	// 平台启用新证书, 刚刷新过时不重复下载
+	mu.Lock()
+	current = []*testPlatform{second, first}
+	mu.Unlock()
+	if _, err := s.Get(context.Background(), second.serial); !errors.Is(err, ErrPlatformCertNotFound) {
+		t.Fatalf("want ErrPlatformCertNotFound, got %v", err)
+	}
+	s.lastRefresh = time.Now().Add(-CertMissRefreshInterval)
+	if _, err := s.Get(context.Background(), second.serial); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("want 2 fetches, got %d", n)
+	}
+
+	// 应答可按 Wechatpay-Serial 使用任一证书验签
+	body := []byte(`{"code":"SUCCESS"}`)
+	if err := s.Verify(context.Background(), first.sign(t, body, time.Now()), body); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Verify(context.Background(), second.sign(t, body, time.Now()), []byte("tampered")); !errors.Is(err, ErrNotifySign) {
+		t.Fatalf("want ErrNotifySign, got %v", err)
+	}
+}
+
+func TestCertificateStoreRejectsUnsignedDownload(t *testing.T) {
+	p := newTestPlatform(t, 0x01, time.Now().Add(48*time.Hour))
+	forger := newTestPlatform(t, 0x02, time.Now().Add(48*time.Hour))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := certificatesBody(t, p)
+		h := forger.sign(t, body, time.Now())
+		h.Set(HeaderWechatpaySerial, p.serial)
+		for k, v := range h {
+			w.Header()[k] = v
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+	_, keyPEM := testV3Key(t)
+	c := &WxClient{MchID: "1230000109", APIv3Key: testAPIv3Key, KeyPEM: keyPEM, BaseURL: srv.URL, HTTPClient: srv.Client()}
+	if err := NewCertificateStore(c).Refresh(context.Background()); !errors.Is(err, ErrNotifySign) {
+		t.Fatalf("want ErrNotifySign, got %v", err)
+	}
+}
+
+func TestCertStorePerClient(t *testing.T) {
+	_, keyPEM := testV3Key(t)
+	_, rotated := testV3Key(t)
+	c := &WxClient{MchID: "1230000109", APIv3Key: testAPIv3Key, KeyPEM: keyPEM, BaseURL: "http://wx.test"}
+	if c.certStore() != c.certStore() {
+		t.Fatal("client should reuse its store")
+	}
+	// 密钥轮换后新建的客户端使用自己的缓存与凭证
+	other := &WxClient{MchID: "1230000109", APIv3Key: "rotatedrotatedrotatedrotatedrota", KeyPEM: rotated, BaseURL: "http://wx.test"}
+	if other.certStore() == c.certStore() {
+		t.Fatal("rotated client shares store")
+	}
+	if other.certStore().client != other {
+		t.Fatal("store uses another client's credentials")
+	}
+	shared := NewCertificateStore(c)
+	other.CertStore = shared
+	if other.certStore() != shared {
+		t.Fatal("configured CertStore not used")
+	}
+}
+
+func TestCertificateStoreRefreshRetry(t *testing.T) {
+	p := newTestPlatform(t, 0x01, time.Now().Add(48*time.Hour))
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&fetches, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"code":"SYSTEM_ERROR","message":"busy"}`))
+			return
+		}
+		certificatesHandler(t, p)(w, r)
+	}))
+	defer srv.Close()
+	_, keyPEM := testV3Key(t)
+	policy := pay.DefaultRetryPolicy
+	policy.BaseDelay = time.Millisecond
+	c := &WxClient{MchID: "1230000109", APIv3Key: testAPIv3Key, KeyPEM: keyPEM, BaseURL: srv.URL, HTTPClient: srv.Client(), RetryPolicy: &policy}
+	if err := NewCertificateStore(c).Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Fatalf("want 2 fetches, got %d", n)
+	}
+}
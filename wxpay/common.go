@@ -2,38 +2,39 @@ package wxpay
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"github.com/astaxie/beego/logs"
 	"github.com/axgle/mahonia"
 	"github.com/jxwt/pay"
 	"github.com/jxwt/tools"
-	"github.com/shopspring/decimal"
 	"io"
-	"io/ioutil"
+	"net/http"
+	neturl "net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // Charge 支付参数
 type Charge struct {
-	TradeNum    string  `json:"tradeNum,omitempty"`
-	Origin      string  `json:"origin,omitempty"`
-	UserID      string  `json:"userId,omitempty"`
-	PayMethod   int64   `json:"payMethod,omitempty"`
-	MoneyFee    float64 `json:"MoneyFee,omitempty"`
-	CallbackURL string  `json:"callbackURL,omitempty"`
-	ReturnURL   string  `json:"returnURL,omitempty"`
-	ShowURL     string  `json:"showURL,omitempty"`
-	Describe    string  `json:"describe,omitempty"`
-	OpenID      string  `json:"openid,omitempty"`
-	CheckName   bool    `json:"check_name,omitempty"`
-	ReUserName  string  `json:"re_user_name,omitempty"`
-	BuyerId     string  `json:"buyerId,omitempty"`
+	TradeNum    string    `json:"tradeNum,omitempty"`
+	Origin      string    `json:"origin,omitempty"`
+	UserID      string    `json:"userId,omitempty"`
+	PayMethod   int64     `json:"payMethod,omitempty"`
+	MoneyFee    pay.Money `json:"MoneyFee,omitempty"`
+	CallbackURL string    `json:"callbackURL,omitempty"`
+	ReturnURL   string    `json:"returnURL,omitempty"`
+	ShowURL     string    `json:"showURL,omitempty"`
+	Describe    string    `json:"describe,omitempty"`
+	OpenID      string    `json:"openid,omitempty"`
+	CheckName   bool      `json:"check_name,omitempty"`
+	ReUserName  string    `json:"re_user_name,omitempty"`
+	BuyerId     string    `json:"buyerId,omitempty"`
 
 	SceneInfo string `json:"omitempty"` //h5支付使用
 
@@ -81,6 +82,11 @@ func RandomStr() string {
 
 // 微信企业付款到零钱
 func WachatCompanyChange(mchAppid, mchid, key string, conn *pay.HTTPSClient, charge *Charge) (map[string]string, error) {
+	return WachatCompanyChangeContext(context.Background(), mchAppid, mchid, key, conn, charge)
+}
+
+// WachatCompanyChangeContext 携带ctx的企业付款到零钱
+func WachatCompanyChangeContext(ctx context.Context, mchAppid, mchid, key string, conn *pay.HTTPSClient, charge *Charge) (map[string]string, error) {
 	var m = make(map[string]string)
 	m["mch_appid"] = mchAppid
 	m["mchid"] = mchid
@@ -106,7 +112,11 @@ func WachatCompanyChange(mchAppid, mchid, key string, conn *pay.HTTPSClient, cha
 	m["sign"] = sign
 
 	// 转出xml结构
-	result, err := PostWechat("https://api.mch.weixin.qq.com/mmpaymkttransfers/promotion/transfers", m, conn)
+	var client *http.Client
+	if conn != nil {
+		client = &conn.Client
+	}
+	result, err := PostWechatContext(ctx, client, WxBaseURL+"/mmpaymkttransfers/promotion/transfers", m)
 	if err != nil {
 		return map[string]string{}, err
 	}
@@ -169,55 +179,121 @@ func FilterTheSpecialSymbol(data string) string {
 
 //对微信下订单或者查订单
 func PostWechat(url string, data map[string]string, h *pay.HTTPSClient) (WeChatQueryResult, error) {
-	var xmlRe WeChatQueryResult
+	var client *http.Client
+	if h != nil {
+		client = &h.Client
+	}
+	return PostWechatContext(context.Background(), client, url, data)
+}
+
+// PostWechatContext 携带ctx请求微信v2接口, client 为空时使用 pay.HTTPSC
+// 不校验应答签名, 需要验签时使用 WxClient 的方法
+func PostWechatContext(ctx context.Context, client *http.Client, url string, data map[string]string) (WeChatQueryResult, error) {
+	return postWechat(ctx, client, url, data, "", callOptions{})
+}
 
-	hc := new(pay.HTTPSClient)
+// callOptions 请求使用的日志与埋点, 零值使用 pay.DefaultLogger 与 pay.DefaultInstrument
+type callOptions struct {
+	logger     pay.Logger
+	instrument pay.Instrument
+}
+
+// postWechat 请求微信v2接口, verifyKey 不为空时用其校验应答签名
+func postWechat(ctx context.Context, client *http.Client, url string, data map[string]string, verifyKey string, o callOptions) (WeChatQueryResult, error) {
+	xmlRe, _, err := postWechatBody(ctx, client, url, data, verifyKey, o)
+	return xmlRe, err
+}
+
+// postWechatBody 同 postWechat, 同时返回原始应答, 用于解析带序号的字段
+func postWechatBody(ctx context.Context, client *http.Client, url string, data map[string]string, verifyKey string, o callOptions) (WeChatQueryResult, []byte, error) {
+	var xmlRe WeChatQueryResult
 	var re []byte
-	var err error
-	if h != nil {
-		resp, err := h.Post(url, "application/xml; charset=utf-8", XmlEncode(data))
-		if err != nil {
-			return xmlRe, errors.New("HTTPSC.PostData: " + err.Error())
-		}
-		defer resp.Body.Close()
-		re, err = ioutil.ReadAll(resp.Body)
-	} else {
-		hc = pay.HTTPSC
-		buf := bytes.NewBufferString("")
-		for k, v := range data {
-			buf.WriteString(fmt.Sprintf("<%s><![CDATA[%s]]></%s>", k, v, k))
-		}
-		xmlStr := fmt.Sprintf("<xml>%s</xml>", buf.String())
-		logs.Warning(xmlStr)
-		re, err = hc.PostData(url, "text/xml:charset=UTF-8", xmlStr)
-		if err != nil {
-			return xmlRe, errors.New("HTTPSC.PostData: " + err.Error())
+	call := &pay.Call{Provider: "wxpay", Method: apiPath(url), Tenant: tenantOf(data)}
+	err := pay.Observe(ctx, o.instrument, call, func(ctx context.Context) error {
+		var err error
+		xmlRe, re, err = doPostWechat(ctx, client, url, data, verifyKey, o.logger)
+		return err
+	})
+	return xmlRe, re, err
+}
+
+// apiPath 接口地址中的路径, 用作埋点的接口名
+func apiPath(rawurl string) string {
+	u, err := neturl.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	return u.Path
+}
+
+// tenantOf 请求参数中的商户号, 服务商模式取子商户号
+func tenantOf(data map[string]string) string {
+	for _, k := range []string{"sub_mch_id", "mch_id", "mchid"} {
+		if data[k] != "" {
+			return data[k]
 		}
 	}
+	return ""
+}
+
+// doPostWechat 发送v2请求并解析应答
+func doPostWechat(ctx context.Context, client *http.Client, url string, data map[string]string, verifyKey string, logger pay.Logger) (WeChatQueryResult, []byte, error) {
+	var xmlRe WeChatQueryResult
+
+	xmlStr := mapToXML(data)
+	pay.Log(logger, pay.LevelDebug, "wxpay: request", pay.F("url", url), pay.F("body", xmlStr))
+	req, err := http.NewRequest("POST", url, strings.NewReader(xmlStr))
+	if err != nil {
+		return xmlRe, nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	_, re, err := pay.DoRequest(ctx, client, req)
+	if err != nil {
+		return xmlRe, nil, fmt.Errorf("HTTPSC.PostData: %w", err)
+	}
 
 	err = xml.Unmarshal(re, &xmlRe)
 	if err != nil {
-		logs.Error("get body:", string(re))
-		return xmlRe, errors.New("xml.Unmarshal: " + err.Error())
+		pay.Log(logger, pay.LevelError, "wxpay: unmarshal response", pay.F("url", url), pay.F("body", re))
+		return xmlRe, re, errors.New("xml.Unmarshal: " + err.Error())
 	}
 
 	if xmlRe.ReturnCode != "SUCCESS" {
 		// 通信失败
-		return xmlRe, errors.New("xmlRe.ReturnMsg: " + xmlRe.ReturnMsg)
+		return xmlRe, re, newProviderError(xmlRe.ReturnCode, "", xmlRe.ReturnMsg, re)
+	}
+
+	if verifyKey != "" {
+		m, err := XmlToMap(re)
+		if err != nil {
+			return xmlRe, re, errors.New("xml.Unmarshal: " + err.Error())
+		}
+		if err := verifyResponseSign(verifyKey, data["sign_type"], m); err != nil {
+			return xmlRe, re, &pay.ResponseSignError{Provider: "wxpay", API: url, Err: err}
+		}
 	}
 
 	if xmlRe.ResultCode != "SUCCESS" {
 		// 业务结果失败
-		return xmlRe, errors.New("xmlRe.ErrCodeDes: " + xmlRe.ErrCodeDes)
+		return xmlRe, re, newProviderError(xmlRe.ResultCode, xmlRe.ErrCode, xmlRe.ErrCodeDes, re)
+	}
+	return xmlRe, re, nil
+}
+
+// mapToXML 参数转为微信请求xml, 值使用CDATA包裹
+func mapToXML(data map[string]string) string {
+	buf := bytes.NewBufferString("")
+	for k, v := range data {
+		buf.WriteString(fmt.Sprintf("<%s><![CDATA[%s]]></%s>", k, v, k))
 	}
-	return xmlRe, nil
+	return fmt.Sprintf("<xml>%s</xml>", buf.String())
 }
 
 func XmlEncode(params map[string]string) io.Reader {
 	var buf bytes.Buffer
 	decoder := mahonia.NewDecoder("utf-8")
 	if decoder == nil {
-		fmt.Println("编码不存在!")
+		pay.Log(nil, pay.LevelWarn, "wxpay: utf-8 decoder not found")
 	}
 	buf.WriteString(`<xml>`)
 	for k, v := range params {
@@ -230,15 +306,13 @@ func XmlEncode(params map[string]string) io.Reader {
 		buf.WriteString(`>`)
 	}
 	buf.WriteString(`</xml>`)
-	fmt.Println(buf.String())
+	pay.Log(nil, pay.LevelDebug, "wxpay: xml encode", pay.F("body", buf.String()))
 	return &buf
 }
 
-// 微信金额浮点转字符串
-func WechatMoneyFeeToString(moneyFee float64) string {
-	aDecimal := decimal.NewFromFloat(moneyFee)
-	bDecimal := decimal.NewFromFloat(100)
-	return aDecimal.Mul(bDecimal).Truncate(0).String()
+// 微信金额转字符串, 单位分
+func WechatMoneyFeeToString(moneyFee pay.Money) string {
+	return strconv.FormatInt(moneyFee.Amount, 10)
 }
 
 func struct2Map(obj interface{}) (map[string]string, error) {
@@ -254,7 +328,8 @@ func struct2Map(obj interface{}) (map[string]string, error) {
 	return j2, err2
 }
 
-func XmlToMap(xmlData []byte) map[string]string {
+// XmlToMap 将微信xml报文展开为map, 报文格式错误时返回错误
+func XmlToMap(xmlData []byte) (map[string]string, error) {
 	decoder := xml.NewDecoder(bytes.NewReader(xmlData))
 	m := make(map[string]string)
 	var token xml.Token
@@ -275,9 +350,9 @@ func XmlToMap(xmlData []byte) map[string]string {
 	}
 
 	if err != nil && err != io.EOF {
-		panic(err)
+		return nil, err
 	}
-	return m
+	return m, nil
 }
 
 // WechatCallBackSuccessRes 构建微信回调成功返回
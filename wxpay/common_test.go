@@ -0,0 +1,28 @@
+package wxpay
+
+import "testing"
+
+func TestXmlToMap(t *testing.T) {
+	m, err := XmlToMap([]byte("<xml><return_code><![CDATA[SUCCESS]]></return_code><total_fee>1</total_fee></xml>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["return_code"] != "SUCCESS" || m["total_fee"] != "1" {
+		t.Fatalf("unexpected map %v", m)
+	}
+	if _, err := XmlToMap([]byte("<xml><return_code>SUCCESS</xml>")); err == nil {
+		t.Fatal("malformed xml should return error")
+	}
+}
+
+func TestNewWxClient(t *testing.T) {
+	if _, err := NewWxClient(&WxClient{MchID: "1900000001", CertPEM: "bad", KeyPEM: "bad"}); err == nil {
+		t.Fatal("bad cert should be rejected")
+	}
+	if _, err := NewWxClient(&WxClient{MchID: "1900000001", PayV3: true, KeyPEM: "bad"}); err == nil {
+		t.Fatal("bad v3 key should be rejected")
+	}
+	if _, err := NewWxClient(&WxClient{MchID: "1900000001", PayKey: "key"}); err != nil {
+		t.Fatal(err)
+	}
+}
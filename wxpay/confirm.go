@@ -0,0 +1,31 @@
+package wxpay
+
+import (
+	"context"
+
+	"github.com/jxwt/pay"
+)
+
+// ConfirmPayment 轮询订单直到支付成功、关闭或失败, 截止时仍未支付则撤销订单并返回 pay.ErrPaymentTimeout
+// 用于付款码支付返回 USERPAYING 等待用户输入密码的场景, 截止时间取 ctx 的 Deadline
+func (i *WxClient) ConfirmPayment(ctx context.Context, tradeNo string) (pay.PaymentStatus, error) {
+	policy := pay.DefaultConfirmPolicy
+	if i.ConfirmPolicy != nil {
+		policy = *i.ConfirmPolicy
+	}
+	query := func(ctx context.Context) (pay.PaymentStatus, error) {
+		result, err := i.QueryOrderContext(ctx, tradeNo)
+		if err != nil {
+			return "", err
+		}
+		return result.PaymentStatus()
+	}
+	reverse := func(ctx context.Context) (bool, error) {
+		result, err := i.PayReverseContext(ctx, tradeNo)
+		if err != nil {
+			return false, err
+		}
+		return result.Recall == "Y", nil
+	}
+	return policy.Confirm(ctx, query, reverse)
+}
@@ -0,0 +1,44 @@
+package wxpay
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jxwt/pay"
+	"github.com/jxwt/pay/paytest"
+)
+
+func TestConfirmPayment(t *testing.T) {
+	s := paytest.NewWechatServer(t)
+	c := testClient(s)
+	c.ConfirmPolicy = &pay.ConfirmPolicy{Interval: 5 * time.Millisecond, Multiplier: 1, Timeout: 200 * time.Millisecond, CancelTimeout: time.Second}
+	micropay := func(tradeNo string) {
+		t.Helper()
+		s.FailNext("/pay/micropay", paytest.StateUserPaying, 1)
+		_, err := c.MicroPay(&MicroPayRequest{OutTradeNo: tradeNo, TotalFee: pay.CNY(100), AuthCode: "134567890123456789", Remark: "test"})
+		if err == nil {
+			t.Fatal("expected USERPAYING")
+		}
+	}
+
+	micropay("T001")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Pay("T001")
+	}()
+	status, err := c.ConfirmPayment(context.Background(), "T001")
+	if err != nil || status != pay.StatusPaid {
+		t.Fatalf("got %s %v", status, err)
+	}
+
+	micropay("T002")
+	status, err = c.ConfirmPayment(context.Background(), "T002")
+	if !errors.Is(err, pay.ErrPaymentTimeout) || status != pay.StatusClosed {
+		t.Fatalf("got %s %v", status, err)
+	}
+	if o, _ := s.Order("T002"); o.State != paytest.StateRevoked {
+		t.Fatalf("order state %s, want REVOKED", o.State)
+	}
+}
@@ -0,0 +1,45 @@
+package wxpay
+
+import (
+	"github.com/jxwt/pay"
+)
+
+// 错误码 https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_1
+// v3 https://pay.weixin.qq.com/wiki/doc/apiv3/Share/error_code.shtml
+
+// errCodes err_code(v2)/code(v3) 对应的通用错误
+var errCodes = map[string]error{
+	"ORDERPAID":       pay.ErrOrderPaid,
+	"ORDERCLOSED":     pay.ErrOrderClosed,
+	"ORDERNOTEXIST":   pay.ErrOrderNotExist,
+	"ORDER_NOT_EXIST": pay.ErrOrderNotExist,
+	"REFUNDNOTEXIST":  pay.ErrRefundNotExist,
+	"NOTENOUGH":       pay.ErrInsufficientBalance,
+	"NOT_ENOUGH":      pay.ErrInsufficientBalance,
+	"SIGNERROR":       pay.ErrSignature,
+	"SIGN_ERROR":      pay.ErrSignature,
+}
+
+// retryableCodes 可原样重试的错误码
+var retryableCodes = map[string]bool{
+	"SYSTEMERROR":        true,
+	"SYSTEM_ERROR":       true,
+	"BANKERROR":          true,
+	"BANK_ERROR":         true,
+	"FREQUENCY_LIMITED":  true,
+	"BIZERR_NEED_RETRY":  true,
+	"FREQUENCY_LIMIT_EX": true,
+}
+
+// newProviderError 按错误码构造 *pay.ProviderError
+func newProviderError(code, subCode, message string, raw []byte) *pay.ProviderError {
+	return &pay.ProviderError{
+		Provider:  "wxpay",
+		Code:      code,
+		SubCode:   subCode,
+		Message:   message,
+		Retryable: retryableCodes[subCode],
+		Raw:       raw,
+		Err:       errCodes[subCode],
+	}
+}
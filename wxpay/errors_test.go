@@ -0,0 +1,35 @@
+package wxpay
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jxwt/pay"
+)
+
+func TestUnifiedOrderProviderError(t *testing.T) {
+	errCode := "ORDERPAID"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := map[string]string{"return_code": "SUCCESS", "result_code": "FAIL", "err_code": errCode, "err_code_des": "该订单已支付", "nonce_str": "5K8264ILTKCH16CQ"}
+		res["sign"], _ = WechatGenSign("paykey", res)
+		w.Write([]byte(mapToXML(res)))
+	}))
+	defer srv.Close()
+
+	c := &WxClient{AppID: "wx0001", MchID: "1230000109", PayKey: "paykey", BaseURL: srv.URL, HTTPClient: srv.Client()}
+	_, err := c.AppPay(&Charge{TradeNum: "T001", MoneyFee: pay.CNY(1)})
+	if !errors.Is(err, pay.ErrOrderPaid) {
+		t.Fatalf("want ErrOrderPaid, got %v", err)
+	}
+	var pe *pay.ProviderError
+	if !errors.As(err, &pe) || pe.Code != "FAIL" || pe.SubCode != "ORDERPAID" || pe.Retryable {
+		t.Fatalf("unexpected provider error %+v", pe)
+	}
+
+	errCode = "SYSTEMERROR"
+	if _, err := c.AppPay(&Charge{TradeNum: "T001", MoneyFee: pay.CNY(1)}); !pay.IsRetryable(err) {
+		t.Fatalf("SYSTEMERROR should be retryable, got %v", err)
+	}
+}
@@ -1,16 +1,17 @@
 package wxpay
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/astaxie/beego/logs"
-	"github.com/jxwt/tools"
-	"io/ioutil"
+	"github.com/jxwt/pay"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 type Errs struct {
@@ -83,13 +84,16 @@ type WxLoginGetPhone struct {
 微信小程序登陆获取
 */
 func (i *WxClient) MiniLogin(code string) (wxInfo RespWXSmall, err error) {
+	return i.MiniLoginContext(context.Background(), code)
+}
+
+// MiniLoginContext 携带ctx的小程序登录
+func (i *WxClient) MiniLoginContext(ctx context.Context, code string) (wxInfo RespWXSmall, err error) {
 	url := "https://api.weixin.qq.com/sns/jscode2session?appid=%s&secret=%s&js_code=%s&grant_type=authorization_code"
-	resp, err := http.Get(fmt.Sprintf(url, i.AppID, i.SecretKey, code))
+	body, err := i.httpGet(ctx, fmt.Sprintf(url, i.AppID, i.SecretKey, code))
 	if err != nil {
 		return wxInfo, err
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
 	err = json.Unmarshal(body, &wxInfo)
 	if err != nil {
 		return wxInfo, err
@@ -101,22 +105,31 @@ func (i *WxClient) MiniLogin(code string) (wxInfo RespWXSmall, err error) {
 }
 
 func (i *WxClient) GetOpenSession(jsCode string) *WxSession {
-	body, _ := tools.HttpBeegoPost("https://api.weixin.qq.com/sns/jscode2session", map[string]string{
+	return i.GetOpenSessionContext(context.Background(), jsCode)
+}
+
+// GetOpenSessionContext 携带ctx获取小程序session
+func (i *WxClient) GetOpenSessionContext(ctx context.Context, jsCode string) *WxSession {
+	body, _ := i.httpPostForm(ctx, "https://api.weixin.qq.com/sns/jscode2session", map[string]string{
 		"appid":      i.AppID,
 		"secret":     i.SecretKey,
 		"js_code":    jsCode,
 		"grant_type": "authorization_code",
-	}, nil)
+	})
 	var wxSession WxSession
 	if err := json.Unmarshal(body, &wxSession); err != nil {
-		logs.Warning("GetOpenSession err", err)
-		logs.Warning("body value : ", string(body))
+		i.log(pay.LevelWarn, "wxpay: get open session", pay.F("err", err), pay.F("body", body))
 	}
 	return &wxSession
 }
 
 func (i *WxClient) GetLoginInfo(iv string, encryptData string, code string) (WxLoginInfoResult, error) {
-	session := i.GetOpenSession(code)
+	return i.GetLoginInfoContext(context.Background(), iv, encryptData, code)
+}
+
+// GetLoginInfoContext 携带ctx获取登录用户信息
+func (i *WxClient) GetLoginInfoContext(ctx context.Context, iv string, encryptData string, code string) (WxLoginInfoResult, error) {
+	session := i.GetOpenSessionContext(ctx, code)
 	if session.SessionKey == "" {
 		var wxLoginInfoResult WxLoginInfoResult
 		return wxLoginInfoResult, errors.New("session获取不到")
@@ -148,7 +161,7 @@ func (i *WxClient) DecryptWXOpenData(session *WxSession, encryptData, iv string)
 	dataBytes, err := i.AesDecrypt(decodeBytes, sessionKeyBytes, ivBytes)
 
 	err = json.Unmarshal(dataBytes, &wxLoginInfoResult)
-	logs.Warning(wxLoginInfoResult, err)
+	i.log(pay.LevelDebug, "wxpay: decrypt open data", pay.F("result", wxLoginInfoResult), pay.F("err", err))
 	if wxLoginInfoResult.Watermark.Appid != i.AppID {
 		return wxLoginInfoResult, fmt.Errorf("invalid appid, get !%s!", wxLoginInfoResult.Watermark.Appid)
 	}
@@ -185,7 +198,12 @@ func (i *WxClient) PKCS7UnPadding(plantText []byte) []byte {
 }
 
 func (i *WxClient) GetPhoneNumber(iv string, encryptData string, code string) (WxLoginGetPhone, error) {
-	session := i.GetOpenSession(code)
+	return i.GetPhoneNumberContext(context.Background(), iv, encryptData, code)
+}
+
+// GetPhoneNumberContext 携带ctx获取手机号
+func (i *WxClient) GetPhoneNumberContext(ctx context.Context, iv string, encryptData string, code string) (WxLoginGetPhone, error) {
+	session := i.GetOpenSessionContext(ctx, code)
 	if session == nil {
 		var wxLoginInfoResult WxLoginGetPhone
 		return wxLoginInfoResult, errors.New("session获取不到")
@@ -210,7 +228,7 @@ func (i *WxClient) DecryptWXPhone(sessionKey, encryptData, iv string) (WxLoginGe
 	dataBytes, err := i.AesDecrypt(decodeBytes, sessionKeyBytes, ivBytes)
 
 	err = json.Unmarshal(dataBytes, &wxLoginInfoResult)
-	logs.Warning(wxLoginInfoResult, err)
+	i.log(pay.LevelDebug, "wxpay: decrypt open data", pay.F("result", wxLoginInfoResult), pay.F("err", err))
 	if wxLoginInfoResult.Watermark.Appid != i.AppID {
 		return wxLoginInfoResult, fmt.Errorf("invalid appid, get %s", wxLoginInfoResult.Watermark.Appid)
 	}
@@ -222,22 +240,27 @@ func (i *WxClient) DecryptWXPhone(sessionKey, encryptData, iv string) (WxLoginGe
 
 //微信app登录
 func (i *WxClient) AppLogin(code string) (*WxLoginInfoResult, error) {
-	res, _ := tools.HttpBeegoPost("https://api.weixin.qq.com/sns/oauth2/access_token", map[string]string{
+	return i.AppLoginContext(context.Background(), code)
+}
+
+// AppLoginContext 携带ctx的微信app登录
+func (i *WxClient) AppLoginContext(ctx context.Context, code string) (*WxLoginInfoResult, error) {
+	res, _ := i.httpPostForm(ctx, "https://api.weixin.qq.com/sns/oauth2/access_token", map[string]string{
 		"appid":      i.AppID,
 		"secret":     i.SecretKey,
 		"code":       code,
 		"grant_type": "authorization_code",
-	}, nil)
+	})
 	wxAppLoginAccessResult := new(WxAppLoginAccessResult)
 	err := json.Unmarshal(res, wxAppLoginAccessResult)
 	if err != nil {
-		logs.Warning("body value : ", string(res))
+		i.log(pay.LevelWarn, "wxpay: app login access token", pay.F("err", err), pay.F("body", res))
 		return nil, err
 	}
-	res, _ = tools.HttpBeegoPost("https://api.weixin.qq.com/sns/userinfo", map[string]string{
+	res, _ = i.httpPostForm(ctx, "https://api.weixin.qq.com/sns/userinfo", map[string]string{
 		"access_token": wxAppLoginAccessResult.AccessToken,
 		"openid":       wxAppLoginAccessResult.Openid,
-	}, nil)
+	})
 	wxLoginInfoResult := new(WxLoginInfoResult)
 	err = json.Unmarshal(res, wxLoginInfoResult)
 	if err != nil {
@@ -248,13 +271,18 @@ func (i *WxClient) AppLogin(code string) (*WxLoginInfoResult, error) {
 
 // 微信公众号:code换取token和openId
 func (i *WxClient) GetUserOpenId(code string) (*UserOpenInfo, error) {
+	return i.GetUserOpenIdContext(context.Background(), code)
+}
+
+// GetUserOpenIdContext 携带ctx换取token和openId
+func (i *WxClient) GetUserOpenIdContext(ctx context.Context, code string) (*UserOpenInfo, error) {
 	url := "https://api.weixin.qq.com/sns/oauth2/access_token?"
 	url += "appid=" + i.AppID
 	url += "&secret=" + i.SecretKey
 	url += "&code=" + code
 	url += "&grant_type=authorization_code"
 
-	body, err := tools.HttpBeegoGet(url, nil)
+	body, err := i.httpGet(ctx, url)
 	if err != nil {
 		return nil, err
 	}
@@ -269,13 +297,18 @@ func (i *WxClient) GetUserOpenId(code string) (*UserOpenInfo, error) {
 
 // 微信公众号:获取用户详细信息
 func (i *WxClient) GetUserInfoByOpenId(openId string, token string) (*WxLoginInfoResult, error) {
+	return i.GetUserInfoByOpenIdContext(context.Background(), openId, token)
+}
+
+// GetUserInfoByOpenIdContext 携带ctx获取用户详细信息
+func (i *WxClient) GetUserInfoByOpenIdContext(ctx context.Context, openId string, token string) (*WxLoginInfoResult, error) {
 	//获取用户信息
 	userUrl := "https://api.weixin.qq.com/sns/userinfo?"
 	userUrl += "access_token=" + token
 	userUrl += "&openid=" + openId
 	userUrl += "&lang=zh_CN"
 
-	userBody, _ := tools.HttpBeegoGet(userUrl, nil)
+	userBody, _ := i.httpGet(ctx, userUrl)
 	userInfo := new(WxLoginInfoResult)
 
 	err := json.Unmarshal(userBody, userInfo)
@@ -290,13 +323,21 @@ func (i *WxClient) GetUserInfoByOpenId(openId string, token string) (*WxLoginInf
 
 // 获取token，只能在通过model/wxpublic里的方法调用
 func (i *WxClient) GetAccessToken() (string, error) {
+	return i.GetAccessTokenContext(context.Background())
+}
+
+// GetAccessTokenContext 携带ctx获取token
+func (i *WxClient) GetAccessTokenContext(ctx context.Context) (string, error) {
 	var resp struct {
 		AccessToken string `json:"access_token"`
 		ErrCode     int    `json:"errcode"`
 		ErrMsg      string `json:"errmsg"`
 	}
 	url := "https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential" + "&appid=" + i.AppID + "&secret=" + i.SecretKey
-	body, err := tools.HttpBeegoGet(url, nil)
+	body, err := i.httpGet(ctx, url)
+	if err != nil {
+		return "", err
+	}
 	err = json.Unmarshal(body, &resp)
 	if err != nil {
 		return "", err
@@ -310,13 +351,21 @@ func (i *WxClient) GetAccessToken() (string, error) {
 }
 
 func (i *WxClient) GetTicket(token string) (string, error) {
+	return i.GetTicketContext(context.Background(), token)
+}
+
+// GetTicketContext 携带ctx获取jsapi ticket
+func (i *WxClient) GetTicketContext(ctx context.Context, token string) (string, error) {
 	var ret struct {
 		Ticket    string `json:"ticket"`
 		Errorcode int    `json:"errorcode"`
 		Errmsg    string `json:"errmsg"`
 	}
 	url := "https://api.weixin.qq.com/cgi-bin/ticket/getticket?access_token=" + token + "&type=jsapi"
-	body, err := tools.HttpBeegoGet(url, nil)
+	body, err := i.httpGet(ctx, url)
+	if err != nil {
+		return "", err
+	}
 	err = json.Unmarshal(body, &ret)
 	if err != nil {
 		return "", err
@@ -328,3 +377,28 @@ func (i *WxClient) GetTicket(token string) (string, error) {
 
 	return ret.Ticket, nil
 }
+
+// httpGet 携带ctx发起get请求
+func (i *WxClient) httpGet(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, body, err := pay.DoRequest(ctx, i.HTTPClient, req)
+	return body, err
+}
+
+// httpPostForm 携带ctx提交表单
+func (i *WxClient) httpPostForm(ctx context.Context, rawURL string, params map[string]string) ([]byte, error) {
+	form := url.Values{}
+	for k, v := range params {
+		form.Set(k, v)
+	}
+	req, err := http.NewRequest("POST", rawURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, body, err := pay.DoRequest(ctx, i.HTTPClient, req)
+	return body, err
+}
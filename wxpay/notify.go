@@ -0,0 +1,169 @@
+package wxpay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jxwt/pay"
+)
+
+var (
+	// ErrNotifySign 通知签名错误, 归类为 pay.ErrSignature
+	ErrNotifySign = fmt.Errorf("wxpay: notification sign mismatch: %w", pay.ErrSignature)
+	// ErrNotifyMerchant 通知的appid/mch_id与客户端配置不符
+	ErrNotifyMerchant = errors.New("wxpay: notification merchant mismatch")
+	// ErrNotifyAmount 通知金额与订单金额不符
+	ErrNotifyAmount = errors.New("wxpay: notification amount mismatch")
+)
+
+// PaymentNotification 微信支付结果通知
+// https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_7
+type PaymentNotification struct {
+	ReturnCode         string `xml:"return_code"`
+	ReturnMsg          string `xml:"return_msg"`
+	AppID              string `xml:"appid"`
+	MchID              string `xml:"mch_id"`
+	SubAppID           string `xml:"sub_appid"`
+	SubMchID           string `xml:"sub_mch_id"`
+	DeviceInfo         string `xml:"device_info"`
+	NonceStr           string `xml:"nonce_str"`
+	Sign               string `xml:"sign"`
+	SignType           string `xml:"sign_type"`
+	ResultCode         string `xml:"result_code"`
+	ErrCode            string `xml:"err_code"`
+	ErrCodeDes         string `xml:"err_code_des"`
+	OpenID             string `xml:"openid"`
+	IsSubscribe        string `xml:"is_subscribe"`
+	SubOpenID          string `xml:"sub_openid"`
+	TradeType          string `xml:"trade_type"`
+	BankType           string `xml:"bank_type"`
+	TotalFee           int    `xml:"total_fee"`            // 订单金额, 单位分
+	SettlementTotalFee int    `xml:"settlement_total_fee"` // 应结订单金额
+	FeeType            string `xml:"fee_type"`
+	CashFee            int    `xml:"cash_fee"` // 现金支付金额
+	CashFeeType        string `xml:"cash_fee_type"`
+	CouponFee          int    `xml:"coupon_fee"`
+	TransactionID      string `xml:"transaction_id"`
+	OutTradeNo         string `xml:"out_trade_no"`
+	Attach             string `xml:"attach"`
+	TimeEnd            string `xml:"time_end"`
+
+	Raw map[string]string `xml:"-"` // 原始通知参数
+}
+
+// IsPaid 是否支付成功
+func (n *PaymentNotification) IsPaid() bool {
+	return n.ReturnCode == "SUCCESS" && n.ResultCode == "SUCCESS"
+}
+
+// ExpectedAmountFunc 按商户单号返回订单应付金额
+type ExpectedAmountFunc func(outTradeNo string) (pay.Money, error)
+
+// ParsePaymentNotification 校验并解析支付结果通知
+// 依次校验签名、appid/mch_id 及订单金额, 任一项失败均返回错误
+// expected 为空时不校验金额, 由调用方自行比对 TotalFee
+func (i *WxClient) ParsePaymentNotification(body []byte, expected ExpectedAmountFunc) (*PaymentNotification, error) {
+	n := new(PaymentNotification)
+	if err := xml.Unmarshal(body, n); err != nil {
+		return nil, errors.New("xml.Unmarshal: " + err.Error())
+	}
+	if n.ReturnCode != "SUCCESS" {
+		return nil, newProviderError(n.ReturnCode, "", n.ReturnMsg, body)
+	}
+	raw, err := XmlToMap(body)
+	if err != nil {
+		return nil, errors.New("xml.Unmarshal: " + err.Error())
+	}
+	n.Raw = raw
+	if err := verifyNotifySign(i.notifyKey(), n.Raw); err != nil {
+		return nil, err
+	}
+	if n.AppID != i.AppID || n.MchID != i.MchID {
+		return nil, ErrNotifyMerchant
+	}
+	if i.SubMchId != "" && n.SubMchID != i.SubMchId {
+		return nil, ErrNotifyMerchant
+	}
+	if expected != nil && n.ResultCode == "SUCCESS" {
+		amount, err := expected(n.OutTradeNo)
+		if err != nil {
+			return nil, err
+		}
+		if amount.Amount != int64(n.TotalFee) {
+			return nil, fmt.Errorf("%w: out_trade_no %s total_fee %d", ErrNotifyAmount, n.OutTradeNo, n.TotalFee)
+		}
+	}
+	return n, nil
+}
+
+// HandlePaymentNotification 处理支付结果通知, 校验通过后才应答SUCCESS
+func (i *WxClient) HandlePaymentNotification(w http.ResponseWriter, r *http.Request, expected ExpectedAmountFunc) (*PaymentNotification, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.Write([]byte(WechatCallBackFailRes("读取通知失败")))
+		return nil, err
+	}
+	n, err := i.ParsePaymentNotification(body, expected)
+	if err != nil {
+		w.Write([]byte(WechatCallBackFailRes(err.Error())))
+		return nil, err
+	}
+	w.Write([]byte(WechatCallBackSuccessRes()))
+	return n, nil
+}
+
+// verifyNotifySign 按 sign_type 校验通知签名, 默认MD5
+func verifyNotifySign(key string, m map[string]string) error {
+	return verifySignType(key, m["sign_type"], m)
+}
+
+// verifySignType 按指定签名方式校验签名
+func verifySignType(key, signType string, m map[string]string) error {
+	var sign string
+	var err error
+	switch signType {
+	case "", "MD5":
+		sign, err = WechatGenSign(key, m)
+	case "HMAC-SHA256":
+		sign = WechatGenSignHMAC(key, m)
+	default:
+		return fmt.Errorf("%w: unknown sign_type %s", ErrNotifySign, signType)
+	}
+	if err != nil {
+		return err
+	}
+	if m["sign"] == "" || subtle.ConstantTimeCompare([]byte(sign), []byte(m["sign"])) != 1 {
+		return ErrNotifySign
+	}
+	return nil
+}
+
+// WechatGenSignHMAC HMAC-SHA256 签名
+func WechatGenSignHMAC(key string, m map[string]string) string {
+	var signData []string
+	for k, v := range m {
+		if v != "" && k != "sign" && k != "key" {
+			signData = append(signData, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	sort.Strings(signData)
+	signStr := strings.Join(signData, "&") + "&key=" + key
+
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(signStr))
+	return strings.ToUpper(fmt.Sprintf("%x", h.Sum(nil)))
+}
+
+// WechatCallBackFailRes 构建微信回调失败返回
+func WechatCallBackFailRes(msg string) string {
+	msg = strings.Replace(msg, "]]>", "", -1)
+	return fmt.Sprintf("<xml><return_code><![CDATA[FAIL]]></return_code><return_msg><![CDATA[%s]]></return_msg></xml>", msg)
+}
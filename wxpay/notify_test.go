@@ -0,0 +1,98 @@
+package wxpay
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jxwt/pay"
+)
+
+func signedNotifyBody(key string, m map[string]string) []byte {
+	if m["sign_type"] == "HMAC-SHA256" {
+		m["sign"] = WechatGenSignHMAC(key, m)
+	} else {
+		m["sign"], _ = WechatGenSign(key, m)
+	}
+	var sb strings.Builder
+	sb.WriteString("<xml>")
+	for k, v := range m {
+		sb.WriteString("<" + k + "><![CDATA[" + v + "]]></" + k + ">")
+	}
+	sb.WriteString("</xml>")
+	return []byte(sb.String())
+}
+
+func notifyParams() map[string]string {
+	return map[string]string{
+		"return_code":    "SUCCESS",
+		"result_code":    "SUCCESS",
+		"appid":          "wx0000000000000001",
+		"mch_id":         "1000000001",
+		"nonce_str":      "5K8264ILTKCH16CQ2502SI8ZNMTM67VS",
+		"openid":         "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o",
+		"trade_type":     "JSAPI",
+		"total_fee":      "101",
+		"cash_fee":       "101",
+		"transaction_id": "1004400740201409030005092168",
+		"out_trade_no":   "T20201010001",
+		"time_end":       "20201010101010",
+	}
+}
+
+func TestParsePaymentNotification(t *testing.T) {
+	c := &WxClient{AppID: "wx0000000000000001", MchID: "1000000001", PayKey: "192006250b4c09247ec02edce69f6a2d"}
+	expected := func(string) (pay.Money, error) { return pay.CNY(101), nil }
+
+	n, err := c.ParsePaymentNotification(signedNotifyBody(c.PayKey, notifyParams()), expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.IsPaid() || n.TotalFee != 101 || n.OutTradeNo != "T20201010001" {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+
+	m := notifyParams()
+	m["sign_type"] = "HMAC-SHA256"
+	if _, err := c.ParsePaymentNotification(signedNotifyBody(c.PayKey, m), expected); err != nil {
+		t.Fatalf("hmac: %v", err)
+	}
+
+	if _, err := c.ParsePaymentNotification(signedNotifyBody("wrong-key", notifyParams()), expected); !errors.Is(err, ErrNotifySign) || !errors.Is(err, pay.ErrSignature) || pay.ResultCode(err) != pay.CodeSignature {
+		t.Fatalf("want ErrNotifySign, got %v", err)
+	}
+
+	m = notifyParams()
+	m["mch_id"] = "1000000002"
+	if _, err := c.ParsePaymentNotification(signedNotifyBody(c.PayKey, m), expected); !errors.Is(err, ErrNotifyMerchant) {
+		t.Fatalf("want ErrNotifyMerchant, got %v", err)
+	}
+
+	cheaper := func(string) (pay.Money, error) { return pay.CNY(1), nil }
+	if _, err := c.ParsePaymentNotification(signedNotifyBody(c.PayKey, notifyParams()), cheaper); !errors.Is(err, ErrNotifyAmount) {
+		t.Fatalf("want ErrNotifyAmount, got %v", err)
+	}
+}
+
+func TestHandlePaymentNotificationAck(t *testing.T) {
+	c := &WxClient{AppID: "wx0000000000000001", MchID: "1000000001", PayKey: "192006250b4c09247ec02edce69f6a2d"}
+
+	body := signedNotifyBody("wrong-key", notifyParams())
+	w := httptest.NewRecorder()
+	if _, err := c.HandlePaymentNotification(w, httptest.NewRequest("POST", "/notify", strings.NewReader(string(body))), nil); err == nil {
+		t.Fatal("forged notification accepted")
+	}
+	if !strings.Contains(w.Body.String(), "<return_code><![CDATA[FAIL]]></return_code>") {
+		t.Fatalf("unexpected ack %s", w.Body.String())
+	}
+
+	body = signedNotifyBody(c.PayKey, notifyParams())
+	w = httptest.NewRecorder()
+	if _, err := c.HandlePaymentNotification(w, httptest.NewRequest("POST", "/notify", strings.NewReader(string(body))), nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(w.Body.String(), "<return_code><![CDATA[SUCCESS]]></return_code>") {
+		t.Fatalf("unexpected ack %s", w.Body.String())
+	}
+}
@@ -0,0 +1,249 @@
+package wxpay
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIv3 回调通知 https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_1_5.shtml
+// 签名验证 https://pay.weixin.qq.com/wiki/doc/apiv3/wechatpay/wechatpay4_1.shtml
+
+// v3 应答及通知的签名头
+const (
+	HeaderWechatpaySignature = "Wechatpay-Signature"
+	HeaderWechatpayTimestamp = "Wechatpay-Timestamp"
+	HeaderWechatpayNonce     = "Wechatpay-Nonce"
+	HeaderWechatpaySerial    = "Wechatpay-Serial"
+)
+
+// V3NotifyMaxSkew 通知时间戳与本地时间允许的最大偏差, 超过视为重放
+var V3NotifyMaxSkew = 5 * time.Minute
+
+var (
+	// ErrNotifyExpired 通知时间戳超出允许范围
+	ErrNotifyExpired = errors.New("wxpay: notification timestamp expired")
+	// ErrPlatformCertNotFound 找不到 Wechatpay-Serial 对应的平台证书
+	ErrPlatformCertNotFound = errors.New("wxpay: platform certificate not found")
+)
+
+// V3Notification v3回调通知
+type V3Notification struct {
+	ID           string           `json:"id"`
+	CreateTime   string           `json:"create_time"`
+	EventType    string           `json:"event_type"` // TRANSACTION.SUCCESS, REFUND.SUCCESS 等
+	ResourceType string           `json:"resource_type"`
+	Summary      string           `json:"summary"`
+	Resource     V3NotifyResource `json:"resource"`
+	Plaintext    []byte           `json:"-"` // resource 解密后的明文
+}
+
+// V3NotifyResource 通知加密数据
+type V3NotifyResource struct {
+	Algorithm      string `json:"algorithm"` // AEAD_AES_256_GCM
+	Ciphertext     string `json:"ciphertext"`
+	AssociatedData string `json:"associated_data"`
+	OriginalType   string `json:"original_type"`
+	Nonce          string `json:"nonce"`
+}
+
+// V3PaymentNotification v3支付结果通知明文
+type V3PaymentNotification struct {
+	AppID          string `json:"appid"`
+	MchID          string `json:"mchid"`
+	SpAppID        string `json:"sp_appid"`
+	SpMchID        string `json:"sp_mchid"`
+	SubAppID       string `json:"sub_appid"`
+	SubMchID       string `json:"sub_mchid"`
+	OutTradeNo     string `json:"out_trade_no"`
+	TransactionID  string `json:"transaction_id"`
+	TradeType      string `json:"trade_type"`
+	TradeState     string `json:"trade_state"` // SUCCESS, REFUND, NOTPAY, CLOSED, REVOKED, USERPAYING, PAYERROR
+	TradeStateDesc string `json:"trade_state_desc"`
+	BankType       string `json:"bank_type"`
+	Attach         string `json:"attach"`
+	SuccessTime    string `json:"success_time"`
+	Payer          struct {
+		OpenID    string `json:"openid"`
+		SpOpenID  string `json:"sp_openid"`
+		SubOpenID string `json:"sub_openid"`
+	} `json:"payer"`
+	Amount struct {
+		Total         int64  `json:"total"`       // 订单金额, 单位分
+		PayerTotal    int64  `json:"payer_total"` // 用户支付金额
+		Currency      string `json:"currency"`
+		PayerCurrency string `json:"payer_currency"`
+	} `json:"amount"`
+}
+
+// IsPaid 是否支付成功
+func (n *V3PaymentNotification) IsPaid() bool {
+	return n.TradeState == TradeStateSuccess
+}
+
+// V3RefundNotification v3退款结果通知明文
+type V3RefundNotification struct {
+	MchID               string `json:"mchid"`
+	SpMchID             string `json:"sp_mchid"`
+	SubMchID            string `json:"sub_mchid"`
+	OutTradeNo          string `json:"out_trade_no"`
+	TransactionID       string `json:"transaction_id"`
+	OutRefundNo         string `json:"out_refund_no"`
+	RefundID            string `json:"refund_id"`
+	RefundStatus        string `json:"refund_status"` // SUCCESS, CLOSED, ABNORMAL
+	SuccessTime         string `json:"success_time"`
+	UserReceivedAccount string `json:"user_received_account"`
+	Amount              struct {
+		Total       int64 `json:"total"`  // 订单金额, 单位分
+		Refund      int64 `json:"refund"` // 退款金额
+		PayerTotal  int64 `json:"payer_total"`
+		PayerRefund int64 `json:"payer_refund"`
+	} `json:"amount"`
+}
+
+// apiV3Key APIv3密钥
+func (i *WxClient) apiV3Key() string {
+	if i.APIv3Key != "" {
+		return i.APIv3Key
+	}
+	return i.SecretKey
+}
+
+// ParseV3Notification 校验签名头并解密v3回调通知
+func (i *WxClient) ParseV3Notification(r *http.Request) (*V3Notification, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.VerifyV3Signature(r.Context(), r.Header, body); err != nil {
+		return nil, err
+	}
+	n := new(V3Notification)
+	if err := json.Unmarshal(body, n); err != nil {
+		return nil, errors.New("json.Unmarshal: " + err.Error())
+	}
+	if n.Resource.Algorithm != "AEAD_AES_256_GCM" {
+		return nil, fmt.Errorf("wxpay: unsupported resource algorithm %s", n.Resource.Algorithm)
+	}
+	n.Plaintext, err = DecryptV3Resource(i.apiV3Key(), n.Resource.Nonce, n.Resource.AssociatedData, n.Resource.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("wxpay: decrypt notification resource: %v", err)
+	}
+	return n, nil
+}
+
+// ParseV3PaymentNotification 校验并解析v3支付结果通知, 同时校验商户号
+func (i *WxClient) ParseV3PaymentNotification(r *http.Request) (*V3PaymentNotification, error) {
+	n, err := i.ParseV3Notification(r)
+	if err != nil {
+		return nil, err
+	}
+	res := new(V3PaymentNotification)
+	if err := json.Unmarshal(n.Plaintext, res); err != nil {
+		return nil, errors.New("json.Unmarshal: " + err.Error())
+	}
+	if i.isPartner() {
+		if res.SpMchID != i.MchID || res.SubMchID != i.SubMchId {
+			return nil, ErrNotifyMerchant
+		}
+	} else if res.MchID != i.MchID {
+		return nil, ErrNotifyMerchant
+	}
+	return res, nil
+}
+
+// ParseV3RefundNotification 校验并解析v3退款结果通知, 同时校验商户号
+func (i *WxClient) ParseV3RefundNotification(r *http.Request) (*V3RefundNotification, error) {
+	n, err := i.ParseV3Notification(r)
+	if err != nil {
+		return nil, err
+	}
+	res := new(V3RefundNotification)
+	if err := json.Unmarshal(n.Plaintext, res); err != nil {
+		return nil, errors.New("json.Unmarshal: " + err.Error())
+	}
+	if i.isPartner() {
+		if res.SpMchID != i.MchID || res.SubMchID != i.SubMchId {
+			return nil, ErrNotifyMerchant
+		}
+	} else if res.MchID != i.MchID {
+		return nil, ErrNotifyMerchant
+	}
+	return res, nil
+}
+
+// HandleV3PaymentNotification 处理v3支付结果通知, 校验通过后才应答成功
+func (i *WxClient) HandleV3PaymentNotification(w http.ResponseWriter, r *http.Request) (*V3PaymentNotification, error) {
+	n, err := i.ParseV3PaymentNotification(r)
+	if err != nil {
+		WechatV3CallBackFailRes(w, err.Error())
+		return nil, err
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"code":"SUCCESS","message":"成功"}`))
+	return n, nil
+}
+
+// WechatV3CallBackFailRes v3回调失败应答, 微信收到非2xx状态码会重新通知
+func WechatV3CallBackFailRes(w http.ResponseWriter, msg string) {
+	body, _ := json.Marshal(V3ErrorResponse{Code: "FAIL", Message: msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(body)
+}
+
+// VerifyV3Signature 按 Wechatpay-* 头校验v3应答或通知的签名
+func (i *WxClient) VerifyV3Signature(ctx context.Context, header http.Header, body []byte) error {
+	return i.certStore().Verify(ctx, header, body)
+}
+
+// verifyV3Header 校验时间戳并用平台证书校验签名
+func verifyV3Header(cert *PlatformCertificate, header http.Header, body []byte) error {
+	timestamp := header.Get(HeaderWechatpayTimestamp)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad %s", ErrNotifySign, HeaderWechatpayTimestamp)
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > V3NotifyMaxSkew || d < -V3NotifyMaxSkew {
+		return ErrNotifyExpired
+	}
+	pub, err := cert.PublicKey()
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("%s\n%s\n%s\n", timestamp, header.Get(HeaderWechatpayNonce), body)
+	return verifyV3Message(pub, message, header.Get(HeaderWechatpaySignature))
+}
+
+// verifyV3Message SHA256-RSA 验签
+func verifyV3Message(pub *rsa.PublicKey, message, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotifySign, err)
+	}
+	h := sha256.Sum256([]byte(message))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig); err != nil {
+		return ErrNotifySign
+	}
+	return nil
+}
+
+// parseCertificate 解析PEM格式证书
+func parseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("wxpay: invalid certificate pem")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,213 @@
+package wxpay
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAPIv3Key = "0123456789abcdef0123456789abcdef"
+
+// testPlatform 模拟微信支付平台: 平台证书私钥与证书
+type testPlatform struct {
+	key     *rsa.PrivateKey
+	serial  string
+	certPEM string
+}
+
+func newTestPlatform(t *testing.T, serial int64, notAfter time.Time) *testPlatform {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "Tenpay.com Root CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testPlatform{
+		key:     key,
+		serial:  strings.ToUpper(fmt.Sprintf("%X", serial)),
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+}
+
+// encrypt AEAD_AES_256_GCM 加密
+func testEncrypt(t *testing.T, plaintext, nonce, associatedData string) string {
+	block, err := aes.NewCipher([]byte(testAPIv3Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nil, []byte(nonce), []byte(plaintext), []byte(associatedData)))
+}
+
+// certificatesBody /v3/certificates 返回
+func certificatesBody(t *testing.T, platforms ...*testPlatform) []byte {
+	var data []map[string]interface{}
+	for _, p := range platforms {
+		block, _ := pem.Decode([]byte(p.certPEM))
+		cert, _ := x509.ParseCertificate(block.Bytes)
+		data = append(data, map[string]interface{}{
+			"serial_no":      p.serial,
+			"effective_time": cert.NotBefore.Format(time.RFC3339),
+			"expire_time":    cert.NotAfter.Format(time.RFC3339),
+			"encrypt_certificate": map[string]string{
+				"algorithm":       "AEAD_AES_256_GCM",
+				"nonce":           "61f9c719728a",
+				"associated_data": "certificate",
+				"ciphertext":      testEncrypt(t, p.certPEM, "61f9c719728a", "certificate"),
+			},
+		})
+	}
+	b, _ := json.Marshal(map[string]interface{}{"data": data})
+	return b
+}
+
+// certificatesHandler 使用第一张证书签名的 /v3/certificates 接口
+func certificatesHandler(t *testing.T, platforms ...*testPlatform) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := certificatesBody(t, platforms...)
+		for k, v := range platforms[0].sign(t, body, time.Now()) {
+			w.Header()[k] = v
+		}
+		w.Write(body)
+	}
+}
+
+// sign 平台对应答或通知签名, 返回签名头
+func (p *testPlatform) sign(t *testing.T, body []byte, ts time.Time) http.Header {
+	nonce := "fdasflkja484w"
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s\n", timestamp, nonce, body)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{}
+	header.Set(HeaderWechatpayTimestamp, timestamp)
+	header.Set(HeaderWechatpayNonce, nonce)
+	header.Set(HeaderWechatpaySerial, p.serial)
+	header.Set(HeaderWechatpaySignature, base64.StdEncoding.EncodeToString(sig))
+	return header
+}
+
+func v3NotifyRequest(t *testing.T, p *testPlatform, eventType, plaintext string, ts time.Time) *http.Request {
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":            "EV-2018022511223320873",
+		"create_time":   "2015-05-20T13:29:35+08:00",
+		"resource_type": "encrypt-resource",
+		"event_type":    eventType,
+		"resource": map[string]string{
+			"algorithm":       "AEAD_AES_256_GCM",
+			"original_type":   "transaction",
+			"associated_data": "transaction",
+			"nonce":           "fdasfjihihih",
+			"ciphertext":      testEncrypt(t, plaintext, "fdasfjihihih", "transaction"),
+		},
+	})
+	r := httptest.NewRequest("POST", "/notify", strings.NewReader(string(body)))
+	for k, v := range p.sign(t, body, ts) {
+		r.Header[k] = v
+	}
+	return r
+}
+
+func v3NotifyClient(t *testing.T, platforms ...*testPlatform) (*WxClient, func()) {
+	_, keyPEM := testV3Key(t)
+	srv := httptest.NewServer(certificatesHandler(t, platforms...))
+	c := &WxClient{AppID: "wxd678efh567hg6787", MchID: "1230000109", APIv3Key: testAPIv3Key, KeyPEM: keyPEM, BaseURL: srv.URL, HTTPClient: srv.Client()}
+	return c, srv.Close
+}
+
+func TestParseV3PaymentNotification(t *testing.T) {
+	p := newTestPlatform(t, 0x5157F09EFDC096DE, time.Now().Add(24*time.Hour))
+	c, done := v3NotifyClient(t, p)
+	defer done()
+
+	plain := `{"mchid":"1230000109","appid":"wxd678efh567hg6787","out_trade_no":"T001","transaction_id":"4200000001","trade_state":"SUCCESS","success_time":"2018-06-08T10:34:56+08:00","amount":{"total":101,"payer_total":101,"currency":"CNY"}}`
+	n, err := c.ParseV3PaymentNotification(v3NotifyRequest(t, p, "TRANSACTION.SUCCESS", plain, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.IsPaid() || n.OutTradeNo != "T001" || n.Amount.Total != 101 {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+
+	// 篡改签名
+	r := v3NotifyRequest(t, p, "TRANSACTION.SUCCESS", plain, time.Now())
+	r.Header.Set(HeaderWechatpaySignature, base64.StdEncoding.EncodeToString([]byte("forged")))
+	if _, err := c.ParseV3PaymentNotification(r); !errors.Is(err, ErrNotifySign) {
+		t.Fatalf("want ErrNotifySign, got %v", err)
+	}
+
+	// 过期通知
+	if _, err := c.ParseV3PaymentNotification(v3NotifyRequest(t, p, "TRANSACTION.SUCCESS", plain, time.Now().Add(-time.Hour))); !errors.Is(err, ErrNotifyExpired) {
+		t.Fatalf("want ErrNotifyExpired, got %v", err)
+	}
+
+	// 其他商户的通知
+	other := strings.Replace(plain, "1230000109", "1230000110", 1)
+	if _, err := c.ParseV3PaymentNotification(v3NotifyRequest(t, p, "TRANSACTION.SUCCESS", other, time.Now())); !errors.Is(err, ErrNotifyMerchant) {
+		t.Fatalf("want ErrNotifyMerchant, got %v", err)
+	}
+
+	// 未知平台证书
+	stranger := newTestPlatform(t, 0x1234, time.Now().Add(time.Hour))
+	if _, err := c.ParseV3PaymentNotification(v3NotifyRequest(t, stranger, "TRANSACTION.SUCCESS", plain, time.Now())); !errors.Is(err, ErrPlatformCertNotFound) {
+		t.Fatalf("want ErrPlatformCertNotFound, got %v", err)
+	}
+}
+
+func TestParseV3RefundNotification(t *testing.T) {
+	p := newTestPlatform(t, 0x5157F09EFDC096DE, time.Now().Add(24*time.Hour))
+	c, done := v3NotifyClient(t, p)
+	defer done()
+
+	plain := `{"mchid":"1230000109","out_trade_no":"T001","transaction_id":"4200000001","out_refund_no":"R001","refund_id":"50000000382019052709732678859","refund_status":"SUCCESS","amount":{"total":101,"refund":50,"payer_total":101,"payer_refund":50}}`
+	n, err := c.ParseV3RefundNotification(v3NotifyRequest(t, p, "REFUND.SUCCESS", plain, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.RefundStatus != "SUCCESS" || n.OutRefundNo != "R001" || n.Amount.Refund != 50 {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+}
+
+func TestHandleV3PaymentNotificationAck(t *testing.T) {
+	p := newTestPlatform(t, 0x5157F09EFDC096DE, time.Now().Add(24*time.Hour))
+	c, done := v3NotifyClient(t, p)
+	defer done()
+
+	r := v3NotifyRequest(t, p, "TRANSACTION.SUCCESS", `{"mchid":"1230000109","trade_state":"SUCCESS"}`, time.Now())
+	r.Header.Set(HeaderWechatpaySignature, base64.StdEncoding.EncodeToString([]byte("forged")))
+	w := httptest.NewRecorder()
+	if _, err := c.HandleV3PaymentNotification(w, r); err == nil || w.Code == http.StatusOK {
+		t.Fatalf("forged notification accepted: %v %d", err, w.Code)
+	}
+}
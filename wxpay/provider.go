@@ -0,0 +1,268 @@
+package wxpay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jxwt/pay"
+)
+
+// Provider 微信支付的 pay.Provider 实现, 一个实例对应一种支付方式
+type Provider struct {
+	client    *WxClient
+	channelID int
+}
+
+// wxChannels 微信支持的支付方式
+var wxChannels = []int{
+	pay.CashChannelWxAppPay,
+	pay.CashChannelWxH5Pay,
+	pay.CashChannelWxMiniPay,
+	pay.CashChannelWxPublicPay,
+	pay.CashChannelWxCodePay,
+}
+
+// NewProvider 按支付方式创建微信支付实现
+func NewProvider(c *WxClient, channelID int) (*Provider, error) {
+	for _, id := range wxChannels {
+		if id == channelID {
+			return &Provider{client: c, channelID: channelID}, nil
+		}
+	}
+	return nil, fmt.Errorf("wxpay: unsupported channel %d", channelID)
+}
+
+// RegisterProviders 将客户端注册到所有微信支付方式
+func RegisterProviders(r *pay.Registry, c *WxClient) {
+	for _, id := range wxChannels {
+		r.Register(id, &Provider{client: c, channelID: id})
+	}
+}
+
+// CreatePayment 统一下单
+func (p *Provider) CreatePayment(ctx context.Context, req *pay.PaymentRequest) (*pay.PaymentResult, error) {
+	c := p.client
+	charge := &Charge{
+		TradeNum:    req.TradeNo,
+		MoneyFee:    req.Amount,
+		Describe:    req.Subject,
+		OpenID:      req.OpenID,
+		CallbackURL: c.notifyURL(req.NotifyURL),
+		SceneInfo:   req.SceneInfo,
+	}
+	res := &pay.PaymentResult{ChannelID: p.channelID, TradeNo: req.TradeNo}
+	switch p.channelID {
+	case pay.CashChannelWxAppPay:
+		appPay := c.AppPayContext
+		if c.PayV3 {
+			appPay = c.AppPayV3Context
+		}
+		params, err := appPay(ctx, charge)
+		if err != nil {
+			return nil, err
+		}
+		res.Params = params
+		res.PrepayID = params["prepayid"]
+	case pay.CashChannelWxH5Pay:
+		h5Pay := c.H5PayContext
+		if c.PayV3 {
+			h5Pay = c.H5PayV3Context
+		}
+		params, err := h5Pay(ctx, charge)
+		if err != nil {
+			return nil, err
+		}
+		res.Params = params
+		res.PrepayID = strings.TrimPrefix(params["package"], "prepay_id=")
+		res.PayURL = params["mweb_url"]
+	case pay.CashChannelWxMiniPay, pay.CashChannelWxPublicPay:
+		miniPay := c.MiniPayContext
+		if c.PayV3 {
+			miniPay = c.MiniPayV3Context
+		}
+		params, err := miniPay(ctx, charge)
+		if err != nil {
+			return nil, err
+		}
+		res.Params = params
+		res.PrepayID = strings.TrimPrefix(params["package"], "prepay_id=")
+	case pay.CashChannelWxCodePay:
+		native := c.WxNativeContext
+		if c.PayV3 {
+			native = c.WxNativeV3Context
+		}
+		result, err := native(ctx, charge)
+		if err != nil {
+			return nil, err
+		}
+		res.PrepayID = result.PrepayID
+		res.PayURL = result.CodeURL
+	}
+	return res, nil
+}
+
+// Query 查询订单
+func (p *Provider) Query(ctx context.Context, tradeNo string) (*pay.QueryResult, error) {
+	result, err := p.client.QueryOrderContext(ctx, tradeNo)
+	if err != nil {
+		return nil, err
+	}
+	status, err := result.PaymentStatus()
+	if err != nil {
+		return nil, err
+	}
+	amount, err := fenToMoney(result.TotalFee)
+	if err != nil {
+		return nil, err
+	}
+	return &pay.QueryResult{
+		TradeNo:       result.OutTradeNO,
+		TransactionID: result.TransactionID,
+		TradeState:    result.TradeState,
+		Status:        status,
+		Paid:          status.IsPaid(),
+		Amount:        amount,
+		PaidAt:        result.TimeEnd,
+	}, nil
+}
+
+// Refund 申请退款, 微信退款为异步处理, 受理成功时状态为处理中
+// 微信退款必须传订单金额 total_fee, 未传 TotalAmount 时不请求网关
+func (p *Provider) Refund(ctx context.Context, req *pay.RefundRequest) (*pay.RefundResult, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if !req.TotalAmount.IsPositive() {
+		return nil, fmt.Errorf("%w: wxpay refund requires total amount", pay.ErrInvalidRefund)
+	}
+	result, err := p.client.PayRefundContext(ctx, &PayRefundRequest{
+		OutRefundNo:   req.RefundNo,
+		RefundDesc:    req.Reason,
+		TotalFee:      req.TotalAmount,
+		RefundFee:     req.RefundAmount,
+		OutTradeNo:    req.TradeNo,
+		TransactionID: req.TransactionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pay.RefundResult{
+		TradeNo:          result.OutTradeNO,
+		TransactionID:    result.TransactionID,
+		RefundNo:         result.OutRefundNo,
+		RefundID:         result.RefundID,
+		RefundAmount:     pay.CNY(int64(result.RefundFee)),
+		SettlementAmount: pay.CNY(int64(result.SettlementRefundFee)),
+		RefundState:      "PROCESSING",
+		Status:           pay.RefundProcessing,
+	}, nil
+}
+
+// QueryRefund 按商户退款单号查询退款, tradeNo 不为空时校验退款所属订单
+func (p *Provider) QueryRefund(ctx context.Context, tradeNo, refundNo string) (*pay.RefundResult, error) {
+	if refundNo == "" {
+		return nil, fmt.Errorf("%w: refund no required", pay.ErrInvalidRefund)
+	}
+	result, err := p.client.QueryRefundContext(ctx, &RefundQueryRequest{OutRefundNo: refundNo})
+	if err != nil {
+		return nil, err
+	}
+	if tradeNo != "" && result.OutTradeNo != tradeNo {
+		return nil, fmt.Errorf("%w: %s belongs to %s, not %s", pay.ErrRefundNotExist, refundNo, result.OutTradeNo, tradeNo)
+	}
+	for _, r := range result.Refunds {
+		if r.OutRefundNo != refundNo {
+			continue
+		}
+		status, err := RefundStatus(r.RefundStatus)
+		if err != nil {
+			return nil, err
+		}
+		return &pay.RefundResult{
+			TradeNo:          result.OutTradeNo,
+			TransactionID:    result.TransactionID,
+			RefundNo:         r.OutRefundNo,
+			RefundID:         r.RefundID,
+			RefundAmount:     pay.CNY(int64(r.RefundFee)),
+			SettlementAmount: pay.CNY(int64(r.SettlementRefundFee)),
+			RefundState:      r.RefundStatus,
+			Status:           status,
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", pay.ErrRefundNotExist, refundNo)
+}
+
+// Close 关闭未支付订单, 订单已关闭时视为成功
+func (p *Provider) Close(ctx context.Context, tradeNo string) error {
+	var err error
+	if p.client.PayV3 {
+		err = p.client.CloseOrderV3Context(ctx, tradeNo)
+	} else {
+		_, err = p.client.CloseOrderContext(ctx, tradeNo)
+	}
+	if errors.Is(err, pay.ErrOrderClosed) {
+		return nil
+	}
+	return err
+}
+
+// ParseNotification 校验签名与商户号并解析支付结果通知, 金额由调用方比对
+func (p *Provider) ParseNotification(r *http.Request) (*pay.Notification, error) {
+	if p.client.PayV3 {
+		n, err := p.client.ParseV3PaymentNotification(r)
+		if err != nil {
+			return nil, err
+		}
+		status, err := n.PaymentStatus()
+		if err != nil {
+			return nil, err
+		}
+		return &pay.Notification{
+			TradeNo:       n.OutTradeNo,
+			TransactionID: n.TransactionID,
+			Amount:        pay.NewMoney(n.Amount.Total, n.Amount.Currency),
+			Status:        status,
+			Paid:          n.IsPaid(),
+			PaidAt:        n.SuccessTime,
+		}, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	n, err := p.client.ParsePaymentNotification(body, nil)
+	if err != nil {
+		return nil, err
+	}
+	// v2通知不带 trade_state, 按 result_code 区分成功与失败
+	status := pay.StatusFailed
+	if n.IsPaid() {
+		status = pay.StatusPaid
+	}
+	return &pay.Notification{
+		TradeNo:       n.OutTradeNo,
+		TransactionID: n.TransactionID,
+		Amount:        pay.CNY(int64(n.TotalFee)),
+		Status:        status,
+		Paid:          n.IsPaid(),
+		PaidAt:        n.TimeEnd,
+		Raw:           n.Raw,
+	}, nil
+}
+
+// fenToMoney 微信金额(分)转 pay.Money, 未返回时为0, 格式错误时返回错误而不是按0处理
+func fenToMoney(fee string) (pay.Money, error) {
+	if fee == "" {
+		return pay.CNY(0), nil
+	}
+	n, err := strconv.ParseInt(fee, 10, 64)
+	if err != nil {
+		return pay.Money{}, fmt.Errorf("wxpay: invalid amount %q: %w", fee, err)
+	}
+	return pay.CNY(n), nil
+}
@@ -2,52 +2,94 @@ package wxpay
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"github.com/jxwt/pay"
 	"github.com/jxwt/tools"
-	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // WithCert 附着商户证书
 func (i *WxClient) WithCert(certFile, keyFile string) error {
 	certByte := FormatCeritficate(certFile)
 	keyByte := FormatPrivateKey(keyFile)
-	i.WithCertBytes(certByte, keyByte)
-	return nil
+	return i.WithCertBytes(certByte, keyByte)
 }
 
+// WithCertBytes 附着商户证书, 证书客户端只在此处创建, 请求时复用
 func (i *WxClient) WithCertBytes(cert, key []byte) error {
-	tlsCert, err := tls.X509KeyPair(cert, key)
+	c, err := i.newCertClient(cert, key)
 	if err != nil {
 		return err
 	}
+	i.certMu.Lock()
+	i.httpsClient = c
+	i.certMu.Unlock()
+	return nil
+}
+
+// certClient 双向证书客户端, 未通过 NewWxClient/WithCert 加载时按 CertPEM/KeyPEM 加载一次
+func (i *WxClient) certClient() (*http.Client, error) {
+	i.certMu.Lock()
+	defer i.certMu.Unlock()
+	if i.httpsClient == nil {
+		c, err := i.newCertClient(FormatCeritficate(i.CertPEM), FormatPrivateKey(i.KeyPEM))
+		if err != nil {
+			i.log(pay.LevelWarn, "wxpay: load merchant certificate", pay.F("err", err))
+			return nil, err
+		}
+		i.httpsClient = c
+	}
+	return &i.httpsClient.Client, nil
+}
+
+// newCertClient 创建附带商户证书的http客户端
+func (i *WxClient) newCertClient(cert, key []byte) (*pay.HTTPSClient, error) {
+	tlsCert, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
 	conf := &tls.Config{
 		Certificates: []tls.Certificate{tlsCert},
 	}
-	trans := &http.Transport{
-		TLSClientConfig: conf,
+	// 沿用自定义客户端的transport与超时, 仅附加商户证书
+	base := http.DefaultTransport.(*http.Transport)
+	var timeout time.Duration
+	if i.HTTPClient != nil {
+		if t, ok := i.HTTPClient.Transport.(*http.Transport); ok {
+			base = t
+		}
+		timeout = i.HTTPClient.Timeout
 	}
+	trans := base.Clone()
+	trans.TLSClientConfig = conf
 
-	httpsClient := http.Client{
-		Transport: trans,
-	}
-	i.httpsClient = &pay.HTTPSClient{
-		httpsClient,
-	}
-	return nil
+	return &pay.HTTPSClient{
+		Client: http.Client{
+			Transport: trans,
+			Timeout:   timeout,
+		},
+	}, nil
 }
 
 // PayRefund 微信退款
 // outRefundNo 为后端自定义的随机字符串（尽量唯一） 与 商户退款单号（确保唯一性）
-// OutTradeNo 需要退款的微信订单号
+// OutTradeNo 需要退款的商户单号, 或填写 TransactionID 按微信订单号退款
 // refundDesc 退款理由
 // totalFee,refundFee 订单的金额,与退款的金额
 func (i *WxClient) PayRefund(payRefundReq *PayRefundRequest) (*WeChatQueryResult, error) {
-	if err := i.WithCert(i.CertPEM, i.KeyPEM); err != nil {
-		log.Printf("PayRefund err:%v\n", err)
+	return i.PayRefundContext(context.Background(), payRefundReq)
+}
+
+// PayRefundContext 携带ctx的微信退款
+func (i *WxClient) PayRefundContext(ctx context.Context, payRefundReq *PayRefundRequest) (*WeChatQueryResult, error) {
+	certClient, err := i.certClient()
+	if err != nil {
 		return nil, err
 	}
 	m := make(map[string]string)
@@ -57,30 +99,139 @@ func (i *WxClient) PayRefund(payRefundReq *PayRefundRequest) (*WeChatQueryResult
 	}
 	m["mch_id"] = i.MchID
 	m["nonce_str"] = RandomStr()
-	m["out_trade_no"] = payRefundReq.OutTradeNo
+	if payRefundReq.TransactionID != "" {
+		m["transaction_id"] = payRefundReq.TransactionID
+	} else {
+		m["out_trade_no"] = payRefundReq.OutTradeNo
+	}
 	m["out_refund_no"] = payRefundReq.OutRefundNo
 	m["total_fee"] = WechatMoneyFeeToString(payRefundReq.TotalFee)
 	m["refund_fee"] = WechatMoneyFeeToString(payRefundReq.RefundFee)
 	m["refund_desc"] = payRefundReq.RefundDesc
-	sign, err := WechatGenSign(i.PayKey, m)
+	key, err := i.signKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := WechatGenSign(key, m)
 	if err != nil {
 		return nil, errors.New("wx refund sign err " + err.Error())
 	}
 	m["sign"] = sign
 
 	// 发起退款申请
-	result, err := PostWechat("https://api.mch.weixin.qq.com/secapi/pay/refund", m, i.httpsClient)
+	result, err := i.postWechat(ctx, certClient, i.apiURL("/secapi/pay/refund"), m)
 	if err != nil {
-		log.Printf("clientPost.Post error: %v", err)
+		i.log(pay.LevelWarn, "wxpay: request failed", pay.F("err", err))
 		return nil, err
 	}
 	return &result, nil
 }
 
+// QueryRefund 查询退款
+func (i *WxClient) QueryRefund(req *RefundQueryRequest) (*RefundQueryResult, error) {
+	return i.QueryRefundContext(context.Background(), req)
+}
+
+// QueryRefundContext 携带ctx查询退款, 退款单不存在时返回 pay.ErrRefundNotExist
+func (i *WxClient) QueryRefundContext(ctx context.Context, req *RefundQueryRequest) (*RefundQueryResult, error) {
+	m := make(map[string]string)
+	m["appid"] = i.AppID
+	m["mch_id"] = i.MchID
+	if i.SubMchId != "" {
+		m["sub_mch_id"] = i.SubMchId
+	}
+	m["nonce_str"] = RandomStr()
+	switch {
+	case req.RefundID != "":
+		m["refund_id"] = req.RefundID
+	case req.OutRefundNo != "":
+		m["out_refund_no"] = req.OutRefundNo
+	case req.TransactionID != "":
+		m["transaction_id"] = req.TransactionID
+	case req.OutTradeNo != "":
+		m["out_trade_no"] = req.OutTradeNo
+	default:
+		return nil, errors.New("wx refund query: one of refund_id, out_refund_no, transaction_id, out_trade_no required")
+	}
+	if req.Offset > 0 {
+		m["offset"] = strconv.Itoa(req.Offset)
+	}
+	key, err := i.signKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := WechatGenSign(key, m)
+	if err != nil {
+		return nil, errors.New("wx refund query sign err " + err.Error())
+	}
+	m["sign"] = sign
+
+	var body []byte
+	err = i.retry(ctx, pay.OpQueryRefund, func(ctx context.Context) error {
+		_, body, err = i.postWechatBody(ctx, i.HTTPClient, i.apiURL("/pay/refundquery"), m)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	raw, err := XmlToMap(body)
+	if err != nil {
+		return nil, errors.New("xml.Unmarshal: " + err.Error())
+	}
+	return parseRefundQuery(raw)
+}
+
+// parseRefundQuery 将带序号的退款字段展开为退款记录
+func parseRefundQuery(m map[string]string) (*RefundQueryResult, error) {
+	atoi := func(k string) int {
+		n, _ := strconv.Atoi(m[k])
+		return n
+	}
+	res := &RefundQueryResult{
+		TransactionID:      m["transaction_id"],
+		OutTradeNo:         m["out_trade_no"],
+		TotalFee:           atoi("total_fee"),
+		SettlementTotalFee: atoi("settlement_total_fee"),
+		CashFee:            atoi("cash_fee"),
+		RefundFee:          atoi("refund_fee"),
+		TotalRefundCount:   atoi("total_refund_count"),
+	}
+	count, err := strconv.Atoi(m["refund_count"])
+	if err != nil {
+		return nil, fmt.Errorf("wx refund query: invalid refund_count %q", m["refund_count"])
+	}
+	for n := 0; n < count; n++ {
+		field := func(name string) string {
+			return name + "_" + strconv.Itoa(n)
+		}
+		if m[field("out_refund_no")] == "" {
+			return nil, fmt.Errorf("wx refund query: missing %s", field("out_refund_no"))
+		}
+		res.Refunds = append(res.Refunds, RefundRecord{
+			OutRefundNo:         m[field("out_refund_no")],
+			RefundID:            m[field("refund_id")],
+			RefundChannel:       m[field("refund_channel")],
+			RefundFee:           atoi(field("refund_fee")),
+			SettlementRefundFee: atoi(field("settlement_refund_fee")),
+			CouponRefundFee:     atoi(field("coupon_refund_fee")),
+			RefundStatus:        m[field("refund_status")],
+			RefundAccount:       m[field("refund_account")],
+			RefundRecvAccout:    m[field("refund_recv_accout")],
+			RefundSuccessTime:   m[field("refund_success_time")],
+		})
+	}
+	return res, nil
+}
+
 // PayReverse 撤销订单
 func (i *WxClient) PayReverse(tradeNum string) (*WeChatQueryResult, error) {
-	if err := i.WithCert(i.CertPEM, i.KeyPEM); err != nil {
-		log.Printf("PayRefund err:%v\n", err)
+	return i.PayReverseContext(context.Background(), tradeNum)
+}
+
+// PayReverseContext 携带ctx撤销订单
+func (i *WxClient) PayReverseContext(ctx context.Context, tradeNum string) (*WeChatQueryResult, error) {
+	certClient, err := i.certClient()
+	if err != nil {
 		return nil, err
 	}
 	m := make(map[string]string)
@@ -88,15 +239,19 @@ func (i *WxClient) PayReverse(tradeNum string) (*WeChatQueryResult, error) {
 	m["mch_id"] = i.MchID
 	m["nonce_str"] = RandomStr()
 	m["out_trade_no"] = tradeNum
-	sign, err := WechatGenSign(i.PayKey, m)
+	key, err := i.signKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := WechatGenSign(key, m)
 	if err != nil {
 		return nil, errors.New("wx refund sign err " + err.Error())
 	}
 	m["sign"] = sign
 	// 发起退款申请
-	result, err := PostWechat("https://api.mch.weixin.qq.com/secapi/pay/reverse", m, i.httpsClient)
+	result, err := i.postWechat(ctx, certClient, i.apiURL("/secapi/pay/reverse"), m)
 	if err != nil {
-		log.Printf("clientPost.Post error: %v", err)
+		i.log(pay.LevelWarn, "wxpay: request failed", pay.F("err", err))
 		return nil, err
 	}
 	return &result, nil
@@ -148,8 +303,13 @@ func formatKey(raw, prefix, suffix string) (result []byte) {
 
 //企业付款，成功返回自定义订单号，微信订单号，true，失败返回错误信息，false
 func (i *WxClient) Transfer(payRefundReq *PayRefundRequest) error {
-	if err := i.WithCert(i.CertPEM, i.KeyPEM); err != nil {
-		log.Printf("PayRefund err:%v\n", err)
+	return i.TransferContext(context.Background(), payRefundReq)
+}
+
+// TransferContext 携带ctx的企业付款
+func (i *WxClient) TransferContext(ctx context.Context, payRefundReq *PayRefundRequest) error {
+	certClient, err := i.certClient()
+	if err != nil {
 		return err
 	}
 	m := make(map[string]string)
@@ -162,16 +322,20 @@ func (i *WxClient) Transfer(payRefundReq *PayRefundRequest) error {
 	m["check_name"] = "NO_CHECK"
 	m["desc"] = payRefundReq.RefundDesc
 	m["spbill_create_ip"] = tools.GetLocalAddr()
-	sign, err := WechatGenSign(i.PayKey, m)
+	key, err := i.signKey(ctx)
+	if err != nil {
+		return err
+	}
+	sign, err := WechatGenSign(key, m)
 	if err != nil {
 		return errors.New("wx refund sign err " + err.Error())
 	}
 	m["sign"] = sign
 
-	// 发起退款申请
-	result, err := PostWechat("https://api.mch.weixin.qq.com/mmpaymkttransfers/promotion/transfers", m, i.httpsClient)
+	// 发起退款申请, 企业付款应答不带签名
+	result, err := PostWechatContext(ctx, certClient, i.apiURL("/mmpaymkttransfers/promotion/transfers"), m)
 	if err != nil {
-		log.Printf("clientPost.Post error: %v", err)
+		i.log(pay.LevelWarn, "wxpay: request failed", pay.F("err", err))
 		return err
 	}
 
@@ -1,25 +1,205 @@
 package wxpay
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/jxwt/pay"
+	"github.com/jxwt/pay/paytest"
+)
 
 func TestPayRefund(t *testing.T) {
-	client := &WxClient{
-		AppID:   "",
-		MchID:   "",
-		Key:     "",
-	}
-	req := &PayRefundRequest{
-		OutRefundNo: "dfsefwdcweiojc3oe233",
-		RefundDesc:  "退款",
-		TotalFee:    0.01,
-		RefundFee:   0.01,
+	s := paytest.NewWechatServer(t)
+	client := testClient(s)
+	if _, err := client.WxNative(&Charge{TradeNum: "1320200729160058Re58BM7fNj", MoneyFee: pay.CNY(100), Describe: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pay("1320200729160058Re58BM7fNj"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 两次部分退款
+	for _, no := range []string{"dfsefwdcweiojc3oe233", "dfsefwdcweiojc3oe234"} {
+		res, err := client.PayRefund(&PayRefundRequest{
+			OutRefundNo: no,
+			RefundDesc:  "退款",
+			TotalFee:    pay.CNY(100),
+			RefundFee:   pay.CNY(50),
+			OutTradeNo:  "1320200729160058Re58BM7fNj",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ResultCode != "SUCCESS" {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	}
+	// 超额退款
+	if _, err := client.PayRefund(&PayRefundRequest{
+		OutRefundNo: "dfsefwdcweiojc3oe235",
+		TotalFee:    pay.CNY(100),
+		RefundFee:   pay.CNY(1),
 		OutTradeNo:  "1320200729160058Re58BM7fNj",
-		OpenId:      "oQ1W_4tgAd51uSJFhXQDGyfmRiSM",
+	}); err == nil {
+		t.Fatal("expected over-refund error")
+	}
+
+	if refunds := s.Refunds("1320200729160058Re58BM7fNj"); len(refunds) != 2 {
+		t.Fatalf("unexpected refunds %+v", refunds)
+	}
+	if o, _ := s.Order("1320200729160058Re58BM7fNj"); o.Refunded != 100 || o.State != paytest.StateRefund {
+		t.Fatalf("unexpected order %+v", o)
+	}
+}
+
+func TestPayRefundConcurrent(t *testing.T) {
+	s := paytest.NewWechatServer(t)
+	client := testClient(s)
+	if _, err := client.WxNative(&Charge{TradeNum: "T001", MoneyFee: pay.CNY(400), Describe: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pay("T001"); err != nil {
+		t.Fatal(err)
+	}
+	// 同一客户端并发退款共用一个证书客户端
+	var wg sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			_, err := client.PayRefund(&PayRefundRequest{OutRefundNo: fmt.Sprintf("R%d", n), TotalFee: pay.CNY(400), RefundFee: pay.CNY(100), OutTradeNo: "T001"})
+			if err != nil {
+				t.Error(err)
+			}
+		}(n)
 	}
-	res, err := client.PayRefund(req)
+	wg.Wait()
+	first, err := client.certClient()
 	if err != nil {
-		t.Logf("%v", err)
+		t.Fatal(err)
 	}
-	t.Logf("%v", res)
+	if _, err := client.PayRefund(&PayRefundRequest{OutRefundNo: "R4", TotalFee: pay.CNY(400), RefundFee: pay.CNY(1), OutTradeNo: "T001"}); err == nil {
+		t.Fatal("expected over-refund error")
+	}
+	if again, _ := client.certClient(); again != first {
+		t.Fatal("certificate client rebuilt per request")
+	}
+	if refunds := s.Refunds("T001"); len(refunds) != 4 {
+		t.Fatalf("unexpected refunds %+v", refunds)
+	}
+}
 
+func TestProviderRefund(t *testing.T) {
+	s := paytest.NewWechatServer(t)
+	p, err := NewProvider(testClient(s), pay.CashChannelWxCodePay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := p.CreatePayment(ctx, &pay.PaymentRequest{TradeNo: "T001", Amount: pay.CNY(100), Subject: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pay("T001"); err != nil {
+		t.Fatal(err)
+	}
+	o, _ := s.Order("T001")
+	res, err := p.Refund(ctx, &pay.RefundRequest{TransactionID: o.TransactionID, RefundNo: "R1", TotalAmount: pay.CNY(100), RefundAmount: pay.CNY(40)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.TradeNo != "T001" || res.RefundID == "" || res.RefundAmount != pay.CNY(40) || res.Status != pay.RefundProcessing {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if _, err := p.Refund(ctx, &pay.RefundRequest{TradeNo: "T001", RefundNo: "R2", TotalAmount: pay.CNY(100), RefundAmount: pay.CNY(200)}); !errors.Is(err, pay.ErrInvalidRefund) {
+		t.Fatalf("refund exceeds total: %v", err)
+	}
+	// 未传订单金额时不请求网关
+	if _, err := p.Refund(ctx, &pay.RefundRequest{TradeNo: "T001", RefundNo: "R3", RefundAmount: pay.CNY(10)}); !errors.Is(err, pay.ErrInvalidRefund) {
+		t.Fatalf("missing total: %v", err)
+	}
+	if n := len(s.Refunds("T001")); n != 1 {
+		t.Fatalf("want 1 refund, got %d", n)
+	}
+}
+
+func TestQueryRefund(t *testing.T) {
+	s := paytest.NewWechatServer(t)
+	client := testClient(s)
+	p, err := NewProvider(client, pay.CashChannelWxCodePay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := p.CreatePayment(ctx, &pay.PaymentRequest{TradeNo: "T001", Amount: pay.CNY(100), Subject: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pay("T001"); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		no     string
+		amount int64
+	}{{"R1", 30}, {"R2", 50}} {
+		if _, err := p.Refund(ctx, &pay.RefundRequest{TradeNo: "T001", RefundNo: r.no, TotalAmount: pay.CNY(100), RefundAmount: pay.CNY(r.amount)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := client.QueryRefund(&RefundQueryRequest{OutTradeNo: "T001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OutTradeNo != "T001" || res.TotalFee != 100 || len(res.Refunds) != 2 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if r := res.Refunds[1]; r.OutRefundNo != "R2" || r.RefundFee != 50 || r.RefundStatus != RefundStatusSuccess || r.RefundID == "" {
+		t.Fatalf("unexpected record %+v", r)
+	}
+
+	q, err := p.QueryRefund(ctx, "T001", "R1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.RefundNo != "R1" || q.RefundAmount != pay.CNY(30) || q.Status != pay.RefundSuccess {
+		t.Fatalf("unexpected refund %+v", q)
+	}
+	if _, err := p.QueryRefund(ctx, "T002", "R1"); !errors.Is(err, pay.ErrRefundNotExist) {
+		t.Fatalf("wrong order: %v", err)
+	}
+	if _, err := client.QueryRefund(&RefundQueryRequest{OutRefundNo: "R9"}); !errors.Is(err, pay.ErrRefundNotExist) {
+		t.Fatalf("unknown refund: %v", err)
+	}
+}
+
+func TestParseRefundQuery(t *testing.T) {
+	res, err := parseRefundQuery(map[string]string{
+		"transaction_id":          "1008450740201411110005820873",
+		"out_trade_no":            "1415757673",
+		"total_fee":               "100",
+		"cash_fee":                "100",
+		"refund_fee":              "100",
+		"refund_count":            "2",
+		"out_refund_no_0":         "1415701182",
+		"refund_id_0":             "2008450740201411110000174436",
+		"refund_fee_0":            "40",
+		"refund_status_0":         "SUCCESS",
+		"refund_success_time_0":   "2016-07-25 15:26:26",
+		"out_refund_no_1":         "1415701183",
+		"refund_id_1":             "2008450740201411110000174437",
+		"refund_fee_1":            "60",
+		"settlement_refund_fee_1": "60",
+		"refund_status_1":         "PROCESSING",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Refunds) != 2 || res.Refunds[0].RefundSuccessTime == "" || res.Refunds[1].RefundStatus != RefundStatusProcessing || res.Refunds[1].SettlementRefundFee != 60 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if _, err := parseRefundQuery(map[string]string{"refund_count": "1"}); err == nil {
+		t.Fatal("expected error for missing record")
+	}
 }
@@ -0,0 +1,162 @@
+package wxpay
+
+import (
+	"crypto/aes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/jxwt/pay"
+)
+
+// 退款状态 refund_status
+const (
+	RefundStatusSuccess    = "SUCCESS"     // 退款成功
+	RefundStatusProcessing = "PROCESSING"  // 退款处理中, 仅退款查询返回
+	RefundStatusChange     = "CHANGE"      // 退款异常, 需在商户平台人工处理
+	RefundStatusClose      = "REFUNDCLOSE" // 退款关闭
+)
+
+// RefundNotification 微信退款结果通知, 外层报文不带签名, 退款信息在 req_info 中加密
+// https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=9_16
+type RefundNotification struct {
+	ReturnCode string `xml:"return_code"`
+	ReturnMsg  string `xml:"return_msg"`
+	AppID      string `xml:"appid"`
+	MchID      string `xml:"mch_id"`
+	SubAppID   string `xml:"sub_appid"`
+	SubMchID   string `xml:"sub_mch_id"`
+	NonceStr   string `xml:"nonce_str"`
+	ReqInfo    string `xml:"req_info"` // 加密的退款信息, 解密后填入 Info
+
+	Info RefundNotificationInfo `xml:"-"`
+}
+
+// RefundNotificationInfo req_info 解密后的退款信息
+type RefundNotificationInfo struct {
+	TransactionID       string `xml:"transaction_id"`
+	OutTradeNo          string `xml:"out_trade_no"`
+	RefundID            string `xml:"refund_id"`
+	OutRefundNo         string `xml:"out_refund_no"`
+	TotalFee            int    `xml:"total_fee"`             // 订单金额, 单位分
+	SettlementTotalFee  int    `xml:"settlement_total_fee"`  // 应结订单金额
+	RefundFee           int    `xml:"refund_fee"`            // 申请退款金额
+	SettlementRefundFee int    `xml:"settlement_refund_fee"` // 退款金额, 去掉非充值代金券后实际退给用户的金额
+	RefundStatus        string `xml:"refund_status"`         // SUCCESS, CHANGE, REFUNDCLOSE
+	SuccessTime         string `xml:"success_time"`          // 退款成功时间, 格式 2006-01-02 15:04:05
+	RefundRecvAccout    string `xml:"refund_recv_accout"`    // 退款入账账户
+	RefundAccount       string `xml:"refund_account"`        // 退款资金来源
+	RefundRequestSource string `xml:"refund_request_source"` // 退款发起来源
+}
+
+// RefundStatus 退款状态对应的统一退款状态
+func RefundStatus(status string) (pay.RefundStatus, error) {
+	switch status {
+	case RefundStatusSuccess:
+		return pay.RefundSuccess, nil
+	case RefundStatusProcessing:
+		return pay.RefundProcessing, nil
+	case RefundStatusChange:
+		return pay.RefundFailed, nil
+	case RefundStatusClose:
+		return pay.RefundClosed, nil
+	}
+	return "", fmt.Errorf("%w: wxpay refund_status %q", pay.ErrUnknownStatus, status)
+}
+
+// Result 转为统一退款结果
+func (n *RefundNotification) Result() (*pay.RefundResult, error) {
+	status, err := RefundStatus(n.Info.RefundStatus)
+	if err != nil {
+		return nil, err
+	}
+	return &pay.RefundResult{
+		TradeNo:          n.Info.OutTradeNo,
+		TransactionID:    n.Info.TransactionID,
+		RefundNo:         n.Info.OutRefundNo,
+		RefundID:         n.Info.RefundID,
+		RefundAmount:     pay.CNY(int64(n.Info.RefundFee)),
+		SettlementAmount: pay.CNY(int64(n.Info.SettlementRefundFee)),
+		RefundState:      n.Info.RefundStatus,
+		Status:           status,
+	}, nil
+}
+
+// ParseRefundNotification 校验商户号并解密退款结果通知
+// 通知本身不带签名, 以商户支付key能否解密 req_info 作为来源校验
+func (i *WxClient) ParseRefundNotification(body []byte) (*RefundNotification, error) {
+	n := new(RefundNotification)
+	if err := xml.Unmarshal(body, n); err != nil {
+		return nil, errors.New("xml.Unmarshal: " + err.Error())
+	}
+	if n.ReturnCode != "SUCCESS" {
+		return nil, newProviderError(n.ReturnCode, "", n.ReturnMsg, body)
+	}
+	if n.AppID != i.AppID || n.MchID != i.MchID {
+		return nil, ErrNotifyMerchant
+	}
+	if i.SubMchId != "" && n.SubMchID != i.SubMchId {
+		return nil, ErrNotifyMerchant
+	}
+	plain, err := DecryptRefundReqInfo(i.notifyKey(), n.ReqInfo)
+	if err != nil {
+		return nil, err
+	}
+	if err := xml.Unmarshal(plain, &n.Info); err != nil {
+		return nil, errors.New("xml.Unmarshal req_info: " + err.Error())
+	}
+	return n, nil
+}
+
+// HandleRefundNotification 处理退款结果通知, 解密成功后才应答SUCCESS
+func (i *WxClient) HandleRefundNotification(w http.ResponseWriter, r *http.Request) (*RefundNotification, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.Write([]byte(WechatCallBackFailRes("读取通知失败")))
+		return nil, err
+	}
+	n, err := i.ParseRefundNotification(body)
+	if err != nil {
+		w.Write([]byte(WechatCallBackFailRes(err.Error())))
+		return nil, err
+	}
+	w.Write([]byte(WechatCallBackSuccessRes()))
+	return n, nil
+}
+
+// DecryptRefundReqInfo 解密退款通知 req_info
+// base64解码后使用 AES-256-ECB 解密, 密钥为商户支付key的MD5小写十六进制串, PKCS#7填充
+func DecryptRefundReqInfo(payKey, reqInfo string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(reqInfo)
+	if err != nil {
+		return nil, fmt.Errorf("wxpay: decode req_info: %v", err)
+	}
+	sum := md5.Sum([]byte(payKey))
+	block, err := aes.NewCipher([]byte(hex.EncodeToString(sum[:])))
+	if err != nil {
+		return nil, err
+	}
+	size := block.BlockSize()
+	if len(data) == 0 || len(data)%size != 0 {
+		return nil, errors.New("wxpay: req_info is not a multiple of the block size")
+	}
+	plain := make([]byte, len(data))
+	for n := 0; n < len(data); n += size {
+		block.Decrypt(plain[n:n+size], data[n:n+size])
+	}
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > size {
+		return nil, errors.New("wxpay: invalid req_info padding, check PayKey")
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, errors.New("wxpay: invalid req_info padding, check PayKey")
+		}
+	}
+	return plain[:len(plain)-pad], nil
+}
@@ -0,0 +1,100 @@
+package wxpay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jxwt/pay"
+	"github.com/jxwt/pay/paytest"
+)
+
+func TestHandleRefundNotification(t *testing.T) {
+	s := paytest.NewWechatServer(t)
+	client := testClient(s)
+	p, err := NewProvider(client, pay.CashChannelWxCodePay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := p.CreatePayment(ctx, &pay.PaymentRequest{TradeNo: "T001", Amount: pay.CNY(100), Subject: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pay("T001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Refund(ctx, &pay.RefundRequest{TradeNo: "T001", RefundNo: "R1", TotalAmount: pay.CNY(100), RefundAmount: pay.CNY(30)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got *RefundNotification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = client.HandleRefundNotification(w, r)
+	}))
+	defer srv.Close()
+	reply, err := s.RefundNotify(srv.URL, "R1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(reply, "SUCCESS") || got == nil {
+		t.Fatalf("reply %s", reply)
+	}
+	res, err := got.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.TradeNo != "T001" || res.RefundNo != "R1" || res.RefundAmount != pay.CNY(30) || res.SettlementAmount != pay.CNY(30) || res.Status != pay.RefundSuccess {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if got.Info.SuccessTime == "" || got.Info.TotalFee != 100 {
+		t.Fatalf("unexpected info %+v", got.Info)
+	}
+
+	// 其他商户的key无法解密
+	body, err := s.RefundNotifyBody("R1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := testClient(s)
+	other.PayKey = "0123456789abcdef0123456789abcdef"
+	if _, err := other.ParseRefundNotification(body); err == nil {
+		t.Fatal("expected decrypt error with wrong key")
+	}
+	other = testClient(s)
+	other.MchID = "1900000109"
+	if _, err := other.ParseRefundNotification(body); !errors.Is(err, ErrNotifyMerchant) {
+		t.Fatalf("merchant mismatch: %v", err)
+	}
+}
+
+func TestRefundNotificationCoupon(t *testing.T) {
+	// 使用代金券时 settlement_refund_fee 小于 refund_fee, 退款金额与查询接口一致取 refund_fee
+	n := &RefundNotification{Info: RefundNotificationInfo{OutTradeNo: "T001", OutRefundNo: "R1", RefundFee: 30, SettlementRefundFee: 20, RefundStatus: RefundStatusSuccess}}
+	res, err := n.Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RefundAmount != pay.CNY(30) || res.SettlementAmount != pay.CNY(20) {
+		t.Fatalf("unexpected amounts %+v", res)
+	}
+}
+
+func TestRefundStatus(t *testing.T) {
+	cases := map[string]pay.RefundStatus{
+		RefundStatusSuccess:    pay.RefundSuccess,
+		RefundStatusProcessing: pay.RefundProcessing,
+		RefundStatusChange:     pay.RefundFailed,
+		RefundStatusClose:      pay.RefundClosed,
+	}
+	for status, want := range cases {
+		if got, err := RefundStatus(status); err != nil || got != want {
+			t.Fatalf("%s: got %s %v", status, got, err)
+		}
+	}
+	if _, err := RefundStatus("NOTSURE"); !errors.Is(err, pay.ErrUnknownStatus) {
+		t.Fatalf("unknown status: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package wxpay
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/jxwt/pay"
+)
+
+// 仿真测试环境 https://pay.weixin.qq.com/wiki/doc/api/jsapi.php?chapter=23_1
+
+const (
+	// WxBaseURL 微信支付接口域名
+	WxBaseURL = "https://api.mch.weixin.qq.com"
+	// sandboxPath 仿真测试环境接口前缀
+	sandboxPath = "/sandboxnew"
+)
+
+// sandboxKeys 仿真测试签名key缓存, key 为 mch_id+PayKey
+var sandboxKeys sync.Map
+
+// sandboxSignKeyResult 获取仿真测试签名key返回
+type sandboxSignKeyResult struct {
+	ReturnCode     string `xml:"return_code"`
+	ReturnMsg      string `xml:"return_msg"`
+	SandboxSignKey string `xml:"sandbox_signkey"`
+}
+
+// baseURL 接口域名, 为空时使用 WxBaseURL
+func (i *WxClient) baseURL() string {
+	if i.BaseURL != "" {
+		return strings.TrimRight(i.BaseURL, "/")
+	}
+	return WxBaseURL
+}
+
+// apiURL v2接口地址, 仿真测试环境加 /sandboxnew 前缀
+func (i *WxClient) apiURL(path string) string {
+	if i.Sandbox {
+		return i.baseURL() + sandboxPath + path
+	}
+	return i.baseURL() + path
+}
+
+// v3URL 将v3接口地址的域名替换为 BaseURL
+func (i *WxClient) v3URL(u string) string {
+	return i.baseURL() + strings.TrimPrefix(u, WxBaseURL)
+}
+
+// signKey 请求签名使用的key, 仿真测试环境使用沙箱key
+func (i *WxClient) signKey(ctx context.Context) (string, error) {
+	if !i.Sandbox {
+		return i.PayKey, nil
+	}
+	return i.GetSandboxSignKeyContext(ctx)
+}
+
+// notifyKey 通知验签使用的key, 仿真测试环境已获取沙箱key时使用沙箱key
+func (i *WxClient) notifyKey() string {
+	if i.Sandbox {
+		if key, ok := sandboxKeys.Load(i.MchID + i.PayKey); ok {
+			return key.(string)
+		}
+	}
+	return i.PayKey
+}
+
+// GetSandboxSignKey 获取仿真测试签名key
+func (i *WxClient) GetSandboxSignKey() (string, error) {
+	return i.GetSandboxSignKeyContext(context.Background())
+}
+
+// GetSandboxSignKeyContext 携带ctx获取仿真测试签名key, 获取成功后按商户缓存
+func (i *WxClient) GetSandboxSignKeyContext(ctx context.Context) (string, error) {
+	if key, ok := sandboxKeys.Load(i.MchID + i.PayKey); ok {
+		return key.(string), nil
+	}
+	var m = make(map[string]string)
+	m["mch_id"] = i.MchID
+	m["nonce_str"] = RandomStr()
+	sign, err := WechatGenSign(i.PayKey, m)
+	if err != nil {
+		return "", err
+	}
+	m["sign"] = sign
+
+	req, err := http.NewRequest("POST", i.baseURL()+sandboxPath+"/pay/getsignkey", strings.NewReader(mapToXML(m)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	_, body, err := pay.DoRequest(ctx, i.HTTPClient, req)
+	if err != nil {
+		return "", err
+	}
+	result := new(sandboxSignKeyResult)
+	if err := xml.Unmarshal(body, result); err != nil {
+		return "", errors.New("xml.Unmarshal: " + err.Error())
+	}
+	if result.ReturnCode != "SUCCESS" || result.SandboxSignKey == "" {
+		return "", errors.New("getsignkey: " + result.ReturnMsg)
+	}
+	sandboxKeys.Store(i.MchID+i.PayKey, result.SandboxSignKey)
+	return result.SandboxSignKey, nil
+}
@@ -0,0 +1,50 @@
+package wxpay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSandboxQueryOrder(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/sandboxnew/pay/getsignkey":
+			w.Write([]byte("<xml><return_code>SUCCESS</return_code><sandbox_signkey>sandboxkey</sandbox_signkey></xml>"))
+		case "/sandboxnew/pay/orderquery":
+			body, _ := ioutil.ReadAll(r.Body)
+			m, _ := XmlToMap(body)
+			if err := verifyNotifySign("sandboxkey", m); err != nil {
+				t.Errorf("request not signed with sandbox key: %v", err)
+			}
+			res := map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "trade_state": "SUCCESS", "nonce_str": "5K8264ILTKCH16CQ"}
+			res["sign"], _ = WechatGenSign("sandboxkey", res)
+			w.Write([]byte(mapToXML(res)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c := &WxClient{AppID: "wx0001", MchID: "sandbox001", PayKey: "realkey", BaseURL: srv.URL, Sandbox: true, HTTPClient: srv.Client()}
+	for n := 0; n < 2; n++ {
+		res, err := c.QueryOrder("T001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.TradeState != "SUCCESS" {
+			t.Fatalf("unexpected trade_state %s", res.TradeState)
+		}
+	}
+	// 沙箱key按商户缓存, 只获取一次
+	if got := strings.Join(paths, ","); got != "/sandboxnew/pay/getsignkey,/sandboxnew/pay/orderquery,/sandboxnew/pay/orderquery" {
+		t.Fatalf("unexpected requests %s", got)
+	}
+	if c.notifyKey() != "sandboxkey" {
+		t.Fatal("notification should be verified with sandbox key")
+	}
+}
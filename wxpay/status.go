@@ -0,0 +1,46 @@
+package wxpay
+
+import (
+	"fmt"
+
+	"github.com/jxwt/pay"
+)
+
+// 微信订单状态 trade_state
+const (
+	TradeStateSuccess    = "SUCCESS"    // 支付成功
+	TradeStateRefund     = "REFUND"     // 转入退款
+	TradeStateNotPay     = "NOTPAY"     // 未支付
+	TradeStateClosed     = "CLOSED"     // 已关闭
+	TradeStateRevoked    = "REVOKED"    // 已撤销(付款码支付)
+	TradeStateUserPaying = "USERPAYING" // 用户支付中(付款码支付)
+	TradeStatePayError   = "PAYERROR"   // 支付失败(其他原因, 如银行返回失败)
+)
+
+// PaymentStatus 微信 trade_state 转为统一订单状态
+// REFUND 不区分部分与全额退款, 归为 partially_refunded, 是否已全额退款需结合退款查询判断
+func PaymentStatus(tradeState string) (pay.PaymentStatus, error) {
+	switch tradeState {
+	case TradeStateNotPay, TradeStateUserPaying:
+		return pay.StatusPending, nil
+	case TradeStateSuccess:
+		return pay.StatusPaid, nil
+	case TradeStateRefund:
+		return pay.StatusPartiallyRefunded, nil
+	case TradeStateClosed, TradeStateRevoked:
+		return pay.StatusClosed, nil
+	case TradeStatePayError:
+		return pay.StatusFailed, nil
+	}
+	return "", fmt.Errorf("%w: wxpay trade_state %q", pay.ErrUnknownStatus, tradeState)
+}
+
+// PaymentStatus 订单查询结果对应的统一订单状态
+func (r *WeChatQueryResult) PaymentStatus() (pay.PaymentStatus, error) {
+	return PaymentStatus(r.TradeState)
+}
+
+// PaymentStatus v3支付通知对应的统一订单状态
+func (n *V3PaymentNotification) PaymentStatus() (pay.PaymentStatus, error) {
+	return PaymentStatus(n.TradeState)
+}
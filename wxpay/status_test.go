@@ -0,0 +1,65 @@
+package wxpay
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jxwt/pay"
+	"github.com/jxwt/pay/paytest"
+)
+
+func TestPaymentStatus(t *testing.T) {
+	cases := map[string]pay.PaymentStatus{
+		TradeStateNotPay:     pay.StatusPending,
+		TradeStateUserPaying: pay.StatusPending,
+		TradeStateSuccess:    pay.StatusPaid,
+		TradeStateRefund:     pay.StatusPartiallyRefunded,
+		TradeStateClosed:     pay.StatusClosed,
+		TradeStateRevoked:    pay.StatusClosed,
+		TradeStatePayError:   pay.StatusFailed,
+	}
+	for state, want := range cases {
+		if got, err := PaymentStatus(state); err != nil || got != want {
+			t.Fatalf("%s: got %s %v, want %s", state, got, err, want)
+		}
+	}
+	if _, err := PaymentStatus("ACCEPT"); !errors.Is(err, pay.ErrUnknownStatus) {
+		t.Fatalf("unknown state: %v", err)
+	}
+}
+
+func TestProviderQueryStatus(t *testing.T) {
+	s := paytest.NewWechatServer(t)
+	p, err := NewProvider(testClient(s), pay.CashChannelWxCodePay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := p.CreatePayment(ctx, &pay.PaymentRequest{TradeNo: "T001", Amount: pay.CNY(100), Subject: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	status := pay.StatusCreated
+	check := func(want pay.PaymentStatus) {
+		t.Helper()
+		res, err := p.Query(ctx, "T001")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != want || res.Paid != want.IsPaid() {
+			t.Fatalf("got %s paid=%v, want %s", res.Status, res.Paid, want)
+		}
+		if status, err = status.Transition(res.Status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(pay.StatusPending)
+	if err := s.Pay("T001"); err != nil {
+		t.Fatal(err)
+	}
+	check(pay.StatusPaid)
+	if _, err := p.Refund(ctx, &pay.RefundRequest{TradeNo: "T001", RefundNo: "R1", TotalAmount: pay.CNY(100), RefundAmount: pay.CNY(10)}); err != nil {
+		t.Fatal(err)
+	}
+	check(pay.StatusPartiallyRefunded)
+}
@@ -0,0 +1,88 @@
+package wxpay
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/jxwt/pay"
+)
+
+// TenantClientKind 商户注册表中微信客户端的渠道名
+const TenantClientKind = "wxpay"
+
+// RegisterTenantClients 向商户注册表注册微信客户端构建方法, callbackURL 为支付结果通知地址
+func RegisterTenantClients(r *pay.TenantRegistry, callbackURL string) {
+	r.RegisterBuilder(TenantClientKind, func(item pay.PayItem) (interface{}, error) {
+		if item.WxMchId == "" || item.WxPayKey == "" {
+			return nil, pay.ErrTenantNotConfigured
+		}
+		return NewWxClient(&WxClient{
+			AppID:       item.WxAppId,
+			MchID:       item.WxMchId,
+			SecretKey:   item.WxSecretKey,
+			PayKey:      item.WxPayKey,
+			CallbackURL: callbackURL,
+			SubMchId:    item.WxSubMchId,
+			SubAppId:    item.WxSubAppId,
+			CertPEM:     item.WxCertPEM,
+			KeyPEM:      item.WxKeyPEM,
+			KeyPemNo:    item.WxKeyPemNo,
+			APIv3Key:    item.WxAPIv3Key,
+			PayV3:       item.WxPayV3,
+		})
+	})
+}
+
+// TenantClient 获取商户的微信客户端
+func TenantClient(r *pay.TenantRegistry, tenantID int) (*WxClient, error) {
+	c, err := r.Client(tenantID, TenantClientKind)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*WxClient), nil
+}
+
+// FindTenant 按通知中的 mch_id/sub_mch_id 反查商户
+func FindTenant(r *pay.TenantRegistry, mchID, subMchID string) (int, error) {
+	return r.FindTenant(func(item pay.PayItem) bool {
+		return item.WxMchId == mchID && item.WxSubMchId == subMchID
+	})
+}
+
+// HandleTenantPaymentNotification 按通知中的商户号从注册表取得商户密钥并处理支付结果通知
+// 校验通过后才应答SUCCESS, 返回通知所属的商户ID
+func HandleTenantPaymentNotification(w http.ResponseWriter, r *http.Request, reg *pay.TenantRegistry, expected ExpectedAmountFunc) (int, *PaymentNotification, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.Write([]byte(WechatCallBackFailRes("读取通知失败")))
+		return 0, nil, err
+	}
+	var head struct {
+		MchID    string `xml:"mch_id"`
+		SubMchID string `xml:"sub_mch_id"`
+	}
+	if err := xml.Unmarshal(body, &head); err != nil {
+		w.Write([]byte(WechatCallBackFailRes("参数错误")))
+		return 0, nil, errors.New("xml.Unmarshal: " + err.Error())
+	}
+	tenantID, err := FindTenant(reg, head.MchID, head.SubMchID)
+	if err != nil {
+		w.Write([]byte(WechatCallBackFailRes("商户不存在")))
+		return 0, nil, fmt.Errorf("wxpay notification mch_id %s sub_mch_id %s: %w", head.MchID, head.SubMchID, err)
+	}
+	c, err := TenantClient(reg, tenantID)
+	if err != nil {
+		w.Write([]byte(WechatCallBackFailRes("商户配置错误")))
+		return tenantID, nil, err
+	}
+	n, err := c.ParsePaymentNotification(body, expected)
+	if err != nil {
+		w.Write([]byte(WechatCallBackFailRes(err.Error())))
+		return tenantID, nil, err
+	}
+	w.Write([]byte(WechatCallBackSuccessRes()))
+	return tenantID, n, nil
+}
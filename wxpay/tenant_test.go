@@ -0,0 +1,74 @@
+package wxpay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jxwt/pay"
+)
+
+func TestHandleTenantPaymentNotification(t *testing.T) {
+	reg, err := pay.NewTenantRegistry(context.Background(), pay.TenantLoaderFunc(func(ctx context.Context) ([]pay.PayItem, error) {
+		return []pay.PayItem{
+			{TenantId: 1, WxAppId: "wx0000000000000001", WxMchId: "1000000001", WxPayKey: "192006250b4c09247ec02edce69f6a2d"},
+			{TenantId: 2, WxAppId: "wx0000000000000002", WxMchId: "1000000002", WxPayKey: "292006250b4c09247ec02edce69f6a2d"},
+		}, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterTenantClients(reg, "https://example.com/notify")
+
+	body := signedNotifyBody("192006250b4c09247ec02edce69f6a2d", notifyParams())
+	w := httptest.NewRecorder()
+	tenantID, n, err := HandleTenantPaymentNotification(w, httptest.NewRequest("POST", "/notify", bytes.NewReader(body)), reg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenantID != 1 || n.OutTradeNo != "T20201010001" || !strings.Contains(w.Body.String(), "SUCCESS") {
+		t.Fatalf("unexpected tenant %d notification %+v", tenantID, n)
+	}
+
+	// 使用其他商户的密钥签名
+	m := notifyParams()
+	m["appid"], m["mch_id"] = "wx0000000000000002", "1000000002"
+	body = signedNotifyBody("192006250b4c09247ec02edce69f6a2d", m)
+	w = httptest.NewRecorder()
+	if _, _, err := HandleTenantPaymentNotification(w, httptest.NewRequest("POST", "/notify", bytes.NewReader(body)), reg, nil); !errors.Is(err, ErrNotifySign) {
+		t.Fatalf("want ErrNotifySign, got %v", err)
+	}
+	if !strings.Contains(w.Body.String(), "FAIL") {
+		t.Fatalf("forged notification acked: %s", w.Body.String())
+	}
+
+	m["mch_id"] = "1000000003"
+	body = signedNotifyBody("192006250b4c09247ec02edce69f6a2d", m)
+	if _, _, err := HandleTenantPaymentNotification(httptest.NewRecorder(), httptest.NewRequest("POST", "/notify", bytes.NewReader(body)), reg, nil); !errors.Is(err, pay.ErrTenantNotFound) {
+		t.Fatalf("want ErrTenantNotFound, got %v", err)
+	}
+}
+
+func TestRegisterTenantClientsV3(t *testing.T) {
+	_, keyPEM := testV3Key(t)
+	reg, err := pay.NewTenantRegistry(context.Background(), pay.TenantLoaderFunc(func(ctx context.Context) ([]pay.PayItem, error) {
+		return []pay.PayItem{
+			{TenantId: 1, WxAppId: "wx0000000000000001", WxMchId: "1000000001", WxPayKey: "192006250b4c09247ec02edce69f6a2d",
+				WxKeyPEM: keyPEM, WxKeyPemNo: "5157F09EFDC096DE15EBE81A47057A7232F1B8E1", WxAPIv3Key: testAPIv3Key, WxPayV3: true},
+		}, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterTenantClients(reg, "https://example.com/notify")
+	c, err := TenantClient(reg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.PayV3 || c.KeyPemNo != "5157F09EFDC096DE15EBE81A47057A7232F1B8E1" || c.apiV3Key() != testAPIv3Key {
+		t.Fatalf("v3 credentials not configured: %+v", c)
+	}
+}
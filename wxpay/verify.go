@@ -0,0 +1,60 @@
+package wxpay
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jxwt/pay"
+)
+
+// 同步应答验签
+// v2: return_code 为 SUCCESS 时应答带 sign, 签名方式与请求的 sign_type 一致
+// v3: 应答头带 Wechatpay-* 签名, 使用 Wechatpay-Serial 对应的平台证书校验
+
+// verifyResponseSign 校验v2应答签名, 应答未带 sign_type 时沿用请求的 sign_type
+func verifyResponseSign(key, signType string, m map[string]string) error {
+	if m["sign_type"] != "" {
+		signType = m["sign_type"]
+	}
+	return verifySignType(key, signType, m)
+}
+
+// postWechat 请求v2接口并校验应答签名, SkipVerifyResponse 为 true 时不校验
+func (i *WxClient) postWechat(ctx context.Context, client *http.Client, url string, m map[string]string) (WeChatQueryResult, error) {
+	if i.SkipVerifyResponse {
+		return postWechat(ctx, client, url, m, "", i.callOptions())
+	}
+	key, err := i.signKey(ctx)
+	if err != nil {
+		return WeChatQueryResult{}, err
+	}
+	return postWechat(ctx, client, url, m, key, i.callOptions())
+}
+
+// postWechatBody 同 postWechat, 同时返回原始应答
+func (i *WxClient) postWechatBody(ctx context.Context, client *http.Client, url string, m map[string]string) (WeChatQueryResult, []byte, error) {
+	if i.SkipVerifyResponse {
+		return postWechatBody(ctx, client, url, m, "", i.callOptions())
+	}
+	key, err := i.signKey(ctx)
+	if err != nil {
+		return WeChatQueryResult{}, nil, err
+	}
+	return postWechatBody(ctx, client, url, m, key, i.callOptions())
+}
+
+// callOptions 客户端配置的日志与埋点
+func (i *WxClient) callOptions() callOptions {
+	return callOptions{logger: i.Logger, instrument: i.Instrument}
+}
+
+// verifyV3Response 校验v3应答签名头, SkipVerifyResponse 为 true 时不校验
+func (i *WxClient) verifyV3Response(ctx context.Context, api string, resp *http.Response, body []byte) error {
+	if i.SkipVerifyResponse {
+		return nil
+	}
+	if err := i.VerifyV3Signature(ctx, resp.Header, body); err != nil {
+		return &pay.ResponseSignError{Provider: "wxpay", API: api, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package wxpay
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jxwt/pay"
+)
+
+func TestUnifiedOrderVerifiesMD5Response(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 应答不带 sign_type, 按请求的 MD5 签名
+		res := map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "appid": "wx0001", "mch_id": "1230000109", "nonce_str": "5K8264ILTKCH16CQ", "trade_type": "NATIVE", "prepay_id": "wx201410272009395522657a690389285100", "code_url": "weixin://wxpay/bizpayurl?pr=1"}
+		res["sign"], _ = WechatGenSign("paykey", res)
+		w.Write([]byte(mapToXML(res)))
+	}))
+	defer srv.Close()
+
+	c := &WxClient{AppID: "wx0001", MchID: "1230000109", PayKey: "paykey", BaseURL: srv.URL, HTTPClient: srv.Client()}
+	res, err := c.WxUnifiedOrder(&Charge{TradeNum: "T001", MoneyFee: pay.CNY(1), Describe: "test"}, "NATIVE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.PrepayID != "wx201410272009395522657a690389285100" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+}
+
+func TestQueryOrderVerifiesResponse(t *testing.T) {
+	signKey := "paykey"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := map[string]string{"return_code": "SUCCESS", "result_code": "SUCCESS", "appid": "wx0001", "mch_id": "1230000109", "nonce_str": "5K8264ILTKCH16CQ", "out_trade_no": "T001", "trade_state": "SUCCESS", "total_fee": "101"}
+		res["sign"], _ = WechatGenSign(signKey, res)
+		w.Write([]byte(mapToXML(res)))
+	}))
+	defer srv.Close()
+
+	c := &WxClient{AppID: "wx0001", MchID: "1230000109", PayKey: "paykey", BaseURL: srv.URL, HTTPClient: srv.Client()}
+	if _, err := c.QueryOrder("T001"); err != nil {
+		t.Fatal(err)
+	}
+
+	signKey = "forged"
+	_, err := c.QueryOrder("T001")
+	var signErr *pay.ResponseSignError
+	if !errors.As(err, &signErr) || !errors.Is(err, ErrNotifySign) {
+		t.Fatalf("want ResponseSignError, got %v", err)
+	}
+}
@@ -1,5 +1,11 @@
 package wxpay
 
+import (
+	"encoding/json"
+
+	"github.com/jxwt/pay"
+)
+
 // WeChatResult 微信支付返回
 type WeChatReResult struct {
 	PrepayID string `xml:"prepay_id" json:"prepay_id,omitempty"`
@@ -78,6 +84,7 @@ type WeChatQueryResult struct {
 	PayRefundResponse
 	TradeState     string `xml:"trade_state" json:"trade_state,omitempty"`
 	TradeStateDesc string `xml:"trade_state_desc" json:"trade_state_desc,omitempty"`
+	Recall         string `xml:"recall" json:"recall,omitempty"` // 撤销订单是否需要继续调用撤销, Y/N
 }
 
 // WxPayRefundResponse 微信退款请求返回
@@ -94,21 +101,79 @@ type PayRefundResponse struct {
 
 // PayRefundRequest 外部调用的退款请求
 type PayRefundRequest struct {
-	OutRefundNo string // 商户退款单号（确保唯一性）
-	//TransactionID string // 需要退款的微信订单号
-	RefundDesc string  // 退款理由
-	TotalFee   float64 // 订单的金额
-	RefundFee  float64 // 退款的金额
-	OutTradeNo string  // 商户自定义单号（需要退款的单号）
-	OpenId     string
+	OutRefundNo   string    // 商户退款单号（确保唯一性）, 同一订单多次部分退款时各不相同
+	TransactionID string    // 需要退款的微信订单号, 与 OutTradeNo 二选一, 均填写时以微信订单号为准
+	RefundDesc    string    // 退款理由
+	TotalFee      pay.Money // 订单的金额
+	RefundFee     pay.Money // 退款的金额
+	OutTradeNo    string    // 商户自定义单号（需要退款的单号）
+	OpenId        string
+}
+
+// RefundQueryRequest 退款查询请求, 四个单号任填其一, 优先级 RefundID > OutRefundNo > TransactionID > OutTradeNo
+type RefundQueryRequest struct {
+	OutTradeNo    string // 商户订单号
+	TransactionID string // 微信订单号
+	OutRefundNo   string // 商户退款单号
+	RefundID      string // 微信退款单号
+	Offset        int    // 偏移量, 订单退款超过10笔时按订单号分页查询
+}
+
+// RefundQueryResult 退款查询返回, 按订单号查询时包含该订单的多笔退款
+type RefundQueryResult struct {
+	TransactionID      string
+	OutTradeNo         string
+	TotalFee           int            // 订单金额, 单位分
+	SettlementTotalFee int            // 应结订单金额
+	CashFee            int            // 现金支付金额
+	RefundFee          int            // 退款总金额
+	TotalRefundCount   int            // 订单总退款次数, 使用 Offset 分页时返回
+	Refunds            []RefundRecord // 退款记录, 对应 refund_count 与带序号的字段
+}
+
+// RefundRecord 单笔退款记录, 对应 *_$n 字段
+type RefundRecord struct {
+	OutRefundNo         string // 商户退款单号
+	RefundID            string // 微信退款单号
+	RefundChannel       string // 退款渠道 ORIGINAL, BALANCE, OTHER_BALANCE, OTHER_BANKCARD
+	RefundFee           int    // 申请退款金额, 单位分
+	SettlementRefundFee int    // 退款金额
+	CouponRefundFee     int    // 代金券退款金额
+	RefundStatus        string // SUCCESS, REFUNDCLOSE, PROCESSING, CHANGE
+	RefundAccount       string // 退款资金来源
+	RefundRecvAccout    string // 退款入账账户
+	RefundSuccessTime   string // 退款成功时间
 }
 
 // MicroPayRequest 付款码支付请求
 type MicroPayRequest struct {
-	OutTradeNo string `json:"out_trade_no"` // 商户订单号
-	TotalFee   int    `json:"total_fee"`    // 单位分 总金额
-	AuthCode   string `json:"auth_code"`    // 授权码（条形码）
-	Remark     string `json:"remark"`       // 备注
+	OutTradeNo string    `json:"out_trade_no"` // 商户订单号
+	TotalFee   pay.Money `json:"total_fee"`    // 总金额, JSON 中单位为分
+	AuthCode   string    `json:"auth_code"`    // 授权码（条形码）
+	Remark     string    `json:"remark"`       // 备注
+}
+
+// microPayJSON 付款码支付请求的JSON格式, total_fee 沿用整数分, 兼容已有调用方与存量数据
+type microPayJSON struct {
+	OutTradeNo string `json:"out_trade_no"`
+	TotalFee   int64  `json:"total_fee"`
+	AuthCode   string `json:"auth_code"`
+	Remark     string `json:"remark"`
+}
+
+// MarshalJSON total_fee 以分输出
+func (r MicroPayRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(microPayJSON{OutTradeNo: r.OutTradeNo, TotalFee: r.TotalFee.Amount, AuthCode: r.AuthCode, Remark: r.Remark})
+}
+
+// UnmarshalJSON total_fee 按整数分解析, 以元表示的小数金额解析失败
+func (r *MicroPayRequest) UnmarshalJSON(data []byte) error {
+	var v microPayJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*r = MicroPayRequest{OutTradeNo: v.OutTradeNo, TotalFee: pay.CNY(v.TotalFee), AuthCode: v.AuthCode, Remark: v.Remark}
+	return nil
 }
 
 // MicroPayResponse 付款码支付返回
@@ -1,13 +1,14 @@
 package wxpay
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"github.com/astaxie/beego/logs"
 	"github.com/jxwt/pay"
 	"github.com/jxwt/tools"
-	"strconv"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,11 +24,24 @@ type WxClient struct {
 	CertPEM string // cert证书
 	KeyPEM  string // 密钥证书
 
-	httpsClient *pay.HTTPSClient // 双向证书链接
+	httpsClient   *pay.HTTPSClient  // 双向证书链接
+	platformCerts *CertificateStore // 未配置 CertStore 时客户端自己的平台证书缓存
+	certMu        sync.Mutex        // 保护 httpsClient 与 platformCerts 的创建, 各客户端独立, 加载证书不影响其他商户
 	KeyPemNo    string
 
-	Ciphertext string // 敏感信息加密使用的证书
-	SerialNo   string // 敏感信息加密使用的证书号
+	HTTPClient *http.Client      // 自定义http客户端, 为空时使用 pay.HTTPSC
+	BaseURL    string            // 接口域名, 为空时使用 WxBaseURL
+	Sandbox    bool              // 仿真测试环境, 接口加 /sandboxnew 前缀并使用沙箱签名key
+	PayV3      bool              // 下单使用APIv3接口, 需配置 KeyPEM 与 KeyPemNo
+	APIv3Key   string            // APIv3密钥, 用于解密平台证书与回调通知, 为空时沿用 SecretKey
+	CertStore  *CertificateStore // 平台证书缓存, 为空时使用客户端自己的缓存; 同一商户的多个客户端可共用一个实例
+
+	ConfirmPolicy *pay.ConfirmPolicy // 付款码支付结果轮询策略, 为空时使用 pay.DefaultConfirmPolicy
+	RetryPolicy   *pay.RetryPolicy   // 查询等幂等操作的瞬时失败重试策略, 为空时不重试, 可使用 &pay.DefaultRetryPolicy
+	Logger        pay.Logger         // 日志, 为空时使用 pay.DefaultLogger, 输出前自动脱敏
+	Instrument    pay.Instrument     // 调用埋点, 为空时使用 pay.DefaultInstrument
+
+	SkipVerifyResponse bool // 跳过同步应答验签, 仅用于调试
 }
 
 func InitWxClient(AppID string, MchID string, SecretKey string, PayKey string, CallbackURL string, subMchId string, subAppId string) *WxClient {
@@ -48,11 +62,39 @@ func InitWxClient(AppID string, MchID string, SecretKey string, PayKey string, C
 	return c
 }
 
+// NewWxClient 预先校验商户证书与APIv3私钥, 配置错误时在创建阶段返回错误
+func NewWxClient(c *WxClient) (*WxClient, error) {
+	if c.CertPEM != "" && c.KeyPEM != "" {
+		if err := c.WithCert(c.CertPEM, c.KeyPEM); err != nil {
+			return nil, fmt.Errorf("wxpay cert: %w", err)
+		}
+	}
+	if c.PayV3 || c.KeyPemNo != "" {
+		if _, err := WxPriStrToRSAPrivateKey(c.KeyPEM); err != nil {
+			return nil, fmt.Errorf("wxpay v3 key: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// notifyURL 支付结果通知地址, 下单时指定的优先, 否则使用客户端的 CallbackURL
+func (i *WxClient) notifyURL(url string) string {
+	if url != "" {
+		return url
+	}
+	return i.CallbackURL
+}
+
 // app支付
 func (i *WxClient) AppPay(charge *Charge) (map[string]string, error) {
-	result, err := i.WxUnifiedOrder(charge, "APP")
+	return i.AppPayContext(context.Background(), charge)
+}
+
+// AppPayContext 携带ctx的app支付
+func (i *WxClient) AppPayContext(ctx context.Context, charge *Charge) (map[string]string, error) {
+	result, err := i.WxUnifiedOrderContext(ctx, charge, "APP")
 	if err != nil {
-		return map[string]string{}, errors.New("wx app pay" + err.Error())
+		return map[string]string{}, fmt.Errorf("wx app pay: %w", err)
 	}
 	var c = make(map[string]string)
 	c["appid"] = i.AppID
@@ -64,7 +106,7 @@ func (i *WxClient) AppPay(charge *Charge) (map[string]string, error) {
 	//c["sign_type"] = "MD5"
 	sign2, err := WechatGenSign(i.PayKey, c)
 	if err != nil {
-		return map[string]string{}, errors.New("wx app pay" + err.Error())
+		return map[string]string{}, fmt.Errorf("wx app pay: %w", err)
 	}
 	c["paySign"] = strings.ToUpper(sign2)
 	return c, nil
@@ -72,9 +114,14 @@ func (i *WxClient) AppPay(charge *Charge) (map[string]string, error) {
 
 // H5支付
 func (i *WxClient) H5Pay(charge *Charge) (map[string]string, error) {
-	result, err := i.WxUnifiedOrder(charge, "MWEB")
+	return i.H5PayContext(context.Background(), charge)
+}
+
+// H5PayContext 携带ctx的H5支付
+func (i *WxClient) H5PayContext(ctx context.Context, charge *Charge) (map[string]string, error) {
+	result, err := i.WxUnifiedOrderContext(ctx, charge, "MWEB")
 	if err != nil {
-		return map[string]string{}, errors.New("wx app pay" + err.Error())
+		return map[string]string{}, fmt.Errorf("wx app pay: %w", err)
 	}
 	var c = make(map[string]string)
 	c["appId"] = i.AppID
@@ -94,9 +141,14 @@ func (i *WxClient) H5Pay(charge *Charge) (map[string]string, error) {
 
 // 小程序 或者公众号支付
 func (i *WxClient) MiniPay(charge *Charge) (map[string]string, error) {
-	result, err := i.WxUnifiedOrder(charge, "JSAPI")
+	return i.MiniPayContext(context.Background(), charge)
+}
+
+// MiniPayContext 携带ctx的小程序或公众号支付
+func (i *WxClient) MiniPayContext(ctx context.Context, charge *Charge) (map[string]string, error) {
+	result, err := i.WxUnifiedOrderContext(ctx, charge, "JSAPI")
 	if err != nil {
-		return map[string]string{}, errors.New("wx app pay" + err.Error())
+		return map[string]string{}, fmt.Errorf("wx app pay: %w", err)
 	}
 	var c = make(map[string]string)
 	if i.SubAppId != "" {
@@ -110,16 +162,21 @@ func (i *WxClient) MiniPay(charge *Charge) (map[string]string, error) {
 	c["signType"] = "MD5"
 	sign2, err := WechatGenSign(i.PayKey, c)
 	if err != nil {
-		return map[string]string{}, errors.New("WechatWeb: " + err.Error())
+		return map[string]string{}, fmt.Errorf("WechatWeb: %w", err)
 	}
 	c["paySign"] = sign2
-	logs.Warning("Pay res:", c)
+	i.log(pay.LevelDebug, "wxpay: mini pay params", pay.F("params", c))
 	return c, nil
 }
 
 // 生成支付二维码信息
 func (i *WxClient) WxNative(charge *Charge) (WeChatQueryResult, error) {
-	result, err := i.WxUnifiedOrder(charge, "NATIVE")
+	return i.WxNativeContext(context.Background(), charge)
+}
+
+// WxNativeContext 携带ctx生成支付二维码信息
+func (i *WxClient) WxNativeContext(ctx context.Context, charge *Charge) (WeChatQueryResult, error) {
+	result, err := i.WxUnifiedOrderContext(ctx, charge, "NATIVE")
 	if err != nil {
 		return result, err
 	}
@@ -127,6 +184,11 @@ func (i *WxClient) WxNative(charge *Charge) (WeChatQueryResult, error) {
 }
 
 func (i *WxClient) WxUnifiedOrder(charge *Charge, tradeType string) (WeChatQueryResult, error) {
+	return i.WxUnifiedOrderContext(context.Background(), charge, tradeType)
+}
+
+// WxUnifiedOrderContext 携带ctx的统一下单
+func (i *WxClient) WxUnifiedOrderContext(ctx context.Context, charge *Charge, tradeType string) (WeChatQueryResult, error) {
 	result := new(WeChatQueryResult)
 	var m = make(map[string]string)
 	m["appid"] = i.AppID
@@ -136,7 +198,7 @@ func (i *WxClient) WxUnifiedOrder(charge *Charge, tradeType string) (WeChatQuery
 	m["out_trade_no"] = charge.TradeNum
 	m["total_fee"] = WechatMoneyFeeToString(charge.MoneyFee)
 	m["spbill_create_ip"] = tools.GetLocalAddr()
-	m["notify_url"] = i.CallbackURL
+	m["notify_url"] = i.notifyURL(charge.CallbackURL)
 	m["trade_type"] = tradeType
 	m["sign_type"] = "MD5"
 	if i.SubMchId != "" {
@@ -161,14 +223,18 @@ func (i *WxClient) WxUnifiedOrder(charge *Charge, tradeType string) (WeChatQuery
 	} else if charge.PackageName != "" {
 		m["scene_info"] = fmt.Sprintf(`{"h5_info": {"type":"%s","app_name": "%s","package_name": "%s"}`, charge.AppType, charge.AppType, charge.PackageName)
 	}
-	sign, err := WechatGenSign(i.PayKey, m)
+	key, err := i.signKey(ctx)
+	if err != nil {
+		return *result, err
+	}
+	sign, err := WechatGenSign(key, m)
 	if err != nil {
 		return *result, errors.New("WechatApp.sign: " + err.Error())
 	}
 	m["sign"] = sign
-	*result, err = PostWechat("https://api.mch.weixin.qq.com/pay/unifiedorder", m, nil)
+	*result, err = i.postWechat(ctx, i.HTTPClient, i.apiURL("/pay/unifiedorder"), m)
 	if err != nil {
-		logs.Warning(m)
+		i.log(pay.LevelWarn, "wxpay: unified order failed", pay.F("params", m), pay.F("err", err))
 		return *result, err
 	}
 	return *result, err
@@ -176,20 +242,64 @@ func (i *WxClient) WxUnifiedOrder(charge *Charge, tradeType string) (WeChatQuery
 
 // QueryOrder 查询订单
 func (i *WxClient) QueryOrder(tradeNum string) (WeChatQueryResult, error) {
+	return i.QueryOrderContext(context.Background(), tradeNum)
+}
+
+// QueryOrderContext 携带ctx查询订单
+func (i *WxClient) QueryOrderContext(ctx context.Context, tradeNum string) (WeChatQueryResult, error) {
 	var m = make(map[string]string)
 	m["appid"] = i.AppID
 	m["mch_id"] = i.MchID
 	m["out_trade_no"] = tradeNum
 	m["nonce_str"] = RandomStr()
 
-	sign, err := WechatGenSign(i.PayKey, m)
+	key, err := i.signKey(ctx)
+	if err != nil {
+		return WeChatQueryResult{}, err
+	}
+	sign, err := WechatGenSign(key, m)
 	if err != nil {
 		return WeChatQueryResult{}, err
 	}
 
 	m["sign"] = sign
 
-	return PostWechat("https://api.mch.weixin.qq.com/pay/orderquery", m, nil)
+	var result WeChatQueryResult
+	err = i.retry(ctx, pay.OpQueryOrder, func(ctx context.Context) error {
+		result, err = i.postWechat(ctx, i.HTTPClient, i.apiURL("/pay/orderquery"), m)
+		return err
+	})
+	return result, err
+}
+
+// CloseOrder 关闭未支付订单, 关单后用户无法继续支付; 已支付订单返回 pay.ErrOrderPaid
+// 下单后至少5分钟才能关单
+func (i *WxClient) CloseOrder(tradeNum string) (WeChatQueryResult, error) {
+	return i.CloseOrderContext(context.Background(), tradeNum)
+}
+
+// CloseOrderContext 携带ctx关闭未支付订单
+func (i *WxClient) CloseOrderContext(ctx context.Context, tradeNum string) (WeChatQueryResult, error) {
+	var m = make(map[string]string)
+	m["appid"] = i.AppID
+	m["mch_id"] = i.MchID
+	if i.SubMchId != "" {
+		m["sub_mch_id"] = i.SubMchId
+	}
+	m["out_trade_no"] = tradeNum
+	m["nonce_str"] = RandomStr()
+
+	key, err := i.signKey(ctx)
+	if err != nil {
+		return WeChatQueryResult{}, err
+	}
+	sign, err := WechatGenSign(key, m)
+	if err != nil {
+		return WeChatQueryResult{}, err
+	}
+	m["sign"] = sign
+
+	return i.postWechat(ctx, i.HTTPClient, i.apiURL("/pay/closeorder"), m)
 }
 
 // MicroPay 微信付款码支付
@@ -197,26 +307,45 @@ func (i *WxClient) QueryOrder(tradeNum string) (WeChatQueryResult, error) {
 // TotalFee 订单的金额
 // AuthCode 用户的授权码(条形码)
 func (i *WxClient) MicroPay(req *MicroPayRequest) (*WeChatQueryResult, error) {
+	return i.MicroPayContext(context.Background(), req)
+}
+
+// MicroPayContext 携带ctx的付款码支付
+func (i *WxClient) MicroPayContext(ctx context.Context, req *MicroPayRequest) (*WeChatQueryResult, error) {
 	var m = make(map[string]string)
 	m["appid"] = i.AppID
 	m["mch_id"] = i.MchID
 	m["nonce_str"] = RandomStr()
 	m["body"] = req.Remark
 	m["out_trade_no"] = req.OutTradeNo
-	m["total_fee"] = strconv.Itoa(req.TotalFee)
+	m["total_fee"] = WechatMoneyFeeToString(req.TotalFee)
 	m["spbill_create_ip"] = tools.GetLocalAddr()
 	m["auth_code"] = req.AuthCode
 
-	sign, err := WechatGenSign(i.PayKey, m)
+	key, err := i.signKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sign, err := WechatGenSign(key, m)
 	if err != nil {
 		return nil, errors.New("MicroPay.sign: " + err.Error())
 	}
 
 	m["sign"] = sign
 
-	xmlRe, err := PostWechat("https://api.mch.weixin.qq.com/pay/micropay", m, nil)
+	xmlRe, err := i.postWechat(ctx, i.HTTPClient, i.apiURL("/pay/micropay"), m)
 	if err != nil {
 		return &xmlRe, err
 	}
 	return &xmlRe, nil
 }
+
+// retry 按 RetryPolicy 调用 fn, 重试时沿用已签名的请求参数
+func (i *WxClient) retry(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	return i.RetryPolicy.Do(ctx, "wxpay", op, fn)
+}
+
+// log 脱敏后记录日志
+func (i *WxClient) log(level pay.Level, msg string, fields ...pay.Field) {
+	pay.Log(i.Logger, level, msg, fields...)
+}
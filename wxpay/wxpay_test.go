@@ -1,48 +1,277 @@
 package wxpay
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/jxwt/pay"
+	"github.com/jxwt/pay/paytest"
 )
 
-func TestH5Pay(t *testing.T) {
-	// 停车
-	client := &WxClient{
-		AppID:       "",
-		MchID:       "",
-		Key:         "",
-		CallbackURL: "www.baidu.com",
-		//SubMchId: "1601177571",
+// testClient 接入模拟网关的v2客户端
+func testClient(s *paytest.WechatServer) *WxClient {
+	return &WxClient{
+		AppID:       s.AppID,
+		MchID:       s.MchID,
+		PayKey:      s.PayKey,
+		CallbackURL: "http://127.0.0.1/notify",
+		CertPEM:     s.MerchantCertPEM,
+		KeyPEM:      s.MerchantKeyPEM,
+		BaseURL:     s.URL,
+		HTTPClient:  s.Client(),
 	}
+}
+
+func TestH5Pay(t *testing.T) {
+	s := paytest.NewWechatServer(t)
+	client := testClient(s)
 	charge := &Charge{
 		TradeNum:    "sdfsdfec2e",
-		MoneyFee:    0.02,
+		MoneyFee:    pay.CNY(2),
 		CallbackURL: client.CallbackURL,
 		Describe:    "test",
 	}
 	m, err := client.H5Pay(charge)
-	t.Logf("%v", m)
-	t.Logf("%v", err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["mweb_url"] == "" || m["package"] == "prepay_id=" {
+		t.Fatalf("unexpected pay params %v", m)
+	}
+	if o, _ := s.Order(charge.TradeNum); o.State != paytest.StateNotPay || o.Amount != 2 {
+		t.Fatalf("unexpected order %+v", o)
+	}
+
+	if err := s.Pay(charge.TradeNum); err != nil {
+		t.Fatal(err)
+	}
+	body, err := s.NotifyBody(charge.TradeNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := func(string) (pay.Money, error) { return pay.CNY(2), nil }
+	n, err := client.ParsePaymentNotification(body, expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.IsPaid() || n.OutTradeNo != charge.TradeNum {
+		t.Fatalf("unexpected notification %+v", n)
+	}
+}
+
+func TestWxClient_DecryptWXOpenData(t *testing.T) {
+	c := &WxClient{AppID: "wxd678efh567hg6787"}
+	sessionKey := []byte("pl3rOB+eRTIKmYYG")
+	iv := []byte("KzevCXXfxsgygyh7")
+	plain := []byte(`{"openid":"oGZUI0egBJY1zhBYw2KhdUfwVJJE","nickName":"Band","watermark":{"timestamp":1477314187,"appid":"wxd678efh567hg6787"}}`)
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	plain = append(plain, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, plain)
+
+	session := &WxSession{SessionKey: base64.StdEncoding.EncodeToString(sessionKey)}
+	enc := base64.StdEncoding.EncodeToString(data)
+	ivStr := base64.StdEncoding.EncodeToString(iv)
+	res, err := c.DecryptWXOpenData(session, enc, ivStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OpenID != "oGZUI0egBJY1zhBYw2KhdUfwVJJE" || res.NickName != "Band" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	c.AppID = "wx0a8581e498061282"
+	if _, err := c.DecryptWXOpenData(session, enc, ivStr); err == nil {
+		t.Fatal("expected watermark appid mismatch")
+	}
+}
+
+func TestCloseOrder(t *testing.T) {
+	s := paytest.NewWechatServer(t)
+	client := testClient(s)
+	s.AddOrder("T001", 100)
+	if _, err := client.CloseOrder("T001"); err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := s.Order("T001"); o.State != paytest.StateClosed {
+		t.Fatalf("order state %s", o.State)
+	}
+	if _, err := client.CloseOrder("T001"); !errors.Is(err, pay.ErrOrderClosed) {
+		t.Fatalf("close twice: %v", err)
+	}
+	p, err := NewProvider(client, pay.CashChannelWxCodePay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(context.Background(), "T001"); err != nil {
+		t.Fatalf("provider close on closed order: %v", err)
+	}
+
+	s.AddOrder("T002", 100)
+	if err := s.Pay("T002"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CloseOrder("T002"); !errors.Is(err, pay.ErrOrderPaid) {
+		t.Fatalf("close paid order: %v", err)
+	}
+
+	v3 := testV3Client(s)
+	s.AddOrder("T003", 100)
+	if err := v3.CloseOrderV3("T003"); err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := s.Order("T003"); o.State != paytest.StateClosed {
+		t.Fatalf("order state %s", o.State)
+	}
+	if err := v3.CloseOrderV3("T002"); !errors.Is(err, pay.ErrOrderPaid) {
+		t.Fatalf("v3 close paid order: %v", err)
+	}
 }
 
-func TestWxClient_MiniLogin(t *testing.T) {
-	c := &WxClient{
-		AppID: "wx0a8581e498061282",
-		Key:   "c45646ffea88cf98e4285dbf75893ff5",
+func TestQueryOrderRetry(t *testing.T) {
+	s := paytest.NewWechatServer(t)
+	client := testClient(s)
+	s.AddOrder("T001", 100)
+
+	s.FailNext("/pay/orderquery", "SYSTEMERROR", 1)
+	if _, err := client.QueryOrder("T001"); !pay.IsRetryable(err) {
+		t.Fatalf("expected retryable error without policy, got %v", err)
+	}
+
+	policy := pay.DefaultRetryPolicy
+	policy.BaseDelay = time.Millisecond
+	client.RetryPolicy = &policy
+	s.FailNext("/pay/orderquery", "SYSTEMERROR", 2)
+	res, err := client.QueryOrder("T001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.OutTradeNO != "T001" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	// 关单不是默认开启重试的操作
+	s.FailNext("/pay/closeorder", "SYSTEMERROR", 1)
+	if _, err := client.CloseOrder("T001"); !pay.IsRetryable(err) {
+		t.Fatalf("expected close not retried, got %v", err)
+	}
+}
+
+func TestClientLoggerRedacts(t *testing.T) {
+	s := paytest.NewWechatServer(t)
+	client := testClient(s)
+	var lines []string
+	client.Logger = pay.LoggerFunc(func(level pay.Level, msg string, fields ...pay.Field) {
+		lines = append(lines, pay.FormatFields(msg, fields))
+	})
+	s.AddOrder("T001", 100)
+	if _, err := client.QueryOrder("T001"); err != nil {
+		t.Fatal(err)
 	}
-	//c.AppID  = "wx3474908ee1c58dea"
-	//c.Key = "49bec205b4aeb983c1193096f80cd9f6"
+	if len(lines) == 0 {
+		t.Fatal("request not logged")
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "<sign>***") || strings.Contains(line, s.PayKey) {
+			t.Fatalf("sign not redacted: %s", line)
+		}
+	}
+}
 
-	session := c.GetOpenSession("081CXKkl2deaQ54SZell2niID84CXKkM")
-	fmt.Println(session.SessionKey)
+// callRecorder 记录埋点
+type callRecorder struct {
+	calls []pay.Call
+}
 
-	key := "pl3rOB+eRTIKmYYGg3at2Q=="
-	iv := "KzevCXXfxsgygyh7EHwVuQ=="
-	data := "y4guz/vPWpCu9tOEBGRMvmS6U4LKnVJ7zd12P7kJKydBocSgl28GkqltcBENJLbbcq7CuM0zXqn7vIIK2ZhU0NvhIcJ/BSg3Ry0M0PzlWyqbhUGXndKEQgU8ERRLN7oF3lZfw/WnPqBY4HFNrvDGMtCf0kQNbkpLbuxwn88Cpb5BAA2Rhbq9rnhEB8c0Hd/aIw5SxfTpE+kCp4IY5HsCQ9AufqB55U+nl9IK7MJtv0h3pxZvUQiw4wIgoQI9VNP71RSZLMUwQrVecGnLUXKf3tqT2VrgLapZdG0/BTn07oLeQ8ra1STdrnQQcbmyV4g+ALCTiY9Ezfqaea5swrgCQNHeGnzgOjxQp5BFsfynsGQT/x9XI0Pm/5iFenvJTxAjSWlh1mTc+zI3grCMe5osL+w12xzpzwZ3do/OeKHhRcHQmTWNP+x0aOa9dzLlD3N7qkb1bdkc4Ua464ptkgEFY2hfjlnn3ryT1/QQdHl9QKo45pxGydwqhpFd0iVzyq29khiBredWK/HhYnqTIdxWTA=="
-	c.DecryptWXOpenData(key, data, iv)
+func (r *callRecorder) Start(ctx context.Context, call *pay.Call) context.Context {
+	return ctx
+}
 
-	c.AppID  = "wx0a8581e498061282"
-	c.Key = "c45646ffea88cf98e4285dbf75893ff5"
+func (r *callRecorder) End(ctx context.Context, call *pay.Call) {
+	r.calls = append(r.calls, *call)
+}
 
-	c.DecryptWXOpenData(key, data, iv)
+func TestClientInstrument(t *testing.T) {
+	s := paytest.NewWechatServer(t)
+	client := testClient(s)
+	r := &callRecorder{}
+	client.Instrument = r
+	s.AddOrder("T001", 100)
+	s.FailNext("/pay/orderquery", "SYSTEMERROR", 1)
+	client.QueryOrder("T001")
+	if _, err := client.QueryOrder("T001"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.calls) != 2 {
+		t.Fatalf("unexpected calls %+v", r.calls)
+	}
+	for n, code := range []string{"SYSTEMERROR", pay.CodeSuccess} {
+		c := r.calls[n]
+		if c.Provider != "wxpay" || c.Method != "/pay/orderquery" || c.Tenant != s.MchID || c.Code != code {
+			t.Fatalf("call %d: %+v", n, c)
+		}
+	}
+
+	v3 := testV3Client(s)
+	v3.Instrument = r
+	s.AddOrder("T002", 100)
+	if err := v3.CloseOrderV3("T002"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v3.CloseOrderV3("T404"); err == nil {
+		t.Fatal("expected close error")
+	}
+	var codes []string
+	for _, c := range r.calls {
+		if c.Method == "POST /v3/pay/transactions/out-trade-no/{out-trade-no}/close" {
+			codes = append(codes, c.Code)
+		}
+	}
+	if len(codes) != 2 || codes[0] != pay.CodeSuccess || codes[1] != "ORDER_NOT_EXIST" {
+		t.Fatalf("unexpected v3 calls %+v", r.calls)
+	}
+}
+
+func TestMicroPayRequestJSON(t *testing.T) {
+	var req MicroPayRequest
+	if err := json.Unmarshal([]byte(`{"out_trade_no":"T001","total_fee":100,"auth_code":"134567890123456789"}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.TotalFee != pay.CNY(100) {
+		t.Fatalf("total_fee 100 decoded as %d fen", req.TotalFee.Amount)
+	}
+	b, err := json.Marshal(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"total_fee":100,`) {
+		t.Fatalf("total_fee not encoded in fen: %s", b)
+	}
+	if err := json.Unmarshal([]byte(`{"total_fee":1.00}`), &req); err == nil {
+		t.Fatal("expected error for yuan amount")
+	}
+}
+
+func TestFenToMoney(t *testing.T) {
+	if m, err := fenToMoney("101"); err != nil || m != pay.CNY(101) {
+		t.Fatalf("101: %v %v", m, err)
+	}
+	if m, err := fenToMoney(""); err != nil || !m.IsZero() {
+		t.Fatalf("empty: %v %v", m, err)
+	}
+	if _, err := fenToMoney("1.01"); err == nil {
+		t.Fatal("malformed amount parsed")
+	}
 }
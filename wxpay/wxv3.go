@@ -2,13 +2,13 @@ package wxpay
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/astaxie/beego/logs"
+	"github.com/jxwt/pay"
 	"github.com/jxwt/tools"
-	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
@@ -36,23 +36,33 @@ const WxMediaUpLoadBody = "--boundary\r\nContent-Disposition:form-data;name=\"me
 
 // Applyment4sub 申请成为特约商户
 func (i *WxClient) Applyment4sub(req *Applyment4subRequest) (*Applyment4subResponse, error) {
-	// 获取证书,证书解析
-	res, _ := i.GetCertificates()
-	if len(res.Data) == 0 {
-		return nil, errors.New("证书获取失败")
+	return i.Applyment4subContext(context.Background(), req)
+}
+
+// Applyment4subContext 携带ctx申请成为特约商户
+func (i *WxClient) Applyment4subContext(ctx context.Context, req *Applyment4subRequest) (*Applyment4subResponse, error) {
+	// 使用当前有效的最新平台证书加密
+	cert, err := i.certStore().Newest(ctx)
+	if err != nil {
+		return nil, err
 	}
-	i.SerialNo = res.Data[0].SerialNo
-	i.Ciphertext, _ = CertificateDecryption(res, i.SecretKey)
 	// 对结构体内的敏感信息进行加密
+	// SerialStruct 原地加密指针指向的结构体
 	if req.ContactInfo != nil {
-		req.ContactInfo = SerialStruct(req.ContactInfo, i.Ciphertext).(*ContactInfoStruct)
+		if _, err := SerialStruct(req.ContactInfo, cert.PEM); err != nil {
+			return nil, err
+		}
 	}
 	if req.BankAccountInfo != nil {
-		req.BankAccountInfo = SerialStruct(req.BankAccountInfo, i.Ciphertext).(*BankAccountInfoStruct)
+		if _, err := SerialStruct(req.BankAccountInfo, cert.PEM); err != nil {
+			return nil, err
+		}
 	}
 	if req.SubjectInfo != nil {
 		if req.SubjectInfo.IdentityInfo.IDCardInfo != nil {
-			req.SubjectInfo.IdentityInfo.IDCardInfo = SerialStruct(req.SubjectInfo.IdentityInfo.IDCardInfo, i.Ciphertext).(*IDCardInfoStruct)
+			if _, err := SerialStruct(req.SubjectInfo.IdentityInfo.IDCardInfo, cert.PEM); err != nil {
+				return nil, err
+			}
 		}
 	}
 	//
@@ -60,78 +70,51 @@ func (i *WxClient) Applyment4sub(req *Applyment4subRequest) (*Applyment4subRespo
 	if err != nil {
 		return nil, err
 	}
-	nonceStr := tools.GetRandomString(32)
-	now := time.Now().Unix()
-	sign := WxV3Sign("POST", "/v3/applyment4sub/applyment/", nonceStr, string(body), now, i.KeyPEM)
-	headerAuthorization := fmt.Sprintf(WxMediaUpLoadHeaderAuthorization, i.MchID, nonceStr, now, i.KeyPemNo, sign)
-
-	client := &http.Client{}
-	request, err := http.NewRequest("POST", WxApplymentURL, bytes.NewBuffer(body))
-	request.Header.Add("Wechatpay-Serial", i.SerialNo)
-	request.Header.Set("Accept", "application/json")
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Authorization", headerAuthorization)
-
-	resp, err := client.Do(request)
-	if err != nil {
-		logs.Warning("http Do err", err)
-		return nil, err
-	}
-	defer resp.Body.Close()
-	resultBody, err := ioutil.ReadAll(resp.Body)
+	header := http.Header{}
+	header.Set("Wechatpay-Serial", cert.SerialNo)
+	resultBody, err := i.v3RequestWith(ctx, "POST", "/v3/applyment4sub/applyment/", &v3Body{sign: body, body: body, header: header})
 	if err != nil {
-		logs.Error(err)
+		i.log(pay.LevelWarn, "wxpay: applyment request", pay.F("err", err))
 		return nil, err
 	}
 	apply4subRes := &Applyment4subResponse{}
-	logs.Warning(string(resultBody))
+	i.log(pay.LevelDebug, "wxpay: applyment response", pay.F("body", resultBody))
 	json.Unmarshal(resultBody, apply4subRes)
 	return apply4subRes, nil
 }
 
 // WxMediaUpLoad 微信图片上传
 func (i *WxClient) WxMediaUpLoad(file string, fileName string) (string, error) {
+	return i.WxMediaUpLoadContext(context.Background(), file, fileName)
+}
+
+// WxMediaUpLoadContext 携带ctx的图片上传
+func (i *WxClient) WxMediaUpLoadContext(ctx context.Context, file string, fileName string) (string, error) {
 	// 对图片文件进行sha256计算
 	h := sha256.New()
 	h.Write([]byte(file))
 	picSha256 := h.Sum(nil)
 
-	timestamp := time.Now().Unix()
-	nonceStr := tools.GetRandomString(32)
-	//nonceStr := "L4s1UE5KRC2p5Kh30Kh8GAfTxpSGXXMd"
-	// 请求构建 请求加签
+	// 请求构建
 	req := &WxMediaUpLoadRequest{
 		FileName: fileName,
 	}
 	req.Sha256 = fmt.Sprintf("%x", string(picSha256))
 	body, err := json.Marshal(req)
 	if err != nil {
-		logs.Warning("WxMediaUpLoad Marshal err", err)
+		i.log(pay.LevelWarn, "wxpay: media upload marshal", pay.F("err", err))
 		return "", err
 	}
-	sign := WxV3Sign("POST", `/v3/merchant/media/upload`, nonceStr, string(body), timestamp, i.KeyPEM)
-	// 请求构建与发送
-	headerAuthorization := fmt.Sprintf(WxMediaUpLoadHeaderAuthorization, i.MchID, nonceStr, timestamp, i.KeyPemNo, sign)
-
 	reqBody := strings.ReplaceAll(WxMediaUpLoadBody, "#file", fileName)
 	reqBody = strings.ReplaceAll(reqBody, "#sha256", req.Sha256)
 	reqBody = strings.ReplaceAll(reqBody, "#body", file)
 
-	client := &http.Client{}
-	request, err := http.NewRequest("POST", WxMediaUploadURL, bytes.NewBuffer([]byte(reqBody)))
-	request.Header.Add("Authorization", headerAuthorization)
-	request.Header.Add("Content-Type", "multipart/form-data;boundary=boundary")
-	request.Header.Set("Accept", "application/json")
-
-	resp, err := client.Do(request)
-	if err != nil {
-		logs.Warning("http Do err", err)
-		return "", err
-	}
-	defer resp.Body.Close()
-	resultBody, err := ioutil.ReadAll(resp.Body)
+	// 签名只针对 meta 部分
+	header := http.Header{}
+	header.Set("Content-Type", "multipart/form-data;boundary=boundary")
+	resultBody, err := i.v3RequestWith(ctx, "POST", "/v3/merchant/media/upload", &v3Body{sign: body, body: []byte(reqBody), header: header})
 	if err != nil {
-		logs.Error(err)
+		i.log(pay.LevelWarn, "wxpay: media upload request", pay.F("err", err))
 		return "", err
 	}
 	return string(resultBody), nil
@@ -139,28 +122,29 @@ func (i *WxClient) WxMediaUpLoad(file string, fileName string) (string, error) {
 
 // WxApplymentCheck 查询
 func (i *WxClient) WxApplymentCheck(businessCode string) (*WxApplymentCheckResponse, error) {
+	return i.WxApplymentCheckContext(context.Background(), businessCode)
+}
+
+// WxApplymentCheckContext 携带ctx查询申请状态
+func (i *WxClient) WxApplymentCheckContext(ctx context.Context, businessCode string) (*WxApplymentCheckResponse, error) {
 	nonceStr := tools.GetRandomString(32)
 	timestamp := time.Now().Unix()
 	uri := "/v3/applyment4sub/applyment/business_code/" + businessCode
 	sign := WxV3Sign("GET", uri, nonceStr, "", timestamp, i.KeyPEM)
 	headerAuthorization := fmt.Sprintf(WxMediaUpLoadHeaderAuthorization, i.MchID, nonceStr, timestamp, i.KeyPemNo, sign)
-	client := &http.Client{}
-	request, err := http.NewRequest("GET", WxApplymentCheckURL+businessCode, bytes.NewBuffer([]byte("")))
+	request, err := http.NewRequest("GET", i.v3URL(WxApplymentCheckURL)+businessCode, bytes.NewBuffer([]byte("")))
 	request.Header.Add("Authorization", headerAuthorization)
 	request.Header.Set("Accept", "application/json")
 
-	resp, err := client.Do(request)
+	resp, resultBody, err := pay.DoRequest(ctx, i.HTTPClient, request)
 	if err != nil {
-		logs.Warning("http Do err", err)
+		i.log(pay.LevelWarn, "wxpay: applyment check request", pay.F("err", err))
 		return nil, err
 	}
-	defer resp.Body.Close()
-	resultBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		logs.Error(err)
+	if err := i.verifyV3Response(ctx, "GET "+uri, resp, resultBody); err != nil {
 		return nil, err
 	}
-	logs.Warning(string(resultBody))
+	i.log(pay.LevelDebug, "wxpay: applyment check response", pay.F("body", resultBody))
 	res := &WxApplymentCheckResponse{}
 	json.Unmarshal(resultBody, res)
 	return res, nil
@@ -168,27 +152,23 @@ func (i *WxClient) WxApplymentCheck(businessCode string) (*WxApplymentCheckRespo
 
 // GetCertificates 获取证书
 func (i *WxClient) GetCertificates() (*GetCertificatesResponse, error) {
-	nonceStr := tools.GetRandomString(32)
-	timestamp := time.Now().Unix()
-	sign := WxV3Sign("GET", `/v3/certificates`, nonceStr, "", timestamp, i.KeyPEM)
-	headerAuthorization := fmt.Sprintf(WxMediaUpLoadHeaderAuthorization, i.MchID, nonceStr, timestamp, i.KeyPemNo, sign)
-	client := &http.Client{}
-	request, err := http.NewRequest("GET", GetCertificatesURL, bytes.NewBuffer([]byte("")))
-	request.Header.Add("Authorization", headerAuthorization)
-	request.Header.Add("User-Agent", "https://zh.wikipedia.org/wiki/User_agent")
-	request.Header.Set("Accept", "application/json")
-	resp, err := client.Do(request)
-	if err != nil {
-		logs.Warning("http Do err", err)
-		return nil, err
-	}
-	defer resp.Body.Close()
-	resultBody, err := ioutil.ReadAll(resp.Body)
+	return i.GetCertificatesContext(context.Background())
+}
+
+// GetCertificatesContext 携带ctx获取平台证书, 返回未解密的原始证书列表
+func (i *WxClient) GetCertificatesContext(ctx context.Context) (*GetCertificatesResponse, error) {
+	var resultBody []byte
+	err := i.retry(ctx, pay.OpGetCertificates, func(ctx context.Context) error {
+		var err error
+		resultBody, err = i.v3Request(ctx, "GET", "/v3/certificates", nil)
+		return err
+	})
 	if err != nil {
-		logs.Error(err)
 		return nil, err
 	}
 	res := &GetCertificatesResponse{}
-	json.Unmarshal(resultBody, res)
+	if err := json.Unmarshal(resultBody, res); err != nil {
+		return nil, errors.New("json.Unmarshal: " + err.Error())
+	}
 	return res, nil
 }
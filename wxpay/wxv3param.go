@@ -1,6 +1,7 @@
 package wxpay
 
 import (
+	"context"
 	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
@@ -11,10 +12,10 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
-	"github.com/astaxie/beego/logs"
+	"github.com/jxwt/pay"
 	"github.com/jxwt/tools"
-	"io/ioutil"
 	"net/http"
 	"reflect"
 	"time"
@@ -223,45 +224,59 @@ func WxV3Sign(method string, uri string, nonceStr string, body string, timestemp
 	// 构建签名meta
 	pre := "%s\n%s\n%d\n%s\n%s\n" // method uri timestemp randomstr body
 	pre = fmt.Sprintf(pre, method, uri, timestemp, nonceStr, body)
+	sign, _ := wxV3SignMessage(pre, privateKey)
+	return sign
+}
+
+// wxV3SignMessage 使用商户私钥对签名串做 SHA256-RSA 签名并base64编码
+func wxV3SignMessage(message string, privateKey string) (string, error) {
 	blocks, _ := pem.Decode(FormatPrivateKey(privateKey))
-	key, _ := x509.ParsePKCS8PrivateKey(blocks.Bytes)
-	//st := key.(*rsa.PrivateKey)
+	if blocks == nil {
+		return "", errors.New("wxv3 sign: invalid private key pem")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(blocks.Bytes)
+	if err != nil {
+		return "", err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("wxv3 sign: private key is not rsa")
+	}
 	h := sha256.New()
-	h.Write([]byte(pre))
+	h.Write([]byte(message))
 	digest := h.Sum(nil)
-	s, _ := rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest)
-	return base64.StdEncoding.EncodeToString(s)
-
+	s, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(s), nil
 }
 
 func (i *WxClient) WxV3GetCertificates() {
+	i.WxV3GetCertificatesContext(context.Background())
+}
+
+// WxV3GetCertificatesContext 携带ctx获取平台证书并打印
+func (i *WxClient) WxV3GetCertificatesContext(ctx context.Context) {
 	nonceStr := tools.GetRandomString(32)
 	now := time.Now().Unix()
 	sign := WxV3Sign("GET", "/v3/certificates", nonceStr, "", now, i.KeyPEM)
-	fmt.Println(sign)
 	headerAuthorization := fmt.Sprintf(WxMediaUpLoadHeaderAuthorization, i.AppID, nonceStr, now, i.KeyPemNo, sign)
-	client := &http.Client{}
-	request, err := http.NewRequest("GET", "https://api.mch.weixin.qq.com/v3/certificates", nil)
+	request, err := http.NewRequest("GET", i.v3URL(GetCertificatesURL), nil)
 	request.Header.Add("Authorization", headerAuthorization)
 	request.Header.Add("User-Agent", "https://zh.wikipedia.org/wiki/User_agent")
 	request.Header.Set("Accept", "application/json")
 
-	resp, err := client.Do(request)
+	_, resultBody, err := pay.DoRequest(ctx, i.HTTPClient, request)
 	if err != nil {
-		logs.Warning("http Do err", err)
+		i.log(pay.LevelWarn, "wxpay: get certificates request", pay.F("err", err))
 		return
 	}
-	defer resp.Body.Close()
-	resultBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		logs.Error(err)
-		return
-	}
-	logs.Info(string(resultBody))
+	i.log(pay.LevelInfo, "wxpay: certificates", pay.F("body", resultBody))
 }
 
 // SerialStruct 对结构体内敏感信息进行加密
-func SerialStruct(obj interface{}, rasPublic string) interface{} {
+func SerialStruct(obj interface{}, rasPublic string) (interface{}, error) {
 	t := reflect.TypeOf(obj)
 	v := reflect.ValueOf(obj)
 	if t.Kind() == reflect.Ptr {
@@ -275,11 +290,14 @@ func SerialStruct(obj interface{}, rasPublic string) interface{} {
 		if tag == "1" {
 			// fmt.Println(rasPublic)
 			msg := v.Field(i).Interface().(string)
-			msg = RSAPublicSign(rasPublic, msg)
+			msg, err := RSAPublicSign(rasPublic, msg)
+			if err != nil {
+				return nil, err
+			}
 			v.Field(i).Set(reflect.ValueOf(msg))
 		}
 	}
-	return obj
+	return obj, nil
 }
 
 type WxMediaUpLoadRequest struct {
@@ -288,59 +306,62 @@ type WxMediaUpLoadRequest struct {
 }
 
 // WxPriStrToRSAPrivateKey string转rsa.private格式
-func WxPriStrToRSAPrivateKey(key string) *rsa.PrivateKey {
+func WxPriStrToRSAPrivateKey(key string) (*rsa.PrivateKey, error) {
 	keyByte := FormatPrivateKey(key)
 	b, _ := pem.Decode(keyByte)
 	if b == nil {
-		fmt.Println("rsaSign private_key error")
-		return nil
+		return nil, errors.New("rsaSign private_key error")
 	}
 	rsaKey, err := x509.ParsePKCS8PrivateKey(b.Bytes)
 	if err != nil {
-		logs.Warning("ParsePKCS8PrivateKey ERR:%v\n", err)
+		return nil, fmt.Errorf("ParsePKCS8PrivateKey: %w", err)
+	}
+	priKey, ok := rsaKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not rsa")
 	}
-	return rsaKey.(*rsa.PrivateKey)
+	return priKey, nil
 }
 
 // WxPubStrToRSAPublic string转rsa.public格式
-func WxPubStrToRSAPublic(publicStr string) *rsa.PublicKey {
+func WxPubStrToRSAPublic(publicStr string) (*rsa.PublicKey, error) {
 	publicByte := FormatCeritficate(publicStr)
 	block, _ := pem.Decode(publicByte)
 	if block == nil {
-		panic("failed to parse PEM block containing the public key")
+		return nil, errors.New("failed to parse PEM block containing the public key")
 	}
 
 	pub, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		panic("failed to parse DER encoded public key:" + err.Error())
+		return nil, errors.New("failed to parse DER encoded public key:" + err.Error())
 	}
-	rsaPublickey, _ := pub.PublicKey.(*rsa.PublicKey)
-	return rsaPublickey
+	rsaPublickey, ok := pub.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not rsa")
+	}
+	return rsaPublickey, nil
 }
 
 // RSAPublicSign RSA敏感信息加密
 // rsaPublicKey=cert Pem
-func RSAPublicSign(rsaPublicKey string, message string) string {
-	secretMessage := []byte(message)
-	rng := rand.Reader
-
-	cipherdata, err := rsa.EncryptOAEP(sha1.New(), rng, WxPubStrToRSAPublic(rsaPublicKey), secretMessage, nil)
+func RSAPublicSign(rsaPublicKey string, message string) (string, error) {
+	pubKey, err := WxPubStrToRSAPublic(rsaPublicKey)
 	if err != nil {
-		fmt.Printf("Error from encryption: %s\n", err)
-		return ""
+		return "", err
 	}
-
-	ciphertext := base64.StdEncoding.EncodeToString(cipherdata)
-	//fmt.Printf("Ciphertext: %x\n", ciphertext)
-	return ciphertext
+	cipherdata, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pubKey, []byte(message), nil)
+	if err != nil {
+		return "", fmt.Errorf("rsa.EncryptOAEP: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(cipherdata), nil
 }
 
 // GetCertificatesResponse .
 type GetCertificatesResponse struct {
 	Data []struct {
 		SerialNo           string `json:"serial_no"`
-		EffectiveTime      string `json:"effective_time "`
-		ExpireTime         string `json:"expire_time "`
+		EffectiveTime      string `json:"effective_time"`
+		ExpireTime         string `json:"expire_time"`
 		EncryptCertificate struct {
 			Algorithm      string `json:"algorithm"`
 			Nonce          string `json:"nonce"`
@@ -350,39 +371,41 @@ type GetCertificatesResponse struct {
 	} `json:"data"`
 }
 
-// CertificateDecryption 证书解密
+// CertificateDecryption 解密返回中的第一张证书, 需按序列号或有效期选择证书时使用 CertificateStore
 func CertificateDecryption(req *GetCertificatesResponse, apiv3key string) (string, error) {
+	if len(req.Data) == 0 {
+		return "", errors.New("证书获取失败")
+	}
 	cpinfo := req.Data[0]
-	// 对编码密文进行base64解码
-	decodeBytes, err := base64.StdEncoding.DecodeString(cpinfo.EncryptCertificate.Ciphertext)
+	plaintext, err := DecryptV3Resource(apiv3key, cpinfo.EncryptCertificate.Nonce, cpinfo.EncryptCertificate.AssociatedData, cpinfo.EncryptCertificate.Ciphertext)
 	if err != nil {
 		return "", err
 	}
+	return string(plaintext), nil
+}
+
+// DecryptV3Resource AEAD_AES_256_GCM 解密, 用于平台证书及回调通知的 resource
+func DecryptV3Resource(apiv3key, nonce, associatedData, ciphertext string) ([]byte, error) {
+	// 对编码密文进行base64解码
+	decodeBytes, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
 
 	c, err := aes.NewCipher([]byte(apiv3key))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	gcm, err := cipher.NewGCM(c)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	publicKey := ""
-	if cpinfo.EncryptCertificate.AssociatedData != "" {
-		plaintext, err := gcm.Open(nil, []byte(cpinfo.EncryptCertificate.Nonce), decodeBytes, []byte(cpinfo.EncryptCertificate.AssociatedData))
-		if err != nil {
-			return "", err
-		}
-		publicKey = string(plaintext)
-	} else {
-		plaintext, err := gcm.Open(nil, []byte(cpinfo.EncryptCertificate.Nonce), decodeBytes, nil)
-		if err != nil {
-			return "", err
-		}
-		publicKey = string(plaintext)
+	var ad []byte
+	if associatedData != "" {
+		ad = []byte(associatedData)
 	}
-	return publicKey, nil
+	return gcm.Open(nil, []byte(nonce), decodeBytes, ad)
 }
 
 // WxApplymentCheckResponse 微信申请审核查询返回
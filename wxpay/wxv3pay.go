@@ -0,0 +1,371 @@
+package wxpay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jxwt/pay"
+	"github.com/jxwt/tools"
+)
+
+// APIv3 下单
+// 直连商户 https://pay.weixin.qq.com/wiki/doc/apiv3/apis/chapter3_1_1.shtml
+// 服务商   https://pay.weixin.qq.com/wiki/doc/apiv3_partner/apis/chapter4_1_1.shtml
+
+// v3 交易类型, 对应下单接口路径的最后一段
+const (
+	TradeTypeV3JSAPI  = "jsapi"
+	TradeTypeV3App    = "app"
+	TradeTypeV3H5     = "h5"
+	TradeTypeV3Native = "native"
+)
+
+// V3Amount 订单金额
+type V3Amount struct {
+	Total    int64  `json:"total"`              // 总金额, 单位分
+	Currency string `json:"currency,omitempty"` // 币种, 默认CNY
+}
+
+// V3Payer 支付者
+type V3Payer struct {
+	OpenID    string `json:"openid,omitempty"`     // 直连商户appid下的openid
+	SpOpenID  string `json:"sp_openid,omitempty"`  // 服务商appid下的openid
+	SubOpenID string `json:"sub_openid,omitempty"` // 子商户appid下的openid
+}
+
+// V3H5Info H5场景信息
+type V3H5Info struct {
+	Type        string `json:"type"` // 场景类型 iOS, Android, Wap
+	AppName     string `json:"app_name,omitempty"`
+	BundleID    string `json:"bundle_id,omitempty"`
+	PackageName string `json:"package_name,omitempty"`
+}
+
+// V3SceneInfo 场景信息
+type V3SceneInfo struct {
+	PayerClientIP string    `json:"payer_client_ip"`
+	H5Info        *V3H5Info `json:"h5_info,omitempty"`
+}
+
+// V3TransactionRequest v3下单请求, 直连商户与服务商共用, 未使用的商户字段为空
+type V3TransactionRequest struct {
+	AppID       string       `json:"appid,omitempty"`     // 直连商户appid
+	MchID       string       `json:"mchid,omitempty"`     // 直连商户号
+	SpAppID     string       `json:"sp_appid,omitempty"`  // 服务商appid
+	SpMchID     string       `json:"sp_mchid,omitempty"`  // 服务商商户号
+	SubAppID    string       `json:"sub_appid,omitempty"` // 子商户appid
+	SubMchID    string       `json:"sub_mchid,omitempty"` // 子商户号
+	Description string       `json:"description"`
+	OutTradeNo  string       `json:"out_trade_no"`
+	NotifyURL   string       `json:"notify_url"`
+	Amount      V3Amount     `json:"amount"`
+	Payer       *V3Payer     `json:"payer,omitempty"`
+	SceneInfo   *V3SceneInfo `json:"scene_info,omitempty"`
+}
+
+// V3TransactionResponse v3下单返回
+type V3TransactionResponse struct {
+	PrepayID string `json:"prepay_id"` // jsapi/app
+	H5URL    string `json:"h5_url"`    // h5
+	CodeURL  string `json:"code_url"`  // native
+}
+
+// V3ErrorResponse v3接口错误返回
+type V3ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// isPartner 是否服务商模式
+func (i *WxClient) isPartner() bool {
+	return i.SubMchId != ""
+}
+
+// V3Transaction v3下单
+func (i *WxClient) V3Transaction(charge *Charge, tradeType string) (*V3TransactionResponse, error) {
+	return i.V3TransactionContext(context.Background(), charge, tradeType)
+}
+
+// V3TransactionContext 携带ctx的v3下单, 配置了 SubMchId 时使用服务商接口
+func (i *WxClient) V3TransactionContext(ctx context.Context, charge *Charge, tradeType string) (*V3TransactionResponse, error) {
+	req := &V3TransactionRequest{
+		Description: TruncatedText(charge.Describe, 32),
+		OutTradeNo:  charge.TradeNum,
+		NotifyURL:   i.notifyURL(charge.CallbackURL),
+		Amount: V3Amount{
+			Total:    charge.MoneyFee.Amount,
+			Currency: charge.MoneyFee.CurrencyCode(),
+		},
+	}
+	path := "/v3/pay/transactions/" + tradeType
+	if i.isPartner() {
+		path = "/v3/pay/partner/transactions/" + tradeType
+		req.SpAppID = i.AppID
+		req.SpMchID = i.MchID
+		req.SubAppID = i.SubAppId
+		req.SubMchID = i.SubMchId
+	} else {
+		req.AppID = i.AppID
+		req.MchID = i.MchID
+	}
+	switch tradeType {
+	case TradeTypeV3JSAPI:
+		switch {
+		case !i.isPartner():
+			req.Payer = &V3Payer{OpenID: charge.OpenID}
+		case i.SubAppId != "":
+			req.Payer = &V3Payer{SubOpenID: charge.OpenID}
+		default:
+			req.Payer = &V3Payer{SpOpenID: charge.OpenID}
+		}
+	case TradeTypeV3H5:
+		h5 := &V3H5Info{Type: "Wap"}
+		if charge.BundleId != "" {
+			h5 = &V3H5Info{Type: "iOS", AppName: charge.AppName, BundleID: charge.BundleId}
+		} else if charge.PackageName != "" {
+			h5 = &V3H5Info{Type: "Android", AppName: charge.AppName, PackageName: charge.PackageName}
+		}
+		req.SceneInfo = &V3SceneInfo{PayerClientIP: tools.GetLocalAddr(), H5Info: h5}
+	case TradeTypeV3Native:
+		req.SceneInfo = &V3SceneInfo{PayerClientIP: tools.GetLocalAddr()}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resultBody, err := i.v3Request(ctx, "POST", path, body)
+	if err != nil {
+		return nil, err
+	}
+	res := new(V3TransactionResponse)
+	if err := json.Unmarshal(resultBody, res); err != nil {
+		return nil, errors.New("json.Unmarshal: " + err.Error())
+	}
+	return res, nil
+}
+
+// AppPayV3 v3 app支付
+func (i *WxClient) AppPayV3(charge *Charge) (map[string]string, error) {
+	return i.AppPayV3Context(context.Background(), charge)
+}
+
+// AppPayV3Context 携带ctx的v3 app支付, 返回参数与 AppPay 一致, 签名方式为RSA
+func (i *WxClient) AppPayV3Context(ctx context.Context, charge *Charge) (map[string]string, error) {
+	result, err := i.V3TransactionContext(ctx, charge, TradeTypeV3App)
+	if err != nil {
+		return map[string]string{}, fmt.Errorf("wx app pay: %w", err)
+	}
+	var c = make(map[string]string)
+	c["appid"] = i.AppID
+	c["partnerid"] = i.MchID
+	if i.isPartner() {
+		if i.SubAppId != "" {
+			c["appid"] = i.SubAppId
+		}
+		c["partnerid"] = i.SubMchId
+	}
+	c["prepayid"] = result.PrepayID
+	c["package"] = "Sign=WXPay"
+	c["noncestr"] = tools.GetRandomString(32)
+	c["timestamp"] = fmt.Sprintf("%d", time.Now().Unix())
+	sign, err := wxV3SignMessage(fmt.Sprintf("%s\n%s\n%s\n%s\n", c["appid"], c["timestamp"], c["noncestr"], c["prepayid"]), i.KeyPEM)
+	if err != nil {
+		return map[string]string{}, fmt.Errorf("wx app pay: %w", err)
+	}
+	c["paySign"] = sign
+	return c, nil
+}
+
+// H5PayV3 v3 H5支付
+func (i *WxClient) H5PayV3(charge *Charge) (map[string]string, error) {
+	return i.H5PayV3Context(context.Background(), charge)
+}
+
+// H5PayV3Context 携带ctx的v3 H5支付, v3 H5下单只返回跳转链接, 放在 mweb_url 中
+func (i *WxClient) H5PayV3Context(ctx context.Context, charge *Charge) (map[string]string, error) {
+	result, err := i.V3TransactionContext(ctx, charge, TradeTypeV3H5)
+	if err != nil {
+		return map[string]string{}, fmt.Errorf("wx h5 pay: %w", err)
+	}
+	return map[string]string{"mweb_url": result.H5URL}, nil
+}
+
+// MiniPayV3 v3 小程序或者公众号支付
+func (i *WxClient) MiniPayV3(charge *Charge) (map[string]string, error) {
+	return i.MiniPayV3Context(context.Background(), charge)
+}
+
+// MiniPayV3Context 携带ctx的v3 小程序或公众号支付, 返回参数与 MiniPay 一致, signType 为RSA
+func (i *WxClient) MiniPayV3Context(ctx context.Context, charge *Charge) (map[string]string, error) {
+	result, err := i.V3TransactionContext(ctx, charge, TradeTypeV3JSAPI)
+	if err != nil {
+		return map[string]string{}, fmt.Errorf("wx mini pay: %w", err)
+	}
+	var c = make(map[string]string)
+	if i.SubAppId != "" {
+		c["appId"] = i.SubAppId
+	} else {
+		c["appId"] = i.AppID
+	}
+	c["timeStamp"] = fmt.Sprintf("%d", time.Now().Unix())
+	c["nonceStr"] = tools.GetRandomString(32)
+	c["package"] = fmt.Sprintf("prepay_id=%s", result.PrepayID)
+	c["signType"] = "RSA"
+	sign, err := wxV3SignMessage(fmt.Sprintf("%s\n%s\n%s\n%s\n", c["appId"], c["timeStamp"], c["nonceStr"], c["package"]), i.KeyPEM)
+	if err != nil {
+		return map[string]string{}, fmt.Errorf("wx mini pay: %w", err)
+	}
+	c["paySign"] = sign
+	return c, nil
+}
+
+// WxNativeV3 v3 生成支付二维码信息
+func (i *WxClient) WxNativeV3(charge *Charge) (WeChatQueryResult, error) {
+	return i.WxNativeV3Context(context.Background(), charge)
+}
+
+// WxNativeV3Context 携带ctx的v3 生成支付二维码信息, 二维码链接在 CodeURL 中
+func (i *WxClient) WxNativeV3Context(ctx context.Context, charge *Charge) (WeChatQueryResult, error) {
+	var result WeChatQueryResult
+	res, err := i.V3TransactionContext(ctx, charge, TradeTypeV3Native)
+	if err != nil {
+		return result, fmt.Errorf("wx native pay: %w", err)
+	}
+	result.CodeURL = res.CodeURL
+	return result, nil
+}
+
+// CloseOrderV3 v3关闭未支付订单
+func (i *WxClient) CloseOrderV3(tradeNum string) error {
+	return i.CloseOrderV3Context(context.Background(), tradeNum)
+}
+
+// CloseOrderV3Context 携带ctx的v3关单, 配置了 SubMchId 时使用服务商接口
+func (i *WxClient) CloseOrderV3Context(ctx context.Context, tradeNum string) error {
+	path := "/v3/pay/transactions/out-trade-no/" + url.PathEscape(tradeNum) + "/close"
+	req := map[string]string{"mchid": i.MchID}
+	if i.isPartner() {
+		path = "/v3/pay/partner/transactions/out-trade-no/" + url.PathEscape(tradeNum) + "/close"
+		req = map[string]string{"sp_mchid": i.MchID, "sub_mchid": i.SubMchId}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = i.v3Request(ctx, "POST", path, body)
+	return err
+}
+
+// v3Request 发送带 Authorization 签名头的v3请求并校验应答签名, 非2xx状态码返回错误
+func (i *WxClient) v3Request(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	return i.v3RequestWith(ctx, method, path, &v3Body{sign: body, body: body})
+}
+
+// v3RequestWith 同 v3Request, 可指定参与签名的报文与附加请求头
+func (i *WxClient) v3RequestWith(ctx context.Context, method, path string, b *v3Body) ([]byte, error) {
+	resp, resultBody, err := i.v3DoWith(ctx, method, path, b)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.verifyV3Response(ctx, method+" "+path, resp, resultBody); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, v3StatusError(method, path, resp.StatusCode, resultBody)
+	}
+	return resultBody, nil
+}
+
+// v3Do 发送带 Authorization 签名头的v3请求, 返回原始应答
+func (i *WxClient) v3Do(ctx context.Context, method, path string, body []byte) (*http.Response, []byte, error) {
+	return i.v3DoWith(ctx, method, path, &v3Body{sign: body, body: body})
+}
+
+// v3Body v3请求报文, 上传文件时参与签名的只有 meta 部分, 与实际发送的 multipart 报文不同
+type v3Body struct {
+	sign   []byte      // 参与签名的报文
+	body   []byte      // 发送的报文
+	header http.Header // 附加请求头, 如敏感信息加密使用的 Wechatpay-Serial
+}
+
+// v3DoWith 同 v3Do, 可指定参与签名的报文与附加请求头
+func (i *WxClient) v3DoWith(ctx context.Context, method, path string, b *v3Body) (*http.Response, []byte, error) {
+	tenant := i.MchID
+	if i.SubMchId != "" {
+		tenant = i.SubMchId
+	}
+	call := &pay.Call{Provider: "wxpay", Method: method + " " + v3Route(path), Tenant: tenant}
+	var resp *http.Response
+	var resultBody []byte
+	err := pay.Observe(ctx, i.Instrument, call, func(ctx context.Context) error {
+		var err error
+		resp, resultBody, err = i.doV3(ctx, method, path, b)
+		if err == nil && resp.StatusCode/100 != 2 {
+			call.Code = pay.ResultCode(v3StatusError(method, path, resp.StatusCode, resultBody))
+		}
+		return err
+	})
+	return resp, resultBody, err
+}
+
+// v3IDSegments 路径中其后一段为单号等变量的片段
+var v3IDSegments = map[string]bool{"out-trade-no": true, "id": true, "out-refund-no": true, "applyment_id": true, "business_code": true}
+
+// v3Route 去掉查询参数并将单号替换为占位符, 用作埋点的接口名
+func v3Route(path string) string {
+	if n := strings.IndexByte(path, '?'); n >= 0 {
+		path = path[:n]
+	}
+	parts := strings.Split(path, "/")
+	for n := 1; n < len(parts); n++ {
+		if v3IDSegments[parts[n-1]] {
+			parts[n] = "{" + parts[n-1] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// doV3 签名并发送v3请求
+func (i *WxClient) doV3(ctx context.Context, method, path string, b *v3Body) (*http.Response, []byte, error) {
+	nonceStr := tools.GetRandomString(32)
+	timestamp := time.Now().Unix()
+	sign, err := wxV3SignMessage(fmt.Sprintf("%s\n%s\n%d\n%s\n%s\n", method, path, timestamp, nonceStr, b.sign), i.KeyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	request, err := http.NewRequest(method, i.baseURL()+path, bytes.NewReader(b.body))
+	if err != nil {
+		return nil, nil, err
+	}
+	request.Header.Set("Authorization", fmt.Sprintf(WxMediaUpLoadHeaderAuthorization, i.MchID, nonceStr, timestamp, i.KeyPemNo, sign))
+	request.Header.Set("Accept", "application/json")
+	if len(b.body) > 0 {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range b.header {
+		request.Header[k] = v
+	}
+	resp, resultBody, err := pay.DoRequest(ctx, i.HTTPClient, request)
+	if err != nil {
+		i.log(pay.LevelWarn, "wxpay: v3 request", pay.F("method", method), pay.F("path", path), pay.F("err", err))
+		return nil, nil, err
+	}
+	return resp, resultBody, nil
+}
+
+// v3StatusError 非2xx应答转为 *pay.ProviderError, 5xx 可重试
+func v3StatusError(method, path string, status int, body []byte) error {
+	e := new(V3ErrorResponse)
+	json.Unmarshal(body, e)
+	perr := newProviderError(strconv.Itoa(status), e.Code, e.Message, body)
+	perr.Retryable = perr.Retryable || status >= 500
+	return fmt.Errorf("wxv3 %s %s: %w", method, path, perr)
+}
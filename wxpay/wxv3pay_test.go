@@ -0,0 +1,154 @@
+package wxpay
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jxwt/pay"
+)
+
+// testV3Key 生成测试用商户私钥(PKCS8 PEM)
+func testV3Key(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func verifyV3Sign(t *testing.T, pub *rsa.PublicKey, message, sign string) {
+	sig, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256([]byte(message))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig); err != nil {
+		t.Fatalf("bad signature for %q", message)
+	}
+}
+
+var authPattern = regexp.MustCompile(`^WECHATPAY2-SHA256-RSA2048 mchid="(.*)",nonce_str="(.*)",timestamp="(\d+)",serial_no="(.*)",signature="(.*)"$`)
+
+// v3TestServer 模拟v3下单接口, 应答使用平台证书签名
+func v3TestServer(t *testing.T, pub *rsa.PublicKey, got *V3TransactionRequest, path *string) *httptest.Server {
+	p := newTestPlatform(t, 0x5157F09EFDC096DE, time.Now().Add(24*time.Hour))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v3/certificates" {
+			certificatesHandler(t, p)(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		auth := authPattern.FindStringSubmatch(r.Header.Get("Authorization"))
+		if auth == nil || auth[4] != "SERIAL01" {
+			t.Errorf("bad Authorization header %q", r.Header.Get("Authorization"))
+		} else {
+			verifyV3Sign(t, pub, fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), auth[3], auth[2], body), auth[5])
+		}
+		*path = r.URL.Path
+		json.Unmarshal(body, got)
+		res := []byte(`{"prepay_id":"wx201410272009395522657a690389285100","h5_url":"https://wx.tenpay.com/h5","code_url":"weixin://wxpay/bizpayurl?pr=p4lpSuKzz"}`)
+		for k, v := range p.sign(t, res, time.Now()) {
+			w.Header()[k] = v
+		}
+		w.Write(res)
+	}))
+}
+
+func TestMiniPayV3(t *testing.T) {
+	key, keyPEM := testV3Key(t)
+	var got V3TransactionRequest
+	var path string
+	srv := v3TestServer(t, &key.PublicKey, &got, &path)
+	defer srv.Close()
+
+	c := &WxClient{AppID: "wxd678efh567hg6787", MchID: "1230000109", KeyPEM: keyPEM, KeyPemNo: "SERIAL01", APIv3Key: testAPIv3Key, CallbackURL: "https://example.com/notify", BaseURL: srv.URL, HTTPClient: srv.Client()}
+	params, err := c.MiniPayV3(&Charge{TradeNum: "T001", MoneyFee: pay.CNY(101), Describe: "停车费", OpenID: "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v3/pay/transactions/jsapi" || got.MchID != "1230000109" || got.Amount.Total != 101 || got.Payer.OpenID == "" {
+		t.Fatalf("unexpected request %s %+v", path, got)
+	}
+	if params["package"] != "prepay_id=wx201410272009395522657a690389285100" || params["signType"] != "RSA" {
+		t.Fatalf("unexpected params %v", params)
+	}
+	verifyV3Sign(t, &key.PublicKey, fmt.Sprintf("%s\n%s\n%s\n%s\n", params["appId"], params["timeStamp"], params["nonceStr"], params["package"]), params["paySign"])
+}
+
+func TestAppPayV3Partner(t *testing.T) {
+	key, keyPEM := testV3Key(t)
+	var got V3TransactionRequest
+	var path string
+	srv := v3TestServer(t, &key.PublicKey, &got, &path)
+	defer srv.Close()
+
+	c := &WxClient{AppID: "wxsp", MchID: "1900000100", SubAppId: "wxsub", SubMchId: "1900000109", KeyPEM: keyPEM, KeyPemNo: "SERIAL01", APIv3Key: testAPIv3Key, BaseURL: srv.URL, HTTPClient: srv.Client()}
+	params, err := c.AppPayV3(&Charge{TradeNum: "T002", MoneyFee: pay.CNY(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/v3/pay/partner/transactions/app" || got.SpMchID != "1900000100" || got.SubMchID != "1900000109" || got.MchID != "" {
+		t.Fatalf("unexpected request %s %+v", path, got)
+	}
+	if params["appid"] != "wxsub" || params["partnerid"] != "1900000109" || params["package"] != "Sign=WXPay" {
+		t.Fatalf("unexpected params %v", params)
+	}
+	verifyV3Sign(t, &key.PublicKey, fmt.Sprintf("%s\n%s\n%s\n%s\n", params["appid"], params["timestamp"], params["noncestr"], params["prepayid"]), params["paySign"])
+}
+
+func TestV3RequestError(t *testing.T) {
+	_, keyPEM := testV3Key(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code":"PARAM_ERROR","message":"参数错误"}`))
+	}))
+	defer srv.Close()
+
+	c := &WxClient{AppID: "wx", MchID: "1230000109", KeyPEM: keyPEM, BaseURL: srv.URL, HTTPClient: srv.Client(), SkipVerifyResponse: true}
+	if _, err := c.WxNativeV3(&Charge{TradeNum: "T003", MoneyFee: pay.CNY(1)}); err == nil || !strings.Contains(err.Error(), "PARAM_ERROR") {
+		t.Fatalf("error response should fail, got %v", err)
+	}
+}
+
+func TestV3ResponseSignature(t *testing.T) {
+	_, keyPEM := testV3Key(t)
+	p := newTestPlatform(t, 0x5157F09EFDC096DE, time.Now().Add(24*time.Hour))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v3/certificates" {
+			certificatesHandler(t, p)(w, r)
+			return
+		}
+		// 签名后篡改应答
+		for k, v := range p.sign(t, []byte(`{"code_url":"weixin://wxpay/bizpayurl?pr=p4lpSuKzz"}`), time.Now()) {
+			w.Header()[k] = v
+		}
+		w.Write([]byte(`{"code_url":"weixin://wxpay/bizpayurl?pr=forged"}`))
+	}))
+	defer srv.Close()
+
+	c := &WxClient{AppID: "wx", MchID: "1230000109", KeyPEM: keyPEM, APIv3Key: testAPIv3Key, BaseURL: srv.URL, HTTPClient: srv.Client()}
+	_, err := c.WxNativeV3(&Charge{TradeNum: "T004", MoneyFee: pay.CNY(1)})
+	var signErr *pay.ResponseSignError
+	if !errors.As(err, &signErr) || !errors.Is(err, ErrNotifySign) {
+		t.Fatalf("want ResponseSignError, got %v", err)
+	}
+}